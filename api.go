@@ -0,0 +1,414 @@
+package main
+
+//
+// read-only statistics api
+// GET /api/stats, /api/blocks, /api/payments and /api/miners on Settings.APIPort.
+// the responses are rebuilt every API_CACHE_TIME seconds, so dashboard
+// traffic only reads cached json and never waits on the pool lock or the
+// database. /api/accounts/0x... is built on request and then cached for
+// API_CACHE_TIME seconds, unknown addresses included. once API_ACCOUNTS_LIMIT
+// accounts are cached, other addresses are refused until the cache expires
+//
+
+import "context"
+import "encoding/json"
+import "errors"
+import "math/big"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+type PoolStats struct {
+	Hashrate       string         `json:"hashrate"`
+	Hashrates      []HashrateStat `json:"hashrates"` // over each of HASHRATE_WINDOWS
+	Miners         int            `json:"miners"`
+	Workers        int            `json:"workers"`
+	BlockNumber    string         `json:"blockNumber"`
+	Difficulty     string         `json:"difficulty"`
+	Round          uint64         `json:"round"`
+	RewardScheme   string         `json:"rewardScheme"`
+	Fee            float64        `json:"fee"`
+	LastBlockFound *time.Time     `json:"lastBlockFound,omitempty"`
+	Time           time.Time      `json:"time"`
+}
+
+type MinerSummary struct {
+	Address   string         `json:"address"`
+	Hashrate  string         `json:"hashrate"`
+	Hashrates []HashrateStat `json:"hashrates"`
+	Workers   int            `json:"workers"`
+	Shares    uint64         `json:"shares"`
+	LastShare time.Time      `json:"lastShare"`
+}
+
+// everything about one miner
+type AccountStats struct {
+	Address  string            `json:"address"`
+	Online   bool              `json:"online"`
+	Stats    *MinerStat        `json:"stats"`   // live while the miner is connected, as last saved otherwise
+	Workers  []*WorkerStat     `json:"workers"` // live workers
+	History  []*HashrateSample `json:"hashrateHistory"`
+	Balance  *LedgerBalance    `json:"balance,omitempty"`
+	Payments []*Transaction    `json:"payments"`
+	Blocks   []*BlockCandidate `json:"blocks"`
+}
+
+var ErrAccountsBusy = errors.New("too many account lookups, retry later")
+
+type cachedAccount struct {
+	response []byte // nil for an unknown miner
+	built    time.Time
+}
+
+type StatsAPI struct {
+	pool      *MinerPool
+	db        Database
+	ledger    *Ledger        // nil leaves balances out
+	settings  PayoutSettings // payout addresses, for the payment history
+	lock      *sync.RWMutex
+	responses map[string][]byte         // cached json by path
+	accounts  map[string]*cachedAccount // at most API_ACCOUNTS_LIMIT
+}
+
+func NewStatsAPI(pool *MinerPool, db Database, ledger *Ledger, settings PayoutSettings) *StatsAPI {
+	return &StatsAPI{pool: pool,
+		db:        db,
+		ledger:    ledger,
+		settings:  settings,
+		lock:      &sync.RWMutex{},
+		responses: make(map[string][]byte),
+		accounts:  make(map[string]*cachedAccount)}
+}
+
+// caller holds the pool lock
+func (self *StatsAPI) getPoolStats(now time.Time) *PoolStats {
+	workers := 0
+	for _, miner := range self.pool.miners {
+		workers += len(miner.workers)
+	}
+
+	return &PoolStats{Hashrate: self.pool.hashrate.getCurrent(now).String(),
+		Hashrates:    self.pool.hashrate.getStats(now),
+		Miners:       len(self.pool.miners),
+		Workers:      workers,
+		BlockNumber:  self.pool.blockNumber.String(),
+		Difficulty:   self.pool.blockDifficulty.String(),
+		Round:        self.pool.round,
+		RewardScheme: self.pool.settings.RewardScheme,
+		Fee:          self.pool.settings.HouseRake,
+		Time:         now}
+}
+
+// caller holds the pool lock; the API_MINERS_LIMIT miners with the most hashrate
+func (self *StatsAPI) getMiners(now time.Time) []*MinerSummary {
+	ret := make([]*MinerSummary, 0, len(self.pool.miners))
+	hashrates := make(map[*MinerSummary]*big.Int)
+
+	for _, miner := range self.pool.miners {
+		hashrate := miner.hashrate.getCurrent(now)
+		summary := &MinerSummary{Address: getHexString(miner.address, 40),
+			Hashrate:  hashrate.String(),
+			Hashrates: miner.hashrate.getStats(now),
+			Workers:   len(miner.workers),
+			Shares:    miner.shares.Uint64(),
+			LastShare: miner.lastSubmit}
+
+		hashrates[summary] = hashrate
+		ret = append(ret, summary)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		c := hashrates[ret[i]].Cmp(hashrates[ret[j]])
+		return c > 0 || (c == 0 && ret[i].Address < ret[j].Address)
+	})
+
+	if len(ret) > API_MINERS_LIMIT {
+		ret = ret[:API_MINERS_LIMIT]
+	}
+
+	return ret
+}
+
+// the last API_BLOCKS_LIMIT blocks found by the pool, newest first
+func (self *StatsAPI) getBlocks() ([]*BlockCandidate, error) {
+	blocks := make([]*BlockCandidate, 0)
+	err := self.db.FindIn("block_candidates", map[string]interface{}{}, "-found", API_BLOCKS_LIMIT, &blocks)
+	return blocks, err
+}
+
+// the last API_PAYMENTS_LIMIT verified payments, newest first
+func (self *StatsAPI) getPayments() ([]*Transaction, error) {
+	payments := make([]*Transaction, 0)
+	err := self.db.FindIn("verified_payments", map[string]interface{}{}, "-_id", API_PAYMENTS_LIMIT, &payments)
+	return payments, err
+}
+
+// reads the saved parts of an account; the caller is connected to the database
+func (self *StatsAPI) readAccount(account *AccountStats, now time.Time) error {
+	if account.Stats == nil {
+		stats := &MinerStat{}
+		if self.db.Get(stats, account.Address) == nil {
+			account.Stats = stats
+		}
+	}
+
+	since := map[string]interface{}{"$gte": now.Add(-API_HISTORY_TIME * time.Second)}
+	err := self.db.FindIn("hashrate_history", map[string]interface{}{"address": account.Address, "time": since}, "time", 0, &account.History)
+
+	if err != nil {
+		return err
+	}
+
+	payees := []string{account.Address}
+	if payTo := self.settings.GetPayoutAddress(account.Address); payTo != account.Address {
+		payees = append(payees, payTo)
+	}
+
+	query := map[string]interface{}{"to": map[string]interface{}{"$in": payees}}
+	err = self.db.FindIn("verified_payments", query, "-_id", API_PAYMENTS_LIMIT, &account.Payments)
+
+	if err != nil {
+		return err
+	}
+
+	query = map[string]interface{}{"finder": account.Address}
+	return self.db.FindIn("block_candidates", query, "-found", API_BLOCKS_LIMIT, &account.Blocks)
+}
+
+/*
+ * the stats, workers, hashrate history, balance, payments and blocks of a
+ * miner. nil if the pool has never seen the address
+ */
+func (self *StatsAPI) getAccount(address string, now time.Time) (*AccountStats, error) {
+	account := &AccountStats{Address: address,
+		Workers:  make([]*WorkerStat, 0),
+		History:  make([]*HashrateSample, 0),
+		Payments: make([]*Transaction, 0),
+		Blocks:   make([]*BlockCandidate, 0)}
+
+	self.pool.lock()
+	if miner, ok := self.pool.miners[address]; ok {
+		account.Online = true
+		account.Stats = self.pool.getLiveMinerStat(miner)
+		for _, worker := range miner.workers {
+			account.Workers = append(account.Workers, worker.getStat())
+		}
+	}
+	self.pool.unlock()
+
+	sort.Slice(account.Workers, func(i, j int) bool { return account.Workers[i].Name < account.Workers[j].Name })
+
+	if self.db != nil {
+		err := self.db.Connect()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer self.db.Disconnect()
+
+		err = self.readAccount(account, now)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if account.Stats == nil {
+		return nil, nil
+	}
+
+	if self.ledger != nil {
+		balance, err := self.ledger.GetBalance(address)
+
+		if err != nil {
+			return nil, err
+		}
+
+		account.Balance = balance
+	}
+
+	return account, nil
+}
+
+/*
+ * an account's json, from the cache while it is fresh; nil for an unknown
+ * miner. refresh drops expired accounts, so a full cache turns away new
+ * addresses for at most API_CACHE_TIME seconds
+ */
+func (self *StatsAPI) getAccountResponse(address string, now time.Time) ([]byte, error) {
+	self.lock.RLock()
+	cached, ok := self.accounts[address]
+	full := len(self.accounts) >= API_ACCOUNTS_LIMIT
+	self.lock.RUnlock()
+
+	if ok && now.Sub(cached.built) < API_CACHE_TIME*time.Second {
+		return cached.response, nil
+	}
+
+	if !ok && full {
+		return nil, ErrAccountsBusy
+	}
+
+	account, err := self.getAccount(address, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte = nil
+
+	if account != nil {
+		response, err = json.Marshal(account)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	self.lock.Lock()
+	if _, ok := self.accounts[address]; ok || len(self.accounts) < API_ACCOUNTS_LIMIT {
+		self.accounts[address] = &cachedAccount{response: response, built: now}
+	}
+	self.lock.Unlock()
+
+	return response, nil
+}
+
+func (self *StatsAPI) serveAccount(w http.ResponseWriter, address string) {
+	address = strings.ToLower(address)
+
+	if !isHexAddress(address) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid address"}`))
+		return
+	}
+
+	response, err := self.getAccountResponse(address, time.Now())
+
+	if err == ErrAccountsBusy {
+		w.Header().Set("Retry-After", strconv.Itoa(int(API_CACHE_TIME)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"too many lookups, retry later"}`))
+		return
+	}
+
+	if err != nil {
+		apiLog.Error("could not read account", "miner", address, "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"account unavailable"}`))
+		return
+	}
+
+	if response == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"unknown miner"}`))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(API_CACHE_TIME)))
+	w.Write(response)
+}
+
+func (self *StatsAPI) setResponse(path string, response interface{}) {
+	bytes, err := json.Marshal(response)
+
+	if err != nil {
+		apiLog.Error("could not encode response", "path", path, "err", err)
+		return
+	}
+
+	self.lock.Lock()
+	self.responses[path] = bytes
+	self.lock.Unlock()
+}
+
+/*
+ * rebuilds the cached responses. if the database is unreachable the
+ * previous blocks and payments are served until the next refresh
+ */
+func (self *StatsAPI) refresh(now time.Time) {
+	self.pool.lock()
+	stats := self.getPoolStats(now)
+	miners := self.getMiners(now)
+	self.pool.unlock()
+
+	self.lock.Lock()
+	for address, cached := range self.accounts {
+		if now.Sub(cached.built) >= API_CACHE_TIME*time.Second {
+			delete(self.accounts, address)
+		}
+	}
+	self.lock.Unlock()
+
+	self.setResponse("/api/miners", miners)
+
+	if self.db == nil || self.db.Connect() != nil {
+		self.setResponse("/api/stats", stats)
+		return
+	}
+
+	defer self.db.Disconnect()
+
+	blocks, err := self.getBlocks()
+
+	if err != nil {
+		apiLog.Error("could not read blocks", "err", err)
+	} else {
+		if len(blocks) > 0 {
+			stats.LastBlockFound = &blocks[0].Found
+		}
+		self.setResponse("/api/blocks", blocks)
+	}
+
+	payments, err := self.getPayments()
+
+	if err != nil {
+		apiLog.Error("could not read payments", "err", err)
+	} else {
+		self.setResponse("/api/payments", payments)
+	}
+
+	self.setResponse("/api/stats", stats)
+}
+
+func (self *StatsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error":"use GET"}`))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/accounts/") {
+		self.serveAccount(w, strings.TrimPrefix(r.URL.Path, "/api/accounts/"))
+		return
+	}
+
+	self.lock.RLock()
+	response, ok := self.responses[r.URL.Path]
+	self.lock.RUnlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(API_CACHE_TIME)))
+	w.Write(response)
+}
+
+func (self *StatsAPI) Start(ctx context.Context) {
+	for ctx.Err() == nil {
+		self.refresh(time.Now())
+		sleepContext(ctx, time.Duration(API_CACHE_TIME)*time.Second)
+	}
+
+	apiLog.Info("stopped")
+}
@@ -0,0 +1,264 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "math/big"
+import "net/http/httptest"
+import "testing"
+import "time"
+
+// block candidates, verified payments and hashrate history, newest first
+type apiDatabase struct {
+	Database
+	stats    []*MinerStat
+	blocks   []*BlockCandidate
+	payments []*Transaction
+	history  []*HashrateSample
+	gets     int // account lookups that reached the database
+}
+
+func (self *apiDatabase) Connect() error    { return nil }
+func (self *apiDatabase) Disconnect() error { return nil }
+
+func (self *apiDatabase) Get(result interface{}, key string) error {
+	self.gets++
+	for _, stat := range self.stats {
+		if stat.Address == key {
+			*result.(*MinerStat) = *stat
+			return nil
+		}
+	}
+	return errors.New("item not found")
+}
+
+func (self *apiDatabase) FindIn(table string, query map[string]interface{}, sort string, limit int, result interface{}) error {
+	switch table {
+	case "block_candidates":
+		ret := result.(*[]*BlockCandidate)
+		for _, block := range self.blocks {
+			if finder, ok := query["finder"]; !ok || block.Finder == finder {
+				*ret = append(*ret, block)
+			}
+		}
+	case "verified_payments":
+		ret := result.(*[]*Transaction)
+		for _, payment := range self.payments {
+			payees, ok := query["to"]
+			if !ok {
+				*ret = append(*ret, payment)
+				continue
+			}
+			for _, payee := range payees.(map[string]interface{})["$in"].([]string) {
+				if payment.To == payee {
+					*ret = append(*ret, payment)
+				}
+			}
+		}
+	case "hashrate_history":
+		ret := result.(*[]*HashrateSample)
+		since := query["time"].(map[string]interface{})["$gte"].(time.Time)
+		for _, sample := range self.history {
+			if sample.Address == query["address"] && !sample.Time.Before(since) {
+				*ret = append(*ret, sample)
+			}
+		}
+	}
+	return nil
+}
+
+func getAPIResponse(t *testing.T, api *StatsAPI, path string, out interface{}) int {
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+	if recorder.Code == 200 {
+		err := json.Unmarshal(recorder.Body.Bytes(), out)
+
+		if err != nil {
+			t.Error("could not decode ", path, " - ", err.Error())
+		}
+	}
+
+	return recorder.Code
+}
+
+func TestStatsAPI(t *testing.T) {
+	now := time.Now()
+	found := now.Add(-time.Hour).UTC().Truncate(time.Second)
+	db := &apiDatabase{blocks: []*BlockCandidate{{Number: "0x64", Status: BLOCK_IMMATURE, Found: found}},
+		payments: []*Transaction{{Hash: "0x01", To: "0x02", Value: "1000"}}}
+
+	statsPool := NewMinerPool(nil, DefaultSettings())
+	statsPool.blockNumber = big.NewInt(100)
+
+	small := statsPool.getMiner(big.NewInt(1))
+	small.touch("rig1")
+	small.claimShare(60000, now, big.NewInt(0))
+
+	large := statsPool.getMiner(big.NewInt(2))
+	large.touch("rig1")
+	large.touch("rig2")
+	large.claimShare(600000, now, big.NewInt(0))
+	statsPool.hashrate.add(660000, now)
+
+	api := NewStatsAPI(statsPool, db, nil, DefaultPayoutSettings{})
+
+	if getAPIResponse(t, api, "/api/stats", &PoolStats{}) != 404 {
+		t.Error("expected nothing to be served before the first refresh")
+	}
+
+	api.refresh(now)
+
+	stats := &PoolStats{}
+	getAPIResponse(t, api, "/api/stats", stats)
+
+	if stats.Miners != 2 || stats.Workers != 3 || stats.BlockNumber != "100" {
+		t.Error("unexpected pool stats ", stats)
+	}
+
+	if stats.Hashrate == "0" || len(stats.Hashrates) != len(HASHRATE_WINDOWS) {
+		t.Error("expected pool hashrates, found ", stats.Hashrate, stats.Hashrates)
+	}
+
+	if stats.LastBlockFound == nil || !stats.LastBlockFound.Equal(found) {
+		t.Error("expected the last block found at ", found, ", found ", stats.LastBlockFound)
+	}
+
+	miners := make([]*MinerSummary, 0)
+	getAPIResponse(t, api, "/api/miners", &miners)
+
+	if len(miners) != 2 || miners[0].Address != getHexString(large.address, 40) || miners[0].Workers != 2 {
+		t.Error("expected the bigger miner first, found ", miners)
+	}
+
+	blocks := make([]*BlockCandidate, 0)
+	getAPIResponse(t, api, "/api/blocks", &blocks)
+
+	if len(blocks) != 1 || blocks[0].Status != BLOCK_IMMATURE {
+		t.Error("expected 1 immature block, found ", blocks)
+	}
+
+	payments := make([]*Transaction, 0)
+	getAPIResponse(t, api, "/api/payments", &payments)
+
+	if len(payments) != 1 || payments[0].Value != "1000" {
+		t.Error("expected 1 payment, found ", payments)
+	}
+
+	// served from the cache until the next refresh
+	statsPool.getMiner(big.NewInt(3))
+	stats = &PoolStats{}
+	getAPIResponse(t, api, "/api/stats", stats)
+
+	if stats.Miners != 2 {
+		t.Error("expected cached stats, found ", stats.Miners, " miners")
+	}
+}
+
+func TestAccountAPI(t *testing.T) {
+	now := time.Now()
+	online := "0x0000000000000000000000000000000000000001"
+	offline := "0x0000000000000000000000000000000000000002"
+
+	db := &apiDatabase{stats: []*MinerStat{{Address: offline, Shares: 7}},
+		blocks:   []*BlockCandidate{{Number: "0x64", Finder: online}, {Number: "0x65", Finder: offline}},
+		payments: []*Transaction{{To: online, Value: "0x10"}, {To: offline, Value: "0x20"}},
+		history: []*HashrateSample{
+			NewHashrateSample(online, big.NewInt(100), 1, now.Add(-48*time.Hour)),
+			NewHashrateSample(online, big.NewInt(200), 1, now.Add(-time.Hour))}}
+
+	journal := &journalDatabase{}
+	ledger := NewLedger(journal)
+	ledger.Credited(&Credit{Share: "0x01:0x02:0x03", Miner: online, Amount: "500", Time: now})
+
+	accountPool := NewMinerPool(nil, DefaultSettings())
+	miner := accountPool.getMiner(big.NewInt(1))
+	miner.touch("rig2")
+	miner.touch("rig1").lastShare = now
+	miner.claimShare(60000, now, big.NewInt(0))
+
+	api := NewStatsAPI(accountPool, db, ledger, DefaultPayoutSettings{})
+
+	account := &AccountStats{}
+	if code := getAPIResponse(t, api, "/api/accounts/"+online, account); code != 200 {
+		t.Fatal("expected the online miner's account, found ", code)
+	}
+
+	if !account.Online || account.Stats == nil || len(account.Workers) != 2 || account.Workers[0].Name != "rig1" {
+		t.Error("expected live stats with 2 workers, found ", account.Stats, account.Workers)
+	}
+
+	if !account.Workers[0].LastShare.Equal(now) {
+		t.Error("expected the worker's last share time, found ", account.Workers[0].LastShare)
+	}
+
+	if len(account.History) != 1 || account.History[0].Hashrate != "200" {
+		t.Error("expected the last day of hashrate history, found ", account.History)
+	}
+
+	if account.Balance == nil || account.Balance.Pending != "500" {
+		t.Error("expected 500 pending, found ", account.Balance)
+	}
+
+	if len(account.Payments) != 1 || account.Payments[0].Value != "0x10" || len(account.Blocks) != 1 || account.Blocks[0].Number != "0x64" {
+		t.Error("expected only the miner's payments and blocks, found ", account.Payments, account.Blocks)
+	}
+
+	account = &AccountStats{}
+	getAPIResponse(t, api, "/api/accounts/"+offline, account)
+
+	if account.Online || account.Stats == nil || account.Stats.Shares != 7 || len(account.Workers) != 0 {
+		t.Error("expected the saved stats of an offline miner, found ", account.Stats)
+	}
+
+	unknown := "/api/accounts/0x0000000000000000000000000000000000000003"
+	gets := db.gets
+
+	for i := 0; i < 2; i++ {
+		if code := getAPIResponse(t, api, unknown, account); code != 404 {
+			t.Error("expected an unknown miner to be not found, found ", code)
+		}
+	}
+
+	if db.gets != gets+1 {
+		t.Error("expected the unknown miner to be looked up once, found ", db.gets-gets)
+	}
+
+	if code := getAPIResponse(t, api, "/api/accounts/0x1234", account); code != 400 {
+		t.Error("expected an invalid address to be rejected, found ", code)
+	}
+}
+
+// lookups of new addresses stop once the cache is full, until it expires
+func TestAccountAPILimit(t *testing.T) {
+	now := time.Now()
+	db := &apiDatabase{}
+	api := NewStatsAPI(NewMinerPool(nil, DefaultSettings()), db, nil, DefaultPayoutSettings{})
+
+	for i := int64(0); i < API_ACCOUNTS_LIMIT; i++ {
+		if response, err := api.getAccountResponse(getHexString(big.NewInt(i), 40), now); response != nil || err != nil {
+			t.Fatal("expected an unknown miner, found ", response, err)
+		}
+	}
+
+	address := getHexString(big.NewInt(API_ACCOUNTS_LIMIT), 40)
+
+	if _, err := api.getAccountResponse(address, now); err != ErrAccountsBusy {
+		t.Error("expected a new address to be refused, found ", err)
+	}
+
+	if code := getAPIResponse(t, api, "/api/accounts/"+address, nil); code != 429 {
+		t.Error("expected too many requests, found ", code)
+	}
+
+	gets := db.gets
+
+	if _, err := api.getAccountResponse(getHexString(big.NewInt(1), 40), now); err != nil || db.gets != gets {
+		t.Error("expected a cached address to be served from the cache, found ", err)
+	}
+
+	api.refresh(now.Add(API_CACHE_TIME * time.Second))
+
+	if _, err := api.getAccountResponse(address, now.Add(API_CACHE_TIME*time.Second)); err != nil {
+		t.Error("expected the address to be looked up once the cache expired, found ", err)
+	}
+}
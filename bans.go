@@ -0,0 +1,395 @@
+package main
+
+//
+// bans and rate limits for the pool endpoints
+// invalid, duplicate and malformed submissions are counted per ip and per
+// miner address; passing a Settings.Ban*Threshold within BanWindow seconds
+// bans the ip or address for BanTime seconds. every ip may also send RateLimit
+// requests a second, in bursts of up to RateLimitBurst. anyone can name an
+// address, so an address is only counted against from ips that had shares for
+// it accepted within BanWindow, and never for malformed submissions.
+// allowlisted ips, networks and addresses are never banned or limited,
+// denylisted ones are always refused. bans are written to a file so they
+// survive a restart
+//
+
+import "errors"
+import "math/big"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+var ErrBanned = errors.New("banned")
+var ErrRateLimited = errors.New("too many requests")
+
+type banCounter struct {
+	invalid   int
+	duplicate int
+	malformed int
+	start     time.Time
+}
+
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// the thresholds, durations and rates from Settings
+type banLimits struct {
+	invalid   int
+	duplicate int
+	malformed int
+	window    time.Duration
+	duration  time.Duration
+	rate      float64
+	burst     float64
+}
+
+func newBanLimits(settings *Settings) *banLimits {
+	return &banLimits{invalid: int(settings.BanInvalidThreshold),
+		duplicate: int(settings.BanDuplicateThreshold),
+		malformed: int(settings.BanMalformedThreshold),
+		window:    time.Duration(settings.BanWindow * float64(time.Second)),
+		duration:  time.Duration(settings.BanTime * float64(time.Second)),
+		rate:      settings.RateLimit,
+		burst:     settings.RateLimitBurst}
+}
+
+type BanManager struct {
+	lock     *sync.Mutex
+	allow    *banList
+	deny     *banList
+	limits   *banLimits
+	counters map[string]*banCounter
+	limiters map[string]*rateLimiter
+	bans     map[string]int64     // ip or address -> unix time the ban ends
+	proven   map[string]time.Time // "ip address" -> last accepted share of the address from the ip
+	persist  *FilePersistence     // nil keeps bans in memory only
+}
+
+// ips, networks (cidr) and miner addresses
+type banList struct {
+	keys     map[string]bool
+	networks []*net.IPNet
+}
+
+func newBanList(entries []string) (*banList, error) {
+	ret := &banList{keys: make(map[string]bool)}
+
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+
+			if err != nil {
+				return nil, errors.New("invalid ban list network " + entry)
+			}
+
+			ret.networks = append(ret.networks, network)
+			continue
+		}
+
+		if net.ParseIP(entry) == nil && !isHexAddress(entry) {
+			return nil, errors.New("invalid ban list entry " + entry)
+		}
+
+		ret.keys[entry] = true
+	}
+
+	return ret, nil
+}
+
+func (self *banList) contains(key string) bool {
+	if self.keys[key] {
+		return true
+	}
+
+	ip := net.ParseIP(key)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range self.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewBanManager(settings *Settings, persistFilename string) (*BanManager, error) {
+	allowList, err := newBanList(settings.BanAllowlist)
+
+	if err != nil {
+		return nil, err
+	}
+
+	denyList, err := newBanList(settings.BanDenylist)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &BanManager{lock: &sync.Mutex{},
+		allow:    allowList,
+		deny:     denyList,
+		limits:   newBanLimits(settings),
+		counters: make(map[string]*banCounter),
+		limiters: make(map[string]*rateLimiter),
+		bans:     make(map[string]int64),
+		proven:   make(map[string]time.Time)}
+
+	if len(persistFilename) > 0 {
+		ret.persist = NewFilePersistence(persistFilename)
+
+		if ret.persist.Read(&ret.bans) == nil {
+			poolLog.Info("loaded bans", "bans", len(ret.bans))
+		}
+
+		if ret.bans == nil {
+			ret.bans = make(map[string]int64)
+		}
+	}
+
+	return ret, nil
+}
+
+// swaps in the allow and deny lists and the limits; bans and counters are kept
+func (self *BanManager) ApplySettings(settings *Settings) {
+	allowList, err := newBanList(settings.BanAllowlist)
+
+	if err != nil {
+		poolLog.Error("could not apply ban allowlist", "err", err)
+		return
+	}
+
+	denyList, err := newBanList(settings.BanDenylist)
+
+	if err != nil {
+		poolLog.Error("could not apply ban denylist", "err", err)
+		return
+	}
+
+	self.lock.Lock()
+	self.allow = allowList
+	self.deny = denyList
+	self.limits = newBanLimits(settings)
+	self.lock.Unlock()
+}
+
+// the ip of a host:port remote address
+func getRemoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+func getBanKey(address *big.Int) string {
+	if address == nil {
+		return ""
+	}
+
+	return getHexString(address, 40)
+}
+
+// caller holds the lock
+func (self *BanManager) isBanned(key string, now time.Time) bool {
+	if len(key) == 0 || self.allow.contains(key) {
+		return false
+	}
+
+	if self.deny.contains(key) {
+		return true
+	}
+
+	until, banned := self.bans[key]
+	return banned && now.Unix() < until
+}
+
+// caller holds the lock
+func (self *BanManager) takeToken(ip string, now time.Time) bool {
+	if self.allow.contains(ip) {
+		return true
+	}
+
+	limiter, exists := self.limiters[ip]
+
+	if !exists {
+		limiter = &rateLimiter{tokens: self.limits.burst, last: now}
+		self.limiters[ip] = limiter
+	}
+
+	limiter.tokens += now.Sub(limiter.last).Seconds() * self.limits.rate
+
+	if limiter.tokens > self.limits.burst {
+		limiter.tokens = self.limits.burst
+	}
+
+	limiter.last = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+
+	limiter.tokens -= 1
+	return true
+}
+
+/*
+ * checks a request from ip for the miner address (nil before login).
+ * returns ErrBanned or ErrRateLimited if it should be turned away
+ */
+func (self *BanManager) Allow(ip string, address *big.Int, now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.isBanned(ip, now) || self.isBanned(getBanKey(address), now) {
+		return ErrBanned
+	}
+
+	if !self.takeToken(ip, now) {
+		return ErrRateLimited
+	}
+
+	return nil
+}
+
+func (self *BanManager) IsBanned(ip string, address *big.Int, now time.Time) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.isBanned(ip, now) || self.isBanned(getBanKey(address), now)
+}
+
+// caller holds the lock
+func (self *BanManager) ban(key string, reason string, now time.Time) {
+	self.bans[key] = now.Add(self.limits.duration).Unix()
+	delete(self.counters, key)
+	poolLog.Warn("banned", "key", key, "duration", self.limits.duration, "reason", reason)
+	self.save()
+}
+
+// caller holds the lock
+func (self *BanManager) save() {
+	if self.persist != nil {
+		self.persist.Write(self.bans)
+	}
+}
+
+// caller holds the lock
+func (self *BanManager) count(key string, status int, now time.Time) {
+	if len(key) == 0 || self.allow.contains(key) || self.isBanned(key, now) {
+		return
+	}
+
+	counter, exists := self.counters[key]
+
+	if !exists || now.Sub(counter.start) > self.limits.window {
+		counter = &banCounter{start: now}
+		self.counters[key] = counter
+	}
+
+	switch status {
+	case SHARE_REJECTED_INVALID:
+		counter.invalid++
+	case SHARE_REJECTED_DUPLICATE:
+		counter.duplicate++
+	case SHARE_MALFORMED:
+		counter.malformed++
+	}
+
+	if counter.invalid >= self.limits.invalid {
+		self.ban(key, "invalid shares", now)
+	} else if counter.duplicate >= self.limits.duplicate {
+		self.ban(key, "duplicate shares", now)
+	} else if counter.malformed >= self.limits.malformed {
+		self.ban(key, "malformed submissions", now)
+	}
+}
+
+func getProvenKey(ip string, key string) string {
+	return ip + " " + key
+}
+
+// caller holds the lock; true if the ip had a share for the address accepted lately
+func (self *BanManager) isProven(ip string, key string, now time.Time) bool {
+	last, ok := self.proven[getProvenKey(ip, key)]
+	return ok && now.Sub(last) <= self.limits.window
+}
+
+/*
+ * counts a rejected share (or SHARE_MALFORMED submission) against the ip, and
+ * against the miner address if the ip has mined for it. accepted shares are
+ * remembered for that
+ */
+func (self *BanManager) RecordShare(ip string, address *big.Int, status int, now time.Time) {
+	key := getBanKey(address)
+
+	if shareAccepted(status) {
+		if len(key) > 0 {
+			self.lock.Lock()
+			self.proven[getProvenKey(ip, key)] = now
+			self.lock.Unlock()
+		}
+		return
+	}
+
+	if status != SHARE_REJECTED_INVALID && status != SHARE_REJECTED_DUPLICATE && status != SHARE_MALFORMED {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.count(ip, status, now)
+
+	if status != SHARE_MALFORMED && self.isProven(ip, key, now) {
+		self.count(key, status, now)
+	}
+}
+
+// forgets ended bans, old counters and idle rate limiters
+func (self *BanManager) expire(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	expired := false
+	for key, until := range self.bans {
+		if now.Unix() >= until {
+			poolLog.Info("ban ended", "key", key)
+			delete(self.bans, key)
+			expired = true
+		}
+	}
+
+	if expired {
+		self.save()
+	}
+
+	for key, counter := range self.counters {
+		if now.Sub(counter.start) > self.limits.window {
+			delete(self.counters, key)
+		}
+	}
+
+	for key, last := range self.proven {
+		if now.Sub(last) > self.limits.window {
+			delete(self.proven, key)
+		}
+	}
+
+	// an idle limiter refills completely; a new one starts out full anyway
+	for ip, limiter := range self.limiters {
+		if now.Sub(limiter.last).Seconds()*self.limits.rate >= self.limits.burst {
+			delete(self.limiters, ip)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import "io/ioutil"
+import "math/big"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func getBanSettings(allow, deny []string) *Settings {
+	ret := DefaultSettings()
+	ret.BanAllowlist = allow
+	ret.BanDenylist = deny
+	return ret
+}
+
+func TestBanThresholds(t *testing.T) {
+	now := time.Now()
+	bans, err := NewBanManager(getBanSettings(nil, nil), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miner := big.NewInt(0x1234)
+
+	// the ip has mined for the address, so its rejected shares count against it
+	bans.RecordShare("10.0.0.1", miner, SHARE_ACCEPTED, now)
+
+	for i := 0; i < BAN_INVALID_THRESHOLD-1; i++ {
+		bans.RecordShare("10.0.0.1", miner, SHARE_REJECTED_INVALID, now)
+	}
+
+	// accepted and stale shares, and shares the verifier failed on, do not count
+	bans.RecordShare("10.0.0.1", miner, SHARE_ACCEPTED, now)
+	bans.RecordShare("10.0.0.1", miner, SHARE_REJECTED_STALE, now)
+	bans.RecordShare("10.0.0.1", miner, SHARE_ERROR, now)
+
+	if bans.IsBanned("10.0.0.1", miner, now) {
+		t.Error("expected no ban below the threshold")
+	}
+
+	bans.RecordShare("10.0.0.1", miner, SHARE_REJECTED_INVALID, now)
+
+	if bans.Allow("10.0.0.1", nil, now) != ErrBanned {
+		t.Error("expected the ip to be banned")
+	}
+
+	if bans.Allow("10.0.0.2", miner, now) != ErrBanned {
+		t.Error("expected the address to be banned from another ip")
+	}
+
+	if bans.Allow("10.0.0.2", big.NewInt(0x5678), now) != nil {
+		t.Error("expected another miner on another ip to be let in")
+	}
+
+	later := now.Add(BAN_TIME * time.Second)
+	bans.expire(later)
+
+	if bans.IsBanned("10.0.0.1", miner, later) {
+		t.Error("expected the ban to end after BAN_TIME")
+	}
+
+	// counts start over after BAN_WINDOW
+	for i := 0; i < BAN_MALFORMED_THRESHOLD-1; i++ {
+		bans.RecordShare("10.0.0.3", nil, SHARE_MALFORMED, now)
+	}
+
+	bans.RecordShare("10.0.0.3", nil, SHARE_MALFORMED, now.Add(BAN_WINDOW*time.Second+time.Second))
+
+	if bans.IsBanned("10.0.0.3", nil, now) {
+		t.Error("expected old malformed submissions to be forgotten")
+	}
+}
+
+func TestBanNamedAddress(t *testing.T) {
+	now := time.Now()
+	bans, _ := NewBanManager(getBanSettings(nil, nil), "")
+	victim := big.NewInt(0x1234)
+
+	// submissions from ips that never mined for the address only ban the ips
+	for i := 0; i < BAN_INVALID_THRESHOLD; i++ {
+		bans.RecordShare("10.0.0.1", victim, SHARE_REJECTED_INVALID, now)
+		bans.RecordShare("10.0.0.2", victim, SHARE_MALFORMED, now)
+	}
+
+	if !bans.IsBanned("10.0.0.1", nil, now) || !bans.IsBanned("10.0.0.2", nil, now) || bans.IsBanned("10.0.0.3", victim, now) {
+		t.Error("expected the ips to be banned, and not the address they named")
+	}
+
+	// malformed submissions never count against an address
+	bans.RecordShare("10.0.0.3", victim, SHARE_ACCEPTED, now)
+
+	for i := 0; i < BAN_MALFORMED_THRESHOLD; i++ {
+		bans.RecordShare("10.0.0.3", victim, SHARE_MALFORMED, now)
+	}
+
+	if bans.IsBanned("10.0.0.4", victim, now) {
+		t.Error("expected malformed submissions not to ban the address")
+	}
+
+	// and the ip has to have mined for it lately
+	later := now.Add(BAN_WINDOW*time.Second + time.Second)
+	bans.expire(later)
+
+	for i := 0; i < BAN_INVALID_THRESHOLD; i++ {
+		bans.RecordShare("10.0.0.3", victim, SHARE_REJECTED_INVALID, later)
+	}
+
+	if bans.IsBanned("10.0.0.4", victim, later) {
+		t.Error("expected shares from an ip that has not mined for the address lately not to count")
+	}
+}
+
+func TestBanLists(t *testing.T) {
+	now := time.Now()
+	denied := "0x000000000000000000000000000000000000beef"
+	bans, err := NewBanManager(getBanSettings([]string{"127.0.0.1", "192.168.0.0/16"}, []string{"10.9.9.9", denied}), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < BAN_DUPLICATE_THRESHOLD; i++ {
+		bans.RecordShare("192.168.1.5", nil, SHARE_REJECTED_DUPLICATE, now)
+	}
+
+	if bans.IsBanned("192.168.1.5", nil, now) {
+		t.Error("expected allowlisted networks never to be banned")
+	}
+
+	if bans.Allow("10.9.9.9", nil, now) != ErrBanned {
+		t.Error("expected denylisted ip to be refused")
+	}
+
+	address, _ := parseHex(denied, 40)
+	if bans.Allow("10.0.0.1", address, now) != ErrBanned {
+		t.Error("expected denylisted address to be refused")
+	}
+
+	_, err = NewBanManager(getBanSettings([]string{"not an ip"}, nil), "")
+
+	if err == nil {
+		t.Error("expected invalid list entries to be rejected")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Now()
+	bans, _ := NewBanManager(getBanSettings([]string{"127.0.0.1"}, nil), "")
+
+	for i := 0; i < int(RATE_LIMIT_BURST); i++ {
+		if bans.Allow("10.0.0.1", nil, now) != nil {
+			t.Fatal("expected requests within the burst to be allowed")
+		}
+	}
+
+	if bans.Allow("10.0.0.1", nil, now) != ErrRateLimited {
+		t.Error("expected request past the burst to be limited")
+	}
+
+	if bans.Allow("10.0.0.1", nil, now.Add(time.Second)) != nil {
+		t.Error("expected the limit to refill")
+	}
+
+	for i := 0; i <= int(RATE_LIMIT_BURST); i++ {
+		if bans.Allow("127.0.0.1", nil, now) != nil {
+			t.Fatal("expected allowlisted ip not to be limited")
+		}
+	}
+}
+
+func TestBanPersistence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bans")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bans.persist")
+	now := time.Now()
+
+	bans, _ := NewBanManager(getBanSettings(nil, nil), filename)
+
+	for i := 0; i < BAN_INVALID_THRESHOLD; i++ {
+		bans.RecordShare("10.0.0.1", nil, SHARE_REJECTED_INVALID, now)
+	}
+
+	restarted, _ := NewBanManager(getBanSettings(nil, nil), filename)
+
+	if !restarted.IsBanned("10.0.0.1", nil, now) {
+		t.Error("expected the ban to survive a restart")
+	}
+}
+
+func TestBanSettings(t *testing.T) {
+	now := time.Now()
+	bans, _ := NewBanManager(getBanSettings(nil, nil), "")
+
+	settings := getBanSettings(nil, nil)
+	settings.BanInvalidThreshold = 2
+	settings.BanTime = 60
+	settings.RateLimitBurst = 1
+	bans.ApplySettings(settings)
+
+	bans.RecordShare("10.0.0.1", nil, SHARE_REJECTED_INVALID, now)
+	bans.RecordShare("10.0.0.1", nil, SHARE_REJECTED_INVALID, now)
+
+	if !bans.IsBanned("10.0.0.1", nil, now) || bans.IsBanned("10.0.0.1", nil, now.Add(time.Minute)) {
+		t.Error("expected a ban at the new threshold for the new ban time")
+	}
+
+	if bans.Allow("10.0.0.2", nil, now) != nil || bans.Allow("10.0.0.2", nil, now) != ErrRateLimited {
+		t.Error("expected the new burst")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+//
+// block rewards
+// what the pool earns for a block: the static reward for its height (set by
+// the fork schedule in Settings.BlockRewardForks), 1/32 of it for every uncle the
+// block includes, and the transaction fees paid to the miner. a block that
+// became an uncle earns (uncle + 8 - nephew) / 8 of the reward instead
+//
+
+import "errors"
+import "math/big"
+
+type BlockRewardFork struct {
+	Name   string `json:"name"`
+	Height uint64 `json:"height"` // first block with this reward
+	Reward string `json:"reward"` // wei
+}
+
+type BlockReward struct {
+	Base   *big.Int `json:"base"`   // static block reward, including the reward for included uncles
+	Uncles *big.Int `json:"uncles"` // rewards for our own blocks that became uncles
+	Fees   *big.Int `json:"fees"`   // transaction fees
+}
+
+func NewBlockReward(base, uncles, fees *big.Int) *BlockReward {
+	return &BlockReward{Base: base, Uncles: uncles, Fees: fees}
+}
+
+func (self *BlockReward) getTotal() *big.Int {
+	ret := big.NewInt(0).Add(self.Base, self.Fees)
+	return ret.Add(ret, self.Uncles)
+}
+
+type BlockRewardCalculator struct {
+	eth   EthChain
+	forks []BlockRewardFork // by height, lowest first
+}
+
+func NewBlockRewardCalculator(eth EthChain, forks []BlockRewardFork) (*BlockRewardCalculator, error) {
+	if len(forks) == 0 || forks[0].Height != 0 {
+		return nil, errors.New("fork schedule must start at block 0")
+	}
+
+	for i, fork := range forks {
+		if _, ok := big.NewInt(0).SetString(fork.Reward, 10); !ok {
+			return nil, errors.New("invalid reward for fork " + fork.Name + ": " + fork.Reward)
+		}
+
+		if i > 0 && fork.Height <= forks[i-1].Height {
+			return nil, errors.New("fork schedule out of order at " + fork.Name)
+		}
+	}
+
+	return &BlockRewardCalculator{eth: eth, forks: forks}, nil
+}
+
+// static reward for a block at the given height
+func (self *BlockRewardCalculator) GetBaseReward(blockNumber *big.Int) *big.Int {
+	fork := self.forks[0]
+
+	for _, next := range self.forks[1:] {
+		if blockNumber.Cmp(big.NewInt(0).SetUint64(next.Height)) < 0 {
+			break
+		}
+		fork = next
+	}
+
+	ret, _ := big.NewInt(0).SetString(fork.Reward, 10)
+	return ret
+}
+
+// reward for an uncle at the given height, included by the block at nephew
+func (self *BlockRewardCalculator) GetUncleReward(uncle, nephew *big.Int) *big.Int {
+	depth := big.NewInt(0).Sub(nephew, uncle)
+
+	if depth.Sign() <= 0 || depth.Cmp(big.NewInt(8)) >= 0 {
+		return big.NewInt(0)
+	}
+
+	ret := big.NewInt(0).Sub(big.NewInt(8), depth)
+	ret.Mul(ret, self.GetBaseReward(nephew))
+	return ret.Div(ret, big.NewInt(8))
+}
+
+// what the miner of the canonical block at this height was paid
+func (self *BlockRewardCalculator) GetBlockReward(blockNumber *big.Int) (*BlockReward, error) {
+	block := self.eth.GetBlockByNumber(blockNumber, true)
+
+	if block == nil {
+		return nil, errors.New("could not get block " + getHexString(blockNumber, 0))
+	}
+
+	base := self.GetBaseReward(blockNumber)
+	inclusion := big.NewInt(0).Div(base, big.NewInt(32))
+	inclusion.Mul(inclusion, big.NewInt(int64(len(block.Uncles))))
+
+	fees, err := self.getFees(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBlockReward(base.Add(base, inclusion), big.NewInt(0), fees), nil
+}
+
+// gas used times the price paid above the base fee, which is burnt
+func (self *BlockRewardCalculator) getFees(block *Block) (*big.Int, error) {
+	baseFee := block.getBaseFee()
+	fees := big.NewInt(0)
+
+	for _, txn := range block.Transactions {
+		receipt, err := self.eth.GetTransactionReceipt(txn.getHash())
+
+		if err != nil {
+			return nil, errors.New("could not get receipt for " + txn.Hash + " - " + err.Error())
+		}
+
+		price := receipt.getEffectiveGasPrice()
+		if price == nil {
+			price = txn.getGasPrice()
+		}
+
+		tip := big.NewInt(0).Sub(price, baseFee)
+		if tip.Sign() < 0 {
+			continue
+		}
+
+		fees.Add(fees, tip.Mul(tip, receipt.getGasUsed()))
+	}
+
+	return fees, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+import "math/big"
+
+func TestBaseReward(t *testing.T) {
+	calculator, err := NewBlockRewardCalculator(&MockGeth{}, BLOCK_REWARD_FORKS)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int64]string{
+		0:       "5000000000000000000",
+		4369999: "5000000000000000000",
+		4370000: "3000000000000000000",
+		7280000: "2000000000000000000",
+		9000000: "2000000000000000000",
+	}
+
+	for number, reward := range expected {
+		if found := calculator.GetBaseReward(big.NewInt(number)).String(); found != reward {
+			t.Error("expected reward ", reward, " at ", number, ", found ", found)
+		}
+	}
+
+	// uncle one block back gets 7/8, six back 2/8
+	if found := calculator.GetUncleReward(big.NewInt(9), big.NewInt(10)).String(); found != "4375000000000000000" {
+		t.Error("unexpected uncle reward ", found)
+	}
+
+	if found := calculator.GetUncleReward(big.NewInt(4), big.NewInt(10)).String(); found != "1250000000000000000" {
+		t.Error("unexpected uncle reward ", found)
+	}
+
+	_, err = NewBlockRewardCalculator(&MockGeth{}, []BlockRewardFork{{Name: "late", Height: 5, Reward: "1"}})
+	if err == nil {
+		t.Error("expected a schedule not starting at 0 to fail")
+	}
+}
+
+func TestBlockReward(t *testing.T) {
+	hash1 := "0x0000000000000000000000000000000000000000000000000000000000000001"
+	hash2 := "0x0000000000000000000000000000000000000000000000000000000000000002"
+
+	geth := &MockGeth{blockNumber: 10,
+		blockUncles: []string{"0x1234"},
+		blockTransactions: []*Transaction{
+			{Hash: hash1, GasPrice: "0x64"}, // 100
+			{Hash: hash2, GasPrice: "0x3e8"}},
+		receipts: map[string]*TransactionReceipt{
+			hash1: {TransactionHash: hash1, GasUsed: "0x5208"},                             // 21000
+			hash2: {TransactionHash: hash2, GasUsed: "0x2710", EffectiveGasPrice: "0xc8"}}} // 10000 at 200
+
+	calculator, _ := NewBlockRewardCalculator(geth, BLOCK_REWARD_FORKS)
+	reward, err := calculator.GetBlockReward(big.NewInt(10))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 ether plus 1/32 for the uncle
+	if reward.Base.String() != "5156250000000000000" {
+		t.Error("unexpected base reward ", reward.Base)
+	}
+
+	if reward.Fees.Int64() != 21000*100+10000*200 {
+		t.Error("unexpected fees ", reward.Fees)
+	}
+
+	delete(geth.receipts, hash2)
+	if _, err = calculator.GetBlockReward(big.NewInt(10)); err == nil {
+		t.Error("expected a missing receipt to fail")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+//
+// block candidates
+// every block found by the pool is recorded as a candidate and followed on
+// chain: immature once geth has it at its height, matured after
+// BLOCK_MATURE_DEPTH confirmations, or orphaned if another block took its place.
+// an orphaned block the chain scanner finds included as an uncle is followed
+// until its nephew matures, and pays the uncle reward
+//
+
+import "errors"
+import "math/big"
+import "time"
+
+const (
+	BLOCK_CANDIDATE = "candidate"
+	BLOCK_IMMATURE  = "immature"
+	BLOCK_MATURED   = "matured"
+	BLOCK_ORPHANED  = "orphaned"
+	BLOCK_UNCLE     = "uncle" // included as an uncle; matures with its nephew
+)
+
+type BlockStatusChange struct {
+	Status string    `json:"status" bson:"status"`
+	Time   time.Time `json:"time" bson:"time"`
+}
+
+type BlockCandidate struct {
+	Number     string              `json:"number" bson:"number"` // hex, like Block
+	Nonce      string              `json:"nonce" bson:"nonce"`
+	HeaderHash string              `json:"headerHash" bson:"headerHash"`
+	MixDigest  string              `json:"mixDigest" bson:"mixDigest"`
+	Hash       string              `json:"hash" bson:"hash"` // block hash, once seen on chain
+	Difficulty string              `json:"difficulty" bson:"difficulty"`
+	Finder     string              `json:"finder" bson:"finder"`
+	Worker     string              `json:"worker" bson:"worker"`
+	Round      uint64              `json:"round" bson:"round"`
+	Nephew     string              `json:"nephew,omitempty" bson:"nephew,omitempty"` // number of the block including it as an uncle
+	Status     string              `json:"status" bson:"status"`
+	Found      time.Time           `json:"found" bson:"found"`
+	History    []BlockStatusChange `json:"history" bson:"history"`
+}
+
+func NewBlockCandidate(job *Job, nonce, mixDigest *big.Int, miner *Miner, worker string, round uint64, now time.Time) *BlockCandidate {
+	return &BlockCandidate{Number: getHexString(job.blockNumber, 0),
+		Nonce:      getHexString(nonce, 16),
+		HeaderHash: getHexString(job.headerHash, 64),
+		MixDigest:  getHexString(mixDigest, 64),
+		Difficulty: job.difficulty.String(),
+		Finder:     getHexString(miner.address, 40),
+		Worker:     worker,
+		Round:      round,
+		Status:     BLOCK_CANDIDATE,
+		Found:      now,
+		History:    []BlockStatusChange{{Status: BLOCK_CANDIDATE, Time: now}}}
+}
+
+func (self *BlockCandidate) getNumber() *big.Int {
+	num, err := parseHex(self.Number, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return num
+}
+
+func (self *BlockCandidate) getNephew() *big.Int {
+	num, err := parseHex(self.Nephew, 0)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return num
+}
+
+func (self *BlockCandidate) isUncle() bool {
+	return len(self.Nephew) > 0
+}
+
+func (self *BlockCandidate) isOpen() bool {
+	return self.Status == BLOCK_CANDIDATE || self.Status == BLOCK_IMMATURE || self.Status == BLOCK_UNCLE
+}
+
+// the chain block at the candidate's height is ours
+func (self *BlockCandidate) matches(block *Block) bool {
+	nonce, err := parseHex(block.Nonce, 8)
+	ours, _ := parseHex(self.Nonce, 8)
+	return err == nil && nonce.Cmp(ours) == 0
+}
+
+func (self *BlockCandidate) setStatus(status string, now time.Time) {
+	self.Status = status
+	self.History = append(self.History, BlockStatusChange{Status: status, Time: now})
+}
+
+type BlockListener interface {
+	BlockImmature(*BlockCandidate)
+	BlockMatured(*BlockCandidate)
+	BlockOrphaned(*BlockCandidate)
+}
+
+/*
+ * status poll processor that moves candidates through their lifecycle
+ */
+type BlockCandidateProcessor struct {
+	db         Database
+	eth        EthAll
+	coinbase   *big.Int          // the pool's; uncles mined by anyone else are ignored
+	candidates []*BlockCandidate // open candidates, loaded for each poll
+	listeners  []BlockListener
+}
+
+func NewBlockCandidateProcessor(db Database, eth EthAll) *BlockCandidateProcessor {
+	return &BlockCandidateProcessor{db: db, eth: eth, listeners: make([]BlockListener, 0, 4)}
+}
+
+func (self *BlockCandidateProcessor) RegisterListener(l BlockListener) {
+	self.listeners = append(self.listeners, l)
+}
+
+func getOpenBlockCandidates(db Database) ([]*BlockCandidate, error) {
+	candidates := make([]*BlockCandidate, 0)
+	query := map[string]interface{}{"status": map[string]interface{}{"$in": []string{BLOCK_CANDIDATE, BLOCK_IMMATURE, BLOCK_UNCLE}}}
+	err := db.FindIn("block_candidates", query, "round", 0, &candidates)
+	return candidates, err
+}
+
+func (self *BlockCandidateProcessor) BeginProcessing() error {
+	if self.coinbase == nil {
+		coinbase, err := self.eth.GetCoinbase()
+
+		if err != nil {
+			return errors.New("could not get coinbase - " + err.Error())
+		}
+
+		self.coinbase = coinbase
+	}
+
+	err := self.db.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	self.candidates, err = getOpenBlockCandidates(self.db)
+
+	if err != nil {
+		self.db.Disconnect()
+		return errors.New("could not load block candidates - " + err.Error())
+	}
+
+	return nil
+}
+
+func (self *BlockCandidateProcessor) AddBlock(*Block) {
+}
+
+// called by the status poll for every uncle of a confirmed block
+func (self *BlockCandidateProcessor) AddUncle(uncle *Block, nephew *Block) {
+	if uncle.getMiner().Cmp(self.coinbase) != 0 {
+		return
+	}
+
+	orphaned := make([]*BlockCandidate, 0, 1)
+	query := map[string]interface{}{"number": getHexString(uncle.getNumber(), 0), "status": BLOCK_ORPHANED}
+	err := self.db.FindIn("block_candidates", query, "", 0, &orphaned)
+
+	if err != nil {
+		blocksLog.Error("could not look up uncle", "block", uncle.Number, "err", err)
+		return
+	}
+
+	// open candidates were loaded already, and those copies are written back at the end
+	for _, candidate := range append(self.candidates, orphaned...) {
+		if candidate.Number != getHexString(uncle.getNumber(), 0) || !candidate.matches(uncle) || candidate.isUncle() {
+			continue
+		}
+
+		self.setUncle(candidate, uncle, nephew, time.Now())
+		return
+	}
+
+	blocksLog.Warn("uncle was mined by the pool but is not a known candidate", "block", uncle.Number, "nonce", uncle.Nonce)
+}
+
+/*
+ * an immature candidate was credited as a block; it is reported orphaned, so
+ * those credits are reverted until the uncle matures
+ */
+func (self *BlockCandidateProcessor) setUncle(candidate *BlockCandidate, uncle *Block, nephew *Block, now time.Time) {
+	blocksLog.Info("candidate is an uncle", "block", candidate.Number, "nonce", candidate.Nonce, "nephew", nephew.Number)
+	immature := candidate.Status == BLOCK_IMMATURE
+	candidate.Hash = uncle.Hash
+	candidate.Nephew = getHexString(nephew.getNumber(), 0)
+	candidate.setStatus(BLOCK_UNCLE, now)
+
+	err := self.db.Update(candidate)
+
+	if err != nil {
+		blocksLog.Error("could not update block candidate", "block", candidate.Number, "nonce", candidate.Nonce, "err", err)
+	}
+
+	if immature {
+		for _, listener := range self.listeners {
+			listener.BlockOrphaned(candidate)
+		}
+	}
+}
+
+/*
+ * the candidate as an uncle of one of the UNCLE_MAX_DEPTH blocks after it,
+ * and that block; nil if none of them up to the head included it
+ */
+func (self *BlockCandidateProcessor) findUncle(candidate *BlockCandidate, head *big.Int) (*Block, *Block) {
+	for i := int64(1); i <= UNCLE_MAX_DEPTH; i++ {
+		number := big.NewInt(0).Add(candidate.getNumber(), big.NewInt(i))
+
+		if number.Cmp(head) > 0 {
+			break
+		}
+
+		nephew := self.eth.GetBlockByNumber(number, false)
+
+		if nephew == nil {
+			continue
+		}
+
+		for index := range nephew.Uncles {
+			uncle := self.eth.GetUncleByBlockNumberAndIndex(number, index)
+
+			if uncle != nil && uncle.getMiner().Cmp(self.coinbase) == 0 &&
+				getHexString(uncle.getNumber(), 0) == candidate.Number && candidate.matches(uncle) {
+				return uncle, nephew
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (self *BlockCandidateProcessor) Commit() error {
+	return nil
+}
+
+// candidates are looked up at their height directly, so this works no matter
+// how far behind the chain scanner is
+func (self *BlockCandidateProcessor) EndProcessing() error {
+	defer self.db.Disconnect()
+
+	head, err := self.eth.GetBlockNumber()
+
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range self.candidates {
+		self.updateCandidate(candidate, head, time.Now())
+	}
+
+	self.candidates = nil
+	return nil
+}
+
+func (self *BlockCandidateProcessor) updateCandidate(candidate *BlockCandidate, head *big.Int, now time.Time) {
+	number := candidate.getNumber()
+
+	if !candidate.isOpen() || head.Cmp(number) < 0 {
+		return
+	}
+
+	if candidate.Status == BLOCK_UNCLE {
+		self.updateUncle(candidate, head, now)
+		return
+	}
+
+	block := self.eth.GetBlockByNumber(number, false)
+
+	if block == nil {
+		return
+	}
+
+	depth := big.NewInt(0).Sub(head, number).Int64()
+	status := candidate.Status
+
+	if candidate.matches(block) {
+		candidate.Hash = block.Hash
+
+		if depth >= BLOCK_MATURE_DEPTH {
+			status = BLOCK_MATURED
+		} else {
+			status = BLOCK_IMMATURE
+		}
+	} else if depth >= BLOCK_CONFIRM_DEPTH {
+		// uncles are found here rather than when the scanner gets to the nephew
+		if uncle, nephew := self.findUncle(candidate, head); uncle != nil {
+			self.setUncle(candidate, uncle, nephew, now)
+			return
+		}
+
+		status = BLOCK_ORPHANED
+	}
+
+	if status == candidate.Status {
+		return
+	}
+
+	self.changeStatus(candidate, status, now)
+}
+
+// uncles mature with their nephew; its chain position was settled by the scanner
+func (self *BlockCandidateProcessor) updateUncle(candidate *BlockCandidate, head *big.Int, now time.Time) {
+	depth := big.NewInt(0).Sub(head, candidate.getNephew()).Int64()
+
+	if depth >= BLOCK_MATURE_DEPTH {
+		self.changeStatus(candidate, BLOCK_MATURED, now)
+	}
+}
+
+func (self *BlockCandidateProcessor) changeStatus(candidate *BlockCandidate, status string, now time.Time) {
+	blocksLog.Info("block candidate status changed", "block", candidate.Number, "nonce", candidate.Nonce, "status", status)
+	candidate.setStatus(status, now)
+
+	err := self.db.Update(candidate)
+
+	if err != nil {
+		blocksLog.Error("could not update block candidate", "block", candidate.Number, "nonce", candidate.Nonce, "err", err)
+	}
+
+	for _, listener := range self.listeners {
+		switch status {
+		case BLOCK_IMMATURE:
+			listener.BlockImmature(candidate)
+		case BLOCK_MATURED:
+			listener.BlockMatured(candidate)
+		case BLOCK_ORPHANED:
+			listener.BlockOrphaned(candidate)
+		}
+	}
+}
+
+// the round after the last recorded candidate
+func getNextRound(db Database) uint64 {
+	candidates := make([]*BlockCandidate, 0, 1)
+	err := db.FindIn("block_candidates", map[string]interface{}{}, "-round", 1, &candidates)
+
+	if err != nil || len(candidates) == 0 {
+		return 1
+	}
+
+	return candidates[0].Round + 1
+}
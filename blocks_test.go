@@ -0,0 +1,176 @@
+package main
+
+import "testing"
+import "math/big"
+import "time"
+
+// keeps block candidates in memory
+type candidateDatabase struct {
+	Database
+	candidates []*BlockCandidate
+}
+
+func (self *candidateDatabase) Connect() error    { return nil }
+func (self *candidateDatabase) Disconnect() error { return nil }
+func (self *candidateDatabase) Update(interface{}) error {
+	return nil
+}
+
+func (self *candidateDatabase) FindIn(table string, query map[string]interface{}, sort string, limit int, result interface{}) error {
+	ret := result.(*[]*BlockCandidate)
+	for _, candidate := range self.candidates {
+		if number, ok := query["number"]; ok {
+			if candidate.Number == number && candidate.Status == query["status"] {
+				*ret = append(*ret, candidate)
+			}
+		} else if candidate.isOpen() {
+			*ret = append(*ret, candidate)
+		}
+	}
+	return nil
+}
+
+type countingBlockListener struct {
+	immature, matured, orphaned int
+}
+
+func (self *countingBlockListener) BlockImmature(*BlockCandidate) { self.immature++ }
+func (self *countingBlockListener) BlockMatured(*BlockCandidate)  { self.matured++ }
+func (self *countingBlockListener) BlockOrphaned(*BlockCandidate) { self.orphaned++ }
+
+func TestBlockCandidateLifecycle(t *testing.T) {
+	job := &Job{headerHash: big.NewInt(0x1234), blockNumber: big.NewInt(100), difficulty: big.NewInt(1000)}
+	miner := MinerNew(nil, big.NewInt(1), time.Now())
+
+	// MockGeth has nonce 0x8888444422221111 at every height
+	nonce, _ := parseHex("0x8888444422221111", 8)
+	ours := NewBlockCandidate(job, nonce, big.NewInt(1), miner, "rig1", 1, time.Now())
+	theirs := NewBlockCandidate(job, big.NewInt(0x1111), big.NewInt(1), miner, "rig1", 2, time.Now())
+
+	db := &candidateDatabase{candidates: []*BlockCandidate{ours, theirs}}
+	geth := &MockGeth{blockNumber: 102}
+	listener := &countingBlockListener{}
+	processor := NewBlockCandidateProcessor(db, geth)
+	processor.RegisterListener(listener)
+
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if ours.Status != BLOCK_IMMATURE || theirs.Status != BLOCK_CANDIDATE || listener.immature != 1 {
+		t.Error("expected immature and candidate, found ", ours.Status, " ", theirs.Status)
+	}
+
+	geth.blockNumber = 100 + BLOCK_MATURE_DEPTH
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if ours.Status != BLOCK_MATURED || theirs.Status != BLOCK_ORPHANED {
+		t.Error("expected matured and orphaned, found ", ours.Status, " ", theirs.Status)
+	}
+
+	if listener.matured != 1 || listener.orphaned != 1 || len(ours.History) != 3 {
+		t.Error("unexpected events ", listener, " history ", ours.History)
+	}
+
+	// closed candidates are left alone
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if listener.matured != 1 || listener.orphaned != 1 {
+		t.Error("expected no more events, found ", listener)
+	}
+}
+
+func TestUncleCandidate(t *testing.T) {
+	job := &Job{headerHash: big.NewInt(0x1234), blockNumber: big.NewInt(100), difficulty: big.NewInt(1000)}
+	miner := MinerNew(nil, big.NewInt(1), time.Now())
+	candidate := NewBlockCandidate(job, big.NewInt(0x1111), big.NewInt(1), miner, "rig1", 1, time.Now())
+
+	db := &candidateDatabase{candidates: []*BlockCandidate{candidate}}
+	geth := &MockGeth{blockNumber: 100 + BLOCK_CONFIRM_DEPTH}
+	listener := &countingBlockListener{}
+	processor := NewBlockCandidateProcessor(db, geth)
+	processor.RegisterListener(listener)
+
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if candidate.Status != BLOCK_ORPHANED {
+		t.Fatal("expected orphaned, found ", candidate.Status)
+	}
+
+	coinbase, _ := geth.GetCoinbase()
+	uncle := &Block{Number: "0x64", Hash: "0x55", Nonce: "0x0000000000001111", Miner: getHexString(coinbase, 40)}
+	nephew := &Block{Number: "0x66"}
+	stranger := &Block{Number: "0x64", Nonce: "0x0000000000001111", Miner: "0x1111111111222222222233333333334444444444"}
+
+	processor.BeginProcessing()
+	processor.AddUncle(stranger, nephew)
+
+	if candidate.Status != BLOCK_ORPHANED {
+		t.Error("expected uncles mined by others to be ignored")
+	}
+
+	processor.AddUncle(uncle, nephew)
+	processor.EndProcessing()
+
+	if candidate.Status != BLOCK_UNCLE || candidate.Nephew != "0x66" || listener.matured != 0 {
+		t.Error("expected an uncle of 0x66, found ", candidate.Status, " ", candidate.Nephew)
+	}
+
+	// matures with its nephew
+	geth.blockNumber = 0x66 + BLOCK_MATURE_DEPTH
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if candidate.Status != BLOCK_MATURED || listener.matured != 1 {
+		t.Error("expected the uncle to mature, found ", candidate.Status)
+	}
+}
+
+func TestUncleCandidateLookup(t *testing.T) {
+	job := &Job{headerHash: big.NewInt(0x1234), blockNumber: big.NewInt(100), difficulty: big.NewInt(1000)}
+	miner := MinerNew(nil, big.NewInt(1), time.Now())
+	candidate := NewBlockCandidate(job, big.NewInt(0x1111), big.NewInt(1), miner, "rig1", 1, time.Now())
+
+	// every block has the candidate as its uncle
+	geth := &MockGeth{blockNumber: 100 + BLOCK_CONFIRM_DEPTH, blockUncles: []string{"0x55"}}
+	coinbase, _ := geth.GetCoinbase()
+	geth.uncleBlocks = []*Block{{Number: "0x64", Hash: "0x55", Nonce: "0x0000000000001111", Miner: getHexString(coinbase, 40)}}
+
+	db := &candidateDatabase{candidates: []*BlockCandidate{candidate}}
+	listener := &countingBlockListener{}
+	processor := NewBlockCandidateProcessor(db, geth)
+	processor.RegisterListener(listener)
+
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	if candidate.Status != BLOCK_UNCLE || candidate.Nephew != "0x65" || listener.orphaned != 0 {
+		t.Error("expected an uncle of 0x65 without being orphaned, found ", candidate.Status, " ", candidate.Nephew)
+	}
+}
+
+func TestImmatureCandidateUncle(t *testing.T) {
+	job := &Job{headerHash: big.NewInt(0x1234), blockNumber: big.NewInt(100), difficulty: big.NewInt(1000)}
+	miner := MinerNew(nil, big.NewInt(1), time.Now())
+	candidate := NewBlockCandidate(job, big.NewInt(0x1111), big.NewInt(1), miner, "rig1", 1, time.Now())
+	candidate.setStatus(BLOCK_IMMATURE, time.Now())
+
+	geth := &MockGeth{blockNumber: 100 + BLOCK_CONFIRM_DEPTH, blockUncles: []string{"0x55"}}
+	coinbase, _ := geth.GetCoinbase()
+	geth.uncleBlocks = []*Block{{Number: "0x64", Hash: "0x55", Nonce: "0x0000000000001111", Miner: getHexString(coinbase, 40)}}
+
+	db := &candidateDatabase{candidates: []*BlockCandidate{candidate}}
+	listener := &countingBlockListener{}
+	processor := NewBlockCandidateProcessor(db, geth)
+	processor.RegisterListener(listener)
+
+	processor.BeginProcessing()
+	processor.EndProcessing()
+
+	// its credits as a block are reverted right away
+	if candidate.Status != BLOCK_UNCLE || listener.orphaned != 1 {
+		t.Error("expected the immature block to become an uncle and be reported orphaned, found ", candidate.Status, " ", listener.orphaned)
+	}
+}
@@ -1,5 +1,14 @@
 package main
 
+import "encoding/json"
+import "errors"
+import "net"
+import "net/url"
+import "os"
+import "math/big"
+import "strconv"
+import "strings"
+
 type Config struct {
 	scanner bool
 	pool    bool
@@ -18,3 +27,368 @@ func NewConfig(scanner, pool, pay, web, all bool) *Config {
 func (self *Config) OnlyScanner() bool {
 	return self.scanner && !self.pool && !self.pay
 }
+
+/*
+ * deployment settings: addresses, ports, the database and the pool's fee and
+ * share time. defaults are below; a json file (-config) and then ONEETHER_*
+ * environment variables (e.g. ONEETHER_GETH_IP) override them. an empty
+ * optional port turns its listener off. settings tagged live are applied
+ * again when the pool gets SIGHUP (see SettingsReloader); the others need a
+ * restart
+ */
+type Settings struct {
+	ListenPort   string `json:"listenPort"`   // http getwork
+	StratumPort  string `json:"stratumPort"`  // optional
+	EthProxyPort string `json:"ethProxyPort"` // optional
+	APIPort      string `json:"apiPort"`      // optional, read-only statistics
+	MetricsPort  string `json:"metricsPort"`  // optional, /metrics and /log
+	MetricsIP    string `json:"metricsIp"`    // address the metrics port listens on; empty for every interface
+	MagicPort    string `json:"magicPort"`    // optional, balance updates sent to the web backend
+	PayRPCPort   string `json:"payRpcPort"`
+
+	GethIP      string `json:"gethIp"`
+	GethPort    string `json:"gethPort"`
+	ConfirmAddr string `json:"confirmAddr"`           // remote verifier url; empty disables it
+	BackendIP   string `json:"backendIp" live:"true"` // web backend told about payments and stats
+	BackendPort string `json:"backendPort" live:"true"`
+	MongoHost   string `json:"mongoHost"`
+	MongoDB     string `json:"mongoDb"`
+
+	HouseRake    float64 `json:"houseRake" live:"true"`    // pool fee, as a fraction of rewards
+	RewardScheme string  `json:"rewardScheme" live:"true"` // pplns, prop, pps, pps+ or solo
+	ShareTime    float64 `json:"shareTime"`                // seconds between shares that vardiff aims for
+
+	BlockRewardForks []BlockRewardFork `json:"blockRewardForks"` // by height, from block 0; only in the file
+
+	VardiffMinDifficulty int64    `json:"vardiffMinDifficulty" live:"true"`
+	VardiffMaxDifficulty int64    `json:"vardiffMaxDifficulty" live:"true"`
+	PayoutMinimum        string   `json:"payoutMinimum" live:"true"`  // wei, for miners who did not set their own
+	PayoutInterval       float64  `json:"payoutInterval" live:"true"` // seconds between payout runs
+	PayoutMaxPerRun      int64    `json:"payoutMaxPerRun" live:"true"`
+	BanAllowlist         []string `json:"banAllowlist" live:"true"` // ips, cidr networks and addresses
+	BanDenylist          []string `json:"banDenylist" live:"true"`
+
+	BanInvalidThreshold   int64   `json:"banInvalidThreshold" live:"true"` // rejected shares within banWindow
+	BanDuplicateThreshold int64   `json:"banDuplicateThreshold" live:"true"`
+	BanMalformedThreshold int64   `json:"banMalformedThreshold" live:"true"`
+	BanWindow             float64 `json:"banWindow" live:"true"` // seconds
+	BanTime               float64 `json:"banTime" live:"true"`   // seconds
+	RateLimit             float64 `json:"rateLimit" live:"true"` // requests a second from each ip
+	RateLimitBurst        float64 `json:"rateLimitBurst" live:"true"`
+
+	LogLevel  string            `json:"logLevel" live:"true"`
+	LogLevels map[string]string `json:"logLevels" live:"true"` // by subsystem; only in the file
+	LogFormat string            `json:"logFormat" live:"true"`
+
+	BlockPersistFilename string `json:"blockPersistFilename"`
+	PayPersistFilename   string `json:"payPersistFilename"`
+}
+
+// the defaults; the lists and maps are copies, so changing one Settings leaves the others alone
+func DefaultSettings() *Settings {
+	logLevels := make(map[string]string, len(LOG_LEVELS))
+	for subsystem, level := range LOG_LEVELS {
+		logLevels[subsystem] = level
+	}
+
+	return &Settings{ListenPort: "8080",
+		StratumPort:           "8008",
+		EthProxyPort:          "8009",
+		APIPort:               "8088",
+		MetricsPort:           "9102",
+		MetricsIP:             "127.0.0.1",
+		MagicPort:             "7777",
+		PayRPCPort:            "9090",
+		GethIP:                "127.0.0.1",
+		GethPort:              "8545",
+		ConfirmAddr:           "http://127.0.0.1:8081",
+		BackendIP:             "oneether.com",
+		BackendPort:           "9999",
+		MongoHost:             "localhost",
+		MongoDB:               "one",
+		HouseRake:             0.02,
+		RewardScheme:          REWARD_SCHEME,
+		ShareTime:             DEFAULT_SHARE_TIME,
+		BlockRewardForks:      append([]BlockRewardFork{}, BLOCK_REWARD_FORKS...),
+		VardiffMinDifficulty:  VARDIFF_MIN_DIFFICULTY,
+		VardiffMaxDifficulty:  VARDIFF_MAX_DIFFICULTY,
+		PayoutMinimum:         PAYOUT_MINIMUM,
+		PayoutInterval:        PAYOUT_INTERVAL,
+		PayoutMaxPerRun:       PAYOUT_MAX_PER_RUN,
+		BanAllowlist:          append([]string{}, BAN_ALLOWLIST...),
+		BanDenylist:           append([]string{}, BAN_DENYLIST...),
+		BanInvalidThreshold:   BAN_INVALID_THRESHOLD,
+		BanDuplicateThreshold: BAN_DUPLICATE_THRESHOLD,
+		BanMalformedThreshold: BAN_MALFORMED_THRESHOLD,
+		BanWindow:             BAN_WINDOW,
+		BanTime:               BAN_TIME,
+		RateLimit:             RATE_LIMIT,
+		RateLimitBurst:        RATE_LIMIT_BURST,
+		LogLevel:              LOG_LEVEL,
+		LogLevels:             logLevels,
+		LogFormat:             LOG_FORMAT,
+		BlockPersistFilename:  "block.last",
+		PayPersistFilename:    "pending.persist"}
+}
+
+// each setting's environment variable and field
+func (self *Settings) getEnvFields() map[string]interface{} {
+	return map[string]interface{}{"LISTEN_PORT": &self.ListenPort,
+		"STRATUM_PORT":            &self.StratumPort,
+		"ETHPROXY_PORT":           &self.EthProxyPort,
+		"API_PORT":                &self.APIPort,
+		"METRICS_PORT":            &self.MetricsPort,
+		"METRICS_IP":              &self.MetricsIP,
+		"MAGIC_PORT":              &self.MagicPort,
+		"PAY_RPC_PORT":            &self.PayRPCPort,
+		"GETH_IP":                 &self.GethIP,
+		"GETH_PORT":               &self.GethPort,
+		"CONFIRM_ADDR":            &self.ConfirmAddr,
+		"BACKEND_IP":              &self.BackendIP,
+		"BACKEND_PORT":            &self.BackendPort,
+		"MONGO_HOST":              &self.MongoHost,
+		"MONGO_DB":                &self.MongoDB,
+		"HOUSE_RAKE":              &self.HouseRake,
+		"REWARD_SCHEME":           &self.RewardScheme,
+		"SHARE_TIME":              &self.ShareTime,
+		"VARDIFF_MIN_DIFFICULTY":  &self.VardiffMinDifficulty,
+		"VARDIFF_MAX_DIFFICULTY":  &self.VardiffMaxDifficulty,
+		"PAYOUT_MINIMUM":          &self.PayoutMinimum,
+		"PAYOUT_INTERVAL":         &self.PayoutInterval,
+		"PAYOUT_MAX_PER_RUN":      &self.PayoutMaxPerRun,
+		"BAN_ALLOWLIST":           &self.BanAllowlist,
+		"BAN_DENYLIST":            &self.BanDenylist,
+		"BAN_INVALID_THRESHOLD":   &self.BanInvalidThreshold,
+		"BAN_DUPLICATE_THRESHOLD": &self.BanDuplicateThreshold,
+		"BAN_MALFORMED_THRESHOLD": &self.BanMalformedThreshold,
+		"BAN_WINDOW":              &self.BanWindow,
+		"BAN_TIME":                &self.BanTime,
+		"RATE_LIMIT":              &self.RateLimit,
+		"RATE_LIMIT_BURST":        &self.RateLimitBurst,
+		"LOG_LEVEL":               &self.LogLevel,
+		"LOG_FORMAT":              &self.LogFormat,
+		"BLOCK_PERSIST_FILENAME":  &self.BlockPersistFilename,
+		"PAY_PERSIST_FILENAME":    &self.PayPersistFilename}
+}
+
+// the json file; unknown keys are an error, so typos are not silently ignored
+func (self *Settings) readFile(filename string) error {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(self)
+
+	if err != nil {
+		return errors.New(filename + ": " + err.Error())
+	}
+
+	return nil
+}
+
+func (self *Settings) readEnv(lookup func(string) (string, bool)) error {
+	for name, field := range self.getEnvFields() {
+		value, ok := lookup(SETTINGS_ENV_PREFIX + name)
+
+		if !ok {
+			continue
+		}
+
+		switch field := field.(type) {
+		case *string:
+			*field = value
+		case *float64:
+			f, err := strconv.ParseFloat(value, 64)
+
+			if err != nil {
+				return errors.New(SETTINGS_ENV_PREFIX + name + ": not a number: " + value)
+			}
+
+			*field = f
+		case *int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+
+			if err != nil {
+				return errors.New(SETTINGS_ENV_PREFIX + name + ": not an integer: " + value)
+			}
+
+			*field = n
+		case *[]string:
+			// comma separated; empty for an empty list
+			*field = []string{}
+
+			for _, entry := range strings.Split(value, ",") {
+				if entry = strings.TrimSpace(entry); len(entry) > 0 {
+					*field = append(*field, entry)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func validatePort(name, port string, optional bool) error {
+	if len(port) == 0 && optional {
+		return nil
+	}
+
+	n, err := strconv.Atoi(port)
+
+	if err != nil || n <= 0 || n > 65535 {
+		return errors.New(name + ": invalid port \"" + port + "\"")
+	}
+
+	return nil
+}
+
+func (self *Settings) Validate() error {
+	ports := []struct {
+		name, port string
+		optional   bool
+	}{{"listenPort", self.ListenPort, false},
+		{"stratumPort", self.StratumPort, true},
+		{"ethProxyPort", self.EthProxyPort, true},
+		{"apiPort", self.APIPort, true},
+		{"metricsPort", self.MetricsPort, true},
+		{"magicPort", self.MagicPort, true},
+		{"payRpcPort", self.PayRPCPort, false},
+		{"gethPort", self.GethPort, false},
+		{"backendPort", self.BackendPort, false}}
+
+	seen := make(map[string]string)
+	for _, p := range ports {
+		err := validatePort(p.name, p.port, p.optional)
+
+		if err != nil {
+			return err
+		}
+
+		// the geth and backend ports are on other hosts
+		if len(p.port) > 0 && p.name != "gethPort" && p.name != "backendPort" {
+			if other, ok := seen[p.port]; ok {
+				return errors.New(p.name + ": port " + p.port + " is already used by " + other)
+			}
+			seen[p.port] = p.name
+		}
+	}
+
+	// /log changes the log levels without authentication, so it is local unless asked otherwise
+	if len(self.MetricsIP) > 0 && net.ParseIP(self.MetricsIP) == nil {
+		return errors.New("metricsIp: expected an ip address, found \"" + self.MetricsIP + "\"")
+	}
+
+	if len(self.GethIP) == 0 || len(self.BackendIP) == 0 || len(self.MongoHost) == 0 || len(self.MongoDB) == 0 {
+		return errors.New("gethIp, backendIp, mongoHost and mongoDb are required")
+	}
+
+	if len(self.ConfirmAddr) > 0 {
+		u, err := url.Parse(self.ConfirmAddr)
+
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("confirmAddr: expected an http url, found \"" + self.ConfirmAddr + "\"")
+		}
+	}
+
+	if self.HouseRake < 0 || self.HouseRake >= 1 {
+		return errors.New("houseRake: expected a fraction from 0 up to 1, found " + strconv.FormatFloat(self.HouseRake, 'f', -1, 64))
+	}
+
+	if _, err := NewRewardScheme(self.RewardScheme, self.HouseRake); err != nil {
+		return errors.New("rewardScheme: " + err.Error())
+	}
+
+	if self.ShareTime <= 0 {
+		return errors.New("shareTime: expected a positive number of seconds")
+	}
+
+	if _, err := NewBlockRewardCalculator(nil, self.BlockRewardForks); err != nil {
+		return errors.New("blockRewardForks: " + err.Error())
+	}
+
+	if self.VardiffMinDifficulty <= 0 || self.VardiffMaxDifficulty < self.VardiffMinDifficulty {
+		return errors.New("vardiffMinDifficulty and vardiffMaxDifficulty: expected 0 < min <= max")
+	}
+
+	if minimum, ok := big.NewInt(0).SetString(self.PayoutMinimum, 10); !ok || minimum.Sign() <= 0 {
+		return errors.New("payoutMinimum: expected a positive amount of wei, found \"" + self.PayoutMinimum + "\"")
+	}
+
+	if self.PayoutInterval <= 0 {
+		return errors.New("payoutInterval: expected a positive number of seconds")
+	}
+
+	if self.PayoutMaxPerRun <= 0 {
+		return errors.New("payoutMaxPerRun: expected at least one payout per run")
+	}
+
+	if _, err := newBanList(self.BanAllowlist); err != nil {
+		return errors.New("banAllowlist: " + err.Error())
+	}
+
+	if _, err := newBanList(self.BanDenylist); err != nil {
+		return errors.New("banDenylist: " + err.Error())
+	}
+
+	if self.BanInvalidThreshold <= 0 || self.BanDuplicateThreshold <= 0 || self.BanMalformedThreshold <= 0 {
+		return errors.New("banInvalidThreshold, banDuplicateThreshold and banMalformedThreshold: expected at least one share")
+	}
+
+	if self.BanWindow <= 0 || self.BanTime <= 0 {
+		return errors.New("banWindow and banTime: expected a positive number of seconds")
+	}
+
+	if self.RateLimit <= 0 || self.RateLimitBurst < 1 {
+		return errors.New("rateLimit and rateLimitBurst: expected a positive rate and a burst of at least one request")
+	}
+
+	if err := validateLogging(self.LogLevel, self.LogLevels, self.LogFormat); err != nil {
+		return errors.New("logging: " + err.Error())
+	}
+
+	if len(self.BlockPersistFilename) == 0 || len(self.PayPersistFilename) == 0 {
+		return errors.New("blockPersistFilename and payPersistFilename are required")
+	}
+
+	return nil
+}
+
+/*
+ * the defaults, overridden by the file (if a filename is given) and then by
+ * the environment; lookup is os.LookupEnv outside of tests
+ */
+func LoadSettings(filename string, lookup func(string) (string, bool)) (*Settings, error) {
+	ret := DefaultSettings()
+
+	if len(filename) > 0 {
+		err := ret.readFile(filename)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := ret.readEnv(lookup)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ret.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (self *Settings) getBackendAddr() string {
+	return "http://" + self.BackendIP + ":" + self.BackendPort
+}
@@ -0,0 +1,175 @@
+package main
+
+import "io/ioutil"
+import "math/big"
+import "os"
+import "strings"
+import "testing"
+
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func TestDefaultSettings(t *testing.T) {
+	settings, err := LoadSettings("", noEnv)
+
+	if err != nil {
+		t.Fatal("expected the defaults to be valid - ", err)
+	}
+
+	if settings.ListenPort != "8080" || settings.MongoHost != "localhost" || settings.MongoDB != "one" ||
+		settings.HouseRake != 0.02 || settings.ShareTime != DEFAULT_SHARE_TIME {
+		t.Error("unexpected defaults ", settings)
+	}
+}
+
+func TestDefaultSettingsCopies(t *testing.T) {
+	settings := DefaultSettings()
+	settings.BanAllowlist[0] = "10.0.0.1"
+	settings.LogLevels["pool"] = "debug"
+
+	file, _ := ioutil.TempFile("", "settings")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"logLevels": {"stratum": "debug"}}`)
+	file.Close()
+
+	if _, err := LoadSettings(file.Name(), noEnv); err != nil {
+		t.Fatal("could not load settings - ", err)
+	}
+
+	settings.BlockRewardForks[0].Reward = "1"
+	defaults := DefaultSettings()
+
+	if defaults.BanAllowlist[0] != "127.0.0.1" || len(defaults.LogLevels) != 0 || len(LOG_LEVELS) != 0 {
+		t.Error("expected the defaults to be left alone, found ", defaults.BanAllowlist, " ", defaults.LogLevels)
+	}
+
+	if defaults.BlockRewardForks[0].Reward != BLOCK_REWARD_FORKS[0].Reward {
+		t.Error("expected the default fork schedule to be left alone, found ", defaults.BlockRewardForks[0])
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	file, _ := ioutil.TempFile("", "settings")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"gethIp": "10.0.0.2", "houseRake": 0.01, "stratumPort": ""}`)
+	file.Close()
+
+	env := map[string]string{"ONEETHER_HOUSE_RAKE": "0.015", "ONEETHER_MONGO_DB": "pool",
+		"ONEETHER_BAN_DENYLIST": "10.0.0.1, 10.0.0.0/24", "ONEETHER_VARDIFF_MIN_DIFFICULTY": "2000000",
+		"ONEETHER_REWARD_SCHEME": "pps", "ONEETHER_RATE_LIMIT": "5", "ONEETHER_BAN_INVALID_THRESHOLD": "10"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	settings, err := LoadSettings(file.Name(), lookup)
+
+	if err != nil {
+		t.Fatal("could not load settings - ", err)
+	}
+
+	// the environment wins over the file, which wins over the defaults
+	if settings.GethIP != "10.0.0.2" || settings.HouseRake != 0.015 || settings.MongoDB != "pool" ||
+		settings.StratumPort != "" || settings.GethPort != "8545" {
+		t.Error("unexpected settings ", settings)
+	}
+
+	if len(settings.BanDenylist) != 2 || settings.BanDenylist[1] != "10.0.0.0/24" || settings.VardiffMinDifficulty != 2000000 {
+		t.Error("expected the list and integer settings from the environment, found ", settings)
+	}
+
+	if settings.RewardScheme != "pps" || settings.RateLimit != 5 || settings.BanInvalidThreshold != 10 || settings.BanTime != BAN_TIME {
+		t.Error("expected the reward scheme and ban settings from the environment, found ", settings)
+	}
+
+	env["ONEETHER_SHARE_TIME"] = "soon"
+	if _, err = LoadSettings(file.Name(), lookup); err == nil || !strings.Contains(err.Error(), "ONEETHER_SHARE_TIME") {
+		t.Error("expected a bad number to be rejected, found ", err)
+	}
+
+	if _, err = LoadSettings("missing.json", noEnv); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+
+	file, _ = ioutil.TempFile("", "settings")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"gethAddress": "10.0.0.2"}`)
+	file.Close()
+
+	if _, err = LoadSettings(file.Name(), noEnv); err == nil {
+		t.Error("expected an unknown key to be rejected")
+	}
+}
+
+// a chain with other rewards only needs a new schedule in the file
+func TestLoadBlockRewardForks(t *testing.T) {
+	file, _ := ioutil.TempFile("", "settings")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"blockRewardForks": [{"name": "genesis", "height": 0, "reward": "4000000000000000000"},
+		{"name": "halving", "height": 1000, "reward": "2000000000000000000"}]}`)
+	file.Close()
+
+	settings, err := LoadSettings(file.Name(), noEnv)
+
+	if err != nil {
+		t.Fatal("could not load settings - ", err)
+	}
+
+	calculator, _ := NewBlockRewardCalculator(&MockGeth{}, settings.BlockRewardForks)
+
+	if reward := calculator.GetBaseReward(big.NewInt(1000)); reward.String() != "2000000000000000000" {
+		t.Error("expected the reward from the file's schedule, found ", reward)
+	}
+
+	file, _ = ioutil.TempFile("", "settings")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"blockRewardForks": [{"name": "late", "height": 5, "reward": "1"}]}`)
+	file.Close()
+
+	if _, err = LoadSettings(file.Name(), noEnv); err == nil || !strings.Contains(err.Error(), "blockRewardForks") {
+		t.Error("expected a schedule without block 0 to be rejected, found ", err)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	invalid := []func(*Settings){
+		func(s *Settings) { s.ListenPort = "" },
+		func(s *Settings) { s.StratumPort = "80808" },
+		func(s *Settings) { s.APIPort = s.ListenPort },
+		func(s *Settings) { s.MongoHost = "" },
+		func(s *Settings) { s.MetricsIP = "localhost" },
+		func(s *Settings) { s.ConfirmAddr = "127.0.0.1:8081" },
+		func(s *Settings) { s.HouseRake = 1 },
+		func(s *Settings) { s.RewardScheme = "ppsx" },
+		func(s *Settings) { s.ShareTime = 0 },
+		func(s *Settings) { s.BlockRewardForks = []BlockRewardFork{} },
+		func(s *Settings) { s.BlockRewardForks[1].Reward = "3 eth" },
+		func(s *Settings) { s.VardiffMaxDifficulty = s.VardiffMinDifficulty - 1 },
+		func(s *Settings) { s.PayoutMinimum = "0.1" },
+		func(s *Settings) { s.PayoutInterval = 0 },
+		func(s *Settings) { s.PayoutMaxPerRun = 0 },
+		func(s *Settings) { s.BanAllowlist = []string{"localhost"} },
+		func(s *Settings) { s.BanMalformedThreshold = 0 },
+		func(s *Settings) { s.BanWindow = 0 },
+		func(s *Settings) { s.RateLimitBurst = 0.5 },
+		func(s *Settings) { s.LogLevels = map[string]string{"pool": "loud"} },
+	}
+
+	for i, change := range invalid {
+		settings := DefaultSettings()
+		change(settings)
+
+		if settings.Validate() == nil {
+			t.Error("expected change ", i, " to be invalid")
+		}
+	}
+
+	settings := DefaultSettings()
+	settings.StratumPort = ""
+	settings.ConfirmAddr = ""
+
+	if err := settings.Validate(); err != nil {
+		t.Error("expected optional settings to be left out - ", err)
+	}
+}
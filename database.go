@@ -6,7 +6,6 @@ package main
 // you might also want to view 'mongo.go', which has *actual* database stuff
 //
 
-import "log"
 
 type DatabaseBlockProcessor struct {
 	db    Database
@@ -84,8 +83,8 @@ func (self *DatabaseBlockProcessor) dumpCache() error {
 		err := self.db.Update(account)
 
 		if err != nil {
-			log.Printf("could not update miner in db: " + err.Error())
-            log.Println(len(account.Incoming), len(account.Outgoing), len(account.Mined))
+			scannerLog.Error("could not update account", "account", account.Address, "incoming", len(account.Incoming),
+				"outgoing", len(account.Outgoing), "mined", len(account.Mined), "err", err)
 			panic(err)
 		}
 	}
@@ -102,7 +101,7 @@ func (self *DatabaseBlockProcessor) updateTransaction(txn *Transaction) {
 	err := self.db.Add(txn)
 
 	if err != nil {
-		log.Printf("error adding transaction to db: " + err.Error())
+		scannerLog.Error("could not add transaction", "txid", txn.Hash, "err", err)
 	}
 
 	fromAccount := self.getAccount(txn.From)
@@ -123,7 +122,7 @@ func (self *DatabaseBlockProcessor) AddPendingBlock(block *Block) error {
 		err := self.db.AddTo("pending_transactions", txn)
 
 		if err != nil {
-			log.Printf("error adding transaction to db: " + err.Error())
+			scannerLog.Error("could not add pending transaction", "txid", txn.Hash, "err", err)
 		}
 
 		fromAccount := self.retrieveAccount(txn.From)
@@ -131,7 +130,7 @@ func (self *DatabaseBlockProcessor) AddPendingBlock(block *Block) error {
 		err = self.db.UpdateTo("pending_accounts", fromAccount)
 
 		if err != nil {
-			log.Printf("error adding 'from' account to db: " + err.Error())
+			scannerLog.Error("could not update pending account", "txid", txn.Hash, "account", txn.From, "err", err)
 		}
 
 		toAccount := self.retrieveAccount(txn.To)
@@ -139,7 +138,7 @@ func (self *DatabaseBlockProcessor) AddPendingBlock(block *Block) error {
 		err = self.db.UpdateTo("pending_accounts", toAccount)
 
 		if err != nil {
-			log.Printf("error adding 'to' transaction to db: " + err.Error())
+			scannerLog.Error("could not update pending account", "txid", txn.Hash, "account", txn.To, "err", err)
 		}
 	}
 	return nil
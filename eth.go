@@ -1,8 +1,6 @@
 package main
 
 import "strings"
-import "log"
-import "fmt"
 import "math/big"
 import "errors"
 import "time"
@@ -36,6 +34,7 @@ type Transaction struct {
 	Nonce       string `json:"nonce"`
 	BlockNumber string `json:"blockNumber"`
 	Timestamp   string `json:"timestamp"`
+	GasPrice    string `json:"gasPrice,omitempty"`
 }
 
 func (self *Transaction) isPending() bool {
@@ -80,6 +79,11 @@ func (self *Transaction) getValue() *big.Int {
     }
 }
 
+func (self *Transaction) getGasPrice() *big.Int {
+	ret, _ := parseHex(self.GasPrice, 0)
+	return ret
+}
+
 func (self *Transaction) getNonce() *big.Int {
 	ret, err := parseHex(self.Nonce, 8)
 	if err != nil {
@@ -100,6 +104,7 @@ type Block struct {
 	Miner      string `json:"miner"`
 	Difficulty string `json:"difficulty"`
 	Timestamp  string `json:"timestamp"`
+	BaseFee    string `json:"baseFeePerGas,omitempty"` // only after london
 
 	Transactions []*Transaction `json:"transactions"`
 
@@ -114,7 +119,7 @@ func (self *Block) getTimestamp() time.Time {
 	num, err := parseHex(self.Timestamp, 0)
 
 	if err != nil {
-		fmt.Printf("could not parse timestamp\n")
+		gethLog.Error("could not parse block timestamp", "block", self.Number, "timestamp", self.Timestamp, "err", err)
 		return time.Time{}
 	}
 
@@ -161,6 +166,37 @@ func (self *Block) getDifficulty() *big.Int {
 	return num
 }
 
+// zero before london
+func (self *Block) getBaseFee() *big.Int {
+	ret, _ := parseHex(self.BaseFee, 0)
+	return ret
+}
+
+/**
+ *
+ */
+type TransactionReceipt struct {
+	TransactionHash   string `json:"transactionHash"`
+	BlockNumber       string `json:"blockNumber"`
+	GasUsed           string `json:"gasUsed"`
+	EffectiveGasPrice string `json:"effectiveGasPrice"` // missing from older geth versions
+}
+
+func (self *TransactionReceipt) getGasUsed() *big.Int {
+	ret, _ := parseHex(self.GasUsed, 0)
+	return ret
+}
+
+// nil if geth did not report it; the transaction's gas price applies then
+func (self *TransactionReceipt) getEffectiveGasPrice() *big.Int {
+	if len(self.EffectiveGasPrice) == 0 {
+		return nil
+	}
+
+	ret, _ := parseHex(self.EffectiveGasPrice, 0)
+	return ret
+}
+
 type EthWallet interface {
 	SendTransaction(from, to, value, nonce *big.Int) (*Transaction, error)
 	GetCoinbase() (*big.Int, error)
@@ -171,7 +207,9 @@ type EthWallet interface {
 
 type EthChain interface {
 	GetBlockByNumber(num *big.Int, full bool) *Block
+	GetUncleByBlockNumberAndIndex(num *big.Int, index int) *Block
 	GetTransactionByHash(num *big.Int) *Transaction
+	GetTransactionReceipt(hash *big.Int) (*TransactionReceipt, error)
 	GetBlockNumber() (*big.Int, error)
 	GetLastConfirmedBlockNumber() (*big.Int, error)
 }
@@ -187,12 +225,28 @@ type Geth struct {
 	address string
 }
 
+// counts a request to geth and how long it took
+func observeGethRequest(method string, start time.Time, failed bool) {
+	metrics.Inc("oneether_geth_requests_total", "method", method)
+	metrics.ObserveSince("oneether_geth_request_seconds", start, "method", method)
+
+	if failed {
+		metrics.Inc("oneether_geth_errors_total", "method", method)
+	}
+}
+
 func (self *Geth) SendRPCRequest(request *RPCRequest) (*RPCResponse, error) {
-	return sendRPCRequest(request, self.address)
+	start := time.Now()
+	response, err := sendRPCRequest(request, self.address)
+	observeGethRequest(request.Method, start, err != nil || response.Error != nil)
+	return response, err
 }
 
 func (self *Geth) SendRPCRequestRaw(request *RPCRequest) ([]byte, error) {
-	return sendRPCRequestRaw(request, self.address)
+	start := time.Now()
+	response, err := sendRPCRequestRaw(request, self.address)
+	observeGethRequest(request.Method, start, err != nil)
+	return response, err
 }
 
 func NewGeth(ip, port string) *Geth {
@@ -223,7 +277,7 @@ func (self *Geth) SendTransaction(from, to, value, nonce *big.Int) (*Transaction
 	response, err := self.SendRPCRequest(request)
 
 	if err != nil {
-		fmt.Printf("could not send transaction: " + err.Error() + "\n")
+		gethLog.Error("could not send transaction", "to", toStr, "value", valueStr, "nonce", nonceStr, "err", err)
 		return nil, err
 	}
 
@@ -237,7 +291,7 @@ func (self *Geth) SendTransaction(from, to, value, nonce *big.Int) (*Transaction
 	txHash, ok := (*response.Result).(string)
 
 	if !ok {
-		fmt.Printf("could not get transaction result; likely errored\n")
+		gethLog.Error("could not read transaction hash", "to", toStr, "value", valueStr, "nonce", nonceStr)
 		return nil, errors.New("could not get transaction hash")
 	}
 
@@ -255,7 +309,7 @@ func (self *Geth) GetBlockByNumber(num *big.Int, full bool) *Block {
 	jresponse, err := self.SendRPCRequestRaw(request)
 
 	if err != nil {
-		fmt.Printf("COULD NOT GET BLOCK " + err.Error() + "\n")
+		gethLog.Error("could not get block", "block", num, "err", err)
 		return nil
 	}
 
@@ -277,6 +331,27 @@ func (self *Geth) GetBlockByNumber(num *big.Int, full bool) *Block {
 	return block
 }
 
+func (self *Geth) GetUncleByBlockNumberAndIndex(num *big.Int, index int) *Block {
+	params := RPCParams{getHexString(num, 0), getHexString(big.NewInt(int64(index)), 0)}
+
+	request := NewRPCRequest(1, "eth_getUncleByBlockNumberAndIndex", params)
+	jresponse, err := self.SendRPCRequestRaw(request)
+
+	if err != nil {
+		gethLog.Error("could not get uncle", "block", num, "index", index, "err", err)
+		return nil
+	}
+
+	type GetBlockResponse struct {
+		Result *Block
+	}
+
+	blockResponse := GetBlockResponse{}
+	json.Unmarshal(jresponse, &blockResponse)
+
+	return blockResponse.Result
+}
+
 func (self *Geth) GetTransactionByHash(num *big.Int) *Transaction {
 	params := make([]interface{}, 1)
 	params[0] = getHexString(num, 40)
@@ -285,7 +360,7 @@ func (self *Geth) GetTransactionByHash(num *big.Int) *Transaction {
 	jresponse, err := self.SendRPCRequestRaw(request)
 
 	if err != nil {
-		fmt.Printf("could not get transaction: " + err.Error() + "\n")
+		gethLog.Error("could not get transaction", "txid", getHexString(num, 40), "err", err)
 		return nil
 	}
 
@@ -306,7 +381,7 @@ func (self *Geth) GetTransactionByHash(num *big.Int) *Transaction {
 		blockNumber, err := parseHex(txn.BlockNumber, 0)
 
 		if err != nil {
-			log.Printf("error getting transaction owned block number")
+			gethLog.Error("could not parse transaction block number", "txid", txn.Hash, "block", txn.BlockNumber, "err", err)
 		} else {
 			ownedBlock := self.GetBlockByNumber(blockNumber, false)
 			txn.Timestamp = ownedBlock.Timestamp
@@ -316,6 +391,32 @@ func (self *Geth) GetTransactionByHash(num *big.Int) *Transaction {
 	return txn
 }
 
+func (self *Geth) GetTransactionReceipt(hash *big.Int) (*TransactionReceipt, error) {
+	request := NewRPCRequest(1, "eth_getTransactionReceipt", RPCParams{getHexString(hash, 64)})
+	jresponse, err := self.SendRPCRequestRaw(request)
+
+	if err != nil {
+		return nil, errors.New("could not get transaction receipt: " + err.Error())
+	}
+
+	type GetReceiptResponse struct {
+		Result *TransactionReceipt
+	}
+
+	receiptResponse := GetReceiptResponse{}
+	err = json.Unmarshal(jresponse, &receiptResponse)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if receiptResponse.Result == nil {
+		return nil, errors.New("no receipt for transaction " + getHexString(hash, 64))
+	}
+
+	return receiptResponse.Result, nil
+}
+
 func (self *Geth) GetCoinbase() (*big.Int, error) {
 	request := NewRPCRequest(1, "eth_coinbase", RPCParams{})
 
@@ -348,6 +449,48 @@ func (self *Geth) GetBlockNumber() (*big.Int, error) {
 	return ret, err
 }
 
+// current work package; newer geth versions include the block number as a 4th entry
+func (self *Geth) GetWork() (headerHash, seedHash, target, blockNumber *big.Int, err error) {
+	request := NewRPCRequest(1, "eth_getWork", RPCParams{})
+	response, err := self.SendRPCRequest(request)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("could not send rpc request to geth: " + err.Error())
+	}
+
+	headerHash, err = response.GetBigIntEntryResult(0, 32)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("could not get result[0] - " + err.Error())
+	}
+
+	seedHash, err = response.GetBigIntEntryResult(1, 32)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("could not get result[1] - " + err.Error())
+	}
+
+	target, err = response.GetBigIntEntryResult(2, 32)
+
+	if err != nil {
+		return nil, nil, nil, nil, errors.New("could not get result[2] - " + err.Error())
+	}
+
+	blockNumber, err = response.GetBigIntEntryResult(3, 0)
+
+	if err != nil {
+		blockNumber, err = self.GetBlockNumber()
+
+		if err != nil {
+			return nil, nil, nil, nil, errors.New("could not get block number - " + err.Error())
+		}
+
+		blockNumber.Add(blockNumber, big.NewInt(1))
+	}
+
+	return headerHash, seedHash, target, blockNumber, nil
+}
+
 func (self *Geth) GetLastConfirmedBlockNumber() (*big.Int, error) {
 	num, err := self.GetBlockNumber()
 
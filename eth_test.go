@@ -3,6 +3,7 @@ package main
 import "testing"
 import "fmt"
 import "math/big"
+import "errors"
 
 /*
 import "math/big"
@@ -22,8 +23,13 @@ func TestGetBlockNumber(t *testing.T) {
 
 type MockGeth struct {
     blockNumber           int64
+    headerHash            int64
 	transactionCount      int64
 	transactionsConfirmed bool
+	blockTransactions     []*Transaction // in every block, for full requests
+	blockUncles           []string
+	uncleBlocks           []*Block // returned by index
+	receipts              map[string]*TransactionReceipt
 }
 
 func (self *MockGeth) SendTransaction(from, to, value, nonce *big.Int) (*Transaction, error) {
@@ -64,7 +70,7 @@ func (*MockGeth) GetBalanceFromCoinbase(coinbase *big.Int) (*big.Int, error) {
 	return bal, nil
 }
 
-func (*MockGeth) GetBlockByNumber(num *big.Int, full bool) *Block {
+func (self *MockGeth) GetBlockByNumber(num *big.Int, full bool) *Block {
 	block := &Block{Number: getHexString(num, 0),
 		Hash:         "0x1234567890123456789012345678901234567890",
 		ParentHash:   "0x098765432109876543210987654210987654321",
@@ -74,9 +80,21 @@ func (*MockGeth) GetBlockByNumber(num *big.Int, full bool) *Block {
 		Timestamp:    "0x55e67c30",
 		Transactions: make([]*Transaction, 0, 10),
 		Uncles:       make([]string, 0, 10)}
+
+	if full {
+		block.Transactions = append(block.Transactions, self.blockTransactions...)
+	}
+	block.Uncles = append(block.Uncles, self.blockUncles...)
 	return block
 }
 
+func (self *MockGeth) GetUncleByBlockNumberAndIndex(num *big.Int, index int) *Block {
+	if index >= len(self.uncleBlocks) {
+		return nil
+	}
+	return self.uncleBlocks[index]
+}
+
 func (self *MockGeth) GetTransactionByHash(num *big.Int) *Transaction {
 	txn := &Transaction{Hash: getHexString(num, 40),
 		From:  "0x1111111111222222222233333333333444444444",
@@ -88,6 +106,16 @@ func (self *MockGeth) GetTransactionByHash(num *big.Int) *Transaction {
 	return txn
 }
 
+func (self *MockGeth) GetTransactionReceipt(hash *big.Int) (*TransactionReceipt, error) {
+	receipt, ok := self.receipts[getHexString(hash, 64)]
+
+	if !ok {
+		return nil, errors.New("no receipt")
+	}
+
+	return receipt, nil
+}
+
 func (self *MockGeth) GetBlockNumber() (*big.Int, error) {
 	return big.NewInt(self.blockNumber), nil
 }
@@ -95,3 +123,9 @@ func (self *MockGeth) GetBlockNumber() (*big.Int, error) {
 func (self *MockGeth) GetLastConfirmedBlockNumber() (*big.Int, error) {
 	return big.NewInt(self.blockNumber-8), nil
 }
+
+func (self *MockGeth) GetWork() (*big.Int, *big.Int, *big.Int, *big.Int, error) {
+	target := big.NewInt(1)
+	target.Lsh(target, 240)
+	return big.NewInt(self.headerHash), big.NewInt(0), target, big.NewInt(self.blockNumber + 1), nil
+}
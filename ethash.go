@@ -0,0 +1,318 @@
+package main
+
+//
+// native ethash share verification (hashimoto light)
+// keeps the caches for the last few epochs in memory and generates the
+// cache for the next epoch ahead of time
+//
+
+import "encoding/binary"
+import "math/big"
+import "sync"
+import "time"
+
+import "golang.org/x/crypto/sha3"
+
+const (
+	ETHASH_DATASET_INIT_BYTES   = 1 << 30 // bytes in dataset at genesis
+	ETHASH_DATASET_GROWTH_BYTES = 1 << 23 // dataset growth per epoch
+	ETHASH_CACHE_INIT_BYTES     = 1 << 24 // bytes in cache at genesis
+	ETHASH_CACHE_GROWTH_BYTES   = 1 << 17 // cache growth per epoch
+	ETHASH_EPOCH_LENGTH         = 30000   // blocks per epoch
+	ETHASH_MIX_BYTES            = 128     // width of mix
+	ETHASH_HASH_BYTES           = 64      // hash length in bytes
+	ETHASH_HASH_WORDS           = 16      // number of 32 bit ints in a hash
+	ETHASH_DATASET_PARENTS      = 256     // number of parents of each dataset element
+	ETHASH_CACHE_ROUNDS         = 3       // number of rounds in cache production
+	ETHASH_LOOP_ACCESSES        = 64      // number of accesses in hashimoto loop
+)
+
+func keccak256(data ...[]byte) []byte {
+	hasher := sha3.NewLegacyKeccak256()
+	for _, b := range data {
+		hasher.Write(b)
+	}
+	return hasher.Sum(nil)
+}
+
+func keccak512(data ...[]byte) []byte {
+	hasher := sha3.NewLegacyKeccak512()
+	for _, b := range data {
+		hasher.Write(b)
+	}
+	return hasher.Sum(nil)
+}
+
+func fnv(a, b uint32) uint32 {
+	return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+	for i := 0; i < len(mix); i++ {
+		mix[i] = mix[i]*0x01000193 ^ data[i]
+	}
+}
+
+func isPrime(n uint64) bool {
+	return new(big.Int).SetUint64(n).ProbablyPrime(1)
+}
+
+func getEthashEpoch(blockNumber *big.Int) uint64 {
+	return blockNumber.Uint64() / ETHASH_EPOCH_LENGTH
+}
+
+// size of the verification cache for an epoch
+func getEthashCacheSize(epoch uint64) uint64 {
+	size := ETHASH_CACHE_INIT_BYTES + ETHASH_CACHE_GROWTH_BYTES*epoch - ETHASH_HASH_BYTES
+	for !isPrime(size / ETHASH_HASH_BYTES) {
+		size -= 2 * ETHASH_HASH_BYTES
+	}
+	return size
+}
+
+// size of the full dataset for an epoch
+func getEthashDatasetSize(epoch uint64) uint64 {
+	size := ETHASH_DATASET_INIT_BYTES + ETHASH_DATASET_GROWTH_BYTES*epoch - ETHASH_MIX_BYTES
+	for !isPrime(size / ETHASH_MIX_BYTES) {
+		size -= 2 * ETHASH_MIX_BYTES
+	}
+	return size
+}
+
+// seed hash for an epoch: keccak256 applied 'epoch' times to 32 zero bytes
+func getEthashSeedHash(epoch uint64) []byte {
+	seed := make([]byte, 32)
+	for i := uint64(0); i < epoch; i++ {
+		seed = keccak256(seed)
+	}
+	return seed
+}
+
+// fills the cache using the RandMemoHash construction over the seed hash
+func generateEthashCache(size uint64, seed []byte) []uint32 {
+	rows := int(size / ETHASH_HASH_BYTES)
+	cache := make([]byte, size)
+
+	copy(cache, keccak512(seed))
+	for offset := uint64(ETHASH_HASH_BYTES); offset < size; offset += ETHASH_HASH_BYTES {
+		copy(cache[offset:], keccak512(cache[offset-ETHASH_HASH_BYTES:offset]))
+	}
+
+	temp := make([]byte, ETHASH_HASH_BYTES)
+	for i := 0; i < ETHASH_CACHE_ROUNDS; i++ {
+		for j := 0; j < rows; j++ {
+			srcOff := ((j - 1 + rows) % rows) * ETHASH_HASH_BYTES
+			dstOff := j * ETHASH_HASH_BYTES
+			xorOff := int(binary.LittleEndian.Uint32(cache[dstOff:])%uint32(rows)) * ETHASH_HASH_BYTES
+
+			for k := 0; k < ETHASH_HASH_BYTES; k++ {
+				temp[k] = cache[srcOff+k] ^ cache[xorOff+k]
+			}
+			copy(cache[dstOff:], keccak512(temp))
+		}
+	}
+
+	ret := make([]uint32, size/4)
+	for i := 0; i < len(ret); i++ {
+		ret[i] = binary.LittleEndian.Uint32(cache[i*4:])
+	}
+	return ret
+}
+
+// computes one 64 byte dataset item from the cache
+func generateEthashDatasetItem(cache []uint32, index uint32) []uint32 {
+	rows := uint32(len(cache) / ETHASH_HASH_WORDS)
+
+	mix := make([]byte, ETHASH_HASH_BYTES)
+	binary.LittleEndian.PutUint32(mix, cache[(index%rows)*ETHASH_HASH_WORDS]^index)
+	for i := 1; i < ETHASH_HASH_WORDS; i++ {
+		binary.LittleEndian.PutUint32(mix[i*4:], cache[(index%rows)*ETHASH_HASH_WORDS+uint32(i)])
+	}
+	mix = keccak512(mix)
+
+	intMix := make([]uint32, ETHASH_HASH_WORDS)
+	for i := 0; i < len(intMix); i++ {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+
+	for i := uint32(0); i < ETHASH_DATASET_PARENTS; i++ {
+		parent := fnv(index^i, intMix[i%16]) % rows
+		fnvHash(intMix, cache[parent*ETHASH_HASH_WORDS:])
+	}
+
+	for i, val := range intMix {
+		binary.LittleEndian.PutUint32(mix[i*4:], val)
+	}
+	mix = keccak512(mix)
+
+	ret := make([]uint32, ETHASH_HASH_WORDS)
+	for i := 0; i < len(ret); i++ {
+		ret[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	return ret
+}
+
+// hashimoto with dataset items computed on the fly from the cache.
+// returns the mix digest and the result that is compared against the target
+func hashimotoLight(datasetSize uint64, cache []uint32, headerHash []byte, nonce uint64) ([]byte, []byte) {
+	rows := uint32(datasetSize / ETHASH_MIX_BYTES)
+
+	seed := make([]byte, 40)
+	copy(seed, headerHash)
+	binary.LittleEndian.PutUint64(seed[32:], nonce)
+	seed = keccak512(seed)
+	seedHead := binary.LittleEndian.Uint32(seed)
+
+	mix := make([]uint32, ETHASH_MIX_BYTES/4)
+	for i := 0; i < len(mix); i++ {
+		mix[i] = binary.LittleEndian.Uint32(seed[i%16*4:])
+	}
+
+	temp := make([]uint32, len(mix))
+	for i := 0; i < ETHASH_LOOP_ACCESSES; i++ {
+		parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+		for j := uint32(0); j < ETHASH_MIX_BYTES/ETHASH_HASH_BYTES; j++ {
+			copy(temp[j*ETHASH_HASH_WORDS:], generateEthashDatasetItem(cache, 2*parent+j))
+		}
+		fnvHash(mix, temp)
+	}
+
+	for i := 0; i < len(mix); i += 4 {
+		mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+	}
+	mix = mix[:len(mix)/4]
+
+	digest := make([]byte, 32)
+	for i, val := range mix {
+		binary.LittleEndian.PutUint32(digest[i*4:], val)
+	}
+
+	return digest, keccak256(seed, digest)
+}
+
+type ethashCache struct {
+	epoch       uint64
+	datasetSize uint64
+	cache       []uint32
+	used        time.Time
+	once        *sync.Once
+	ready       bool
+}
+
+func (self *ethashCache) generate() {
+	self.once.Do(func() {
+		start := time.Now()
+		size := getEthashCacheSize(self.epoch)
+		self.cache = generateEthashCache(size, getEthashSeedHash(self.epoch))
+		self.datasetSize = getEthashDatasetSize(self.epoch)
+		verifyLog.Info("generated ethash cache", "epoch", self.epoch, "duration", time.Since(start))
+	})
+}
+
+type EthashVerifier struct {
+	lock      *sync.Mutex
+	caches    map[uint64]*ethashCache
+	maxCaches int
+}
+
+func NewEthashVerifier(maxCaches int) *EthashVerifier {
+	return &EthashVerifier{lock: &sync.Mutex{}, caches: make(map[uint64]*ethashCache), maxCaches: maxCaches}
+}
+
+// finds or creates the cache entry for an epoch, evicting the least recently used one
+func (self *EthashVerifier) getCacheEntry(epoch uint64) *ethashCache {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry, ok := self.caches[epoch]
+
+	if !ok {
+		if len(self.caches) >= self.maxCaches {
+			var oldest *ethashCache = nil
+			for _, cache := range self.caches {
+				if oldest == nil || cache.used.Before(oldest.used) {
+					oldest = cache
+				}
+			}
+			delete(self.caches, oldest.epoch)
+		}
+
+		entry = &ethashCache{epoch: epoch, once: &sync.Once{}}
+		self.caches[epoch] = entry
+	}
+
+	entry.used = time.Now()
+	return entry
+}
+
+// blocks until the cache for the epoch is generated
+func (self *EthashVerifier) getCache(epoch uint64) *ethashCache {
+	entry := self.getCacheEntry(epoch)
+	entry.generate()
+
+	self.lock.Lock()
+	entry.ready = true
+	self.lock.Unlock()
+
+	return entry
+}
+
+// returns the cache for the epoch only if it has already been generated;
+// otherwise generation is started in the background
+func (self *EthashVerifier) getReadyCache(epoch uint64) *ethashCache {
+	entry := self.getCacheEntry(epoch)
+
+	self.lock.Lock()
+	ready := entry.ready
+	self.lock.Unlock()
+
+	if !ready {
+		go self.getCache(epoch)
+		return nil
+	}
+
+	return entry
+}
+
+// generate the cache for the next epoch before miners switch to it
+func (self *EthashVerifier) pregenerate(epoch uint64) {
+	self.lock.Lock()
+	_, ok := self.caches[epoch+1]
+	self.lock.Unlock()
+
+	if !ok {
+		go self.getCache(epoch + 1)
+	}
+}
+
+func (self *EthashVerifier) hashimotoWith(entry *ethashCache, headerHash, nonce *big.Int) (*big.Int, *big.Int) {
+	self.pregenerate(entry.epoch)
+
+	header := make([]byte, 32)
+	headerBytes := headerHash.Bytes()
+	copy(header[32-len(headerBytes):], headerBytes)
+
+	digest, result := hashimotoLight(entry.datasetSize, entry.cache, header, nonce.Uint64())
+	return new(big.Int).SetBytes(digest), new(big.Int).SetBytes(result)
+}
+
+func (self *EthashVerifier) getShareResult(entry *ethashCache, work *ShareWork) *ShareResult {
+	digest, result := self.hashimotoWith(entry, work.headerHash, work.nonce)
+	return &ShareResult{mixDigest: digest, result: result}
+}
+
+// evaluates a share, waiting for the epoch cache if it is still being generated
+func (self *EthashVerifier) Verify(work *ShareWork) (*ShareResult, error) {
+	return self.getShareResult(self.getCache(getEthashEpoch(work.blockNumber)), work), nil
+}
+
+// like Verify, but fails with ErrCacheNotReady instead of waiting for the epoch cache
+func (self *EthashVerifier) TryVerify(work *ShareWork) (*ShareResult, error) {
+	entry := self.getReadyCache(getEthashEpoch(work.blockNumber))
+
+	if entry == nil {
+		return nil, ErrCacheNotReady
+	}
+
+	return self.getShareResult(entry, work), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+import "math/big"
+
+func TestEthashSizes(t *testing.T) {
+	if size := getEthashCacheSize(0); size != 16776896 {
+		t.Error("expected epoch 0 cache size of 16776896, found ", size)
+	}
+
+	if size := getEthashDatasetSize(0); size != 1073739904 {
+		t.Error("expected epoch 0 dataset size of 1073739904, found ", size)
+	}
+}
+
+// mainnet block 1
+func TestEthashVerify(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generating the epoch 0 cache takes a while")
+	}
+
+	blockNumber := big.NewInt(1)
+	sealHash, _ := parseHex("0x85913a3057ea8bec78cd916871ca73802e77724e014dda65add3405d02240eb7", 32)
+	mixHash, _ := parseHex("0x969b900de27b6ac6a67742365dd65f55a0526c41fd18e1b16f1a1215c2e66f59", 32)
+	nonce, _ := parseHex("0x539bd4979fef1ec4", 8)
+	difficulty := big.NewInt(17171480576)
+
+	verifier := NewEthashVerifier(2)
+	work := &ShareWork{blockNumber: blockNumber, headerHash: sealHash, nonce: nonce, mixHash: mixHash,
+		shareDifficulty: difficulty, blockTarget: getBoundaryCondition(difficulty)}
+
+	result, err := verifier.Verify(work)
+	if err != nil || !result.isValidShare(work) || !result.isBlock(work) {
+		t.Error("expected block 1 to verify")
+	}
+
+	// a nonce-only submission gets the digest computed for it
+	if result.mixDigest.Cmp(mixHash) != 0 {
+		t.Error("expected mix digest ", mixHash.String(), ", found ", result.mixDigest.String())
+	}
+
+	badMix := &ShareWork{blockNumber: blockNumber, headerHash: sealHash, nonce: nonce,
+		mixHash: big.NewInt(0).Add(mixHash, big.NewInt(1)), shareDifficulty: difficulty}
+	if result.isValidShare(badMix) {
+		t.Error("expected a wrong mix digest to fail")
+	}
+
+	hard := &ShareWork{blockNumber: blockNumber, headerHash: sealHash, nonce: nonce, mixHash: mixHash,
+		shareDifficulty: big.NewInt(0).Lsh(difficulty, 64)}
+	if result.isValidShare(hard) {
+		t.Error("expected block 1 to fail a much higher difficulty")
+	}
+
+	_, err = verifier.TryVerify(work)
+	if err != nil {
+		t.Error("expected the generated cache to be ready, found ", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+//
+// eth-proxy ("stratum1") tcp server
+// newline delimited json-rpc as spoken by claymore and eth-proxy:
+// eth_submitLogin once per connection, then the usual getwork calls.
+// new work is pushed as an unsolicited eth_getWork result with id 0
+//
+
+import "context"
+import "math/big"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+// the login and difficulty are shared with the job broadcasts, so they are read under the lock
+type EthProxySession struct {
+	client     *tcpClient
+	lock       *sync.Mutex
+	address    *big.Int // set by eth_submitLogin
+	worker     string
+	difficulty *big.Int // difficulty of the last work sent out
+}
+
+func NewEthProxySession(client *tcpClient) *EthProxySession {
+	return &EthProxySession{client: client, lock: &sync.Mutex{}}
+}
+
+func (self *EthProxySession) getLogin() (*big.Int, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.address, self.worker
+}
+
+func (self *EthProxySession) setLogin(address *big.Int, worker string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.address = address
+	self.worker = worker
+}
+
+func (self *EthProxySession) setDifficulty(difficulty *big.Int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.difficulty = big.NewInt(0).Set(difficulty)
+}
+
+// false until work was sent out
+func (self *EthProxySession) isDifficultyChanged(difficulty *big.Int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.difficulty != nil && self.difficulty.Cmp(difficulty) != 0
+}
+
+type EthProxyServer struct {
+	port        string
+	listener    net.Listener
+	sessions    map[*EthProxySession]bool
+	lock        *sync.Mutex
+	connections *sync.WaitGroup
+}
+
+func NewEthProxyServer(port string) *EthProxyServer {
+	return &EthProxyServer{port: port,
+		sessions:    make(map[*EthProxySession]bool),
+		lock:        &sync.Mutex{},
+		connections: &sync.WaitGroup{}}
+}
+
+func (self *EthProxyServer) addSession(session *EthProxySession) {
+	self.lock.Lock()
+	self.sessions[session] = true
+	self.lock.Unlock()
+}
+
+func (self *EthProxyServer) removeSession(session *EthProxySession) {
+	self.lock.Lock()
+	delete(self.sessions, session)
+	self.lock.Unlock()
+}
+
+// the current work package with the target set to the miner's share difficulty
+func (self *EthProxySession) getWorkResult(job *Job) RPCResultArray {
+	address, name := self.getLogin()
+
+	pool.lock()
+	worker := pool.getMiner(address).touch(name)
+	difficulty := big.NewInt(0).Set(worker.getDifficulty())
+	pool.unlock()
+
+	self.setDifficulty(difficulty)
+	return job.getWorkResult(difficulty)
+}
+
+func (self *EthProxySession) sendWork() error {
+	job := work.getJob()
+
+	if job == nil {
+		return nil
+	}
+
+	return self.client.send(NewRPCResult(0, self.getWorkResult(job)))
+}
+
+// vardiff may have moved the worker; hand out work with the new target
+func (self *EthProxySession) sendDifficultyUpdate() {
+	address, name := self.getLogin()
+
+	pool.lock()
+	worker := pool.getMiner(address).getWorker(name)
+	changed := self.isDifficultyChanged(worker.getDifficulty())
+	pool.unlock()
+
+	if changed {
+		self.sendWork()
+	}
+}
+
+func (self *EthProxyServer) handle_submitLogin(session *EthProxySession, request *RPCRequest) *RPCResponse {
+	login, err := request.GetParam(0)
+
+	if err != nil {
+		return NewRPCError(request.Id, -1, "missing login", nil)
+	}
+
+	// the rig name comes either from the login or from the request's worker field
+	if len(request.Worker) > 0 && strings.IndexAny(login, "./") < 0 {
+		login += "." + request.Worker
+	}
+
+	address, worker, err := parseMinerLogin(login)
+
+	if err != nil {
+		return NewRPCError(request.Id, -1, err.Error(), nil)
+	}
+
+	session.setLogin(address, worker)
+	ethproxyLog.Info("login", "login", login, "ip", session.client.ip)
+
+	return NewRPCResult(request.Id, true)
+}
+
+func (self *EthProxyServer) handleRequest(session *EthProxySession, request *RPCRequest) *RPCResponse {
+	if request.Method == "eth_submitLogin" {
+		return self.handle_submitLogin(session, request)
+	}
+
+	address, worker := session.getLogin()
+
+	if address == nil {
+		return NewRPCError(request.Id, -1, "you need to authorize first (eth_submitLogin)", nil)
+	}
+
+	response, err := proxyRequest(request, address, worker, session.client.ip)
+
+	if err != nil {
+		ethproxyLog.Error("could not proxy request", "miner", getHexString(address, 40), "worker", worker, "method", request.Method, "err", err)
+		return NewRPCError(request.Id, -1, err.Error(), nil)
+	}
+
+	response.Id = request.Id
+	return response
+}
+
+func (self *EthProxyServer) handleConnection(ctx context.Context, conn net.Conn) {
+	session := NewEthProxySession(newTcpClient(conn))
+
+	self.addSession(session)
+	defer self.removeSession(session)
+	defer session.client.close()
+
+	session.client.startPushing(session.sendWork)
+
+	// sessions added after shutdown began were missed by interruptSessions
+	for ctx.Err() == nil {
+		request, err := session.client.readRequest()
+
+		if err != nil {
+			ethproxyLog.Info("closing connection", "ip", session.client.ip, "err", err)
+			return
+		}
+
+		address, _ := session.getLogin()
+		err = session.client.checkBans(address)
+
+		if err == ErrBanned {
+			ethproxyLog.Info("closing connection, banned", "ip", session.client.ip, "miner", getHexString(address, 40))
+			return
+		}
+
+		if err != nil {
+			if session.client.send(NewRPCError(request.Id, -1, err.Error(), nil)) != nil {
+				return
+			}
+			continue
+		}
+
+		response := self.handleRequest(session, request)
+
+		if session.client.send(response) != nil {
+			return
+		}
+
+		if request.Method == "eth_submitWork" {
+			session.sendDifficultyUpdate()
+		}
+	}
+}
+
+func (self *EthProxyServer) getSessions() []*EthProxySession {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	sessions := make([]*EthProxySession, 0, len(self.sessions))
+	for session := range self.sessions {
+		if address, _ := session.getLogin(); address != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// push a new job to logged in sessions
+func (self *EthProxyServer) NewJob(job *Job) {
+	for _, session := range self.getSessions() {
+		session.client.queuePush()
+	}
+}
+
+// pushed-to miners rarely poll, so keep the pool from dropping them as idle.
+// also passes on difficulty changes made while the worker was quiet
+func (self *EthProxyServer) keepalive() {
+	for _, session := range self.getSessions() {
+		address, name := session.getLogin()
+
+		pool.lock()
+		pool.getMiner(address).touch(name)
+		pool.unlock()
+
+		session.sendDifficultyUpdate()
+	}
+}
+
+func (self *EthProxyServer) interruptSessions() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for session := range self.sessions {
+		session.client.interrupt()
+	}
+}
+
+// see StratumServer.Start
+func (self *EthProxyServer) Start(ctx context.Context) {
+	var err error
+	self.listener, err = net.Listen("tcp", ":"+self.port)
+
+	if err != nil {
+		ethproxyLog.Error("could not listen", "port", self.port, "err", err)
+		return
+	}
+
+	ethproxyLog.Info("listening", "port", self.port)
+	self.connections.Add(1)
+	go acceptConnections(ctx, self.listener, self.connections, ethproxyLog, self.handleConnection)
+
+	for sleepContext(ctx, time.Duration(TCP_KEEPALIVE_TIME)*time.Second) {
+		self.keepalive()
+	}
+
+	self.listener.Close()
+	self.interruptSessions()
+	self.connections.Wait()
+	ethproxyLog.Info("server is down")
+}
@@ -0,0 +1,220 @@
+package main
+
+import "bufio"
+import "context"
+import "encoding/json"
+import "math/big"
+import "net"
+import "testing"
+import "time"
+
+// answers every share with the same digest and result
+type fixedVerifier struct {
+	mixDigest *big.Int
+	result    *big.Int
+}
+
+func (self *fixedVerifier) Verify(work *ShareWork) (*ShareResult, error) {
+	return &ShareResult{mixDigest: self.mixDigest, result: self.result}, nil
+}
+
+// requests, responses and notifications as the miner sees them
+type pipeMessage struct {
+	Id     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params RPCParams   `json:"params"`
+	Result interface{} `json:"result"`
+	Error  *RPCError   `json:"error"`
+}
+
+// the miner's end of a session served over net.Pipe
+type pipeMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// the returned func hangs up and waits for the session to end
+func newPipeMiner(t *testing.T, handle func(context.Context, net.Conn)) (*pipeMiner, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	serverConn, minerConn := net.Pipe()
+	handled := make(chan bool)
+
+	go func() {
+		handle(ctx, serverConn)
+		close(handled)
+	}()
+
+	miner := &pipeMiner{t: t, conn: minerConn, reader: bufio.NewReader(minerConn)}
+	return miner, func() { cancel(); minerConn.Close(); <-handled }
+}
+
+func (self *pipeMiner) send(request *RPCRequest) {
+	self.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := self.conn.Write(append([]byte(request.ToJson()), '\n'))
+
+	if err != nil {
+		self.t.Fatal("could not send ", request.Method, " - ", err)
+	}
+}
+
+func (self *pipeMiner) read() *pipeMessage {
+	self.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := self.reader.ReadBytes('\n')
+
+	if err != nil {
+		self.t.Fatal("could not read from the server - ", err)
+	}
+
+	message := &pipeMessage{}
+
+	if err := json.Unmarshal(line, message); err != nil {
+		self.t.Fatal("invalid message ", string(line), " - ", err)
+	}
+
+	return message
+}
+
+// sends a request and returns its response, skipping anything pushed in between
+func (self *pipeMiner) call(id int, method string, params RPCParams) *pipeMessage {
+	self.send(NewRPCRequest(id, method, params))
+
+	for {
+		message := self.read()
+
+		if message.Id == float64(id) {
+			return message
+		}
+	}
+}
+
+// a fresh pool with one job, and shares that are valid unless the digest is not 0
+func setupTcpTest() *Job {
+	pool = NewMinerPool(nil, DefaultSettings())
+	work = NewWorkManager(&MockGeth{blockNumber: 10, headerHash: 0x1234})
+	job, _ := work.update()
+	job.target = big.NewInt(1)
+	pool.NewJob(job)
+
+	verifier = NewVerifyPool(&fixedVerifier{mixDigest: big.NewInt(0), result: big.NewInt(2)}, 1, 4)
+	bans = nil
+	return job
+}
+
+func TestEthProxySession(t *testing.T) {
+	job := setupTcpTest()
+	defer verifier.Close(context.Background())
+
+	server := NewEthProxyServer("")
+	miner, done := newPipeMiner(t, server.handleConnection)
+	defer done()
+
+	response := miner.call(1, "eth_getWork", RPCParams{})
+
+	if response.Error == nil || response.Error.Message != "you need to authorize first (eth_submitLogin)" {
+		t.Error("expected work to be refused before login, found ", response)
+	}
+
+	response = miner.call(2, "eth_submitLogin", RPCParams{"0x1234"})
+
+	if response.Error == nil {
+		t.Error("expected an invalid login to be refused")
+	}
+
+	login := NewRPCRequest(3, "eth_submitLogin", RPCParams{"0x00000000000000000000000000000000000000ab"})
+	login.Worker = "rig1"
+	miner.send(login)
+
+	if response = miner.read(); response.Result != true {
+		t.Fatal("expected the login to be accepted, found ", response)
+	}
+
+	address, worker := server.getSessions()[0].getLogin()
+
+	if address.Cmp(big.NewInt(0xab)) != 0 || worker != "rig1" {
+		t.Error("expected the session to be logged in as 0xab.rig1, found ", address, worker)
+	}
+
+	response = miner.call(4, "eth_getWork", RPCParams{})
+	result, ok := response.Result.([]interface{})
+
+	if !ok || len(result) != 3 || result[0] != getHexString(job.headerHash, 64) {
+		t.Fatal("expected the current work package, found ", response)
+	}
+
+	header := getHexString(job.headerHash, 64)
+	zero := getHexString(big.NewInt(0), 64)
+
+	response = miner.call(5, "eth_submitWork", RPCParams{12, header, zero})
+
+	if response.Error == nil || response.Error.Message != "invalid RPC parameters(0) - Nonce" {
+		t.Error("expected a malformed nonce to be refused, found ", response)
+	}
+
+	response = miner.call(6, "eth_submitWork", RPCParams{"0x0000000000000001", header, zero})
+
+	if response.Result != true {
+		t.Error("expected the share to be accepted, found ", response)
+	}
+
+	response = miner.call(7, "eth_submitWork", RPCParams{"0x0000000000000001", header, zero})
+
+	if response.Result != false {
+		t.Error("expected the duplicate share to be rejected, found ", response)
+	}
+
+	response = miner.call(8, "eth_submitWork", RPCParams{"0x0000000000000002", header, getHexString(big.NewInt(1), 64)})
+
+	if response.Result != false {
+		t.Error("expected the share with the wrong digest to be rejected, found ", response)
+	}
+
+	pool.lock()
+	credited := !pool.getMiner(big.NewInt(0xab)).getWorker("rig1").lastShare.IsZero()
+	pool.unlock()
+
+	if !credited {
+		t.Error("expected the accepted share to be credited to the worker")
+	}
+
+	// new work is pushed to the logged in session
+	next := newTestJob("next", 0x5678)
+	work.current = next
+	server.NewJob(next)
+
+	// a difficulty update may still be queued ahead of it
+	for {
+		push := miner.read()
+		result, ok = push.Result.([]interface{})
+
+		if push.Id != float64(0) || !ok {
+			t.Fatal("expected work to be pushed, found ", push)
+		}
+
+		if result[0] == getHexString(next.headerHash, 64) {
+			break
+		}
+	}
+}
+
+func TestEthProxyMalformedRequest(t *testing.T) {
+	setupTcpTest()
+	defer verifier.Close(context.Background())
+
+	server := NewEthProxyServer("")
+	closed := make(chan bool)
+	miner, done := newPipeMiner(t, func(ctx context.Context, conn net.Conn) {
+		server.handleConnection(ctx, conn)
+		closed <- true
+	})
+	defer done()
+
+	miner.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	miner.conn.Write([]byte("{\"id\": 1, \"method\": \n"))
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection to be closed after invalid json")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+//
+// windowed hashrate estimates
+// the difficulty of accepted shares is summed in HASHRATE_BUCKET_TIME second
+// buckets covering the longest of HASHRATE_WINDOWS. the hashrate over a window
+// is the difficulty found within it divided by the time it covers (or by the
+// time since the miner joined, if that is shorter)
+//
+
+import "math/big"
+import "time"
+
+type HashrateStat struct {
+	Window   int64  `json:"window" bson:"window"` // seconds
+	Hashrate string `json:"hashrate" bson:"hashrate"`
+}
+
+// a point in a miner's hashrate history, saved with the miner stats
+type HashrateSample struct {
+	Address  string    `json:"address" bson:"address"`
+	Hashrate string    `json:"hashrate" bson:"hashrate"`
+	Workers  int       `json:"workers" bson:"workers"`
+	Time     time.Time `json:"time" bson:"time"`
+}
+
+func NewHashrateSample(address string, hashrate *big.Int, workers int, now time.Time) *HashrateSample {
+	return &HashrateSample{Address: address, Hashrate: hashrate.String(), Workers: workers, Time: now}
+}
+
+type HashrateWindow struct {
+	buckets []float64 // ring of difficulty sums, indexed by bucket number
+	newest  int64     // bucket number of the latest share
+	since   time.Time // first time the hashrate was tracked
+}
+
+func getHashrateBucket(now time.Time) int64 {
+	return now.Unix() / HASHRATE_BUCKET_TIME
+}
+
+// long enough for the longest of HASHRATE_WINDOWS
+func NewHashrateWindow(now time.Time) *HashrateWindow {
+	longest := int64(HASHRATE_BUCKET_TIME)
+	for _, window := range HASHRATE_WINDOWS {
+		if window > longest {
+			longest = window
+		}
+	}
+
+	size := (longest + HASHRATE_BUCKET_TIME - 1) / HASHRATE_BUCKET_TIME
+	return &HashrateWindow{buckets: make([]float64, size),
+		newest: getHashrateBucket(now),
+		since:  now}
+}
+
+func (self *HashrateWindow) getIndex(bucket int64) int {
+	return int(bucket % int64(len(self.buckets)))
+}
+
+// moves the ring up to 'bucket', clearing the buckets it skipped
+func (self *HashrateWindow) advance(bucket int64) {
+	if bucket <= self.newest {
+		return
+	}
+
+	if bucket-self.newest >= int64(len(self.buckets)) {
+		for i := range self.buckets {
+			self.buckets[i] = 0
+		}
+	} else {
+		for b := self.newest + 1; b <= bucket; b++ {
+			self.buckets[self.getIndex(b)] = 0
+		}
+	}
+
+	self.newest = bucket
+}
+
+// records an accepted share
+func (self *HashrateWindow) add(difficulty float64, now time.Time) {
+	bucket := getHashrateBucket(now)
+	self.advance(bucket)
+
+	// a share from a moment ago still counts, as long as its bucket is kept
+	if self.newest-bucket < int64(len(self.buckets)) {
+		self.buckets[self.getIndex(bucket)] += difficulty
+	}
+}
+
+// hashes a second over the last 'window' seconds
+func (self *HashrateWindow) getHashrate(window int64, now time.Time) float64 {
+	current := getHashrateBucket(now)
+	count := (window + HASHRATE_BUCKET_TIME - 1) / HASHRATE_BUCKET_TIME
+
+	if count > int64(len(self.buckets)) {
+		count = int64(len(self.buckets))
+	}
+
+	sum := 0.0
+	for b := current - count + 1; b <= current && b <= self.newest; b++ {
+		if self.newest-b < int64(len(self.buckets)) {
+			sum += self.buckets[self.getIndex(b)]
+		}
+	}
+
+	// the current bucket is only partly over
+	first := time.Unix((current-count+1)*HASHRATE_BUCKET_TIME, 0)
+	length := now.Sub(first).Seconds()
+
+	// a young window has not seen its full length yet
+	if age := now.Sub(self.since).Seconds(); age < length {
+		length = age
+	}
+
+	if length < HASHRATE_BUCKET_TIME {
+		length = HASHRATE_BUCKET_TIME
+	}
+
+	return sum / length
+}
+
+// the hashrate over the shortest window
+func (self *HashrateWindow) getCurrent(now time.Time) *big.Int {
+	if len(HASHRATE_WINDOWS) == 0 {
+		return big.NewInt(0)
+	}
+
+	return big.NewInt(int64(self.getHashrate(HASHRATE_WINDOWS[0], now)))
+}
+
+func (self *HashrateWindow) getStats(now time.Time) []HashrateStat {
+	ret := make([]HashrateStat, 0, len(HASHRATE_WINDOWS))
+	for _, window := range HASHRATE_WINDOWS {
+		hashrate := big.NewInt(int64(self.getHashrate(window, now)))
+		ret = append(ret, HashrateStat{Window: window, Hashrate: hashrate.String()})
+	}
+	return ret
+}
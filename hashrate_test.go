@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+import "time"
+
+func TestHashrateWindows(t *testing.T) {
+	start := time.Unix(1000000*HASHRATE_BUCKET_TIME, 0)
+	window := NewHashrateWindow(start.Add(-24 * time.Hour))
+
+	// 1000 hashes a second for the last hour
+	for i := 0; i < 3600; i += 10 {
+		window.add(10000, start.Add(time.Duration(i)*time.Second))
+	}
+
+	now := start.Add(time.Hour)
+
+	if hashrate := window.getHashrate(600, now); hashrate < 950 || hashrate > 1050 {
+		t.Error("expected 1000 H/s over 10 minutes, found ", hashrate)
+	}
+
+	if hashrate := window.getHashrate(3600, now); hashrate < 950 || hashrate > 1050 {
+		t.Error("expected 1000 H/s over an hour, found ", hashrate)
+	}
+
+	if hashrate := window.getHashrate(86400, now); hashrate < 1000.0/24-5 || hashrate > 1000.0/24+5 {
+		t.Error("expected 1/24 of the rate over a day, found ", hashrate)
+	}
+
+	// quiet for 10 minutes: the short window is empty, the long ones keep their shares
+	later := now.Add(11 * time.Minute)
+
+	if hashrate := window.getHashrate(600, later); hashrate != 0 {
+		t.Error("expected no hashrate after 10 quiet minutes, found ", hashrate)
+	}
+
+	if hashrate := window.getHashrate(3600, later); hashrate <= 0 {
+		t.Error("expected hashrate over the last hour")
+	}
+
+	// a day later everything has rolled out of the ring
+	window.add(600, now.Add(48*time.Hour))
+
+	if hashrate := window.getHashrate(86400, now.Add(48*time.Hour)); hashrate <= 0 || hashrate > 600.0/86000 {
+		t.Error("expected only the new share over a day, found ", hashrate)
+	}
+
+	stats := window.getStats(now)
+
+	if len(stats) != len(HASHRATE_WINDOWS) || stats[0].Window != HASHRATE_WINDOWS[0] {
+		t.Error("expected a stat for each window, found ", stats)
+	}
+}
+
+func TestYoungHashrateWindow(t *testing.T) {
+	now := time.Now()
+	window := NewHashrateWindow(now)
+
+	// a miner that joined 5 minutes ago is judged over those 5 minutes
+	for i := 1; i <= 5; i++ {
+		window.add(6000, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	if hashrate := window.getHashrate(3600, now.Add(5*time.Minute)); hashrate < 95 || hashrate > 105 {
+		t.Error("expected 100 H/s for a young window, found ", hashrate)
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+//
+// miner balance ledger
+// the authoritative record of what the pool owes. every change is a journal
+// entry of transfers between accounts, so all balances always add up to zero:
+// block rewards come in from the chain, the pool fee and miner credits are
+// paid out of them, and payouts lock part of a miner's pending balance until
+// the payment is verified, then move it to paid. miner balances are kept per
+// address in an immature, pending, locked and paid account; immature credits
+// are reversed when the block matures or is orphaned. the pay instance folds
+// new entries into per-account balance snapshots, so payouts and checks do not
+// read the whole journal
+//
+
+import "errors"
+import "math/big"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	LEDGER_CHAIN         = "chain"         // outside the pool: rewards come from here
+	LEDGER_POOL_IMMATURE = "pool:immature" // rewards of immature blocks
+	LEDGER_POOL_REWARDS  = "pool:rewards"  // matured rewards, until they are divided up
+	LEDGER_POOL_FEES     = "pool:fees"     // the pool's own; pays for pay per share credits
+
+	LEDGER_IMMATURE = "immature"
+	LEDGER_PENDING  = "pending"
+	LEDGER_LOCKED   = "locked" // set aside for a payout that was not verified yet
+	LEDGER_PAID     = "paid"
+)
+
+var ErrNoPayout = errors.New("no payout locked")
+
+const (
+	JOURNAL_IMMATURE = "immature"
+	JOURNAL_REVERSAL = "reversal"
+	JOURNAL_MATURED  = "matured"
+	JOURNAL_SHARE    = "share"
+	JOURNAL_LOCK     = "lock"
+	JOURNAL_PAYOUT   = "payout"
+)
+
+type LedgerTransfer struct {
+	From   string `json:"from" bson:"from"`
+	To     string `json:"to" bson:"to"`
+	Amount string `json:"amount" bson:"amount"` // wei, positive
+}
+
+func (self *LedgerTransfer) getAmount() *big.Int {
+	ret, ok := big.NewInt(0).SetString(self.Amount, 10)
+	if !ok {
+		return nil
+	}
+	return ret
+}
+
+type JournalEntry struct {
+	Id        string           `json:"id" bson:"id"` // unique; writing an entry twice is a no-op
+	Kind      string           `json:"kind" bson:"kind"`
+	Block     string           `json:"block,omitempty" bson:"block,omitempty"`
+	Nonce     string           `json:"nonce,omitempty" bson:"nonce,omitempty"`
+	Payout    string           `json:"payout,omitempty" bson:"payout,omitempty"` // payout id, for locks and payouts
+	Accounts  []string         `json:"accounts" bson:"accounts"`                 // every account touched, for lookups
+	Transfers []LedgerTransfer `json:"transfers" bson:"transfers"`
+	Time      time.Time        `json:"time" bson:"time"`
+	Folded    bool             `json:"folded" bson:"folded"` // added to the account snapshots
+}
+
+func NewJournalEntry(id, kind string, now time.Time) *JournalEntry {
+	return &JournalEntry{Id: id, Kind: kind, Accounts: make([]string, 0, 4), Transfers: make([]LedgerTransfer, 0, 4), Time: now}
+}
+
+func (self *JournalEntry) addAccount(account string) {
+	for _, known := range self.Accounts {
+		if known == account {
+			return
+		}
+	}
+	self.Accounts = append(self.Accounts, account)
+}
+
+func (self *JournalEntry) transfer(from, to string, amount *big.Int) {
+	if amount.Sign() == 0 {
+		return
+	}
+
+	if amount.Sign() < 0 {
+		from, to = to, from
+		amount = big.NewInt(0).Neg(amount)
+	}
+
+	self.Transfers = append(self.Transfers, LedgerTransfer{From: from, To: to, Amount: amount.String()})
+	self.addAccount(from)
+	self.addAccount(to)
+}
+
+// an entry undoing this one
+func (self *JournalEntry) getReversal(id string, now time.Time) *JournalEntry {
+	ret := NewJournalEntry(id, JOURNAL_REVERSAL, now)
+	ret.Block = self.Block
+	ret.Nonce = self.Nonce
+
+	for _, transfer := range self.Transfers {
+		ret.transfer(transfer.To, transfer.From, transfer.getAmount())
+	}
+
+	return ret
+}
+
+func getLedgerAccount(address, bucket string) string {
+	return address + ":" + bucket
+}
+
+func getBlockEntryId(kind string, block *BlockCandidate) string {
+	return kind + ":" + block.Number + ":" + block.Nonce
+}
+
+// an account's balance with every folded journal entry in it
+type LedgerAccount struct {
+	Account string `json:"account" bson:"account"`
+	Balance string `json:"balance" bson:"balance"` // wei; the chain's is negative
+	Last    string `json:"last" bson:"last"`       // id of the last entry folded in
+}
+
+func (self *LedgerAccount) getBalance() *big.Int {
+	ret, ok := big.NewInt(0).SetString(self.Balance, 10)
+	if !ok {
+		return big.NewInt(0)
+	}
+	return ret
+}
+
+type LedgerBalance struct {
+	Address  string `json:"address"`
+	Immature string `json:"immature"`
+	Pending  string `json:"pending"`
+	Locked   string `json:"locked"`
+	Paid     string `json:"paid"`
+}
+
+type Ledger struct {
+	db   Database
+	lock *sync.Mutex
+}
+
+func NewLedger(db Database) *Ledger {
+	return &Ledger{db: db, lock: &sync.Mutex{}}
+}
+
+func (self *Ledger) findEntries(query map[string]interface{}) ([]*JournalEntry, error) {
+	entries := make([]*JournalEntry, 0)
+	err := self.db.FindIn("journal", query, "time", 0, &entries)
+	return entries, err
+}
+
+func (self *Ledger) getEntry(id string) (*JournalEntry, error) {
+	entries, err := self.findEntries(map[string]interface{}{"id": id})
+
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	return entries[0], nil
+}
+
+// writes entries in order; an entry already in the journal is skipped.
+// callers hold the lock
+func (self *Ledger) post(entries ...*JournalEntry) error {
+	err := self.db.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer self.db.Disconnect()
+
+	for _, entry := range entries {
+		err = self.db.Add(entry)
+
+		if err == ErrDuplicate {
+			ledgerLog.Info("entry was already posted", "entry", entry.Id)
+			continue
+		}
+
+		if err != nil {
+			return errors.New("could not post " + entry.Id + " - " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (self *Ledger) postLogged(entries ...*JournalEntry) {
+	err := self.post(entries...)
+
+	if err != nil {
+		ledgerLog.Error("could not post entries", "err", err)
+	}
+}
+
+// the immature entry for a block, if one was posted and not reversed yet
+func (self *Ledger) getOpenImmatureEntry(block *BlockCandidate) (*JournalEntry, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	reversal, err := self.getEntry(getBlockEntryId(JOURNAL_REVERSAL, block))
+
+	if err != nil || reversal != nil {
+		return nil, err
+	}
+
+	return self.getEntry(getBlockEntryId(JOURNAL_IMMATURE, block))
+}
+
+func (self *Ledger) reverseImmature(block *BlockCandidate, now time.Time) []*JournalEntry {
+	immature, err := self.getOpenImmatureEntry(block)
+
+	if err != nil {
+		ledgerLog.Error("could not look up immature credits", "block", block.Number, "err", err)
+	}
+
+	if immature == nil {
+		return []*JournalEntry{}
+	}
+
+	return []*JournalEntry{immature.getReversal(getBlockEntryId(JOURNAL_REVERSAL, block), now)}
+}
+
+func (self *Ledger) Credited(credit *Credit) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// share keys are unique, so a credit is only lost if it was posted already
+	entry := NewJournalEntry(JOURNAL_SHARE+":"+credit.Share, JOURNAL_SHARE, credit.Time)
+	entry.transfer(LEDGER_POOL_FEES, getLedgerAccount(credit.Miner, LEDGER_PENDING), credit.getAmount())
+	self.postLogged(entry)
+}
+
+func (self *Ledger) BlockCredited(credits *BlockCredits) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	block := credits.Block
+
+	if credits.Immature {
+		entry := NewJournalEntry(getBlockEntryId(JOURNAL_IMMATURE, block), JOURNAL_IMMATURE, now)
+		entry.Block = block.Number
+		entry.Nonce = block.Nonce
+		entry.transfer(LEDGER_CHAIN, LEDGER_POOL_IMMATURE, credits.Reward.getTotal())
+
+		for _, credit := range credits.Credits {
+			entry.transfer(LEDGER_POOL_IMMATURE, getLedgerAccount(credit.Miner, LEDGER_IMMATURE), credit.getAmount())
+		}
+
+		self.postLogged(entry)
+		return
+	}
+
+	entry := NewJournalEntry(getBlockEntryId(JOURNAL_MATURED, block), JOURNAL_MATURED, now)
+	entry.Block = block.Number
+	entry.Nonce = block.Nonce
+	entry.transfer(LEDGER_CHAIN, LEDGER_POOL_REWARDS, credits.Reward.getTotal())
+	entry.transfer(LEDGER_POOL_REWARDS, LEDGER_POOL_FEES, credits.getPoolFee())
+
+	for _, credit := range credits.Credits {
+		entry.transfer(LEDGER_POOL_REWARDS, getLedgerAccount(credit.Miner, LEDGER_PENDING), credit.getAmount())
+	}
+
+	self.postLogged(append(self.reverseImmature(block, now), entry)...)
+}
+
+func (self *Ledger) BlockReverted(block *BlockCandidate) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.postLogged(self.reverseImmature(block, time.Now())...)
+}
+
+// sets aside part of a pending balance for the payout with this id.
+// locking the same payout twice is a no-op
+func (self *Ledger) Lock(address string, amount *big.Int, id string) (*JournalEntry, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	balance, err := self.GetBalance(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pending, _ := big.NewInt(0).SetString(balance.Pending, 10)
+
+	if pending.Cmp(amount) < 0 {
+		return nil, errors.New("payout of " + amount.String() + " is more than the pending balance of " + address)
+	}
+
+	entry := NewJournalEntry(JOURNAL_LOCK+":"+id, JOURNAL_LOCK, time.Now())
+	entry.Payout = id
+	entry.transfer(getLedgerAccount(address, LEDGER_PENDING), getLedgerAccount(address, LEDGER_LOCKED), amount)
+	return entry, self.post(entry)
+}
+
+// the address a lock entry pays, and how much
+func getLockPayment(lock *JournalEntry) (string, *big.Int, error) {
+	if lock.Kind != JOURNAL_LOCK || len(lock.Transfers) != 1 {
+		return "", nil, errors.New("entry " + lock.Id + " is not a payout lock")
+	}
+
+	transfer := lock.Transfers[0]
+	return strings.TrimSuffix(transfer.To, ":"+LEDGER_LOCKED), transfer.getAmount(), nil
+}
+
+// marks a locked payout as paid; safe to call more than once. ErrNoPayout if
+// nothing was locked for the id
+func (self *Ledger) Pay(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	err := self.db.Connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer self.db.Disconnect()
+
+	lock, err := self.getEntry(JOURNAL_LOCK + ":" + id)
+
+	if err != nil {
+		return err
+	}
+
+	if lock == nil {
+		return ErrNoPayout
+	}
+
+	entry := NewJournalEntry(JOURNAL_PAYOUT+":"+id, JOURNAL_PAYOUT, time.Now())
+	entry.Payout = id
+
+	address, amount, err := getLockPayment(lock)
+
+	if err != nil {
+		return err
+	}
+
+	entry.transfer(getLedgerAccount(address, LEDGER_LOCKED), getLedgerAccount(address, LEDGER_PAID), amount)
+	return self.post(entry)
+}
+
+// whether the payout with this id was marked paid
+func (self *Ledger) IsPaid(id string) (bool, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer self.db.Disconnect()
+
+	entry, err := self.getEntry(JOURNAL_PAYOUT + ":" + id)
+	return entry != nil, err
+}
+
+/*
+ * locks that were not paid yet. only the locks and payouts of addresses with
+ * a locked balance, or a lock posted since the last fold, are read
+ */
+func (self *Ledger) GetOpenLocks() ([]*JournalEntry, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	accounts, err := self.getAccounts(map[string]interface{}{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make([]string, 0)
+	for name, account := range accounts {
+		if strings.HasSuffix(name, ":"+LEDGER_LOCKED) && account.getBalance().Sign() != 0 {
+			locked = append(locked, name)
+		}
+	}
+
+	unfolded, err := self.findEntries(map[string]interface{}{"kind": JOURNAL_LOCK, "folded": map[string]interface{}{"$ne": true}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range unfolded {
+		for _, transfer := range entry.Transfers {
+			locked = append(locked, transfer.To)
+		}
+	}
+
+	if len(locked) == 0 {
+		return []*JournalEntry{}, nil
+	}
+
+	entries, err := self.findEntries(map[string]interface{}{"kind": map[string]interface{}{"$in": []string{JOURNAL_LOCK, JOURNAL_PAYOUT}},
+		"accounts": map[string]interface{}{"$in": locked}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	paid := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Kind == JOURNAL_PAYOUT {
+			paid[entry.Payout] = true
+		}
+	}
+
+	locks := make([]*JournalEntry, 0)
+	for _, entry := range entries {
+		if entry.Kind == JOURNAL_LOCK && !paid[entry.Payout] {
+			locks = append(locks, entry)
+		}
+	}
+
+	return locks, nil
+}
+
+// account snapshots by name; callers are connected
+func (self *Ledger) getAccounts(query map[string]interface{}) (map[string]*LedgerAccount, error) {
+	accounts := make([]*LedgerAccount, 0)
+	err := self.db.FindIn("ledger_accounts", query, "", 0, &accounts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*LedgerAccount)
+	for _, account := range accounts {
+		ret[account.Account] = account
+	}
+	return ret, nil
+}
+
+// adds one entry to the snapshots of the accounts it touches, then marks it folded
+func (self *Ledger) foldEntry(accounts map[string]*LedgerAccount, entry *JournalEntry) error {
+	for name, amount := range getLedgerBalances([]*JournalEntry{entry}) {
+		account, ok := accounts[name]
+
+		if !ok {
+			account = &LedgerAccount{Account: name, Balance: "0"}
+			accounts[name] = account
+		}
+
+		// folded in before the last fold was interrupted
+		if account.Last == entry.Id {
+			continue
+		}
+
+		account.Balance = amount.Add(amount, account.getBalance()).String()
+		account.Last = entry.Id
+
+		err := self.db.Update(account)
+
+		if err != nil {
+			return errors.New("could not update account " + name + " - " + err.Error())
+		}
+	}
+
+	entry.Folded = true
+	return self.db.Update(entry)
+}
+
+/*
+ * adds the entries posted since the last fold to the account snapshots and
+ * returns every account's balance, with the problems found in the new
+ * entries. entries are folded one at a time and each account remembers the
+ * last one it got, so an interrupted fold picks up where it stopped. only the
+ * pay instance folds
+ */
+func (self *Ledger) fold() (map[string]*big.Int, []error, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	accounts, err := self.getAccounts(map[string]interface{}{})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := self.findEntries(map[string]interface{}{"folded": map[string]interface{}{"$ne": true}})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	problems := make([]error, 0)
+	for _, entry := range entries {
+		problems = append(problems, self.checkEntry(entry)...)
+		err = self.foldEntry(accounts, entry)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	balances := make(map[string]*big.Int)
+	for name, account := range accounts {
+		balances[name] = account.getBalance()
+	}
+
+	return balances, problems, nil
+}
+
+// pending balances by address
+func (self *Ledger) GetPendingBalances() (map[string]*big.Int, error) {
+	balances, problems, err := self.fold()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, problem := range problems {
+		ledgerLog.Warn("journal problem", "err", problem)
+	}
+
+	ret := make(map[string]*big.Int)
+	suffix := ":" + LEDGER_PENDING
+
+	for account, balance := range balances {
+		if strings.HasSuffix(account, suffix) && strings.HasPrefix(account, "0x") {
+			ret[strings.TrimSuffix(account, suffix)] = balance
+		}
+	}
+
+	return ret, nil
+}
+
+func getLedgerBalances(entries []*JournalEntry) map[string]*big.Int {
+	balances := make(map[string]*big.Int)
+
+	add := func(account string, amount *big.Int) {
+		if _, ok := balances[account]; !ok {
+			balances[account] = big.NewInt(0)
+		}
+		balances[account].Add(balances[account], amount)
+	}
+
+	for _, entry := range entries {
+		for _, transfer := range entry.Transfers {
+			amount := transfer.getAmount()
+			if amount == nil {
+				continue
+			}
+			add(transfer.From, big.NewInt(0).Neg(amount))
+			add(transfer.To, amount)
+		}
+	}
+
+	return balances
+}
+
+/*
+ * the address's account snapshots plus the entries posted since the last
+ * fold. a fold running in between (only outside the ledger lock) may leave
+ * out an entry until the next call
+ */
+func (self *Ledger) GetBalance(address string) (*LedgerBalance, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	buckets := []string{LEDGER_IMMATURE, LEDGER_PENDING, LEDGER_LOCKED, LEDGER_PAID}
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, getLedgerAccount(address, bucket))
+	}
+
+	accounts, err := self.getAccounts(map[string]interface{}{"account": map[string]interface{}{"$in": names}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := self.findEntries(map[string]interface{}{"accounts": map[string]interface{}{"$in": names},
+		"folded": map[string]interface{}{"$ne": true}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make(map[string]*big.Int)
+	for name, account := range accounts {
+		balances[name] = account.getBalance()
+	}
+
+	for _, entry := range entries {
+		for name, amount := range getLedgerBalances([]*JournalEntry{entry}) {
+			// folded in before the last fold was interrupted
+			if account, ok := accounts[name]; ok && account.Last == entry.Id {
+				continue
+			}
+
+			if _, ok := balances[name]; !ok {
+				balances[name] = big.NewInt(0)
+			}
+			balances[name].Add(balances[name], amount)
+		}
+	}
+
+	get := func(bucket string) string {
+		if balance, ok := balances[getLedgerAccount(address, bucket)]; ok {
+			return balance.String()
+		}
+		return "0"
+	}
+
+	return &LedgerBalance{Address: address, Immature: get(LEDGER_IMMATURE), Pending: get(LEDGER_PENDING), Locked: get(LEDGER_LOCKED), Paid: get(LEDGER_PAID)}, nil
+}
+
+// problems with one entry; ids are unique in the journal. callers are connected
+func (self *Ledger) checkEntry(entry *JournalEntry) []error {
+	problems := make([]error, 0)
+
+	for _, transfer := range entry.Transfers {
+		amount := transfer.getAmount()
+		if amount == nil || amount.Sign() <= 0 {
+			problems = append(problems, errors.New("entry "+entry.Id+" has an invalid amount: "+transfer.Amount))
+		}
+	}
+
+	if entry.Kind == JOURNAL_REVERSAL {
+		immature, err := self.getEntry(JOURNAL_IMMATURE + ":" + entry.Block + ":" + entry.Nonce)
+
+		if err != nil {
+			problems = append(problems, errors.New("could not look up what entry "+entry.Id+" reverses - "+err.Error()))
+		} else if immature == nil {
+			problems = append(problems, errors.New("entry "+entry.Id+" reverses nothing"))
+		}
+	}
+
+	return problems
+}
+
+// problems with the account balances
+func checkBalances(balances map[string]*big.Int) []error {
+	problems := make([]error, 0)
+	total := big.NewInt(0)
+	accounts := make([]string, 0, len(balances))
+
+	for account, balance := range balances {
+		total.Add(total, balance)
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	if total.Sign() != 0 {
+		problems = append(problems, errors.New("balances add up to "+total.String()+" instead of 0"))
+	}
+
+	// only the chain gives, and only the pool's fees may be spent ahead of time
+	for _, account := range accounts {
+		balance := balances[account]
+
+		if account == LEDGER_CHAIN || account == LEDGER_POOL_FEES {
+			continue
+		}
+
+		if account == LEDGER_POOL_REWARDS && balance.Sign() != 0 {
+			problems = append(problems, errors.New("matured rewards of "+balance.String()+" were not divided up"))
+		} else if balance.Sign() < 0 {
+			problems = append(problems, errors.New("account "+account+" is negative: "+balance.String()))
+		}
+	}
+
+	return problems
+}
+
+// the problems with the balances and with entries posted since the last fold
+func (self *Ledger) Check() ([]error, error) {
+	balances, problems, err := self.fold()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, checkBalances(balances)...), nil
+}
+
+// logs the problems in the journal
+func checkLedger(ledger *Ledger) {
+	problems, err := ledger.Check()
+
+	if err != nil {
+		ledgerLog.Error("could not check journal", "err", err)
+		return
+	}
+
+	for _, problem := range problems {
+		ledgerLog.Warn("journal problem", "err", problem)
+	}
+
+	ledgerLog.Info("journal checked", "problems", len(problems))
+}
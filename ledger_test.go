@@ -0,0 +1,223 @@
+package main
+
+import "testing"
+import "math/big"
+import "time"
+
+// keeps the journal in memory
+type journalDatabase struct {
+	Database
+	entries  []*JournalEntry
+	accounts map[string]LedgerAccount
+}
+
+func (self *journalDatabase) Connect() error    { return nil }
+func (self *journalDatabase) Disconnect() error { return nil }
+
+func (self *journalDatabase) Add(item interface{}) error {
+	entry := item.(*JournalEntry)
+	for _, known := range self.entries {
+		if known.Id == entry.Id {
+			return ErrDuplicate
+		}
+	}
+	self.entries = append(self.entries, entry)
+	return nil
+}
+
+func (self *journalDatabase) Update(item interface{}) error {
+	switch item := item.(type) {
+	case *JournalEntry:
+		for i, known := range self.entries {
+			if known.Id == item.Id {
+				entry := *item
+				self.entries[i] = &entry
+			}
+		}
+	case *LedgerAccount:
+		if self.accounts == nil {
+			self.accounts = make(map[string]LedgerAccount)
+		}
+		self.accounts[item.Account] = *item
+	}
+	return nil
+}
+
+func (self *journalDatabase) FindIn(table string, query map[string]interface{}, sort string, limit int, result interface{}) error {
+	if table == "ledger_accounts" {
+		ret := result.(*[]*LedgerAccount)
+		for _, account := range self.accounts {
+			if names, ok := query["account"]; ok {
+				found := false
+				for _, name := range names.(map[string]interface{})["$in"].([]string) {
+					found = found || account.Account == name
+				}
+				if !found {
+					continue
+				}
+			}
+
+			account := account
+			*ret = append(*ret, &account)
+		}
+		return nil
+	}
+
+	ret := result.(*[]*JournalEntry)
+	for _, entry := range self.entries {
+		if id, ok := query["id"]; ok && entry.Id != id {
+			continue
+		}
+
+		if _, ok := query["folded"]; ok && entry.Folded {
+			continue
+		}
+
+		if kind, ok := query["kind"].(string); ok && entry.Kind != kind {
+			continue
+		}
+
+		if kinds, ok := query["kind"].(map[string]interface{}); ok {
+			found := false
+			for _, kind := range kinds["$in"].([]string) {
+				found = found || entry.Kind == kind
+			}
+			if !found {
+				continue
+			}
+		}
+
+		if accounts, ok := query["accounts"]; ok {
+			found := false
+			for _, account := range accounts.(map[string]interface{})["$in"].([]string) {
+				for _, touched := range entry.Accounts {
+					found = found || account == touched
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+
+		found := *entry
+		*ret = append(*ret, &found)
+	}
+	return nil
+}
+
+func newTestBlockCredits(block *BlockCandidate, immature bool) *BlockCredits {
+	return &BlockCredits{Block: block,
+		Reward:   NewBlockReward(big.NewInt(1000), big.NewInt(0), big.NewInt(0)),
+		Immature: immature,
+		Credits: []*Credit{
+			{Miner: "0xa", Amount: "600", Block: block.Number, Nonce: block.Nonce},
+			{Miner: "0xb", Amount: "380", Block: block.Number, Nonce: block.Nonce}}}
+}
+
+func expectLedgerBalance(t *testing.T, ledger *Ledger, address, immature, pending, paid string) {
+	balance, err := ledger.GetBalance(address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance.Immature != immature || balance.Pending != pending || balance.Paid != paid {
+		t.Error("unexpected balance for ", address, ": ", balance)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	db := &journalDatabase{}
+	ledger := NewLedger(db)
+	block := &BlockCandidate{Number: "0x10", Nonce: "0x01"}
+	orphan := &BlockCandidate{Number: "0x11", Nonce: "0x02"}
+
+	ledger.BlockCredited(newTestBlockCredits(block, true))
+	ledger.BlockCredited(newTestBlockCredits(orphan, true))
+	expectLedgerBalance(t, ledger, "0xa", "1200", "0", "0")
+
+	ledger.BlockCredited(newTestBlockCredits(block, false))
+	ledger.BlockCredited(newTestBlockCredits(block, false))
+	ledger.BlockReverted(orphan)
+	expectLedgerBalance(t, ledger, "0xa", "0", "600", "0")
+	expectLedgerBalance(t, ledger, "0xb", "0", "380", "0")
+
+	// shares credited at the same time both count, the same share only once
+	now := time.Now()
+	ledger.Credited(&Credit{Share: "0x01:0x02:0x03", Miner: "0xb", Amount: "10", Time: now})
+	ledger.Credited(&Credit{Share: "0x01:0x04:0x03", Miner: "0xb", Amount: "10", Time: now})
+	ledger.Credited(&Credit{Share: "0x01:0x02:0x03", Miner: "0xb", Amount: "10", Time: now})
+
+	if _, err := ledger.Lock("0xb", big.NewInt(400), "p1"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ledger.Lock("0xb", big.NewInt(400), "p2"); err == nil {
+		t.Error("expected a payout over the pending balance to fail")
+	}
+	expectLedgerBalance(t, ledger, "0xb", "0", "0", "0")
+
+	if err := ledger.Pay("p1"); err != nil {
+		t.Error(err)
+	}
+
+	if err := ledger.Pay("p1"); err != nil || ledger.Pay("p2") == nil {
+		t.Error("expected paying twice to be a no-op, and unknown payouts to fail")
+	}
+	expectLedgerBalance(t, ledger, "0xb", "0", "0", "400")
+
+	problems, _ := ledger.Check()
+	if len(problems) != 0 {
+		t.Error("expected a balanced journal, found ", problems)
+	}
+
+	balances := getLedgerBalances(db.entries)
+	if balances[LEDGER_POOL_FEES].Int64() != 0 || balances[LEDGER_CHAIN].Int64() != -1000 {
+		t.Error("unexpected pool balances ", balances)
+	}
+
+	// a credit nobody paid for
+	bad := NewJournalEntry("bad", JOURNAL_SHARE, time.Now())
+	bad.transfer(LEDGER_POOL_REWARDS, getLedgerAccount("0xa", LEDGER_PENDING), big.NewInt(5))
+	db.entries = append(db.entries, bad)
+
+	problems, _ = ledger.Check()
+	if len(problems) != 1 {
+		t.Error("expected one problem, found ", problems)
+	}
+
+	// a fold interrupted before the entry was marked folded does not count it twice
+	for _, entry := range db.entries {
+		if entry.Id == JOURNAL_PAYOUT+":p1" {
+			entry.Folded = false
+		}
+	}
+	expectLedgerBalance(t, ledger, "0xb", "0", "0", "400")
+	ledger.Check()
+
+	for account, balance := range getLedgerBalances(db.entries) {
+		if db.accounts[account].Balance != balance.String() {
+			t.Error("expected the snapshot of ", account, " to be ", balance, ", found ", db.accounts[account])
+		}
+	}
+
+	// open locks are found before and after they are folded
+	if _, err := ledger.Lock("0xa", big.NewInt(100), "p3"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		locks, err := ledger.GetOpenLocks()
+
+		if err != nil || len(locks) != 1 || locks[0].Payout != "p3" {
+			t.Error("expected the open p3 lock, found ", locks, err)
+		}
+
+		ledger.Check()
+	}
+
+	// balances come from the snapshots, not the folded entries
+	db.entries = []*JournalEntry{}
+	expectLedgerBalance(t, ledger, "0xa", "0", "505", "0")
+	expectLedgerBalance(t, ledger, "0xb", "0", "0", "400")
+}
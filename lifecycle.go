@@ -0,0 +1,169 @@
+package main
+
+//
+// graceful shutdown
+// long running loops are started with Go and watch the lifecycle's context.
+// on shutdown the context is cancelled, so listeners stop taking connections
+// and loops return once the work in hand is done. then the OnStop steps run
+// in the order they were added (finishing share verifications, writing miner
+// stats, committing the scanner, saving payments). the whole shutdown is
+// bounded by SHUTDOWN_TIMEOUT; anything still running after it is abandoned
+//
+
+import "context"
+import "errors"
+import "net/http"
+import "os"
+import "os/signal"
+import "sync"
+import "syscall"
+import "time"
+
+var ErrShuttingDown = errors.New("pool is shutting down")
+
+type stopStep struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+type Lifecycle struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	running *sync.WaitGroup
+	lock    *sync.Mutex
+	steps   []stopStep
+}
+
+func NewLifecycle(timeout time.Duration) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, cancel: cancel, timeout: timeout, running: &sync.WaitGroup{}, lock: &sync.Mutex{}}
+}
+
+// cancelled when shutdown begins
+func (self *Lifecycle) Context() context.Context {
+	return self.ctx
+}
+
+// runs a loop until the context is cancelled; shutdown waits for it to return
+func (self *Lifecycle) Go(name string, run func(ctx context.Context)) {
+	self.running.Add(1)
+
+	go func() {
+		defer self.running.Done()
+		run(self.ctx)
+		mainLog.Debug("stopped", "component", name)
+	}()
+}
+
+// a step run after the loops have returned
+func (self *Lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.steps = append(self.steps, stopStep{name: name, stop: stop})
+}
+
+// serves until shutdown, then stops taking requests and waits for the ones in flight
+func (self *Lifecycle) Serve(name string, server *http.Server) {
+	self.Go(name, func(ctx context.Context) {
+		go func() {
+			err := server.ListenAndServe()
+
+			if err != nil && err != http.ErrServerClosed {
+				mainLog.Error("could not serve", "component", name, "addr", server.Addr, "err", err)
+			}
+		}()
+
+		<-ctx.Done()
+
+		drainCtx, cancel := context.WithTimeout(context.Background(), self.timeout)
+		defer cancel()
+
+		err := server.Shutdown(drainCtx)
+
+		if err != nil {
+			mainLog.Warn("requests still in flight", "component", name, "err", err)
+		}
+	})
+}
+
+// waits for the wait group, or until the context is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan bool)
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleeps for d; false if the context was cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// blocks until the process is asked to stop
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	return <-signals
+}
+
+/*
+ * cancels the context, waits for the loops and runs the stop steps, giving
+ * up after the timeout. returns the first error
+ */
+func (self *Lifecycle) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+	defer cancel()
+
+	mainLog.Info("shutting down", "timeout", self.timeout)
+	self.cancel()
+
+	ret := waitContext(ctx, self.running)
+
+	if ret != nil {
+		mainLog.Error("gave up waiting for components to stop", "err", ret)
+	}
+
+	self.lock.Lock()
+	steps := self.steps
+	self.lock.Unlock()
+
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			mainLog.Error("skipped stop step, out of time", "step", step.name)
+			continue
+		}
+
+		err := step.stop(ctx)
+
+		if err != nil {
+			mainLog.Error("stop step failed", "step", step.name, "err", err)
+
+			if ret == nil {
+				ret = err
+			}
+		}
+	}
+
+	return ret
+}
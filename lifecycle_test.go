@@ -0,0 +1,107 @@
+package main
+
+import "context"
+import "errors"
+import "net"
+import "testing"
+import "time"
+
+func TestLifecycleShutdown(t *testing.T) {
+	lifecycle := NewLifecycle(time.Second)
+	order := make(chan string, 4)
+
+	lifecycle.Go("loop", func(ctx context.Context) {
+		for sleepContext(ctx, time.Millisecond) {
+		}
+		order <- "loop"
+	})
+
+	lifecycle.OnStop("first", func(ctx context.Context) error {
+		order <- "first"
+		return errors.New("could not save")
+	})
+
+	lifecycle.OnStop("second", func(ctx context.Context) error {
+		order <- "second"
+		return nil
+	})
+
+	err := lifecycle.Shutdown()
+
+	if err == nil || err.Error() != "could not save" {
+		t.Error("expected the failed step's error, found ", err)
+	}
+
+	close(order)
+	found := ""
+	for name := range order {
+		found += name + " "
+	}
+
+	// the loops stop before the steps run, and a failed step does not stop the rest
+	if found != "loop first second " {
+		t.Error("unexpected shutdown order ", found)
+	}
+}
+
+func TestLifecycleTimeout(t *testing.T) {
+	lifecycle := NewLifecycle(10 * time.Millisecond)
+	stuck := make(chan bool)
+	defer close(stuck)
+
+	lifecycle.Go("stuck", func(ctx context.Context) {
+		<-stuck
+	})
+
+	ran := false
+	lifecycle.OnStop("save", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	start := time.Now()
+	err := lifecycle.Shutdown()
+
+	if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Error("expected the shutdown to give up after its timeout, found ", err, " after ", time.Since(start))
+	}
+
+	if ran {
+		t.Error("expected the step to be skipped while a loop is still running")
+	}
+}
+
+func TestTcpClientInterrupt(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	client := newTcpClient(local)
+	defer client.close()
+
+	go remote.Write([]byte("{\"id\": 1, \"method\": \"mining.subscribe\"}\n"))
+
+	if request, err := client.readRequest(); err != nil || request.Method != "mining.subscribe" {
+		t.Fatal("expected a request, found ", request, " ", err)
+	}
+
+	read := make(chan error)
+	go func() {
+		_, err := client.readRequest()
+		read <- err
+	}()
+
+	client.interrupt()
+
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("expected the waiting read to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the interrupt to wake the read")
+	}
+
+	if _, err := client.readRequest(); err != ErrShuttingDown {
+		t.Error("expected no more reads after an interrupt, found ", err)
+	}
+}
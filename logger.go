@@ -0,0 +1,354 @@
+package main
+
+//
+// leveled, structured logging
+// each subsystem (pool, stratum, pay, scanner, web, verify, ...) has its own
+// logger and level. messages carry key/value fields like miner, worker, block
+// and txid, and are written as text or as one json object a line (LOG_FORMAT).
+// levels start from LOG_LEVEL and LOG_LEVELS, and can be changed at runtime
+// on the metrics port (Settings.MetricsPort, local only by default) at /log:
+//     curl -X POST 'http://127.0.0.1:9102/log?subsystem=pool&level=debug'
+//
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (self LogLevel) String() string {
+	if self < LOG_DEBUG || self > LOG_ERROR {
+		return "unknown"
+	}
+	return logLevelNames[self]
+}
+
+func parseLogLevel(name string) (LogLevel, error) {
+	for i, level := range logLevelNames {
+		if strings.ToLower(name) == level {
+			return LogLevel(i), nil
+		}
+	}
+	return LOG_INFO, errors.New("unknown log level " + name)
+}
+
+// levels and output shared by all loggers
+type logConfig struct {
+	lock    *sync.RWMutex
+	level   LogLevel            // for subsystems without their own level
+	levels  map[string]LogLevel // by subsystem
+	json    bool
+	out     io.Writer
+	outLock *sync.Mutex
+}
+
+var logging = &logConfig{lock: &sync.RWMutex{},
+	level:   LOG_INFO,
+	levels:  make(map[string]LogLevel),
+	out:     os.Stderr,
+	outLock: &sync.Mutex{}}
+
+// an empty subsystem sets the default level
+func SetLogLevel(subsystem, level string) error {
+	parsed, err := parseLogLevel(level)
+
+	if err != nil {
+		return err
+	}
+
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+
+	if len(subsystem) == 0 {
+		logging.level = parsed
+	} else {
+		logging.levels[subsystem] = parsed
+	}
+
+	return nil
+}
+
+func SetLogFormat(format string) error {
+	if format != "text" && format != "json" {
+		return errors.New("unknown log format " + format + ", use text or json")
+	}
+
+	logging.lock.Lock()
+	logging.json = format == "json"
+	logging.lock.Unlock()
+	return nil
+}
+
+// checks levels and a format for configureLogging, without applying them
+func validateLogging(level string, levels map[string]string, format string) error {
+	if _, err := parseLogLevel(level); err != nil {
+		return err
+	}
+
+	for _, name := range levels {
+		if _, err := parseLogLevel(name); err != nil {
+			return err
+		}
+	}
+
+	if format != "text" && format != "json" {
+		return errors.New("unknown log format " + format + ", use text or json")
+	}
+
+	return nil
+}
+
+/*
+ * applies LOG_LEVEL, LOG_LEVELS and LOG_FORMAT (or the Settings for them);
+ * subsystems left out of LOG_LEVELS go back to the default level
+ */
+func configureLogging(level string, levels map[string]string, format string) error {
+	defaultLevel, err := parseLogLevel(level)
+
+	if err != nil {
+		return err
+	}
+
+	parsed := make(map[string]LogLevel)
+	for subsystem, name := range levels {
+		parsed[subsystem], err = parseLogLevel(name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = SetLogFormat(format)
+
+	if err != nil {
+		return err
+	}
+
+	logging.lock.Lock()
+	logging.level = defaultLevel
+	logging.levels = parsed
+	logging.lock.Unlock()
+	return nil
+}
+
+func getLogLevel(subsystem string) LogLevel {
+	logging.lock.RLock()
+	defer logging.lock.RUnlock()
+
+	if level, ok := logging.levels[subsystem]; ok {
+		return level
+	}
+	return logging.level
+}
+
+type Logger struct {
+	subsystem string
+	fields    []interface{} // key/value pairs added to every message
+}
+
+func NewLogger(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// a logger that adds these key/value pairs to every message
+func (self *Logger) With(fields ...interface{}) *Logger {
+	joined := make([]interface{}, 0, len(self.fields)+len(fields))
+	joined = append(joined, self.fields...)
+	joined = append(joined, fields...)
+	return &Logger{subsystem: self.subsystem, fields: joined}
+}
+
+func (self *Logger) enabled(level LogLevel) bool {
+	return level >= getLogLevel(self.subsystem)
+}
+
+func getLogValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func (self *Logger) formatText(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "%s %-5s %s: %s", now.Format("2006-01-02T15:04:05.000Z07:00"), strings.ToUpper(level.String()), self.subsystem, msg)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fmt.Sprint(getLogValue(fields[i+1]))
+
+		if len(value) == 0 || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		fmt.Fprintf(line, " %v=%s", fields[i], value)
+	}
+
+	line.WriteString("\n")
+	return line.String()
+}
+
+func (self *Logger) formatJSON(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	entry := map[string]interface{}{"time": now.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"subsystem": self.subsystem,
+		"msg":       msg}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if _, taken := entry[key]; !taken {
+			entry[key] = getLogValue(fields[i+1])
+		}
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": entry["level"],
+			"subsystem": self.subsystem, "msg": msg, "logError": err.Error()})
+	}
+
+	return string(line) + "\n"
+}
+
+func (self *Logger) write(level LogLevel, msg string, fields []interface{}) {
+	if self.enabled(level) {
+		self.output(level, msg, fields)
+	}
+}
+
+func (self *Logger) output(level LogLevel, msg string, fields []interface{}) {
+	all := fields
+	if len(self.fields) > 0 {
+		all = append(append(make([]interface{}, 0, len(self.fields)+len(fields)), self.fields...), fields...)
+	}
+
+	logging.lock.RLock()
+	asJSON := logging.json
+	logging.lock.RUnlock()
+
+	now := time.Now()
+	var line string
+
+	if asJSON {
+		line = self.formatJSON(now, level, msg, all)
+	} else {
+		line = self.formatText(now, level, msg, all)
+	}
+
+	logging.outLock.Lock()
+	io.WriteString(logging.out, line)
+	logging.outLock.Unlock()
+}
+
+func (self *Logger) Debug(msg string, fields ...interface{}) {
+	self.write(LOG_DEBUG, msg, fields)
+}
+
+func (self *Logger) Info(msg string, fields ...interface{}) {
+	self.write(LOG_INFO, msg, fields)
+}
+
+func (self *Logger) Warn(msg string, fields ...interface{}) {
+	self.write(LOG_WARN, msg, fields)
+}
+
+func (self *Logger) Error(msg string, fields ...interface{}) {
+	self.write(LOG_ERROR, msg, fields)
+}
+
+// logs at error level, whatever the subsystem's level, and exits
+func (self *Logger) Fatal(msg string, fields ...interface{}) {
+	self.output(LOG_ERROR, msg, fields)
+	os.Exit(1)
+}
+
+var mainLog = NewLogger("main")
+var poolLog = NewLogger("pool")
+var stratumLog = NewLogger("stratum")
+var ethproxyLog = NewLogger("ethproxy")
+var verifyLog = NewLogger("verify")
+var scannerLog = NewLogger("scanner")
+var blocksLog = NewLogger("blocks")
+var rewardsLog = NewLogger("rewards")
+var ledgerLog = NewLogger("ledger")
+var payLog = NewLogger("pay")
+var payoutsLog = NewLogger("payouts")
+var webLog = NewLogger("web")
+var apiLog = NewLogger("api")
+var dbLog = NewLogger("db")
+var gethLog = NewLogger("geth")
+
+type logLevelsResponse struct {
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+	Format string            `json:"format"`
+	Error  string            `json:"error,omitempty"`
+}
+
+func getLogLevelsResponse() *logLevelsResponse {
+	logging.lock.RLock()
+	defer logging.lock.RUnlock()
+
+	ret := &logLevelsResponse{Level: logging.level.String(), Levels: make(map[string]string), Format: "text"}
+	for subsystem, level := range logging.levels {
+		ret.Levels[subsystem] = level.String()
+	}
+
+	if logging.json {
+		ret.Format = "json"
+	}
+
+	return ret
+}
+
+/*
+ * GET shows the log levels; POST ?subsystem=pool&level=debug changes one
+ * (no subsystem changes the default), POST ?format=json the output format
+ */
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" {
+		var err error
+		query := r.URL.Query()
+
+		if format := query.Get("format"); len(format) > 0 {
+			err = SetLogFormat(format)
+		}
+
+		if level := query.Get("level"); err == nil && len(level) > 0 {
+			err = SetLogLevel(query.Get("subsystem"), level)
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&logLevelsResponse{Error: err.Error()})
+			return
+		}
+
+		mainLog.Info("log settings changed", "subsystem", query.Get("subsystem"), "level", query.Get("level"), "format", query.Get("format"))
+	} else if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(getLogLevelsResponse())
+}
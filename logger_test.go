@@ -0,0 +1,117 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "math/big"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+// sends the log to a buffer until the returned function is called
+func captureLog() (*bytes.Buffer, func()) {
+	out := &bytes.Buffer{}
+	saved := logging.out
+	logging.out = out
+
+	return out, func() {
+		logging.out = saved
+		configureLogging("info", nil, "text")
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	out, restore := captureLog()
+	defer restore()
+
+	err := configureLogging("warn", map[string]string{"pool": "debug"}, "text")
+
+	if err != nil {
+		t.Fatal("could not configure logging - ", err)
+	}
+
+	NewLogger("pool").Debug("pool detail")
+	NewLogger("pay").Info("pay detail")
+	NewLogger("pay").Warn("pay problem")
+
+	text := out.String()
+
+	if !strings.Contains(text, "DEBUG pool: pool detail") || !strings.Contains(text, "WARN  pay: pay problem") {
+		t.Error("expected the pool debug and pay warning, found\n", text)
+	}
+
+	if strings.Contains(text, "pay detail") {
+		t.Error("expected pay info to be filtered, found\n", text)
+	}
+
+	// changed at runtime
+	SetLogLevel("pay", "info")
+	NewLogger("pay").Info("pay detail")
+
+	if !strings.Contains(out.String(), "pay detail") {
+		t.Error("expected pay info after lowering its level, found\n", out.String())
+	}
+
+	if SetLogLevel("pay", "verbose") == nil || configureLogging("info", nil, "xml") == nil {
+		t.Error("expected an unknown level and format to be rejected")
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	out, restore := captureLog()
+	defer restore()
+
+	minerLog := NewLogger("pool").With("miner", "0x01", "worker", "rig 1")
+	minerLog.Info("share accepted", "difficulty", big.NewInt(1000), "err", errors.New("none"))
+
+	text := out.String()
+
+	if !strings.Contains(text, `pool: share accepted miner=0x01 worker="rig 1" difficulty=1000 err=none`) {
+		t.Error("expected the fields in order, found ", text)
+	}
+
+	out.Reset()
+	SetLogFormat("json")
+	minerLog.Warn("block found", "block", big.NewInt(100), "txid", "0xab")
+
+	entry := make(map[string]interface{})
+	err := json.Unmarshal(out.Bytes(), &entry)
+
+	if err != nil {
+		t.Fatal("expected one json line, found ", out.String())
+	}
+
+	if entry["level"] != "warn" || entry["subsystem"] != "pool" || entry["msg"] != "block found" ||
+		entry["miner"] != "0x01" || entry["block"] != "100" || entry["txid"] != "0xab" {
+		t.Error("unexpected json entry ", entry)
+	}
+}
+
+func TestLogLevelsHandler(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+
+	recorder := httptest.NewRecorder()
+	serveLogLevels(recorder, httptest.NewRequest("POST", "/log?subsystem=verify&level=debug", nil))
+
+	if recorder.Code != 200 || getLogLevel("verify") != LOG_DEBUG || getLogLevel("pool") != LOG_INFO {
+		t.Error("expected only verify to be set to debug, found ", recorder.Code, " ", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	serveLogLevels(recorder, httptest.NewRequest("POST", "/log?level=loud", nil))
+
+	if recorder.Code != 400 {
+		t.Error("expected an unknown level to be rejected, found ", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	serveLogLevels(recorder, httptest.NewRequest("GET", "/log", nil))
+
+	levels := &logLevelsResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), levels)
+
+	if levels.Level != "info" || levels.Levels["verify"] != "debug" || levels.Format != "text" {
+		t.Error("unexpected log levels ", recorder.Body.String())
+	}
+}
@@ -4,33 +4,35 @@ package main
 // OneEther
 //
 
-import "os/signal"
 import "runtime/pprof"
 import "flag"
 import "os"
 import "math/big"
 import "time"
 import "errors"
+import "net"
 import "net/http"
 import "fmt"
 import "io/ioutil"
 import "bufio"
 import "encoding/json"
-import "log"
+import "strings"
 
 //TODO proper miner diff
 
-var workLog *log.Logger
-
 var pool *MinerPool
 var geth *Geth
+var work *WorkManager
+var verifier *VerifyPool
+var rewards *RoundAccountant
+var ledger *Ledger
+var minerSettings *MinerSettingsStore
+var bans *BanManager
 var server *Server
 var pay *PaymentProcessor
 
 var config *Config
 
-var sigkill chan os.Signal
-
 const (
 	PUBLIC_ERROR  = iota
 	PRIVATE_ERROR = iota
@@ -57,10 +59,7 @@ func NewRequestError(message string, kind int) RequestError {
 func writeResponse(w http.ResponseWriter, response interface{}) {
 	responseOutput, _ := json.Marshal(response)
 
-	if debugRPC {
-		log.Printf("\n\n----- RESPONSE ----->>\n")
-		log.Printf(string(responseOutput))
-	}
+	poolLog.Debug("response", "body", string(responseOutput))
 
 	fmt.Fprintf(w, string(responseOutput))
 }
@@ -152,198 +151,267 @@ func methodIsAllowed(method string) bool {
 }
 
 // send work to the miner
-func eth_getWork(request *RPCRequest, miner *big.Int) (*RPCResponse, error) {
-	mr := pool.getMiner(miner)
+func eth_getWork(request *RPCRequest, miner *big.Int, workerName string) (*RPCResponse, error) {
+	job := work.getJob()
 
-	if mr == nil {
-		return nil, errors.New("invalid miner")
+	if job == nil {
+		return nil, errors.New("no work available yet")
 	}
 
-	response, err := geth.SendRPCRequest(request)
+	pool.lock()
+	worker := pool.getMiner(miner).touch(workerName)
+	difficulty := big.NewInt(0).Set(worker.getDifficulty())
+	pool.unlock()
 
-	if err != nil {
-		return nil, errors.New("could send rpc request to geth: " + err.Error())
+	return NewRPCResult(request.Id, job.getWorkResult(difficulty)), nil
+}
+
+// native ethash when enabled, with the remote verifier at confirmAddr as
+// a fallback while the cache for a new epoch is being generated
+func newShareVerifier(confirmAddr string) ShareVerifier {
+	if !VERIFY_NATIVE {
+		return NewRemoteVerifier(confirmAddr)
 	}
 
-	headerHash, err := response.GetBigIntEntryResult(0, 32)
+	ethash := NewEthashVerifier(ETHASH_CACHES)
 
-	if err != nil {
-		return nil, errors.New("could not get result[0] - " + err.Error())
+	if !VERIFY_REMOTE_FALLBACK || len(confirmAddr) <= 0 {
+		return ethash
 	}
 
-	seedHash, err := response.GetBigIntEntryResult(1, 32)
+	return NewFallbackVerifier(ethash, NewRemoteVerifier(confirmAddr))
+}
 
-	if err != nil {
-		return nil, errors.New("could not get result[1] - " + err.Error())
-	}
+// forward a solved block to geth
+func submitBlock(id RPCId, nonce, headerHash, mixHash *big.Int) (*RPCResponse, error) {
+	request := NewRPCRequest(id, "eth_submitWork", RPCParams{
+		getHexString(nonce, 16),
+		getHexString(headerHash, 64),
+		getHexString(mixHash, 64),
+	})
 
-	target, err := response.GetBigIntEntryResult(2, 32)
+	return geth.SendRPCRequest(request)
+}
 
-	if err != nil {
-		return nil, errors.New("could not get result[2] - " + err.Error())
+// outcome of a share submission
+const (
+	SHARE_ACCEPTED           = iota
+	SHARE_ACCEPTED_STALE     = iota // valid share for a recently replaced job
+	SHARE_REJECTED_STALE     = iota // share for an unknown job, or outside the grace window
+	SHARE_REJECTED_INVALID   = iota
+	SHARE_REJECTED_DUPLICATE = iota
+	SHARE_BUSY               = iota // not checked, the verify queue is full; the miner should resubmit
+	SHARE_MALFORMED          = iota // the submission could not be parsed; never returned by processShare
+	SHARE_ERROR              = iota // not checked, the verifier failed; not the miner's fault
+)
+
+func shareAccepted(status int) bool {
+	return status == SHARE_ACCEPTED || status == SHARE_ACCEPTED_STALE
+}
+
+func getShareStatusName(status int) string {
+	switch status {
+	case SHARE_ACCEPTED:
+		return "accepted"
+	case SHARE_ACCEPTED_STALE:
+		return "accepted_stale"
+	case SHARE_REJECTED_STALE:
+		return "stale"
+	case SHARE_REJECTED_INVALID:
+		return "invalid"
+	case SHARE_REJECTED_DUPLICATE:
+		return "duplicate"
+	case SHARE_BUSY:
+		return "busy"
+	case SHARE_ERROR:
+		return "error"
+	}
+	return "malformed"
+}
+
+func countShare(status int) {
+	metrics.Inc("oneether_shares_total", "status", getShareStatusName(status))
+}
+
+// records the outcome of a share; rejected or malformed shares count against
+// the miner's ip and address
+func reportShare(ip string, minerAddr *big.Int, status int) {
+	countShare(status)
+
+	if bans != nil {
+		bans.RecordShare(ip, minerAddr, status, time.Now())
 	}
+}
 
-	// block has changed, update pool information
-	if pool.headerHash.Cmp(headerHash) != 0 {
-		var err error = nil
+// checks a share against the job it was mined on and credits the miner.
+// state is nil when the job is no longer known, mixHash is nil when the miner did not send it.
+// returns the share status, and the geth response if it also solved the block
+func processShare(id RPCId, miner *Miner, worker *MinerWorker, state *BlockState, nonce, mixHash *big.Int) (int, *RPCResponse, error) {
+	now := time.Now()
+	difficulty := big.NewInt(0)
+	difficulty.Set(worker.vardiff.getShareDifficulty(now))
+	diff := float64(difficulty.Int64())
 
-		difficulty := big.NewInt(1)
-		difficulty.Lsh(difficulty, 255)
-		difficulty.Div(difficulty, target)
-		difficulty.Lsh(difficulty, 1)
+	miner.lastPost = now
+	worker.lastSeen = miner.lastPost
 
+	if state == nil || !state.inGraceWindow(now) || (state.isStale() && !ACCEPT_STALE_SHARES) {
+		poolLog.Info("stale share rejected", "miner", getHexString(miner.address, 40), "worker", worker.name)
 		pool.lock()
-		pool.blockStart = time.Now()
-		pool.submissions = make(map[string]bool)
-		pool.blockNumber, err = geth.GetBlockNumber()
-		pool.blockDifficulty = difficulty
-		pool.headerHash = headerHash
-		pool.seedHash = seedHash
+		miner.staleRejected.Add(miner.staleRejected, big.NewInt(1))
 		pool.unlock()
+		return SHARE_REJECTED_STALE, nil, nil
+	}
 
-		if err != nil {
-			log.Printf("could not get block number!\n")
-			return nil, err
-		}
+	job := state.job
+	share := &ShareWork{blockNumber: job.blockNumber,
+		headerHash:      job.headerHash,
+		nonce:           nonce,
+		mixHash:         mixHash,
+		shareDifficulty: difficulty,
+		blockTarget:     job.target}
+
+	// one evaluation answers both the share and the block check
+	result, err := verifier.Verify(share)
+
+	if err == ErrVerifyBusy {
+		return SHARE_BUSY, nil, nil
 	}
 
-	mr.lastPost = time.Now()
+	if err != nil {
+		poolLog.Error("could not verify share", "miner", getHexString(miner.address, 40), "worker", worker.name, "err", err)
+		return SHARE_ERROR, nil, err
+	}
 
-	response.ReplaceResult(2, getHexString(getBoundaryCondition(mr.getDifficulty()), 32))
-	return response, nil
-}
+	if !result.isValidShare(share) {
+		poolLog.Info("invalid share rejected", "miner", getHexString(miner.address, 40), "worker", worker.name)
+		return SHARE_REJECTED_INVALID, nil, nil
+	}
+
+	poolDifficulty := job.difficulty
 
-// sends an RPC to a verify process. Currently this is a modified version of the py-ethereum library (for historical reasons)
-func verifyWork(blockNumber, headerHash, mixHash, nonce, difficulty *big.Int) bool {
-	if debugVerify {
-		log.Printf("sending verify #1: " + difficulty.String() + " : " + nonce.String() + "\n")
-		log.Printf("sending verify #2: " + blockNumber.String() + " : " + headerHash.String() + "\n")
+
+	submission := NewShareSubmission(miner.address, worker.name, job.headerHash, nonce, result.mixDigest, now)
+
+	if !pool.shares.add(submission) {
+		poolLog.Info("duplicate share rejected", "miner", getHexString(miner.address, 40), "worker", worker.name)
+		return SHARE_REJECTED_DUPLICATE, nil, nil
 	}
 
-	request := NewRPCRequest(1, "verify", RPCParams{
-		blockNumber.String(),
-		getHexString(headerHash, 32),
-		getHexString(mixHash, 32),
-		getHexString(nonce, 8),
-		difficulty.String(),
-	})
+	payout := big.NewInt(0)
 
-	response, err := sendRPCRequest(request, CONFIRM_ADDR)
+	if rewards != nil {
+		payout = rewards.ShareAccepted(NewShareRecord(submission.Key, pool.getRound(), miner, worker.name, difficulty, job, now))
+	}
 
-	if err != nil {
-		log.Printf("error while running verify!\n")
-		return false
+	pool.lock()
+
+	pool.hashrate.add(diff, now)
+	miner.claimShare(diff, now, payout)
+	miner.lastSubmit = now
+	worker.claimShare(diff, now)
+	worker.lastShare = miner.lastSubmit
+
+	status := SHARE_ACCEPTED
+
+	if state.isStale() {
+		miner.staleShares.Add(miner.staleShares, big.NewInt(1))
+		status = SHARE_ACCEPTED_STALE
 	}
 
-	ret, err := response.GetBoolResult()
-	return err == nil && ret
-}
+	worker.vardiff.onShare(now)
+
+	poolLog.Debug("share accepted", "miner", getHexString(miner.address, 40), "worker", worker.name, "difficulty", difficulty,
+		"poolDifficulty", poolDifficulty, "hashrate", miner.getTrueHashrate(), "claimedHashrate", miner.getClaimedHashrate())
+
+	var candidate *BlockCandidate
+
+	//FOUND A BLOCK, DAWG
+	if result.isBlock(share) {
+		poolLog.Info("block found", "miner", getHexString(miner.address, 40), "worker", worker.name, "block", job.blockNumber, "nonce", getHexString(nonce, 16))
+		miner.blocks.Add(miner.blocks, big.NewInt(1))
+		candidate = NewBlockCandidate(job, nonce, result.mixDigest, miner, worker.name, pool.round, now)
+		pool.addSolution(candidate)
+	}
+
+	pool.unlock()
+
+	// geth, the web backend and the database are not waited on under the lock
+	if server != nil {
+		server.submitShare(miner, difficulty, payout)
+	}
+
+	if candidate == nil {
+		return status, nil, nil
+	}
 
-// assumes 5Eth block payout, calculates the worth of a share.
-func calculateSharePayout(difficulty, poolDifficulty *big.Int) float64 {
-    fiveEther := big.NewRat(1, 1)
-    fiveEther.SetFrac(big.NewInt(5000000000000000000), big.NewInt(1))
-    sharePrice := big.NewRat(1, 1)
-    sharePrice.SetFrac(difficulty, poolDifficulty)
-    sharePrice.Mul(sharePrice, fiveEther)
-    shareFloat, _ := sharePrice.Float64()
-
-    shareFloat *= (1.0 - HOUSE_RAKE)
-    return shareFloat
+	response, err := submitBlock(id, nonce, job.headerHash, result.mixDigest)
+	pool.recordSolution(candidate)
+	return status, response, err
 }
 
 // figure out if the submitted share is valid
-func eth_submitWork(request *RPCRequest, minerAddr *big.Int) (*RPCResponse, error) {
+func eth_submitWork(request *RPCRequest, minerAddr *big.Int, workerName string, ip string) (*RPCResponse, error) {
 	nonce, err := request.GetBigIntParam(0, 8)
 
 	if err != nil {
+		reportShare(ip, minerAddr, SHARE_MALFORMED)
 		return nil, NewRequestError("invalid RPC parameters(0) - Nonce", PUBLIC_ERROR)
 	}
 
-	_, err = request.GetBigIntParam(1, 32)
+	headerHash, err := request.GetBigIntParam(1, 32)
 
 	if err != nil {
+		reportShare(ip, minerAddr, SHARE_MALFORMED)
 		return nil, NewRequestError("invalid RPC parameters(1) - POW Hash", PUBLIC_ERROR)
 	}
 
 	mixHash, err := request.GetBigIntParam(2, 32)
 
 	if err != nil {
+		reportShare(ip, minerAddr, SHARE_MALFORMED)
 		return nil, NewRequestError("invalid RPC parameters(2) - digest", PUBLIC_ERROR)
 	}
 
+	pool.lock()
 	miner := pool.getMiner(minerAddr)
+	worker := miner.getWorker(workerName)
+	pool.unlock()
 
-	dt := time.Since(miner.lastSubmit).Seconds() + 0.1
-    difficulty := big.NewInt(0)
-	difficulty.Set(miner.getDifficulty())
-	diff := float64(difficulty.Int64())
-
-    miner.lastPost = time.Now()
-	blockNumber := pool.getBlockNumber()
-	headerHash := pool.getHeaderHash()
-
-	// block#, header hash, mix hash, nonce, difficulty
-	if verifyWork(blockNumber, headerHash, mixHash, nonce, difficulty) {
-		poolDifficulty := pool.getDifficulty()
+	state := pool.getBlockStateByHeader(headerHash)
 
-		hashrate := diff / dt
+	status, blockResponse, err := processShare(request.Id, miner, worker, state, nonce, mixHash)
 
-		log.Println("MINER: ", miner.shares.String(), " ", time.Since(miner.joinTime), "::", float64(miner.shares.Uint64())/time.Since(miner.joinTime).Seconds())
-        log.Println("HRATE: DT-", dt, " C-", miner.getClaimedHashrate().String(), " T-", miner.getTrueHashrate().String())
-
-		pool.lock()
-		defer pool.unlock()
-
-		// avoid duplicates by storing nonce in global map; if entry is not in map, then this is a new solution
-		_, exists := pool.submissions[nonce.String()]
-		if !exists {
-            payout := calculateSharePayout(difficulty, poolDifficulty)
-		    miner.claimShare(diff, dt, payout)
-			miner.hashrate.push(hashrate)
-	        miner.lastSubmit = time.Now()
-			pool.submissions[nonce.String()] = true
-
-            if server != nil {
-                server.submitShare(miner, big.NewInt(int64(payout)))
-            }
-		} else {
-			return NewRPCResult(request.Id, false), nil
-		}
-
-		miner.difficulty = miner.GetNewDifficulty()
+	// a verifier or geth failure is not held against the miner
+	if err == nil {
+		reportShare(ip, minerAddr, status)
+	} else {
+		countShare(status)
+	}
 
-		//FOUND A BLOCK, DAWG
-		log.Printf("POOL DIFFICULTY: " + poolDifficulty.String())
-		if verifyWork(blockNumber, headerHash, mixHash, nonce, poolDifficulty) {
-			log.Printf("BLOCK FOUND!!!!")
-            miner.blocks.Add(miner.blocks, big.NewInt(1))
-			return geth.SendRPCRequest(request)
-		}
+	if blockResponse != nil || err != nil {
+		return blockResponse, err
+	}
 
-		workLog.Printf("DT: %f\n", dt)
-		workLog.Printf("DIF: %f\n", diff)
-		workLog.Printf("HASHRATE: %f\n", miner.hashrate.getAverage())
-	} else {
-		log.Println("FAIL SUBMIT! ", getHexString(miner.address, 40))
-		return NewRPCResult(request.Id, false), nil
+	if status == SHARE_BUSY {
+		return NewRPCError(request.Id, -32000, ErrVerifyBusy.Error(), nil), nil
 	}
 
-	return NewRPCResult(request.Id, true), nil
+	return NewRPCResult(request.Id, shareAccepted(status)), nil
 }
 
 /*
  */
 
 // process miner's submitted hashrate. helpful for estimating share difficulty
-func eth_submitHashrate(request *RPCRequest, minerAddr *big.Int) (*RPCResponse, error) {
+func eth_submitHashrate(request *RPCRequest, minerAddr *big.Int, workerName string) (*RPCResponse, error) {
+	pool.lock()
 	miner := pool.getMiner(minerAddr)
+	trueHashrate := miner.getTrueHashrate()
+	pool.unlock()
 
 	claimedHashrate, err := request.GetBigIntParam(0, 32)
-
-	if miner != nil {
-		request.Params[0] = getHexString(miner.getTrueHashrate(), 32)
-	}
+	request.Params[0] = getHexString(trueHashrate, 32)
 
 	if err != nil {
 		return nil, errors.New("invalid RPC parameter(0) - " + err.Error())
@@ -366,17 +434,21 @@ func eth_submitHashrate(request *RPCRequest, minerAddr *big.Int) (*RPCResponse,
 		return nil, NewRequestError("hashrate submitted is invalid", PUBLIC_ERROR)
 	}
 
-    miner.lastPost = time.Now()
+	pool.lock()
+	miner.touch(workerName)
 	machine := miner.getMachine(id)
+	machine.worker = workerName
 	machine.claimedHashrate.Set(claimedHashrate)
 	machine.lastUpdate = pool.tick
+	pool.unlock()
 
 
 	return response, nil
 }
 
-// figure out how to handle the request, send it to geth if needed
-func proxyRequest(request *RPCRequest, minerAddr *big.Int) (*RPCResponse, error) {
+// figure out how to handle the request, send it to geth if needed.
+// ip is the miner's address, shares are counted against it for bans
+func proxyRequest(request *RPCRequest, minerAddr *big.Int, workerName string, ip string) (*RPCResponse, error) {
 	if !methodIsValid(request.Method) {
 		return nil, NewRequestError("invalid RPC method: "+request.Method, PUBLIC_ERROR)
 	}
@@ -389,11 +461,11 @@ func proxyRequest(request *RPCRequest, minerAddr *big.Int) (*RPCResponse, error)
     case "eth_ping":
         return NewRPCResult(request.Id, true), nil
 	case "eth_getWork":
-		return eth_getWork(request, minerAddr)
+		return eth_getWork(request, minerAddr, workerName)
 	case "eth_submitWork":
-		return eth_submitWork(request, minerAddr)
+		return eth_submitWork(request, minerAddr, workerName, ip)
 	case "eth_submitHashrate":
-		return eth_submitHashrate(request, minerAddr)
+		return eth_submitHashrate(request, minerAddr, workerName)
     case "eth_alive":
         return NewRPCResult(request.Id, true), nil
 	default:
@@ -401,62 +473,85 @@ func proxyRequest(request *RPCRequest, minerAddr *big.Int) (*RPCResponse, error)
 	}
 }
 
+// turns away banned and rate limited clients; false if the request was answered
+func checkBans(w http.ResponseWriter, ip string, minerAddr *big.Int) bool {
+	err := bans.Allow(ip, minerAddr, time.Now())
+
+	if err == nil {
+		return true
+	}
+
+	if err == ErrBanned {
+		w.WriteHeader(http.StatusForbidden)
+	} else {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+
+	writeResponse(w, NewRPCError(1, -32000, err.Error(), nil))
+	return false
+}
+
 // main HTTP entry point
 func httpHandler(w http.ResponseWriter, r *http.Request) {
-    if SHUTDOWN {
-        return
-    }
+	ip := getRemoteIP(r.RemoteAddr)
+
+	if bans != nil && !checkBans(w, ip, nil) {
+		return
+	}
 
 	err := r.ParseForm()
 
 	if err != nil {
-		log.Printf("ERROR: invalid http request form - " + err.Error() + "\n")
+		poolLog.Warn("invalid http request form", "ip", ip, "err", err)
 		rpcerr := NewRPCError(1, -32602, "invalid http request", nil)
 		writeResponse(w, rpcerr)
 		return
 	}
 
+	// miners log in with ?miner=0xaddr.rigname, ?miner=0xaddr&worker=rigname or /0xaddr/rigname
 	minerAddrStr := r.FormValue("miner")
 
 	if len(minerAddrStr) <= 0 {
-		log.Printf("WARNING attempt to mine to NULL - " + r.URL.String() + "\n")
+		minerAddrStr = strings.Trim(r.URL.Path, "/")
+	}
+
+	if len(minerAddrStr) <= 0 {
+		poolLog.Warn("attempt to mine without a miner address", "ip", ip, "url", r.URL.String())
 		rpcerr := NewRPCError(1, -32602, "invalid or missing miner id", nil)
 		writeResponse(w, rpcerr)
 		return
 	}
 
-	minerAddr, err := parseHex(minerAddrStr, 0)
+	if workerStr := r.FormValue("worker"); len(workerStr) > 0 {
+		minerAddrStr += "." + workerStr
+	}
+
+	minerAddr, workerName, err := parseMinerLogin(minerAddrStr)
 
 	if err != nil {
-		log.Printf("ERROR getting miner form value - " + err.Error() + "\n")
+		poolLog.Warn("invalid miner login", "ip", ip, "login", minerAddrStr, "err", err)
 		rpcerr := NewRPCError(1, -32602, "could not retrieve miner id from request", nil)
 		writeResponse(w, rpcerr)
 		return
 	}
 
+	if bans != nil && bans.IsBanned(ip, minerAddr, time.Now()) {
+		w.WriteHeader(http.StatusForbidden)
+		writeResponse(w, NewRPCError(1, -32000, ErrBanned.Error(), nil))
+		return
+	}
+
 	bodyReader := bufio.NewReader(r.Body)
 	bytes, _ := ioutil.ReadAll(bodyReader)
 	request := RPCRequest{}
 	json.Unmarshal(bytes, &request)
 
-	if debugRPC {
-		log.Printf("\n\n<<----- REQUEST -----\n")
-		log.Printf(string(bytes))
-	}
+	poolLog.Debug("request", "miner", getHexString(minerAddr, 40), "worker", workerName, "ip", ip, "body", string(bytes))
 
-	if debugRequest {
-		workLog.Printf("REQ FROM " + minerAddrStr + "\n")
-		workLog.Printf(string(bytes))
-	}
-
-	if len(minerAddrStr) <= 0 {
-		log.Printf("NULLMSG: " + string(bytes) + "\n")
-	}
-
-	response, err := proxyRequest(&request, minerAddr)
+	response, err := proxyRequest(&request, minerAddr, workerName, ip)
 
 	if err != nil {
-		log.Printf("ERROR proxying request - " + err.Error() + "\n")
+		poolLog.Error("could not proxy request", "miner", getHexString(minerAddr, 40), "worker", workerName, "method", request.Method, "err", err)
 		rpcerr := NewRPCError(1, -32602, "could not process request - server side error", nil)
 		writeResponse(w, rpcerr)
 		return
@@ -476,7 +571,7 @@ func getBoundaryCondition(minerDifficulty *big.Int) *big.Int {
 	difficulty := minerDifficulty
 
 	if difficulty.Cmp(zero) == 0 {
-        difficulty = big.NewInt(DEFAULT_HASHRATE_ESTIMATE * SHARE_TIME)
+        difficulty = getVardiffStartDifficulty(DEFAULT_SHARE_TIME)
 	}
 
 	ret := big.NewInt(1)
@@ -502,7 +597,7 @@ func (secretCommand) ServeHTTP(response http.ResponseWriter, request *http.Reque
 	eth := big.NewInt(int64(cmd.Magic))
 	mul := big.NewInt(1)
 
-	fmt.Printf("MAGIC! %f\n", cmd.Magic)
+	mainLog.Info("magic", "eth", cmd.Magic)
 	mul.SetString(weiToEth, 10)
 	eth.Mul(eth, mul)
 
@@ -516,79 +611,192 @@ func main() {
 	flag_web := flag.Bool("web", false, "Enable web backend communication")
 	flag_all := flag.Bool("all", false, "Enable all features")
 	flag_cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
+	flag_config := flag.String("config", "", "json settings file (ONEETHER_* environment variables override it)")
 	flag.Parse()
 
-	wait := make(chan bool)
-	sigkill = make(chan os.Signal)
-	signal.Notify(sigkill, os.Interrupt)
+	err := configureLogging(LOG_LEVEL, LOG_LEVELS, LOG_FORMAT)
+
+	if err != nil {
+		mainLog.Fatal("invalid log settings", "err", err)
+	}
+
+	settings, err := LoadSettings(*flag_config, os.LookupEnv)
+
+	if err != nil {
+		mainLog.Fatal("invalid settings", "file", *flag_config, "err", err)
+	}
+
+	loggingSettingsListener{}.ApplySettings(settings)
+	reloader := NewSettingsReloader(*flag_config, os.LookupEnv, settings)
+	reloader.RegisterListener(loggingSettingsListener{})
 
 	config = NewConfig(*flag_scanner, *flag_pool, *flag_pay, *flag_web, *flag_all)
+	lifecycle := NewLifecycle(time.Duration(SHUTDOWN_TIMEOUT) * time.Second)
+
+	if len(settings.MetricsPort) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		mux.HandleFunc("/log", serveLogLevels)
+		lifecycle.Serve("metrics", &http.Server{Addr: net.JoinHostPort(settings.MetricsIP, settings.MetricsPort), Handler: mux})
+	}
 
 	if *flag_cpuprofile != "" {
 		f, err := os.Create(*flag_cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			mainLog.Fatal("could not create cpu profile", "err", err)
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
-	db := NewMongoDB("one")
-	pool = newMinerPool(db)
-	geth = NewGeth(GETH_IP, GETH_PORT)
+	db := NewMongoDB(settings.MongoHost, settings.MongoDB)
+	pool = NewMinerPool(db, settings)
+	geth = NewGeth(settings.GethIP, settings.GethPort)
+	verifier = NewVerifyPool(newShareVerifier(settings.ConfirmAddr), VERIFY_WORKERS, VERIFY_QUEUE_SIZE)
 
-	workFile, _ := os.Create("work.log")
-	workLog = log.New(workFile, "", log.Ldate|log.Ltime)
+	scheme, err := NewRewardScheme(settings.RewardScheme, settings.HouseRake)
 
-	statusPoll := NewStatusPoll(geth, BLOCK_PERSIST_FILENAME)
+	if err != nil {
+		mainLog.Fatal("invalid reward scheme", "scheme", settings.RewardScheme, "err", err)
+	}
 
-	log.Println("starting...")
+	blockRewards, err := NewBlockRewardCalculator(geth, settings.BlockRewardForks)
+
+	if err != nil {
+		mainLog.Fatal("invalid block reward forks", "err", err)
+	}
+
+	rewards = NewRoundAccountant(scheme, NewShareLog(db), blockRewards)
+	rewards.RegisterListener(NewDatabaseCreditListener(db))
+
+	ledger = NewLedger(db)
+	rewards.RegisterListener(ledger)
+	minerSettings = NewMinerSettingsStore(db, settings)
+
+	work = NewWorkManager(geth)
+	work.RegisterListener(pool)
+
+	statusPoll := NewStatusPoll(geth, settings)
+	var blocks *BlockCandidateProcessor
+
+	mainLog.Info("starting", "scanner", config.scanner, "pool", config.pool, "pay", config.pay, "web", config.web)
 
     // launches block chain scanner thread
 	if config.scanner {
 		bp := NewDatabaseBlockProcessor(db)
 		statusPoll.RegisterBlockProcessor(bp)
-        log.Println("registered block processor")
+        scannerLog.Info("registered block processor")
 	}
 
     // launches payment thread
 	if config.pay {
-		bu := NewBalanceUpdater(geth)
+		// only the payment instance follows block candidates, so maturity is handled once
+		blocks = NewBlockCandidateProcessor(db, geth)
+		blocks.RegisterListener(rewards)
+		statusPoll.RegisterBlockProcessor(blocks)
+		checkLedger(ledger)
 
-		statusPoll.RegisterBlockProcessor(bu)
-
-		pay = NewPaymentProcessor(geth, PAY_PERSIST_FILENAME)
+		pay = NewPaymentProcessor(geth, settings)
         dbproc := NewDatabasePaymentProcessor(db)
         pay.RegisterListener(dbproc)
-        log.Println("registered db payment listener")
-		go pay.Start(wait)
-		defer func() { <-wait }()
-	}
+        payLog.Info("registered db payment listener")
+		pay.RegisterListener(MetricsPaymentListener{})
+		metrics.RegisterCollector(pay.collectMetrics)
 
-	go statusPoll.Start(wait)
-	defer func() { <-wait }()
+		payouts := NewPayoutScheduler(ledger, pay, minerSettings, settings)
+		pay.RegisterListener(payouts)
+		reloader.RegisterListener(payouts)
+		lifecycle.Go("payouts", payouts.Start)
+		lifecycle.Go("pay", pay.Start)
+		lifecycle.Serve("pay rpc", pay.getServer())
+	}
 
     // launches pool thread
 	if config.pool {
-		go pool.start(wait)
-		defer func() { <-wait }()
-		http.HandleFunc("/", httpHandler)
-		go http.ListenAndServe(":7777", secretCommand{})
-		go http.ListenAndServe(":"+LISTEN_PORT, nil)
+		bans, err = NewBanManager(settings, BAN_PERSIST_FILENAME)
+
+		if err != nil {
+			mainLog.Fatal("could not load bans", "err", err)
+		}
+
+		reloader.RegisterListener(bans)
+
+		metrics.RegisterCollector(pool.collectMetrics)
+		metrics.RegisterCollector(verifier.collectMetrics)
+
+		lifecycle.Go("pool", pool.start)
+		lifecycle.Go("share log", rewards.Start)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", httpHandler)
+		mux.Handle("/settings", minerSettings)
+		lifecycle.Serve("http", &http.Server{Addr: ":" + settings.ListenPort, Handler: mux})
+
+		if len(settings.MagicPort) > 0 {
+			lifecycle.Serve("secret http", &http.Server{Addr: ":" + settings.MagicPort, Handler: secretCommand{}})
+		}
+
+		if len(settings.APIPort) > 0 {
+			api := NewStatsAPI(pool, db, ledger, minerSettings)
+			lifecycle.Go("api", api.Start)
+			lifecycle.Serve("api http", &http.Server{Addr: ":" + settings.APIPort, Handler: api})
+		}
+
+		if len(settings.StratumPort) > 0 {
+			stratum := NewStratumServer(settings.StratumPort)
+			work.RegisterListener(stratum)
+			lifecycle.Go("stratum", stratum.Start)
+		}
+
+		if len(settings.EthProxyPort) > 0 {
+			ethproxy := NewEthProxyServer(settings.EthProxyPort)
+			work.RegisterListener(ethproxy)
+			lifecycle.Go("ethproxy", ethproxy.Start)
+		}
+
+		// listeners are all registered; start polling geth
+		lifecycle.Go("work", work.Start)
+
+		// shares still queued are credited before the miner stats are written
+		lifecycle.OnStop("verifier", verifier.Close)
+		lifecycle.OnStop("share log", rewards.Close)
+		lifecycle.OnStop("miner stats", pool.Close)
 	}
 
     // launches web payment listener thread
     if config.web {
-        server = NewServer()
+        server = NewServer(settings)
 
         if pay != nil {
             webproc := NewWebPaymentProcessor(server)
             pay.RegisterListener(webproc)
-            log.Println("registered web payment listener")
+            webLog.Info("registered web payment listener")
+        }
+
+        if blocks != nil {
+            blocks.RegisterListener(NewWebBlockListener(server))
+            webLog.Info("registered web block listener")
         }
+
+        reloader.RegisterListener(server)
     }
 
-	<-sigkill
-	SHUTDOWN = true
-	log.Println("exiting")
+	if pay != nil {
+		lifecycle.OnStop("payments", pay.Close)
+	}
+
+	// block listeners are all registered
+	lifecycle.Go("scanner", statusPoll.Start)
+
+	reloader.RegisterListener(pool)
+	reloader.RegisterListener(rewards)
+	reloader.RegisterListener(minerSettings)
+	lifecycle.Go("reload", reloader.Start)
+
+	mainLog.Info("got signal", "signal", waitForSignal())
+
+	if lifecycle.Shutdown() != nil {
+		mainLog.Error("did not shut down cleanly")
+	}
+
+	mainLog.Info("exiting")
 }
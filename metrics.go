@@ -0,0 +1,221 @@
+package main
+
+//
+// prometheus metrics
+// counters, gauges and summaries (sum and count only) kept in memory and
+// written in the prometheus text format on Settings.MetricsPort/metrics. values that
+// are cheaper to read on demand (connected miners, queue depths) are set by
+// collectors when the metrics are scraped
+//
+
+import "bytes"
+import "fmt"
+import "io"
+import "math/big"
+import "net/http"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	METRIC_COUNTER = "counter"
+	METRIC_GAUGE   = "gauge"
+	METRIC_SUMMARY = "summary"
+)
+
+type metricFamily struct {
+	name   string
+	kind   string
+	help   string
+	values map[string]float64 // by suffix and labels, e.g. `_sum{method="eth_getWork"}`
+}
+
+type Metrics struct {
+	lock       *sync.Mutex
+	families   map[string]*metricFamily
+	collectors []func(*Metrics)
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	self := &Metrics{lock: &sync.Mutex{}, families: make(map[string]*metricFamily)}
+
+	self.Describe("oneether_shares_total", METRIC_COUNTER, "Submitted shares by outcome.")
+	self.Describe("oneether_verify_seconds", METRIC_SUMMARY, "Time from submitting a share to its verify result.")
+	self.Describe("oneether_verify_queue_depth", METRIC_GAUGE, "Shares waiting to be verified.")
+	self.Describe("oneether_geth_requests_total", METRIC_COUNTER, "Geth RPC requests by method.")
+	self.Describe("oneether_geth_errors_total", METRIC_COUNTER, "Failed geth RPC requests by method.")
+	self.Describe("oneether_geth_request_seconds", METRIC_SUMMARY, "Geth RPC request latency by method.")
+	self.Describe("oneether_miners", METRIC_GAUGE, "Connected miners.")
+	self.Describe("oneether_workers", METRIC_GAUGE, "Connected workers.")
+	self.Describe("oneether_pool_hashrate", METRIC_GAUGE, "Pool hashrate over each hashrate window, in hashes a second.")
+	self.Describe("oneether_scanner_head_block", METRIC_GAUGE, "Latest block number reported by geth.")
+	self.Describe("oneether_scanner_processed_block", METRIC_GAUGE, "Last block processed by the chain scanner.")
+	self.Describe("oneether_scanner_lag_blocks", METRIC_GAUGE, "Blocks between the chain head and the last processed block.")
+	self.Describe("oneether_payments_total", METRIC_COUNTER, "Payment processor events.")
+	self.Describe("oneether_payments_pending", METRIC_GAUGE, "Payments waiting to be sent or verified.")
+	self.Describe("oneether_wallet_balance_ether", METRIC_GAUGE, "Balance of the pool wallet.")
+
+	return self
+}
+
+// pairs of label names and values as `{name="value",...}`
+func getMetricLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escape.Replace(labels[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// caller holds the lock
+func (self *Metrics) getFamily(name, kind string) *metricFamily {
+	family, ok := self.families[name]
+
+	if !ok {
+		family = &metricFamily{name: name, kind: kind, values: make(map[string]float64)}
+		self.families[name] = family
+	}
+
+	return family
+}
+
+func (self *Metrics) Describe(name, kind, help string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	family := self.getFamily(name, kind)
+	family.kind = kind
+	family.help = help
+}
+
+func (self *Metrics) Add(name string, value float64, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.getFamily(name, METRIC_COUNTER).values[getMetricLabels(labels)] += value
+}
+
+func (self *Metrics) Inc(name string, labels ...string) {
+	self.Add(name, 1, labels...)
+}
+
+func (self *Metrics) Set(name string, value float64, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.getFamily(name, METRIC_GAUGE).values[getMetricLabels(labels)] = value
+}
+
+func (self *Metrics) SetBig(name string, value *big.Int, labels ...string) {
+	f, _ := new(big.Float).SetInt(value).Float64()
+	self.Set(name, f, labels...)
+}
+
+// adds an observation to a summary
+func (self *Metrics) Observe(name string, value float64, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	family := self.getFamily(name, METRIC_SUMMARY)
+	key := getMetricLabels(labels)
+	family.values["_sum"+key] += value
+	family.values["_count"+key]++
+}
+
+func (self *Metrics) ObserveSince(name string, start time.Time, labels ...string) {
+	self.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// collectors set gauges right before the metrics are written
+func (self *Metrics) RegisterCollector(collector func(*Metrics)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.collectors = append(self.collectors, collector)
+}
+
+func (self *Metrics) Write(w io.Writer) {
+	self.lock.Lock()
+	collectors := self.collectors
+	self.lock.Unlock()
+
+	for _, collector := range collectors {
+		collector(self)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	names := make([]string, 0, len(self.families))
+	for name := range self.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := self.families[name]
+
+		if len(family.values) == 0 {
+			continue
+		}
+
+		if len(family.help) > 0 {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, family.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.kind)
+
+		keys := make([]string, 0, len(family.values))
+		for key := range family.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %v\n", name, key, family.values[key])
+		}
+	}
+}
+
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	out := &bytes.Buffer{}
+	self.Write(out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+/*
+ * counts payment processor events
+ */
+type MetricsPaymentListener struct {
+}
+
+func (MetricsPaymentListener) PaymentAdded(*PendingTransaction) {
+	metrics.Inc("oneether_payments_total", "event", "added")
+}
+
+func (MetricsPaymentListener) PaymentSent(*PendingTransaction) {
+	metrics.Inc("oneether_payments_total", "event", "sent")
+}
+
+func (MetricsPaymentListener) PaymentResent(*PendingTransaction) {
+	metrics.Inc("oneether_payments_total", "event", "resent")
+}
+
+func (MetricsPaymentListener) PaymentVerified(*PendingTransaction) {
+	metrics.Inc("oneether_payments_total", "event", "verified")
+}
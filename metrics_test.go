@@ -0,0 +1,82 @@
+package main
+
+import "bytes"
+import "math/big"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	m.Inc("oneether_shares_total", "status", "accepted")
+	m.Inc("oneether_shares_total", "status", "accepted")
+	m.Inc("oneether_shares_total", "status", "invalid")
+	m.Observe("oneether_geth_request_seconds", 0.25, "method", "eth_getWork")
+	m.Observe("oneether_geth_request_seconds", 0.5, "method", "eth_getWork")
+	m.Set("test_label_escaping", 1, "name", "a\"b\\c")
+	m.RegisterCollector(func(m *Metrics) { m.Set("oneether_miners", 3) })
+
+	out := &bytes.Buffer{}
+	m.Write(out)
+	text := out.String()
+
+	expected := []string{
+		"# HELP oneether_shares_total Submitted shares by outcome.\n# TYPE oneether_shares_total counter\n",
+		"oneether_shares_total{status=\"accepted\"} 2\n",
+		"oneether_shares_total{status=\"invalid\"} 1\n",
+		"# TYPE oneether_geth_request_seconds summary\n",
+		"oneether_geth_request_seconds_count{method=\"eth_getWork\"} 2\n",
+		"oneether_geth_request_seconds_sum{method=\"eth_getWork\"} 0.75\n",
+		"oneether_miners 3\n",
+		"# TYPE test_label_escaping gauge\ntest_label_escaping{name=\"a\\\"b\\\\c\"} 1\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(text, line) {
+			t.Error("expected ", line, " in\n", text)
+		}
+	}
+
+	// families nobody touched are left out
+	if strings.Contains(text, "oneether_wallet_balance_ether") {
+		t.Error("expected empty families to be skipped")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.SetBig("oneether_scanner_head_block", big.NewInt(100))
+	m.ObserveSince("oneether_verify_seconds", time.Now())
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), "oneether_scanner_head_block 100\n") {
+		t.Error("expected metrics, found ", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/other", nil))
+
+	if recorder.Code != 404 {
+		t.Error("expected other paths to be not found, found ", recorder.Code)
+	}
+}
+
+func TestShareMetrics(t *testing.T) {
+	before := metrics
+	metrics = NewMetrics()
+	defer func() { metrics = before }()
+
+	reportShare("10.0.0.1", big.NewInt(1), SHARE_REJECTED_DUPLICATE)
+	reportShare("10.0.0.1", big.NewInt(1), SHARE_MALFORMED)
+
+	out := &bytes.Buffer{}
+	metrics.Write(out)
+
+	if !strings.Contains(out.String(), "oneether_shares_total{status=\"duplicate\"} 1\n") ||
+		!strings.Contains(out.String(), "oneether_shares_total{status=\"malformed\"} 1\n") {
+		t.Error("expected share outcomes to be counted, found\n", out.String())
+	}
+}
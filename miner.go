@@ -4,44 +4,47 @@ package main
 // manages miner information
 //
 
-import "log"
+import "errors"
 import "math/big"
+import "regexp"
+import "strings"
 import "time"
 
+var minerAddressPattern = regexp.MustCompile("^(0x)?[0-9a-fA-F]{40}$")
+var workerNamePattern = regexp.MustCompile("^[0-9a-zA-Z_-]+$")
 
-// the queues are no longer used.
-// it turns out that it is more accurate to estimate
-// hashrate using the current easing technique
-const QUEUE_LEN = 8
+/*
+ * splits a miner login ("0xaddr", "0xaddr.rigname" or "0xaddr/rigname")
+ * into the miner address and the worker name
+ */
+func parseMinerLogin(login string) (*big.Int, string, error) {
+	addr := login
+	worker := DEFAULT_WORKER_NAME
 
-type AverageQueue struct {
-	entries []float64
-}
+	if i := strings.IndexAny(login, "./"); i >= 0 {
+		addr = login[:i]
+		worker = login[i+1:]
+	}
 
-func (self *AverageQueue) push(val float64) {
-	if len(self.entries) >= QUEUE_LEN {
-		copy(self.entries[:len(self.entries)-1], self.entries[1:len(self.entries)])
-		self.entries[QUEUE_LEN-1] = val
-	} else {
-		self.entries = append(self.entries, val)
+	if !minerAddressPattern.MatchString(addr) {
+		return nil, "", errors.New("invalid miner address: " + addr)
 	}
-}
 
-func (self *AverageQueue) getAverage() float64 {
-	var sum float64 = 0
-	for i := 0; i < len(self.entries); i++ {
-		sum += self.entries[i]
+	if len(worker) == 0 {
+		worker = DEFAULT_WORKER_NAME
 	}
 
-	if len(self.entries) > 0 {
-		sum /= float64(len(self.entries))
+	if len(worker) > MAX_WORKER_NAME || !workerNamePattern.MatchString(worker) {
+		return nil, "", errors.New("invalid worker name: " + worker)
 	}
 
-	return sum
+	ret, err := parseHex(addr, 40)
+	return ret, worker, err
 }
 
 type MinerMachine struct {
 	id              *big.Int  // id of the machine
+	worker          string    // name of the worker that reported this machine
 	claimedHashrate *big.Int  // hashrate the client claims to have
 	lastUpdate      time.Time // last time since hash count update
 }
@@ -56,98 +59,140 @@ func (self *MinerMachine) update(dt int64) {
 	//self.hashes.Add(self.hashes, hashes)
 }
 
-type Miner struct {
-    owner      *MinerPool
-	machines   map[string]*MinerMachine
-	address    *big.Int  // Miner address
-    payout     *big.Int  // amount we have paid this miner (in wei)
-	hashes     *big.Int  // hashes since last commit
-	shares     *big.Int  // shares submitted since join (or reset)
-    blocks     *big.Int  // mined blocks
-	difficulty *big.Int  // current miner difficulty; updates on 'submit'
-    onlineTime time.Duration // time this miner has been online (updated each mongo write)
-	joinTime   time.Time // time the miner is first seen
-    lastStat   time.Time // last time we updated the stats in the database
-	lastPost   time.Time // last time since we sent status update to server
-	lastSubmit time.Time // time since last valid submit
-	hashrate   AverageQueue
-    ehashrate float64
+/*
+ * a named rig mining to a miner address ("0xaddr.rigname")
+ */
+type MinerWorker struct {
+	name      string
+	shares    *big.Int  // shares accepted from this worker
+	hashes    *big.Int  // hashes done by this worker
+	hashrate  *HashrateWindow
+	vardiff   *Vardiff  // share difficulty of this worker
+	joinTime  time.Time // time the worker is first seen
+	lastShare time.Time // time of the last accepted share
+	lastSeen  time.Time // last time the worker made any request
 }
 
-func MinerNew(owner *MinerPool, address *big.Int, now time.Time) *Miner {
-	defaultDifficulty := big.NewInt(DEFAULT_HASHRATE_ESTIMATE)
-	defaultDifficulty.Mul(defaultDifficulty, big.NewInt(int64(SHARE_TIME)))
+func NewMinerWorker(address *big.Int, name string, difficulty *big.Int, shareTime float64, bounds *VardiffBounds, now time.Time) *MinerWorker {
+	return &MinerWorker{name: name,
+		shares:    big.NewInt(0),
+		hashes:    big.NewInt(0),
+		hashrate:  NewHashrateWindow(now),
+		vardiff:   NewVardiff(getHexString(address, 40)+"."+name, difficulty, shareTime, bounds, now),
+		joinTime:  now,
+		lastShare: now,
+		lastSeen:  now}
+}
 
-	return &Miner{machines: make(map[string]*MinerMachine),
-		address:    address,
-        payout:     big.NewInt(0),
-		hashes:     big.NewInt(0),
-		shares:     big.NewInt(0),
-        blocks:     big.NewInt(0),
-		difficulty: defaultDifficulty,
-        onlineTime: 0,
-		joinTime:   now,
-        lastStat:   now,
-		lastPost:   now,
-		lastSubmit: now,
-        ehashrate: DEFAULT_HASHRATE_ESTIMATE,
-	}
+func (self *MinerWorker) claimShare(diff float64, now time.Time) {
+	self.hashrate.add(diff, now)
+	self.shares.Add(self.shares, big.NewInt(1))
+	self.hashes.Add(self.hashes, big.NewInt(int64(diff)))
+}
+
+func (self *MinerWorker) getDifficulty() *big.Int {
+	return self.vardiff.getDifficulty()
+}
+
+func (self *MinerWorker) getTrueHashrate() *big.Int {
+	return self.hashrate.getCurrent(time.Now())
 }
 
-func (miner *Miner) GetNewDifficulty() *big.Int {
-	defaultHashrate := big.NewInt(DEFAULT_HASHRATE_ESTIMATE)
-	newDifficulty := big.NewInt(0)
+func (self *MinerWorker) getStat() *WorkerStat {
+	now := time.Now()
+	return &WorkerStat{Name: self.name,
+		Shares:     self.shares.Uint64(),
+		Hashes:     self.hashes.String(),
+		Hashrate:   self.hashrate.getCurrent(now).String(),
+		Hashrates:  self.hashrate.getStats(now),
+		Difficulty: self.getDifficulty().String(),
+		LastShare:  self.lastShare,
+		LastSeen:   self.lastSeen,
+
+		ClaimedHashrate: "0"}
+}
 
-    claimHashrate := miner.getClaimedHashrate()
-	trueHashrate := miner.getTrueHashrate()
+type Miner struct {
+	owner         *MinerPool
+	machines      map[string]*MinerMachine
+	workers       map[string]*MinerWorker
+	workerStats   map[string]*WorkerStat // persisted worker stats, including workers that are offline
+	address       *big.Int               // Miner address
+	payout        *big.Int               // amount credited to, or expected by, this miner for shares (in wei)
+	hashes        *big.Int               // hashes since last commit
+	shares        *big.Int               // shares submitted since join (or reset)
+	staleShares   *big.Int               // stale shares credited within the grace window
+	staleRejected *big.Int               // stale shares that were turned away
+	blocks        *big.Int               // mined blocks
+	onlineTime    time.Duration          // time this miner has been online (updated each mongo write)
+	joinTime      time.Time              // time the miner is first seen
+	lastStat      time.Time              // last time we updated the stats in the database
+	lastPost      time.Time              // last time since we sent status update to server
+	lastSubmit    time.Time              // time since last valid submit
+	hashrate      *HashrateWindow        // accepted share difficulty over time
+}
 
-    if claimHashrate.Cmp(defaultHashrate) > 0 {
-		newDifficulty.Set(claimHashrate)
-    } else if trueHashrate.Cmp(defaultHashrate) > 0 {
-		newDifficulty.Set(trueHashrate)
-	} else {
-		newDifficulty.Set(defaultHashrate)
+func MinerNew(owner *MinerPool, address *big.Int, now time.Time) *Miner {
+	return &Miner{owner: owner,
+		machines:      make(map[string]*MinerMachine),
+		workers:       make(map[string]*MinerWorker),
+		workerStats:   make(map[string]*WorkerStat),
+		address:       address,
+		payout:        big.NewInt(0),
+		hashes:        big.NewInt(0),
+		shares:        big.NewInt(0),
+		staleShares:   big.NewInt(0),
+		staleRejected: big.NewInt(0),
+		blocks:        big.NewInt(0),
+		onlineTime:    0,
+		joinTime:      now,
+		lastStat:      now,
+		lastPost:      now,
+		lastSubmit:    now,
+		hashrate:      NewHashrateWindow(now),
 	}
-	newDifficulty.Mul(newDifficulty, big.NewInt(int64(SHARE_TIME)))
-	return newDifficulty
 }
 
 func (m *Miner) removeMachine(key string) {
     delete(m.machines, key)
 }
 
+func (m *Miner) removeWorker(key string) {
+	if worker, ok := m.workers[key]; ok {
+		m.workerStats[key] = worker.getStat()
+	}
+	delete(m.workers, key)
+}
+
 func (m *Miner) Update(dt int64) {
 	for key, machine := range m.machines {
 		machine.update(dt)
 
 		if pool.tick.Sub(machine.lastUpdate) > time.Second * MACHINE_TIMEOUT {
-            log.Println("removing idle machine - ", key)
+            poolLog.Info("removing idle machine", "miner", getHexString(m.address, 40), "machine", key)
 			m.removeMachine(key)
 		}
 	}
+
+	for key, worker := range m.workers {
+		if pool.tick.Sub(worker.lastSeen) > time.Second*WORKER_TIMEOUT {
+			poolLog.Info("removing idle worker", "miner", getHexString(m.address, 40), "worker", key)
+			m.removeWorker(key)
+		} else {
+			worker.vardiff.update(pool.tick)
+		}
+	}
 }
 
 /*
  * used for hashrate calculation and statistics; not payments
  */
-func (m *Miner) claimShare(diff, dt, payout float64) {
-    clamp := func(a, b, val float64) float64 {
-        if val < a { return a }
-        if val > b { return b }
-        return val
-    }
-
-    MIN_TIME := SHARE_TIME * 0.2
-    MAX_TIME := SHARE_TIME * 2.0
-    hashrate := diff / (2.0 * clamp(MIN_TIME, MAX_TIME, dt))
-
-
-    DAMPING_FACTOR := 0.3
-    m.ehashrate += ((hashrate - m.ehashrate) * DAMPING_FACTOR)
+func (m *Miner) claimShare(diff float64, now time.Time, payout *big.Int) {
+	m.hashrate.add(diff, now)
 
 	m.shares.Add(m.shares, big.NewInt(1))
-    m.hashes.Add(m.hashes, big.NewInt(int64(diff)))
-    m.payout.Add(m.payout, big.NewInt(int64(payout)))
+	m.hashes.Add(m.hashes, big.NewInt(int64(diff)))
+	m.payout.Add(m.payout, payout)
 }
 
 func (m *Miner) getMachine(id *big.Int) *MinerMachine {
@@ -155,7 +200,7 @@ func (m *Miner) getMachine(id *big.Int) *MinerMachine {
     machine, ok := m.machines[idStr]
 
     if !ok {
-        log.Println("new machine joined: ", idStr)
+        poolLog.Info("new machine joined", "miner", getHexString(m.address, 40), "machine", idStr)
         machine = NewMinerMachine(id, big.NewInt(0), m.lastSubmit)
         m.machines[idStr] = machine
     }
@@ -163,6 +208,71 @@ func (m *Miner) getMachine(id *big.Int) *MinerMachine {
     return machine
 }
 
+// get a worker by name, creating it (with any persisted counts) on first sight
+func (m *Miner) getWorker(name string) *MinerWorker {
+	worker, ok := m.workers[name]
+
+	if !ok {
+		poolLog.Info("new worker joined", "miner", getHexString(m.address, 40), "worker", name)
+		difficulty := m.getWorkerStartDifficulty()
+		stat, ok := m.workerStats[name]
+
+		// a returning worker picks up where vardiff left it
+		if ok && len(stat.Difficulty) > 0 {
+			difficulty.SetString(stat.Difficulty, 10)
+		}
+
+		worker = NewMinerWorker(m.address, name, difficulty, m.getShareTime(), m.getVardiffBounds(), time.Now())
+
+		if ok {
+			worker.shares = big.NewInt(int64(stat.Shares))
+			worker.hashes.SetString(stat.Hashes, 10)
+		}
+
+		m.workers[name] = worker
+	}
+
+	return worker
+}
+
+// mark the miner and one of its workers as alive
+func (m *Miner) touch(workerName string) *MinerWorker {
+	worker := m.getWorker(workerName)
+	m.lastPost = time.Now()
+	worker.lastSeen = m.lastPost
+	return worker
+}
+
+// all known workers, live ones first and then the persisted offline ones
+func (m *Miner) getWorkerStats() []*WorkerStat {
+	ret := make([]*WorkerStat, 0, len(m.workerStats)+len(m.workers))
+
+	for _, worker := range m.workers {
+		stat := worker.getStat()
+		stat.ClaimedHashrate = m.getWorkerClaimedHashrate(worker.name).String()
+		ret = append(ret, stat)
+	}
+
+	for key, stat := range m.workerStats {
+		if _, ok := m.workers[key]; !ok {
+			ret = append(ret, stat)
+		}
+	}
+
+	return ret
+}
+
+// what the machines reported by the worker claim in eth_submitHashrate
+func (m *Miner) getWorkerClaimedHashrate(name string) *big.Int {
+	ret := big.NewInt(0)
+	for _, machine := range m.machines {
+		if machine.worker == name {
+			ret.Add(ret, machine.claimedHashrate)
+		}
+	}
+	return ret
+}
+
 func (self *Miner) getTotalHashes() *big.Int {
 	return self.hashes
 }
@@ -180,16 +290,60 @@ func (m *Miner) getClaimedHashrate() *big.Int {
 	return ret
 }
 
+// accepted share difficulty a second over the shortest of HASHRATE_WINDOWS
 func (m *Miner) getTrueHashrate() *big.Int {
-	// ret := big.NewInt(int64(m.hashrate.getAverage()))
-    ret := big.NewInt(int64(m.ehashrate))
-	return ret
+	return m.hashrate.getCurrent(time.Now())
+}
+
+// seconds between shares that vardiff aims for
+func (m *Miner) getShareTime() float64 {
+	if m.owner == nil {
+		return DEFAULT_SHARE_TIME
+	}
+	return m.owner.settings.ShareTime
+}
+
+func (m *Miner) getVardiffBounds() *VardiffBounds {
+	if m.owner == nil {
+		return NewVardiffBounds(VARDIFF_MIN_DIFFICULTY, VARDIFF_MAX_DIFFICULTY)
+	}
+	return m.owner.vardiffBounds
+}
+
+// a new worker gets its share of the miner's measured hashrate; the default
+// estimate until the miner has found shares
+func (m *Miner) getWorkerStartDifficulty() *big.Int {
+	hashrate := m.getTrueHashrate()
+
+	if hashrate.Sign() <= 0 {
+		return getVardiffStartDifficulty(m.getShareTime())
+	}
+
+	difficulty := hashrate.Mul(hashrate, big.NewInt(int64(m.getShareTime())))
+	return m.getVardiffBounds().clamp(difficulty.Div(difficulty, big.NewInt(int64(len(m.workers)+1))))
+}
+
+// fraction of valid submissions that came in for a replaced job
+func (m *Miner) getStaleRate() float64 {
+	stale := m.staleShares.Int64() + m.staleRejected.Int64()
+	total := m.shares.Int64() + m.staleRejected.Int64()
+
+	if total <= 0 {
+		return 0
+	}
+
+	return float64(stale) / float64(total)
 }
 
 func (m *Miner) getHashes() *big.Int {
 	return m.hashes
 }
 
+// combined difficulty of the live workers
 func (self *Miner) getDifficulty() *big.Int {
-	return self.difficulty
+	ret := big.NewInt(0)
+	for _, worker := range self.workers {
+		ret.Add(ret, worker.getDifficulty())
+	}
+	return ret
 }
@@ -4,55 +4,8 @@ import "testing"
 import "time"
 import "math/big"
 
-func TestQueue (t *testing.T) {
-    queue := AverageQueue{}
-
-    queue.push(1)
-    queue.push(1)
-    queue.push(1)
-    queue.push(1)
-
-    if queue.getAverage() - 1 > 0.05 {
-        t.Error("expected average of 1, found ", queue.getAverage())
-    }
-
-    queue.push(3)
-    queue.push(3)
-    queue.push(3)
-    queue.push(3)
-
-    if queue.getAverage() - 2 > 0.05 {
-        t.Error("expected average of 2, found ", queue.getAverage())
-    }
-
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-    queue.push(100)
-
-    if queue.getAverage() - 100 > 0.05 {
-        t.Error("expected average 100, found ", queue.getAverage())
-    }
-}
-
 func TestClaimedHashrate(t *testing.T) {
-    miner := MinerNew(big.NewInt(1), time.Now())
+    miner := MinerNew(nil, big.NewInt(1), time.Now())
     m1 := miner.getMachine(big.NewInt(1))
     m2 := miner.getMachine(big.NewInt(2))
 
@@ -65,41 +18,113 @@ func TestClaimedHashrate(t *testing.T) {
 }
 
 func TestTrueHashrate(t *testing.T) {
-    miner := MinerNew(big.NewInt(1), time.Now())
-    miner.hashrate.push(10)
-    miner.hashrate.push(10)
-    miner.hashrate.push(10)
+    now := time.Now().Add(-time.Hour)
+    miner := MinerNew(nil, big.NewInt(1), now)
+
+    // a share of 1000 every 10 seconds for an hour is 100 hashes a second
+    for i := 1; i <= 360; i++ {
+        miner.claimShare(1000, now.Add(time.Duration(i * 10) * time.Second), big.NewInt(0))
+    }
+
+    hashrate := miner.getTrueHashrate().Int64()
+
+    if hashrate < 95 || hashrate > 105 {
+        t.Error("expected true hashrate of 100, found ", hashrate)
+    }
+
+    worker := miner.getWorker("rig1")
+
+    if worker.getDifficulty().Cmp(NewVardiffBounds(VARDIFF_MIN_DIFFICULTY, VARDIFF_MAX_DIFFICULTY).clamp(big.NewInt(int64(hashrate * DEFAULT_SHARE_TIME)))) != 0 {
+        t.Error("expected a new worker to start at the miner's hashrate, found ", worker.getDifficulty())
+    }
+}
+
+func TestWorkerDifficulty(t *testing.T) {
+    miner := MinerNew(nil, big.NewInt(1), time.Now())
+    m1 := miner.getMachine(big.NewInt(1))
+    m1.claimedHashrate.Set(big.NewInt(1000000000000))
+
+    // claimed hashrate does not move the difficulty
+    if d1 := miner.getWorker("rig1").getDifficulty(); d1.Cmp(getVardiffStartDifficulty(DEFAULT_SHARE_TIME)) != 0 {
+        t.Error("expected start difficulty, found ", d1.String())
+    }
+
+    miner.getWorker("rig1").vardiff.difficulty = big.NewInt(VARDIFF_MIN_DIFFICULTY * 2)
+    miner.removeWorker("rig1")
+
+    if d2 := miner.getWorker("rig1").getDifficulty(); d2.Cmp(big.NewInt(VARDIFF_MIN_DIFFICULTY*2)) != 0 {
+        t.Error("expected returning worker to keep its difficulty, found ", d2.String())
+    }
+}
+
+func TestParseMinerLogin(t *testing.T) {
+    addr := "0x1111111111222222222233333333334444444444"
+
+    miner, worker, err := parseMinerLogin(addr + ".rig1")
+
+    if err != nil || getHexString(miner, 40) != addr || worker != "rig1" {
+        t.Error("expected rig1 worker, found ", worker, err)
+    }
+
+    _, worker, err = parseMinerLogin(addr + "/rig-2")
+
+    if err != nil || worker != "rig-2" {
+        t.Error("expected rig-2 worker, found ", worker, err)
+    }
 
-    if miner.getTrueHashrate().Cmp(big.NewInt(10)) != 0 {
-        t.Error("expected true hashrate of 1, found ", miner.getTrueHashrate)
+    _, worker, err = parseMinerLogin(addr)
+
+    if err != nil || worker != DEFAULT_WORKER_NAME {
+        t.Error("expected default worker, found ", worker, err)
     }
 
-    miner.hashrate.push(30)
-    miner.hashrate.push(30)
-    miner.hashrate.push(30)
+    if _, _, err = parseMinerLogin("0x1234.rig1"); err == nil {
+        t.Error("expected short address to be rejected")
+    }
 
-    if miner.getTrueHashrate().Cmp(big.NewInt(20)) != 0 {
-        t.Error("expected true hashrate of 1, found ", miner.getTrueHashrate)
+    if _, _, err = parseMinerLogin(addr + ".rig 1"); err == nil {
+        t.Error("expected bad worker name to be rejected")
     }
+}
 
-    miner.hashrate.push(20)
-    miner.hashrate.push(10)
-    miner.hashrate.push(20)
-    miner.hashrate.push(10)
+func TestWorkerIdleRemoval(t *testing.T) {
+    pool = NewMinerPool(nil, DefaultSettings())
+    miner := MinerNew(pool, big.NewInt(1), time.Now())
+    miner.touch("rig1").shares.SetInt64(3)
+    miner.touch("rig2")
 
-    if miner.getTrueHashrate().Cmp(big.NewInt(20)) != 0 {
-        t.Error("expected true hashrate of 1, found ", miner.getTrueHashrate)
+    pool.tick = time.Now().Add(time.Second * (WORKER_TIMEOUT + 1))
+    miner.getWorker("rig2").lastSeen = pool.tick
+    miner.Update(1)
+
+    if len(miner.workers) != 1 {
+        t.Error("expected 1 live worker, found ", len(miner.workers))
+    }
+
+    if len(miner.getWorkerStats()) != 2 {
+        t.Error("expected stats for 2 workers, found ", len(miner.getWorkerStats()))
+    }
+
+    if miner.getWorker("rig1").shares.Int64() != 3 {
+        t.Error("expected returning worker to keep its 3 shares, found ", miner.getWorker("rig1").shares)
     }
 }
 
-func TestGetNewDifficulty(t *testing.T) {
-    defaultDifficulty := big.NewInt(DEFAULT_HASHRATE_ESTIMATE)
-    defaultDifficulty.Mul(defaultDifficulty, big.NewInt(SHARE_TIME))
+func TestWorkerClaimedHashrate(t *testing.T) {
+    pool = NewMinerPool(nil, DefaultSettings())
+    miner := MinerNew(pool, big.NewInt(1), time.Now())
+    miner.touch("rig1")
+    miner.touch("rig2")
 
-    miner := MinerNew(big.NewInt(1), time.Now())
-    d1 := miner.GetNewDifficulty()
+    for i, name := range []string{"rig1", "rig1", "rig2"} {
+        machine := miner.getMachine(big.NewInt(int64(i)))
+        machine.worker = name
+        machine.claimedHashrate.SetInt64(1000)
+    }
 
-    if d1.Cmp(defaultDifficulty) != 0 {
-        t.Error("expected default difficulty, found ", d1.String())
+    for _, stat := range miner.getWorkerStats() {
+        if (stat.Name == "rig1" && stat.ClaimedHashrate != "2000") || (stat.Name == "rig2" && stat.ClaimedHashrate != "1000") {
+            t.Error("unexpected claimed hashrate for ", stat.Name, ": ", stat.ClaimedHashrate)
+        }
     }
 }
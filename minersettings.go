@@ -0,0 +1,258 @@
+package main
+
+//
+// miner account settings
+// miners change their settings by signing the settings json with their
+// mining address (personal_sign) and posting it to /settings:
+//     {"message": "{\"address\": \"0x...\", \"minPayout\": \"...\", ...}", "signature": "0x..."}
+// the settings are stored only if the signer is the address in the settings,
+// and the signed time is recent and newer than the stored settings
+//
+
+import "encoding/json"
+import "errors"
+import "io/ioutil"
+import "math/big"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+
+type MinerSettings struct {
+	Address       string `json:"address" bson:"address"`
+	MinPayout     string `json:"minPayout,omitempty" bson:"minPayout,omitempty"`         // wei; Settings.PayoutMinimum if empty
+	PayoutAddress string `json:"payoutAddress,omitempty" bson:"payoutAddress,omitempty"` // pay here instead of the mining address
+	OfflineAlert  bool   `json:"offlineAlert" bson:"offlineAlert"`                       // alert when a worker goes offline
+	AlertEmail    string `json:"alertEmail,omitempty" bson:"alertEmail,omitempty"`
+	Time          int64  `json:"time" bson:"time"` // unix time the settings were signed at
+}
+
+func isHexAddress(address string) bool {
+	if len(address) != 42 || !strings.HasPrefix(address, "0x") {
+		return false
+	}
+
+	_, ok := big.NewInt(0).SetString(address[2:], 16)
+	return ok
+}
+
+// the settings anyone may read: without the alert email
+func (self *MinerSettings) getPublic() *MinerSettings {
+	ret := *self
+	ret.AlertEmail = ""
+	return &ret
+}
+
+func (self *MinerSettings) getMinPayout() *big.Int {
+	ret, _ := big.NewInt(0).SetString(self.MinPayout, 10)
+	return ret
+}
+
+func (self *MinerSettings) validate(now time.Time, minimum *big.Int) error {
+	if !isHexAddress(self.Address) {
+		return errors.New("invalid address")
+	}
+
+	if len(self.MinPayout) > 0 {
+		payout := self.getMinPayout()
+
+		if payout == nil || payout.Cmp(minimum) < 0 {
+			return errors.New("minimum payout must be at least " + minimum.String() + " wei")
+		}
+	}
+
+	if len(self.PayoutAddress) > 0 && !isHexAddress(self.PayoutAddress) {
+		return errors.New("invalid payout address")
+	}
+
+	if self.OfflineAlert && len(self.AlertEmail) == 0 {
+		return errors.New("offline alerts need an email address")
+	}
+
+	signed := time.Unix(self.Time, 0)
+
+	if now.Sub(signed) > MINER_SETTINGS_MAX_AGE*time.Second || signed.Sub(now) > MINER_SETTINGS_MAX_AGE*time.Second {
+		return errors.New("settings must be signed within " + (MINER_SETTINGS_MAX_AGE * time.Second).String())
+	}
+
+	return nil
+}
+
+type MinerSettingsStore struct {
+	db      Database
+	lock    *sync.Mutex
+	minimum *big.Int // Settings.PayoutMinimum
+}
+
+func NewMinerSettingsStore(db Database, settings *Settings) *MinerSettingsStore {
+	minimum, _ := big.NewInt(0).SetString(settings.PayoutMinimum, 10)
+	return &MinerSettingsStore{db: db, lock: &sync.Mutex{}, minimum: minimum}
+}
+
+// the payout threshold of miners who did not set their own, and the lowest they may set
+func (self *MinerSettingsStore) getPayoutMinimum() *big.Int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return big.NewInt(0).Set(self.minimum)
+}
+
+func (self *MinerSettingsStore) ApplySettings(settings *Settings) {
+	minimum, _ := big.NewInt(0).SetString(settings.PayoutMinimum, 10)
+
+	self.lock.Lock()
+	self.minimum = minimum
+	self.lock.Unlock()
+}
+
+// nil if the miner never saved settings
+func (self *MinerSettingsStore) Get(address string) *MinerSettings {
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil
+	}
+
+	defer self.db.Disconnect()
+
+	settings := &MinerSettings{}
+	err = self.db.Get(settings, strings.ToLower(address))
+
+	if err != nil {
+		return nil
+	}
+
+	return settings
+}
+
+/*
+ * checks and stores settings signed by the miner
+ */
+func (self *MinerSettingsStore) ApplySigned(message []byte, signature string, now time.Time) (*MinerSettings, error) {
+	settings := &MinerSettings{}
+	err := json.Unmarshal(message, settings)
+
+	if err != nil {
+		return nil, errors.New("invalid settings: " + err.Error())
+	}
+
+	settings.Address = strings.ToLower(settings.Address)
+	settings.PayoutAddress = strings.ToLower(settings.PayoutAddress)
+	err = settings.validate(now, self.getPayoutMinimum())
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := recoverPersonalSigner(message, signature)
+
+	if err != nil {
+		return nil, err
+	}
+
+	address, _ := parseHex(settings.Address, 40)
+
+	if signer.Cmp(address) != 0 {
+		return nil, errors.New("settings were signed by " + getHexString(signer, 40) + ", not " + settings.Address)
+	}
+
+	if previous := self.Get(settings.Address); previous != nil && previous.Time >= settings.Time {
+		return nil, errors.New("newer settings were saved already")
+	}
+
+	err = self.db.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	err = self.db.Update(settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	poolLog.Info("saved miner settings", "miner", settings.Address)
+	return settings, nil
+}
+
+func (self *MinerSettingsStore) GetPayoutThreshold(address string) *big.Int {
+	settings := self.Get(address)
+
+	if settings == nil || len(settings.MinPayout) == 0 {
+		return self.getPayoutMinimum()
+	}
+
+	return settings.getMinPayout()
+}
+
+func (self *MinerSettingsStore) GetPayoutAddress(address string) string {
+	settings := self.Get(address)
+
+	if settings == nil || len(settings.PayoutAddress) == 0 {
+		return address
+	}
+
+	return settings.PayoutAddress
+}
+
+type signedSettingsRequest struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+type settingsResponse struct {
+	Settings *MinerSettings `json:"settings,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func writeSettingsResponse(w http.ResponseWriter, status int, response *settingsResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /settings?address=0x... reads the public settings, POST stores signed settings
+func (self *MinerSettingsStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		settings := self.Get(r.URL.Query().Get("address"))
+
+		if settings == nil {
+			writeSettingsResponse(w, http.StatusNotFound, &settingsResponse{Error: "no settings"})
+			return
+		}
+
+		writeSettingsResponse(w, http.StatusOK, &settingsResponse{Settings: settings.getPublic()})
+		return
+	}
+
+	if r.Method != "POST" {
+		writeSettingsResponse(w, http.StatusMethodNotAllowed, &settingsResponse{Error: "use GET or POST"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+
+	if err != nil {
+		writeSettingsResponse(w, http.StatusBadRequest, &settingsResponse{Error: "could not read request"})
+		return
+	}
+
+	request := &signedSettingsRequest{}
+	err = json.Unmarshal(body, request)
+
+	if err != nil {
+		writeSettingsResponse(w, http.StatusBadRequest, &settingsResponse{Error: "invalid request"})
+		return
+	}
+
+	settings, err := self.ApplySigned([]byte(request.Message), request.Signature, time.Now())
+
+	if err != nil {
+		writeSettingsResponse(w, http.StatusBadRequest, &settingsResponse{Error: err.Error()})
+		return
+	}
+
+	writeSettingsResponse(w, http.StatusOK, &settingsResponse{Settings: settings})
+}
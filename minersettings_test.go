@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+import "fmt"
+import "math/big"
+import "net/http/httptest"
+import "strings"
+import "time"
+
+// keeps miner settings in memory
+type settingsDatabase struct {
+	Database
+	settings map[string]*MinerSettings
+}
+
+func (self *settingsDatabase) Connect() error    { return nil }
+func (self *settingsDatabase) Disconnect() error { return nil }
+
+func (self *settingsDatabase) Get(result interface{}, key string) error {
+	settings, ok := self.settings[key]
+
+	if !ok {
+		return fmt.Errorf("item not found")
+	}
+
+	*result.(*MinerSettings) = *settings
+	return nil
+}
+
+func (self *settingsDatabase) Update(item interface{}) error {
+	settings := item.(*MinerSettings)
+	self.settings[settings.Address] = settings
+	return nil
+}
+
+func TestMinerSettings(t *testing.T) {
+	store := NewMinerSettingsStore(&settingsDatabase{settings: make(map[string]*MinerSettings)}, DefaultSettings())
+	now := time.Now()
+	address := "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" // private key 1
+
+	message := []byte(fmt.Sprintf(`{"address": "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", "minPayout": "500000000000000000", "payoutAddress": "0x000000000000000000000000000000000000000a", "time": %d}`, now.Unix()))
+	signature := signPersonalMessage(message, big.NewInt(1), big.NewInt(99))
+
+	if _, err := store.ApplySigned(message, signature, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.GetPayoutThreshold(address).String() != "500000000000000000" || store.GetPayoutAddress(address) != "0x000000000000000000000000000000000000000a" {
+		t.Error("unexpected settings ", store.Get(address))
+	}
+
+	// replayed settings are refused
+	if _, err := store.ApplySigned(message, signature, now); err == nil {
+		t.Error("expected replayed settings to fail")
+	}
+
+	// someone else's key
+	message = []byte(fmt.Sprintf(`{"address": "%s", "time": %d}`, address, now.Unix()+1))
+	if _, err := store.ApplySigned(message, signPersonalMessage(message, big.NewInt(2), big.NewInt(99)), now); err == nil {
+		t.Error("expected settings signed by another key to fail")
+	}
+
+	// too old
+	message = []byte(fmt.Sprintf(`{"address": "%s", "time": %d}`, address, now.Unix()-2*MINER_SETTINGS_MAX_AGE))
+	if _, err := store.ApplySigned(message, signPersonalMessage(message, big.NewInt(1), big.NewInt(99)), now); err == nil {
+		t.Error("expected old settings to fail")
+	}
+
+	if store.GetPayoutAddress("0x000000000000000000000000000000000000000b") != "0x000000000000000000000000000000000000000b" {
+		t.Error("expected miners without settings to be paid at their address")
+	}
+}
+
+func TestMinerSettingsEmailPrivate(t *testing.T) {
+	address := "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf"
+	db := &settingsDatabase{settings: map[string]*MinerSettings{address: {Address: address, OfflineAlert: true, AlertEmail: "miner@example.com"}}}
+	store := NewMinerSettingsStore(db, DefaultSettings())
+
+	recorder := httptest.NewRecorder()
+	store.ServeHTTP(recorder, httptest.NewRequest("GET", "/settings?address="+address, nil))
+
+	if recorder.Code != 200 || strings.Contains(recorder.Body.String(), "miner@example.com") || !strings.Contains(recorder.Body.String(), "offlineAlert") {
+		t.Error("expected the settings without the alert email, found ", recorder.Body.String())
+	}
+
+	if store.Get(address).AlertEmail != "miner@example.com" {
+		t.Error("expected the stored email to be kept")
+	}
+}
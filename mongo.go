@@ -5,12 +5,15 @@ package main
 //
 
 import "reflect"
-import "fmt"
 import "gopkg.in/mgo.v2"
 import "gopkg.in/mgo.v2/bson"
 import "errors"
 import "sync"
 import "strings"
+import "time"
+
+// returned by Add when a unique index rejects the item
+var ErrDuplicate = errors.New("duplicate entry")
 
 type SimpleStorage interface {
 	Add(interface{}) error
@@ -27,6 +30,7 @@ type TableStorage interface {
 	UpdateTo(string, interface{}) error
 	ExistsIn(string, interface{}) bool
 	GetFrom(string, interface{}, string) error
+	FindIn(string, map[string]interface{}, string, int, interface{}) error
 }
 
 type Database interface {
@@ -45,8 +49,8 @@ type Mongo struct {
 	db_id    string
 }
 
-func NewMongoDB(db string) *Mongo {
-	return &Mongo{session: nil, lock: &sync.Mutex{}, refcount: 0, ip: "localhost", db_id: db}
+func NewMongoDB(host, db string) *Mongo {
+	return &Mongo{session: nil, lock: &sync.Mutex{}, refcount: 0, ip: host, db_id: db}
 }
 
 func (self *Mongo) Connect() error {
@@ -107,6 +111,24 @@ func (self *Mongo) getCollection(table string) *mgo.Collection {
 	case "accounts":
 		idx := mgo.Index{Key: []string{"$text:address"}}
 		c.EnsureIndex(idx)
+	case "share_records":
+		c.EnsureIndex(mgo.Index{Key: []string{"round"}})
+		c.EnsureIndex(mgo.Index{Key: []string{"-time"}})
+	case "hashrate_history":
+		c.EnsureIndex(mgo.Index{Key: []string{"address", "time"}})
+		c.EnsureIndex(mgo.Index{Key: []string{"time"}, ExpireAfter: HASHRATE_HISTORY_TTL * time.Second})
+	case "verified_payments":
+		c.EnsureIndex(mgo.Index{Key: []string{"to"}})
+	case "block_candidates":
+		c.EnsureIndex(mgo.Index{Key: []string{"finder", "-found"}})
+	case "credits":
+		c.EnsureIndex(mgo.Index{Key: []string{"miner"}})
+	case "journal":
+		c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true})
+		c.EnsureIndex(mgo.Index{Key: []string{"accounts"}})
+		c.EnsureIndex(mgo.Index{Key: []string{"folded"}})
+	case "ledger_accounts":
+		c.EnsureIndex(mgo.Index{Key: []string{"account"}, Unique: true})
 	}
 
 	return c
@@ -131,18 +153,32 @@ func (self *Mongo) getCollectionForType(item interface{}) (*mgo.Collection, erro
 		idx := mgo.Index{Key: []string{"$text:hash"}}
 		c.EnsureIndex(idx)
 	case *Block:
-		c = self.session.DB(MONGO_DB_ID).C("blocks")
+		c = self.session.DB(self.db_id).C("blocks")
 		idx := mgo.Index{Key: []string{"$text:hash"}}
 		c.EnsureIndex(idx)
 	case *Account:
-		c = self.session.DB(MONGO_DB_ID).C("accounts")
+		c = self.session.DB(self.db_id).C("accounts")
 		idx := mgo.Index{Key: []string{"$text:address"}}
 		c.EnsureIndex(idx)
+	case *BlockCandidate:
+		c = self.session.DB(self.db_id).C("block_candidates")
+		c.EnsureIndex(mgo.Index{Key: []string{"number", "nonce"}, Unique: true})
+	case *JournalEntry:
+		c = self.getCollection("journal")
+	case *LedgerAccount:
+		c = self.getCollection("ledger_accounts")
+	case *MinerSettings:
+		c = self.session.DB(self.db_id).C("miner_settings")
+		c.EnsureIndex(mgo.Index{Key: []string{"address"}, Unique: true})
+	case *ShareSubmission:
+		c = self.session.DB(self.db_id).C("share_submissions")
+		c.EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true})
+		c.EnsureIndex(mgo.Index{Key: []string{"created"}, ExpireAfter: SHARE_DEDUPE_TTL * time.Second})
 	default:
         // default, create a table with the type name + s
         // example struct MyStruct -> mystructs
         typename := self.getTypeBaseName(item) + "s"
-		c = self.session.DB(MONGO_DB_ID).C(typename)
+		c = self.session.DB(self.db_id).C(typename)
 	}
 	return c, nil
 }
@@ -161,6 +197,10 @@ func (self *Mongo) Add(item interface{}) error {
 
 	err = c.Insert(item)
 
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+
 	return err
 }
 
@@ -233,6 +273,22 @@ func (self *Mongo) GetFrom(table string, result interface{}, key string) error {
 	return nil
 }
 
+// all items in a table matching the query, sorted by a field ("-field" for
+// descending, "" for none); a limit of 0 returns everything. result is a pointer to a slice
+func (self *Mongo) FindIn(table string, query map[string]interface{}, sort string, limit int, result interface{}) error {
+	q := self.getCollection(table).Find(bson.M(query))
+
+	if len(sort) > 0 {
+		q = q.Sort(sort)
+	}
+
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	return q.All(result)
+}
+
 func (self *Mongo) Get(result interface{}, key string) error {
 	rv := reflect.ValueOf(result)
 
@@ -257,6 +313,8 @@ func (self *Mongo) Get(result interface{}, key string) error {
 		query = c.Find(bson.M{"address": key})
     case *MinerStat:
 		query = c.Find(bson.M{"address": key})
+	case *MinerSettings:
+		query = c.Find(bson.M{"address": key})
 	}
 
 	n, err := query.Count()
@@ -314,6 +372,8 @@ func (self *Mongo) Exists(item interface{}) bool {
 		query = c.Find(bson.M{"address": item.(*Account).Address})
 	case *MinerStat:
 		query = c.Find(bson.M{"address": item.(*MinerStat).Address})
+	case *ShareSubmission:
+		query = c.Find(bson.M{"key": item.(*ShareSubmission).Key})
 	}
 
 	num, err := query.Count()
@@ -337,7 +397,7 @@ func (self *Mongo) UpdateTo(table string, item interface{}) error {
 	}
 
 	if err != nil {
-		fmt.Println(err)
+		dbLog.Error("could not update", "collection", c.Name, "err", err)
 	}
 
 	return err
@@ -359,10 +419,19 @@ func (self *Mongo) Update(item interface{}) error {
 		_, err = c.Upsert(bson.M{"address": item.(*Account).Address}, bson.M{"$set": item})
 	case *MinerStat:
 		_, err = c.Upsert(bson.M{"address": item.(*MinerStat).Address}, bson.M{"$set": item})
+	case *BlockCandidate:
+		candidate := item.(*BlockCandidate)
+		_, err = c.Upsert(bson.M{"number": candidate.Number, "nonce": candidate.Nonce}, bson.M{"$set": item})
+	case *MinerSettings:
+		_, err = c.Upsert(bson.M{"address": item.(*MinerSettings).Address}, bson.M{"$set": item})
+	case *JournalEntry:
+		_, err = c.Upsert(bson.M{"id": item.(*JournalEntry).Id}, bson.M{"$set": item})
+	case *LedgerAccount:
+		_, err = c.Upsert(bson.M{"account": item.(*LedgerAccount).Account}, bson.M{"$set": item})
 	}
 
 	if err != nil {
-		fmt.Println(err)
+		dbLog.Error("could not update", "collection", c.Name, "err", err)
 	}
 
 	return err
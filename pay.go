@@ -5,8 +5,8 @@ package main
 // implements a reliable payment system on top of geth's unreliable payments
 //
 
+import "context"
 import "math/big"
-import "log"
 import "time"
 import "os"
 import "sync"
@@ -27,10 +27,17 @@ type PaymentListener interface {
     PaymentVerified(*PendingTransaction)
 }
 
+// a listener that must record a verified payment. the payment stays pending,
+// and is recorded again on the next update, until every recorder succeeds
+type PaymentRecorder interface {
+    RecordPayment(*PendingTransaction) error
+}
+
 type PendingTransaction struct {
 	BlockSent   string       // the block in which the transaction was originally sent. '0' means it originally failed to send and we may need a new nonce
     Id          string
 	Transaction *Transaction
+	Verified    bool // confirmed on chain, waiting for the recorders
 }
 
 func (self *PendingTransaction) getBlockSent() *big.Int {
@@ -65,6 +72,7 @@ type PaymentProcessor struct {
 	lock         *sync.Mutex
     listeners   []PaymentListener
 	pending_file *FilePersistence
+	settings     *Settings
 	blockCache   []*Block
 	pending      map[string]*PendingTransaction
 }
@@ -72,16 +80,17 @@ type PaymentProcessor struct {
 /*
  * create a new payment processor
  */
-func NewPaymentProcessor(eth EthAll, pendingFilename string) *PaymentProcessor {
+func NewPaymentProcessor(eth EthAll, settings *Settings) *PaymentProcessor {
 	self := &PaymentProcessor{
 		eth:          eth,
 		currentNonce: big.NewInt(0),
 		lock:         &sync.Mutex{},
         listeners: make([]PaymentListener, 0, 10),
-		pending_file: NewFilePersistence(pendingFilename),
+		pending_file: NewFilePersistence(settings.PayPersistFilename),
+		settings:     settings,
 		pending:      nil}
 
-	if _, err := os.Stat(pendingFilename); os.IsNotExist(err) {
+	if _, err := os.Stat(settings.PayPersistFilename); os.IsNotExist(err) {
 		self.pending = make(map[string]*PendingTransaction)
 		self.pending_file.Write(self.pending)
 	} else {
@@ -141,6 +150,23 @@ func (self *PaymentProcessor) addTransaction(id string, from, to, value *big.Int
     self.addToPending(ptxn)
 }
 
+/*
+ * send a transaction, unless one with the same id is still pending
+ */
+func (self *PaymentProcessor) enqueuePayment(id string, from, to, value *big.Int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, txn := range self.pending {
+		if txn.Id == id {
+			return false
+		}
+	}
+
+	self.addTransaction(id, from, to, value)
+	return true
+}
+
 /*
  * add a pending transaction to the pending list.
  */
@@ -152,7 +178,7 @@ func (self *PaymentProcessor) addToPending(tx *PendingTransaction) {
         // if (in the unlikely event) we already have this UUID in the map
         // grab a new one
         if _, ok := self.pending[key]; ok {
-            log.Println("pay: HASH COLLISION; very unlikely")
+            payLog.Warn("pending key collision, very unlikely", "key", key)
             continue
         }
 
@@ -167,6 +193,26 @@ func (self *PaymentProcessor) updatePending(key string, tx *PendingTransaction)
 	self.pending_file.Write(self.pending)
 }
 
+/*
+ * removes a verified payment once every PaymentRecorder has it. until then it
+ * stays pending, so the same payment id cannot be sent again
+ */
+func (self *PaymentProcessor) completePayment(key string, txn *PendingTransaction) error {
+	for _, listener := range self.listeners {
+		if recorder, ok := listener.(PaymentRecorder); ok {
+			err := recorder.RecordPayment(txn)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	delete(self.pending, key)
+	self.pending_file.Write(self.pending)
+	return nil
+}
+
 /*
  * update the payment state.
  * check if there are any confirmed payments or if
@@ -179,22 +225,33 @@ func (self *PaymentProcessor) update() {
 	lastConfirmedBlock, err := self.eth.GetLastConfirmedBlockNumber()
 
 	if err != nil {
-		log.Printf("pay: error getting last confirmed block - " + err.Error())
+		payLog.Error("could not get last confirmed block", "err", err)
 		return
 	}
 
 	currentBlock, err := self.eth.GetBlockNumber()
 
 	if err != nil {
-        log.Printf("pay: error getting block number - " + err.Error())
+        payLog.Error("could not get block number", "err", err)
 		return
 	}
 
 	for key, txn := range self.pending {
+		txnLog := payLog.With("payment", txn.Id, "txid", txn.Transaction.Hash)
+
+		if txn.Verified {
+			err := self.completePayment(key, txn)
+
+			if err != nil {
+				txnLog.Error("could not record verified payment, keeping it pending", "err", err)
+			}
+			continue
+		}
+
 		txnBlockNum, err := parseHex(txn.BlockSent, 0)
 
         if err != nil {
-            log.Println("pay: ERROR, could not get sent block of txn: ", err.Error())
+            txnLog.Error("could not parse sent block", "block", txn.BlockSent, "err", err)
             continue
         }
 
@@ -205,19 +262,19 @@ func (self *PaymentProcessor) update() {
             nonce, err := self.getNewNonce()
 
             if err != nil {
-                log.Println("pay: error, could not get new nonce for unsent transaction: ", err.Error())
+                txnLog.Error("could not get a new nonce for unsent transaction", "err", err)
                 continue
             }
 
 			newTxn, err := self.eth.SendTransaction(fromAddr, toAddr, value, nil)
 
             if err != nil {
-                log.Println("pay: could not send transaction - ", err.Error())
+                txnLog.Error("could not send transaction", "nonce", nonce, "err", err)
                 txn.Transaction.Nonce = getHexString(nonce, 8)
                 newTxn = txn.Transaction
             }
 
-            log.Println("pay: found unsent txn (nonce: ", nonce.String(), "); sending now")
+            txnLog.Info("found unsent transaction, sending now", "nonce", nonce, "newTxid", newTxn.Hash)
 
             txn.BlockSent = getHexString(currentBlock, 0)
             txn.Transaction = newTxn
@@ -228,7 +285,6 @@ func (self *PaymentProcessor) update() {
 
 			self.updatePending(key, txn)
         } else if txn.isInvalid() {
-            log.Println(txn.Transaction)
             fromAddr := txn.Transaction.getFromAddr()
             toAddr := txn.Transaction.getToAddr()
             value := txn.Transaction.getValue()
@@ -240,19 +296,19 @@ func (self *PaymentProcessor) update() {
                 nonce, err = self.getNewNonce()
 
                 if err != nil {
-                    log.Println("could not retrieve new nonce for stale, invalid txn: ", err.Error())
+                    txnLog.Error("could not get a new nonce for stale, invalid transaction", "err", err)
                     continue
                 }
 
-                log.Println("invalid transaction is stale, grabbed new nonce (nonce:",nonce.String(),")")
+                txnLog.Info("invalid transaction is stale, using a new nonce", "nonce", nonce)
             }
 
-            log.Println("pay: found invalid txn (nonce: ", nonce.String(), "); resending")
+            txnLog.Info("found invalid transaction, resending", "nonce", nonce)
 
 			newTxn, err := self.eth.SendTransaction(fromAddr, toAddr, value, nil)
 
             if err != nil {
-                log.Println("pay: could not send invalid transaction - ", err.Error())
+                txnLog.Error("could not resend invalid transaction", "nonce", nonce, "err", err)
                 continue
             }
 
@@ -283,16 +339,16 @@ func (self *PaymentProcessor) update() {
 				nonce, err := self.getNewNonce()
 
                 if err != nil {
-                    log.Println("could not get a fresh nonce")
+                    txnLog.Error("could not get a new nonce for stale transaction", "err", err)
                     continue
                 }
 
-                log.Println("pay: found stale txn (nonce: ", nonce.String(), "); resending")
+                txnLog.Info("found stale transaction, resending", "nonce", nonce)
 
 				newTxn, err := self.eth.SendTransaction(fromAddr, toAddr, value, nil)
 
 				if err != nil {
-					log.Println("could not resend transaction: " + err.Error())
+					txnLog.Error("could not resend stale transaction", "nonce", nonce, "err", err)
 					continue
 				}
 
@@ -301,22 +357,25 @@ func (self *PaymentProcessor) update() {
                 self.updatePending(key, txn)
 			} else {
                 txn.Transaction = gethTxn
+                txn.Verified = true
+                self.updatePending(key, txn)
 
                 for _, listener := range(self.listeners) {
                     listener.PaymentVerified(txn)
                 }
 
-                delete(self.pending, key)
-                self.pending_file.Write(self.pending)
+                txnLog.Info("transaction confirmed", "nonce", txn.Transaction.getNonce(), "block", txn.Transaction.BlockNumber)
 
-				nonce := txn.Transaction.getNonce()
-                log.Println("pay: found complete txn (nonce: ", nonce.String(), ") adding to db")
+                err = self.completePayment(key, txn)
+
+                if err != nil {
+                    txnLog.Error("could not record verified payment, keeping it pending", "err", err)
+                }
 			}
 		} else {
             waitBlock := big.NewInt(8)
             waitBlock.Add(waitBlock, txnBlockNum)
-			nonce := txn.Transaction.getNonce()
-            log.Println("pay: waiting for hardened block before confirmation: (block: ", currentBlock.String(), "wait block: ", waitBlock.String(), ", nonce: ", nonce.String(), ")")
+            txnLog.Debug("waiting for hardened block before confirmation", "block", currentBlock, "waitBlock", waitBlock, "nonce", txn.Transaction.getNonce())
 		}
 	}
 }
@@ -356,6 +415,13 @@ func (self *PaymentProcessor) handle_addPayment(rpcRequest *RPCRequest) *RPCResp
 	return NewRPCResult(rpcRequest.Id, true)
 }
 
+func (self *PaymentProcessor) collectMetrics(m *Metrics) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	m.Set("oneether_payments_pending", float64(len(self.pending)))
+}
+
 func (self *PaymentProcessor) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 	bodyReader := bufio.NewReader(request.Body)
 	bytes, _ := ioutil.ReadAll(bodyReader)
@@ -373,7 +439,7 @@ func (self *PaymentProcessor) ServeHTTP(responseWriter http.ResponseWriter, requ
 	jresponse, err := json.Marshal(rpcResponse)
 
 	if err != nil {
-		log.Println("invalid json marshalling!!!")
+		payLog.Error("could not encode rpc response", "method", rpcRequest.Method, "err", err)
 		return
 	}
 
@@ -381,27 +447,50 @@ func (self *PaymentProcessor) ServeHTTP(responseWriter http.ResponseWriter, requ
 }
 
 /*
- * starts the main payment processing thread
+ * starts the main payment processing thread. the rpc server is served
+ * separately, see getServer
  */
-func (self *PaymentProcessor) Start(finished chan bool) {
-	go http.ListenAndServe(":" + PAY_RPC_PORT, self)
-
-	for !SHUTDOWN {
+func (self *PaymentProcessor) Start(ctx context.Context) {
+	for ctx.Err() == nil {
 		self.update()
-		time.Sleep(time.Duration(PAY_WAIT) * time.Second)
+		sleepContext(ctx, time.Duration(PAY_WAIT)*time.Second)
 	}
-	log.Printf("pay server is down")
+	payLog.Info("server is down")
+}
 
-	if finished != nil {
-		finished <- true
-	}
+func (self *PaymentProcessor) getServer() *http.Server {
+	return &http.Server{Addr: ":" + self.settings.PayRPCPort, Handler: self}
+}
+
+/*
+ * saves the pending transactions once the processor and its rpc server have
+ * stopped
+ */
+func (self *PaymentProcessor) Close(ctx context.Context) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.pending_file.Write(self.pending)
+	payLog.Info("saved pending transactions", "pending", len(self.pending))
+	return nil
 }
 
 func pay_main() {
-	geth := NewGeth(GETH_IP, GETH_PORT)
+	settings, err := LoadSettings("", os.LookupEnv)
+
+	if err != nil {
+		payLog.Fatal("invalid settings", "err", err)
+	}
+
+	geth := NewGeth(settings.GethIP, settings.GethPort)
     //XXX add db listener
-	pay := NewPaymentProcessor(geth, PAY_PERSIST_FILENAME)
+	pay := NewPaymentProcessor(geth, settings)
+
+	lifecycle := NewLifecycle(time.Duration(SHUTDOWN_TIMEOUT) * time.Second)
+	lifecycle.Serve("pay rpc", pay.getServer())
+	lifecycle.Go("pay", pay.Start)
+	lifecycle.OnStop("payments", pay.Close)
 
-	//http.ListenAndServe(":" + PAY_RPC_PORT, pay)
-	pay.Start(nil)
+	waitForSignal()
+	lifecycle.Shutdown()
 }
@@ -1,5 +1,6 @@
 package main
 
+import "errors"
 import "fmt"
 import "os"
 import "testing"
@@ -12,13 +13,20 @@ func makePendingTxn(e EthAll, from, to, val *big.Int) *PendingTransaction {
 	return &PendingTransaction{"1", tx}
 }*/
 
+// a payment processor keeping its pending payments in filename
+func newTestPaymentProcessor(eth EthAll, filename string) *PaymentProcessor {
+	settings := DefaultSettings()
+	settings.PayPersistFilename = filename
+	return NewPaymentProcessor(eth, settings)
+}
+
 func TestAddToPending(t *testing.T) {
 	if _, err := os.Stat("test.pending"); !os.IsNotExist(err) {
 		os.Remove("test.pending")
 	}
 
 	geth := &MockGeth{}
-	pay := NewPaymentProcessor(geth, "test.pending")
+	pay := newTestPaymentProcessor(geth, "test.pending")
 
     pay.addTransaction("1", big.NewInt(0x124), big.NewInt(0x421), big.NewInt(6))
     pay.addTransaction("2", big.NewInt(0x125), big.NewInt(0x521), big.NewInt(5))
@@ -26,7 +34,7 @@ func TestAddToPending(t *testing.T) {
     pay.addTransaction("4", big.NewInt(0x127), big.NewInt(0x721), big.NewInt(3))
 
 	pay = nil
-	pay = NewPaymentProcessor(&MockGeth{}, "test.pending")
+	pay = newTestPaymentProcessor(&MockGeth{}, "test.pending")
 
 	if len(pay.pending) != 4 {
 		t.Error("expected 4 pending transaction, found ", len(pay.pending))
@@ -44,7 +52,7 @@ func TestUpdate(t *testing.T) {
 
 	geth := &MockGeth{blockNumber: 0x01}
 	geth.transactionsConfirmed = true
-	pay := NewPaymentProcessor(geth, "test.pending")
+	pay := newTestPaymentProcessor(geth, "test.pending")
     pay.addTransaction("1", big.NewInt(0x127), big.NewInt(0x721), big.NewInt(3))
     pay.addTransaction("2", big.NewInt(0x127), big.NewInt(0x721), big.NewInt(3))
 	pay.update()
@@ -81,3 +89,49 @@ func TestUpdate(t *testing.T) {
 		os.Remove("test.pending")
 	}
 }
+
+// fails until told otherwise
+type failingRecorder struct {
+	MetricsPaymentListener
+	fail     bool
+	recorded int
+}
+
+func (self *failingRecorder) RecordPayment(*PendingTransaction) error {
+	if self.fail {
+		return errors.New("database down")
+	}
+	self.recorded++
+	return nil
+}
+
+func TestVerifiedPaymentKeptUntilRecorded(t *testing.T) {
+	defer os.Remove("test.recorded")
+
+	geth := &MockGeth{blockNumber: 0x01}
+	geth.transactionsConfirmed = true
+	pay := newTestPaymentProcessor(geth, "test.recorded")
+	recorder := &failingRecorder{fail: true}
+	pay.RegisterListener(recorder)
+
+	pay.enqueuePayment("0x0a:100", big.NewInt(0x127), big.NewInt(0x721), big.NewInt(3))
+	pay.update()
+	geth.blockNumber = 0x10
+	pay.update()
+
+	if len(pay.pending) != 1 {
+		t.Fatal("expected the payment to stay pending, found ", len(pay.pending))
+	}
+
+	// not sent again while it waits to be recorded
+	if pay.enqueuePayment("0x0a:100", big.NewInt(0x127), big.NewInt(0x721), big.NewInt(3)) || geth.transactionCount != 1 {
+		t.Error("expected the payment not to be sent twice, found ", geth.transactionCount, " transactions")
+	}
+
+	recorder.fail = false
+	pay.update()
+
+	if len(pay.pending) != 0 || recorder.recorded != 1 {
+		t.Error("expected the payment to be recorded once, found ", len(pay.pending), " pending and ", recorder.recorded, " recorded")
+	}
+}
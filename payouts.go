@@ -0,0 +1,242 @@
+package main
+
+//
+// payout scheduler
+// every Settings.PayoutInterval seconds, pending ledger balances over the miner's
+// payout threshold are locked and handed to the payment processor. a payout
+// id is derived from what the miner was paid before, so a run that is cut
+// short can be repeated without paying anyone twice. locked balances become
+// paid when the payment processor has verified the transaction
+//
+
+import "context"
+import "errors"
+import "math/big"
+import "sort"
+import "sync"
+import "time"
+
+// payout settings by mining address
+type PayoutSettings interface {
+	GetPayoutThreshold(address string) *big.Int
+	GetPayoutAddress(address string) string
+}
+
+// PAYOUT_MINIMUM for everyone, paid to the mining address
+type DefaultPayoutSettings struct {
+}
+
+func (DefaultPayoutSettings) GetPayoutThreshold(string) *big.Int {
+	ret, _ := big.NewInt(0).SetString(PAYOUT_MINIMUM, 10)
+	return ret
+}
+
+func (DefaultPayoutSettings) GetPayoutAddress(address string) string {
+	return address
+}
+
+type PayoutScheduler struct {
+	ledger     *Ledger
+	pay        *PaymentProcessor
+	settings   PayoutSettings
+	lock       *sync.Mutex
+	interval   time.Duration
+	maxPayouts int
+	lastRun    time.Time
+}
+
+func NewPayoutScheduler(ledger *Ledger, pay *PaymentProcessor, payoutSettings PayoutSettings, settings *Settings) *PayoutScheduler {
+	ret := &PayoutScheduler{ledger: ledger, pay: pay, settings: payoutSettings, lock: &sync.Mutex{}}
+	ret.ApplySettings(settings)
+	return ret
+}
+
+// PayoutInterval and PayoutMaxPerRun; a run in progress keeps its limit
+func (self *PayoutScheduler) ApplySettings(settings *Settings) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.interval = time.Duration(settings.PayoutInterval * float64(time.Second))
+	self.maxPayouts = int(settings.PayoutMaxPerRun)
+}
+
+func (self *PayoutScheduler) getInterval() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.interval
+}
+
+func (self *PayoutScheduler) getMaxPayouts() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.maxPayouts
+}
+
+func getPayoutId(address string, balance *LedgerBalance) string {
+	total, _ := big.NewInt(0).SetString(balance.Locked, 10)
+	paid, _ := big.NewInt(0).SetString(balance.Paid, 10)
+	return address + ":" + total.Add(total, paid).String()
+}
+
+// sends the payment for a lock, unless it is already on its way or was paid
+func (self *PayoutScheduler) enqueue(lock *JournalEntry, coinbase *big.Int) error {
+	address, amount, err := getLockPayment(lock)
+
+	if err != nil {
+		return err
+	}
+
+	paid, err := self.ledger.IsPaid(lock.Payout)
+
+	if err != nil {
+		return err
+	}
+
+	if paid {
+		payoutsLog.Warn("payout was paid already, not sending it again", "miner", address, "payout", lock.Payout)
+		return nil
+	}
+
+	payTo := self.settings.GetPayoutAddress(address)
+	to, err := parseHex(payTo, 40)
+
+	if err != nil {
+		return err
+	}
+
+	if self.pay.enqueuePayment(lock.Payout, coinbase, to, amount) {
+		payoutsLog.Info("sending payout", "miner", address, "to", payTo, "amount", amount, "payout", lock.Payout)
+	}
+
+	return nil
+}
+
+// addresses due a payout, largest balance first
+func (self *PayoutScheduler) getDuePayouts(balances map[string]*big.Int, locked map[string]bool, maxPayouts int) []string {
+	due := make([]string, 0)
+
+	for address, pending := range balances {
+		if !locked[address] && pending.Cmp(self.settings.GetPayoutThreshold(address)) >= 0 {
+			due = append(due, address)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		c := balances[due[i]].Cmp(balances[due[j]])
+		return c > 0 || (c == 0 && due[i] < due[j])
+	})
+
+	if len(due) > maxPayouts {
+		due = due[:maxPayouts]
+	}
+
+	return due
+}
+
+func (self *PayoutScheduler) run() error {
+	coinbase, err := self.pay.eth.GetCoinbase()
+
+	if err != nil {
+		return errors.New("could not get coinbase - " + err.Error())
+	}
+
+	// payouts locked before, which may not have made it to the payment processor
+	locks, err := self.ledger.GetOpenLocks()
+
+	if err != nil {
+		return err
+	}
+
+	locked := make(map[string]bool)
+	for _, lock := range locks {
+		address, _, _ := getLockPayment(lock)
+		locked[address] = true
+
+		err = self.enqueue(lock, coinbase)
+
+		if err != nil {
+			payoutsLog.Error("could not send payout", "miner", address, "payout", lock.Payout, "err", err)
+		}
+	}
+
+	balances, err := self.ledger.GetPendingBalances()
+
+	if err != nil {
+		return err
+	}
+
+	for _, address := range self.getDuePayouts(balances, locked, self.getMaxPayouts()) {
+		balance, err := self.ledger.GetBalance(address)
+
+		if err != nil {
+			return err
+		}
+
+		id := getPayoutId(address, balance)
+		amount := balances[address]
+
+		lock, err := self.ledger.Lock(address, amount, id)
+
+		if err != nil {
+			payoutsLog.Error("could not lock balance", "miner", address, "payout", id, "err", err)
+			continue
+		}
+
+		err = self.enqueue(lock, coinbase)
+
+		if err != nil {
+			payoutsLog.Error("could not send payout", "miner", address, "payout", id, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (*PayoutScheduler) PaymentAdded(*PendingTransaction) {
+}
+
+func (*PayoutScheduler) PaymentSent(*PendingTransaction) {
+}
+
+func (*PayoutScheduler) PaymentResent(*PendingTransaction) {
+}
+
+func (*PayoutScheduler) PaymentVerified(*PendingTransaction) {
+}
+
+// the payment stays pending, and its id is not sent again, until the payout is marked paid
+func (self *PayoutScheduler) RecordPayment(txn *PendingTransaction) error {
+	err := self.ledger.Pay(txn.Id)
+
+	// sent through echo_addPayment rather than by the scheduler
+	if err == ErrNoPayout {
+		return nil
+	}
+
+	if err != nil {
+		return errors.New("could not mark payout " + txn.Id + " paid - " + err.Error())
+	}
+
+	payoutsLog.Info("payout was paid", "payout", txn.Id)
+	return nil
+}
+
+func (self *PayoutScheduler) Start(ctx context.Context) {
+	for ctx.Err() == nil {
+		if time.Since(self.lastRun) >= self.getInterval() {
+			err := self.run()
+
+			if err != nil {
+				payoutsLog.Error("payout run failed", "err", err)
+			}
+
+			self.lastRun = time.Now()
+		}
+
+		sleepContext(ctx, time.Second)
+	}
+
+	payoutsLog.Info("stopped")
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+import "math/big"
+import "os"
+
+func TestPayoutScheduler(t *testing.T) {
+	defer os.Remove("test.payouts")
+
+	db := &journalDatabase{}
+	ledger := NewLedger(db)
+	block := &BlockCandidate{Number: "0x10", Nonce: "0x01"}
+
+	credits := &BlockCredits{Block: block,
+		Reward: NewBlockReward(big.NewInt(1000), big.NewInt(0), big.NewInt(0)),
+		Credits: []*Credit{
+			{Miner: "0x000000000000000000000000000000000000000a", Amount: "600"},
+			{Miner: "0x000000000000000000000000000000000000000b", Amount: "300"},
+			{Miner: "0x000000000000000000000000000000000000000c", Amount: "50"}}}
+	ledger.BlockCredited(credits)
+
+	pay := newTestPaymentProcessor(&MockGeth{}, "test.payouts")
+	settings := DefaultSettings()
+	settings.PayoutMaxPerRun = 1
+
+	scheduler := NewPayoutScheduler(ledger, pay, &fixedPayoutThreshold{DefaultPayoutSettings{}, big.NewInt(100)}, settings)
+	pay.RegisterListener(scheduler)
+
+	// one payout per run, largest first
+	scheduler.run()
+
+	if len(pay.pending) != 1 {
+		t.Fatal("expected one payment, found ", len(pay.pending))
+	}
+
+	var payment *PendingTransaction
+	for _, txn := range pay.pending {
+		payment = txn
+	}
+
+	if payment.Id != "0x000000000000000000000000000000000000000a:0" || payment.Transaction.getValue().Int64() != 600 {
+		t.Error("unexpected payment ", payment.Id, " ", payment.Transaction)
+	}
+
+	if scheduler.RecordPayment(payment) != nil || scheduler.RecordPayment(payment) != nil {
+		t.Error("expected the payout to be marked paid once")
+	}
+	expectLedgerBalance(t, ledger, "0x000000000000000000000000000000000000000a", "0", "0", "600")
+
+	// b is next; c is under the threshold, and b is not paid twice
+	scheduler.run()
+	scheduler.run()
+
+	if len(pay.pending) != 2 {
+		t.Error("expected a payment for b, found ", len(pay.pending))
+	}
+
+	expectLedgerBalance(t, ledger, "0x000000000000000000000000000000000000000c", "0", "50", "0")
+
+	problems, _ := ledger.Check()
+	if len(problems) != 0 {
+		t.Error("expected a balanced journal, found ", problems)
+	}
+
+	// a paid payout is not sent again, even if its pending payment was lost
+	lock, _ := ledger.getEntry(JOURNAL_LOCK + ":" + payment.Id)
+	for key := range pay.pending {
+		delete(pay.pending, key)
+	}
+
+	if err := scheduler.enqueue(lock, big.NewInt(1)); err != nil || len(pay.pending) != 0 {
+		t.Error("expected the paid payout to be skipped, found ", err, " ", len(pay.pending))
+	}
+}
+
+type fixedPayoutThreshold struct {
+	DefaultPayoutSettings
+	threshold *big.Int
+}
+
+func (self *fixedPayoutThreshold) GetPayoutThreshold(string) *big.Int {
+	return self.threshold
+}
@@ -4,45 +4,72 @@ package main
 // main pool functionality
 //
 
+import "context"
 import "math/big"
 import "time"
 import "sync"
-import "log"
 import "errors"
+import "strconv"
 
 type BlockState struct {
-    blockNumber *big.Int
-    blockDifficulty *big.Int
-    headerHash  *big.Int
-	blockStart  time.Time
-	submissions map[string]bool // check here to see if someone submitted the solution already
+	job        *Job
+	blockStart time.Time
+	staleTime  time.Time // when a newer job replaced this one; zero for the current job
+}
+
+func (self *BlockState) isStale() bool {
+	return !self.staleTime.IsZero()
 }
 
-type BlockSolution struct {
-    nonce       *big.Int
-    blockNumber *big.Int
+// shares for a replaced job are still taken for a little while
+func (self *BlockState) inGraceWindow(now time.Time) bool {
+	return !self.isStale() || now.Sub(self.staleTime) <= STALE_GRACE_TIME*time.Second
 }
 
 type MinerStat struct {
     Address     string          `json:"address"`
     Hashes      string          `json:"hashes"`
+    Hashrate    string          `json:"hashrate"`
+    Hashrates   []HashrateStat  `json:"hashrates"` // over each of HASHRATE_WINDOWS
     Payout      string          `json:"payout"`
     OnlineTime  time.Duration   `json:"online"`
     Shares      uint64          `json:"shares"`
     Blocks      uint64          `json:"blocks"`
+    Stale       uint64          `json:"stale"`         // stale shares credited within the grace window
+    StaleRejected uint64        `json:"staleRejected"` // stale shares turned away
+    Workers     []*WorkerStat   `json:"workers"`
+    MinPayout     string        `json:"minPayout,omitempty"` // from the settings store, for the web backend
+    PayoutAddress string        `json:"payoutAddress,omitempty"`
+}
+
+type WorkerStat struct {
+	Name       string         `json:"name"`
+	Shares     uint64         `json:"shares"`
+	Hashes     string         `json:"hashes"`
+	Hashrate   string         `json:"hashrate"`
+	Hashrates  []HashrateStat `json:"hashrates"` // over each of HASHRATE_WINDOWS
+	Difficulty string         `json:"difficulty"`
+	LastShare  time.Time      `json:"lastShare"`
+	LastSeen   time.Time      `json:"lastSeen"`
+
+	ClaimedHashrate string `json:"claimedHashrate"` // eth_submitHashrate of the worker's machines; 0 once offline
 }
 
 type MinerPool struct {
 	miners      map[string]*Miner
-	submissions map[string]bool // check here to see if someone submitted the solution already
-	solutions   map[string]*BlockSolution // check here to see if someone submitted the solution already
+	solutions   map[string]*BlockCandidate // blocks found recently, by nonce
+	round       uint64                     // blocks found so far; shares belong to the current round
 	stateLock   *sync.Mutex
 	tick        time.Time
 	blockStart  time.Time
 
     db Database
+    settings *Settings
+    vardiffBounds *VardiffBounds // Settings.VardiffMinDifficulty and VardiffMaxDifficulty
+    shares *ShareStore // accepted shares, to turn away duplicates
+    hashrate *HashrateWindow // accepted share difficulty of all miners
 
-    workingBlocks   []BlockState
+    workingBlocks   []*BlockState // most recent job first
 
 	totalHashrate   *big.Int
 	blockDifficulty *big.Int
@@ -51,16 +78,23 @@ type MinerPool struct {
 	seedHash        *big.Int
 }
 
-func newMinerPool(db Database) *MinerPool {
+func NewMinerPool(db Database, settings *Settings) *MinerPool {
 	blockDif := big.NewInt(0)
 	blockDif.SetString("5000000000000", 10)
 	ret := &MinerPool{miners: make(map[string]*Miner),
-		submissions:     make(map[string]bool),
 		stateLock:       &sync.Mutex{},
 		tick:            time.Now(),
 		blockStart:      time.Now(),
 
         db: db,
+        settings: settings,
+        vardiffBounds: NewVardiffBounds(settings.VardiffMinDifficulty, settings.VardiffMaxDifficulty),
+        shares: NewShareStore(db, SHARE_DEDUPE_TTL*time.Second),
+        hashrate: NewHashrateWindow(time.Now()),
+        solutions: make(map[string]*BlockCandidate),
+        round: 1,
+
+		workingBlocks:   make([]*BlockState, 0, STALE_JOB_COUNT+1),
 
 		totalHashrate:   big.NewInt(0),
 		blockDifficulty: blockDif,
@@ -68,21 +102,58 @@ func newMinerPool(db Database) *MinerPool {
 		headerHash:      big.NewInt(0),
 		seedHash:        big.NewInt(0)}
 
-    if db != nil {
-        db.Connect()
+    if db != nil && db.Connect() == nil {
+        ret.round = getNextRound(db)
     }
 
 	return ret
 }
 
-func (self *MinerPool) destroy() {
-    for key, mr := range(self.miners) {
-        self.removeMiner(mr, key)
+/*
+ * writes the stats of every miner still connected, so that nothing since the
+ * last CLIENT_DB_WRITEBACK is lost on exit
+ */
+func (self *MinerPool) Close(ctx context.Context) error {
+    self.lock()
+    miners := make(map[string]*Miner, len(self.miners))
+    for key, mr := range self.miners {
+        miners[key] = mr
+    }
+    self.unlock()
+
+    var ret error
+
+    for key, mr := range miners {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        self.lock()
+        err := self.writeMinerStats(mr)
+        delete(self.miners, key)
+        self.unlock()
+
+        if err != nil && ret == nil {
+            ret = err
+        }
     }
 
+    poolLog.Info("wrote miner stats", "miners", len(miners))
+
     if self.db != nil {
         self.db.Disconnect()
     }
+
+    return ret
+}
+
+// the fee shown in the statistics and the vardiff bounds
+func (self *MinerPool) ApplySettings(settings *Settings) {
+	self.lock()
+	self.settings = settings
+	self.unlock()
+
+	self.vardiffBounds.set(settings.VardiffMinDifficulty, settings.VardiffMaxDifficulty)
 }
 
 func (self *MinerPool) lock() {
@@ -109,6 +180,64 @@ func (self *MinerPool) getSeedHash() *big.Int {
 	return self.seedHash
 }
 
+func (self *MinerPool) getRound() uint64 {
+	self.lock()
+	defer self.unlock()
+
+	return self.round
+}
+
+// a new job from the work manager starts a new block; the previous
+// STALE_JOB_COUNT jobs are kept around for late shares
+func (self *MinerPool) NewJob(job *Job) {
+	self.lock()
+	defer self.unlock()
+
+	now := time.Now()
+	for _, state := range self.workingBlocks {
+		if !state.isStale() {
+			state.staleTime = now
+		}
+	}
+
+	state := &BlockState{job: job, blockStart: job.created}
+	self.workingBlocks = append([]*BlockState{state}, self.workingBlocks...)
+
+	if len(self.workingBlocks) > STALE_JOB_COUNT+1 {
+		self.workingBlocks = self.workingBlocks[:STALE_JOB_COUNT+1]
+	}
+
+	self.blockStart = job.created
+	self.blockNumber = job.blockNumber
+	self.blockDifficulty = job.difficulty
+	self.headerHash = job.headerHash
+	self.seedHash = job.seedHash
+}
+
+func (self *MinerPool) getBlockStateById(jobId string) *BlockState {
+	self.lock()
+	defer self.unlock()
+
+	for _, state := range self.workingBlocks {
+		if state.job.id == jobId {
+			return state
+		}
+	}
+	return nil
+}
+
+func (self *MinerPool) getBlockStateByHeader(headerHash *big.Int) *BlockState {
+	self.lock()
+	defer self.unlock()
+
+	for _, state := range self.workingBlocks {
+		if state.job.headerHash.Cmp(headerHash) == 0 {
+			return state
+		}
+	}
+	return nil
+}
+
 func (self *MinerPool) getTotalHashes() *big.Int {
 	ret := big.NewInt(0)
 	for _, mr := range self.miners {
@@ -125,19 +254,40 @@ func (self *MinerPool) getAverageHashrate() *big.Int {
 	return ret
 }
 
-func (self *MinerPool) addSolution(blockNum, nonce *big.Int) {
-    solution := &BlockSolution{blockNumber: blockNum, nonce: nonce}
-    self.solutions[nonce.String()] = solution
+// records a found block and starts the next round; called with the lock held
+func (self *MinerPool) addSolution(candidate *BlockCandidate) {
+    self.solutions[candidate.Nonce] = candidate
+    self.round++
 }
 
+// saves a found block for the payment instance to follow; called without the lock
+func (self *MinerPool) recordSolution(candidate *BlockCandidate) {
+    if self.db == nil {
+        return
+    }
+
+    err := self.db.Connect()
+
+    if err == nil {
+        err = self.db.Add(candidate)
+        self.db.Disconnect()
+    }
+
+    if err != nil {
+        poolLog.Error("could not record block candidate", "block", candidate.Number, "nonce", candidate.Nonce, "miner", candidate.Finder, "err", err)
+    }
+}
+
+// caller holds the pool lock
 func (self *MinerPool) removeMiner(miner *Miner, key string) {
-    pool.lock()
-    defer pool.unlock()
     self.writeMinerStats(miner)
 	delete(self.miners, key)
 }
 
 func (self *MinerPool) update() {
+	self.lock()
+	defer self.unlock()
+
 	now := time.Now()
 	dt := now.Sub(self.tick)
 	dstep := int64(dt.Seconds())
@@ -151,7 +301,7 @@ func (self *MinerPool) update() {
 		mr.Update(dstep)
 
 		if now.Sub(mr.lastPost) > CLIENT_TIMEOUT * time.Second {
-            log.Println("pool: removing idle miner - ", key)
+            poolLog.Info("removing idle miner", "miner", key)
 			self.removeMiner(mr, key)
 		} else if now.Sub(mr.lastStat) > CLIENT_DB_WRITEBACK * time.Second {
             self.writeMinerStats(mr)
@@ -159,11 +309,17 @@ func (self *MinerPool) update() {
         }
 	}
 
+    self.shares.expire(now)
+
+    if bans != nil {
+        bans.expire(now)
+    }
+
     staleBlockNum := big.NewInt(0)
     staleBlockNum.Set(self.blockNumber)
     staleBlockNum.Sub(staleBlockNum, big.NewInt(8))
     for key, sub := range(self.solutions) {
-        if sub.blockNumber.Cmp(staleBlockNum) < 0 {
+        if sub.getNumber().Cmp(staleBlockNum) < 0 {
             delete(self.solutions, key)
         }
     }
@@ -179,6 +335,25 @@ func (self *MinerPool) getHashrate() *big.Int {
 	return ret
 }
 
+func (self *MinerPool) collectMetrics(m *Metrics) {
+	now := time.Now()
+
+	self.lock()
+	defer self.unlock()
+
+	workers := 0
+	for _, miner := range self.miners {
+		workers += len(miner.workers)
+	}
+
+	m.Set("oneether_miners", float64(len(self.miners)))
+	m.Set("oneether_workers", float64(workers))
+
+	for _, window := range HASHRATE_WINDOWS {
+		m.Set("oneether_pool_hashrate", self.hashrate.getHashrate(window, now), "window", strconv.FormatInt(window, 10))
+	}
+}
+
 func (self *MinerPool) resetHashcounts() {
 	self.stateLock.Lock()
 	for _, mr := range self.miners {
@@ -187,30 +362,50 @@ func (self *MinerPool) resetHashcounts() {
 	self.stateLock.Unlock()
 }
 
+// the stats of a connected miner as they are now
+func (self *MinerPool) getLiveMinerStat(miner *Miner) *MinerStat {
+    return &MinerStat{Address: getHexString(miner.address, 40),
+                      Hashes: miner.hashes.String(),
+                      Hashrate: miner.getTrueHashrate().String(),
+                      Hashrates: miner.hashrate.getStats(time.Now()),
+                      Payout: miner.payout.String(),
+                      OnlineTime: miner.onlineTime,
+                      Shares: miner.shares.Uint64(),
+                      Blocks: miner.blocks.Uint64(),
+                      Stale: miner.staleShares.Uint64(),
+                      StaleRejected: miner.staleRejected.Uint64(),
+                      Workers: miner.getWorkerStats()}
+}
+
 func (self *MinerPool) writeMinerStats(miner *Miner) error {
     dt := time.Since(miner.lastStat)
     miner.onlineTime += dt
 
-    minerStat := &MinerStat{Address: getHexString(miner.address, 40),
-                            Hashes: miner.hashes.String(),
-                            Payout: miner.payout.String(),
-                            OnlineTime: miner.onlineTime,
-                            Shares: miner.shares.Uint64(),
-                            Blocks: miner.blocks.Uint64()}
+    minerStat := self.getLiveMinerStat(miner)
+
     if self.db == nil {
         return errors.New("no database")
     }
 
+    // only the payout settings; the alert email is not for the stats
+    if minerSettings != nil {
+        if settings := minerSettings.Get(minerStat.Address); settings != nil {
+            minerStat.MinPayout = settings.MinPayout
+            minerStat.PayoutAddress = settings.PayoutAddress
+        }
+    }
+
     err := self.db.Connect()
 
     if err != nil {
-        log.Println("could not connect to database")
+        poolLog.Error("could not connect to database", "err", err)
         return err
     }
 
-    log.Println("writing miner stats - ", getHexString(miner.address, 40))
+    poolLog.Debug("writing miner stats", "miner", getHexString(miner.address, 40))
 
     self.db.Update(minerStat)
+    self.db.AddTo("hashrate_history", NewHashrateSample(minerStat.Address, miner.getTrueHashrate(), len(miner.workers), time.Now()))
 
     self.db.Disconnect()
 
@@ -234,7 +429,7 @@ func (self *MinerPool) getMinerStats(miner *Miner) *MinerStat {
     err := self.db.Connect()
 
     if err != nil {
-        log.Println("could not connect to database")
+        poolLog.Error("could not connect to database", "err", err)
         return minerStat
     }
 
@@ -242,7 +437,7 @@ func (self *MinerPool) getMinerStats(miner *Miner) *MinerStat {
 
     self.db.Disconnect()
 
-    log.Println("reading miner stats: ", getHexString(miner.address, 40))
+    poolLog.Debug("reading miner stats", "miner", getHexString(miner.address, 40))
 
     return minerStat
 }
@@ -259,14 +454,19 @@ func (self *MinerPool) getMiner(address *big.Int) *Miner {
         ret.hashes.SetString(minerStats.Hashes, 10)
         ret.shares = big.NewInt(int64(minerStats.Shares))
         ret.blocks = big.NewInt(int64(minerStats.Blocks))
+        ret.staleShares = big.NewInt(int64(minerStats.Stale))
+        ret.staleRejected = big.NewInt(int64(minerStats.StaleRejected))
         ret.payout.SetString(minerStats.Payout, 10)
         ret.onlineTime = minerStats.OnlineTime
 
+        for _, stat := range minerStats.Workers {
+            ret.workerStats[stat.Name] = stat
+        }
+
         teraHashes := big.NewRat(1,1)
         teraHashes.SetFrac(ret.hashes, big.NewInt(1000000000000))
         fteraHashes, _ := teraHashes.Float64()
-        log.Println("new miner joined: ", minerStr)
-        log.Println("info: ", ret.onlineTime, " - terahashes: ", fteraHashes, " blocks: ", ret.blocks.String())
+        poolLog.Info("new miner joined", "miner", minerStr, "onlineTime", ret.onlineTime, "terahashes", fteraHashes, "blocks", ret.blocks)
     }
 
 	return ret
@@ -276,21 +476,16 @@ func (self *MinerPool) getTotalHashrate() *big.Int {
 	return self.totalHashrate
 }
 
-func (self *MinerPool) start(finished chan bool) {
-	for !SHUTDOWN {
-		time.Sleep(time.Duration(POOL_POLL_TIME) * time.Second)
+func (self *MinerPool) start(ctx context.Context) {
+	for sleepContext(ctx, time.Duration(POOL_POLL_TIME)*time.Second) {
 		pool.update()
 
-		for _, mr := range pool.miners {
-            if server != nil {
-                pool.lock()
-			    server.SubmitHashrate(mr)
-                pool.unlock()
-            }
+		if server != nil {
+			pool.lock()
+			for _, mr := range pool.miners {
+				server.SubmitHashrate(mr)
+			}
+			pool.unlock()
 		}
 	}
-
-    self.destroy()
-
-	finished <- true
 }
@@ -0,0 +1,124 @@
+package main
+
+import "testing"
+import "time"
+import "math/big"
+import "sync"
+
+func newTestJob(id string, header int64) *Job {
+	return &Job{id: id,
+		headerHash:  big.NewInt(header),
+		seedHash:    big.NewInt(0),
+		target:      big.NewInt(1),
+		difficulty:  big.NewInt(1),
+		blockNumber: big.NewInt(header),
+		created:     time.Now()}
+}
+
+func TestRecentJobs(t *testing.T) {
+	pool := NewMinerPool(nil, DefaultSettings())
+
+	for i := int64(1); i <= STALE_JOB_COUNT+3; i++ {
+		pool.NewJob(newTestJob(getHexString(big.NewInt(i), 8), i))
+	}
+
+	if len(pool.workingBlocks) != STALE_JOB_COUNT+1 {
+		t.Error("expected ", STALE_JOB_COUNT+1, " recent jobs, found ", len(pool.workingBlocks))
+	}
+
+	current := pool.getBlockStateByHeader(big.NewInt(STALE_JOB_COUNT + 3))
+
+	if current == nil || current.isStale() {
+		t.Error("expected the newest job to be current")
+	}
+
+	previous := pool.getBlockStateById(getHexString(big.NewInt(STALE_JOB_COUNT+2), 8))
+
+	if previous == nil || !previous.isStale() {
+		t.Error("expected the previous job to be stale")
+	}
+
+	if pool.getBlockStateByHeader(big.NewInt(1)) != nil {
+		t.Error("expected the oldest job to be dropped")
+	}
+}
+
+func TestStaleGraceWindow(t *testing.T) {
+	now := time.Now()
+	state := &BlockState{job: newTestJob("1", 1), blockStart: now}
+
+	if !state.inGraceWindow(now.Add(time.Hour)) {
+		t.Error("expected the current job to always take shares")
+	}
+
+	state.staleTime = now
+
+	if !state.inGraceWindow(now.Add(time.Second)) {
+		t.Error("expected a just replaced job to take shares")
+	}
+
+	if state.inGraceWindow(now.Add(time.Duration(STALE_GRACE_TIME+1) * time.Second)) {
+		t.Error("expected shares after the grace window to be stale")
+	}
+}
+
+func TestStaleRate(t *testing.T) {
+	miner := MinerNew(nil, big.NewInt(1), time.Now())
+	miner.shares.SetInt64(8)
+	miner.staleShares.SetInt64(1)
+	miner.staleRejected.SetInt64(2)
+
+	if rate := miner.getStaleRate(); rate < 0.29 || rate > 0.31 {
+		t.Error("expected stale rate of 0.3, found ", rate)
+	}
+}
+
+// run with make race: http getwork, stratum logins and the pool's own update share the miners
+func TestConcurrentMinerAccess(t *testing.T) {
+	pool = NewMinerPool(nil, DefaultSettings())
+	work = NewWorkManager(&MockGeth{blockNumber: 10, headerHash: 0x1234})
+	work.update()
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := int64(0); j < 50; j++ {
+				_, err := eth_getWork(NewRPCRequest(1, "eth_getWork", RPCParams{}), big.NewInt(j), "http")
+
+				if err != nil {
+					t.Error("could not get work - ", err)
+					return
+				}
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := int64(0); j < 50; j++ {
+				pool.lock()
+				pool.getMiner(big.NewInt(j)).touch("stratum")
+				pool.unlock()
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pool.lock()
+				pool.tick = pool.tick.Add(-time.Second)
+				pool.unlock()
+				pool.update()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(pool.miners) != 50 || len(pool.getMiner(big.NewInt(1)).workers) != 2 {
+		t.Error("expected 50 miners with 2 workers each, found ", len(pool.miners))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+//
+// settings reload
+// on SIGHUP the settings are loaded again from the -config file and the
+// environment. if they are valid, the ones tagged live in Settings are handed
+// to every registered SettingsListener, each of which swaps them in under its
+// own lock. changes to the other settings are reported as needing a restart
+// and otherwise ignored; invalid settings change nothing
+//
+
+import "context"
+import "os"
+import "os/signal"
+import "reflect"
+import "strings"
+import "sync"
+import "syscall"
+
+type SettingsListener interface {
+	ApplySettings(settings *Settings)
+}
+
+// LogLevel, LogLevels and LogFormat; levels changed on /log since are reset
+type loggingSettingsListener struct {
+}
+
+func (loggingSettingsListener) ApplySettings(settings *Settings) {
+	err := configureLogging(settings.LogLevel, settings.LogLevels, settings.LogFormat)
+
+	if err != nil {
+		mainLog.Error("could not apply log settings", "err", err)
+	}
+}
+
+// json names of the changed settings
+type SettingsReload struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart"` // changed, but only read at startup
+}
+
+type SettingsReloader struct {
+	filename  string
+	lookup    func(string) (string, bool)
+	lock      *sync.Mutex
+	current   *Settings
+	listeners []SettingsListener
+}
+
+func NewSettingsReloader(filename string, lookup func(string) (string, bool), current *Settings) *SettingsReloader {
+	return &SettingsReloader{filename: filename,
+		lookup:    lookup,
+		lock:      &sync.Mutex{},
+		current:   current,
+		listeners: make([]SettingsListener, 0, 8)}
+}
+
+func (self *SettingsReloader) RegisterListener(l SettingsListener) {
+	self.listeners = append(self.listeners, l)
+}
+
+/*
+ * the current settings with the live settings of next. the current settings
+ * are not changed
+ */
+func mergeLiveSettings(current, next *Settings) (*Settings, *SettingsReload) {
+	merged := *current
+	ret := &SettingsReload{Applied: []string{}, Restart: []string{}}
+
+	to := reflect.ValueOf(&merged).Elem()
+	from := reflect.ValueOf(next).Elem()
+
+	for i := 0; i < to.NumField(); i++ {
+		if reflect.DeepEqual(to.Field(i).Interface(), from.Field(i).Interface()) {
+			continue
+		}
+
+		field := to.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		if field.Tag.Get("live") != "true" {
+			ret.Restart = append(ret.Restart, name)
+			continue
+		}
+
+		to.Field(i).Set(from.Field(i))
+		ret.Applied = append(ret.Applied, name)
+	}
+
+	return &merged, ret
+}
+
+// loads the settings and applies the live ones that changed
+func (self *SettingsReloader) Reload() (*SettingsReload, error) {
+	next, err := LoadSettings(self.filename, self.lookup)
+
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	merged, ret := mergeLiveSettings(self.current, next)
+
+	// the live settings are checked with the ones the pool is running with
+	err = merged.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ret.Applied) > 0 {
+		for _, listener := range self.listeners {
+			listener.ApplySettings(merged)
+		}
+	}
+
+	self.current = merged
+	return ret, nil
+}
+
+// reloads on every SIGHUP until the context is cancelled
+func (self *SettingsReloader) Start(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		reload, err := self.Reload()
+
+		if err != nil {
+			mainLog.Error("could not reload settings, keeping the current ones", "file", self.filename, "err", err)
+			continue
+		}
+
+		mainLog.Info("reloaded settings", "file", self.filename, "applied", strings.Join(reload.Applied, ","))
+
+		if len(reload.Restart) > 0 {
+			mainLog.Warn("changed settings need a restart", "settings", strings.Join(reload.Restart, ","))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import "io/ioutil"
+import "math/big"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+func TestMergeLiveSettings(t *testing.T) {
+	current := DefaultSettings()
+	next := DefaultSettings()
+	next.HouseRake = 0.01
+	next.BanDenylist = []string{"10.0.0.1"}
+	next.GethIP = "10.0.0.2"
+
+	merged, reload := mergeLiveSettings(current, next)
+
+	if strings.Join(reload.Applied, ",") != "houseRake,banDenylist" || strings.Join(reload.Restart, ",") != "gethIp" {
+		t.Error("unexpected changes ", reload)
+	}
+
+	if merged.HouseRake != 0.01 || len(merged.BanDenylist) != 1 || merged.GethIP != current.GethIP {
+		t.Error("expected only the live settings to change, found ", merged)
+	}
+
+	if current.HouseRake != 0.02 {
+		t.Error("expected the current settings to be left alone")
+	}
+}
+
+func writeSettingsFile(t *testing.T, filename string, settings string) {
+	err := ioutil.WriteFile(filename, []byte(settings), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSettingsReload(t *testing.T) {
+	file, _ := ioutil.TempFile("", "settings")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeSettingsFile(t, file.Name(), `{}`)
+	settings, _ := LoadSettings(file.Name(), noEnv)
+
+	testPool := NewMinerPool(nil, settings)
+	testBans, _ := NewBanManager(settings, "")
+	store := NewMinerSettingsStore(nil, settings)
+	scheme, _ := NewRewardScheme("pplns", settings.HouseRake)
+	accountant := NewRoundAccountant(scheme, nil, nil)
+
+	reloader := NewSettingsReloader(file.Name(), noEnv, settings)
+	reloader.RegisterListener(testPool)
+	reloader.RegisterListener(testBans)
+	reloader.RegisterListener(store)
+	reloader.RegisterListener(accountant)
+
+	writeSettingsFile(t, file.Name(), `{"houseRake": 0.01, "vardiffMinDifficulty": 5000000, "payoutMinimum": "20",
+		"banDenylist": ["10.0.0.1"], "stratumPort": ""}`)
+
+	reload, err := reloader.Reload()
+
+	if err != nil {
+		t.Fatal("could not reload - ", err)
+	}
+
+	if strings.Join(reload.Restart, ",") != "stratumPort" || len(reload.Applied) != 4 {
+		t.Error("unexpected changes ", reload)
+	}
+
+	if testPool.settings.HouseRake != 0.01 || testPool.settings.StratumPort != "8008" ||
+		testPool.vardiffBounds.clamp(big.NewInt(1)).Int64() != 5000000 {
+		t.Error("expected the pool to get the new fee and vardiff bounds only, found ", testPool.settings)
+	}
+
+	if !testBans.IsBanned("10.0.0.1", nil, time.Now()) || store.getPayoutMinimum().Int64() != 20 {
+		t.Error("expected the new ban list and payout minimum")
+	}
+
+	if accountant.scheme.(*PPLNSScheme).fee != 0.01 {
+		t.Error("expected the new fee in the reward scheme, found ", accountant.scheme)
+	}
+
+	writeSettingsFile(t, file.Name(), `{"houseRake": 0.01, "vardiffMinDifficulty": 5000000, "payoutMinimum": "20",
+		"banDenylist": ["10.0.0.1"], "stratumPort": "", "rewardScheme": "prop"}`)
+
+	if _, err = reloader.Reload(); err != nil {
+		t.Fatal("could not reload - ", err)
+	}
+
+	if accountant.scheme.Name() != "prop" || testPool.settings.RewardScheme != "prop" {
+		t.Error("expected the new reward scheme, found ", accountant.scheme.Name())
+	}
+
+	// invalid settings change nothing
+	writeSettingsFile(t, file.Name(), `{"houseRake": 0.03, "banDenylist": ["nowhere"]}`)
+
+	if _, err = reloader.Reload(); err == nil {
+		t.Error("expected an invalid ban list to be rejected")
+	}
+
+	if testPool.settings.HouseRake != 0.01 || accountant.scheme.(*PropScheme).fee != 0.01 {
+		t.Error("expected the fee to be kept after a failed reload")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+//
+// reward schemes
+// decide how much of a block reward (or of the expected reward, for the pay
+// per share schemes) each miner is credited. all amounts are in wei and
+// splits are exact: the credits and the pool fee add up to the reward
+//
+
+import "errors"
+import "math"
+import "math/big"
+import "sort"
+import "strings"
+
+// where block rewards come from
+type BlockRewardSource interface {
+	GetBaseReward(blockNumber *big.Int) *big.Int
+	GetBlockReward(blockNumber *big.Int) (*BlockReward, error)
+	GetUncleReward(uncle, nephew *big.Int) *big.Int
+}
+
+// shares of the share log, as used by the schemes paying on blocks
+type ShareSource interface {
+	GetRoundShares(round uint64) ([]*ShareRecord, error)
+	GetSharesBefore(block *BlockCandidate, limit int) ([]*ShareRecord, error) // newest first
+}
+
+type RewardScheme interface {
+	Name() string
+	// credit for an accepted share, nil if the scheme only pays on blocks
+	ShareCredit(share *ShareRecord, baseReward *big.Int) *big.Int
+	// what a share is expected to earn, shown to miners before blocks are credited
+	ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int
+	// credits by miner address for a matured block
+	BlockCredits(block *BlockCandidate, reward *BlockReward, shares ShareSource) (map[string]*big.Int, error)
+}
+
+// fee is the pool's part of every reward (Settings.HouseRake)
+func NewRewardScheme(name string, fee float64) (RewardScheme, error) {
+	switch strings.ToLower(name) {
+	case "pplns":
+		return &PPLNSScheme{window: PPLNS_WINDOW, fee: fee}, nil
+	case "prop":
+		return &PropScheme{fee: fee}, nil
+	case "pps":
+		return &PPSScheme{fee: fee}, nil
+	case "pps+":
+		return &PPSPlusScheme{fees: &PPLNSScheme{window: PPLNS_WINDOW, fee: fee}}, nil
+	case "solo":
+		return &SoloScheme{fee: fee}, nil
+	}
+
+	return nil, errors.New("unknown reward scheme: " + name)
+}
+
+// splits an amount into what goes to miners and the pool fee
+func takePoolFee(amount *big.Int, rake float64) (*big.Int, *big.Int) {
+	basisPoints := int64(math.Round(rake * 10000))
+	fee := big.NewInt(0).Mul(amount, big.NewInt(basisPoints))
+	fee.Div(fee, big.NewInt(10000))
+	return big.NewInt(0).Sub(amount, fee), fee
+}
+
+/*
+ * splits an amount by weight, exactly: everyone gets the floor of their part,
+ * and the wei left over go one each to the largest remainders
+ */
+func splitReward(amount *big.Int, weights map[string]*big.Int) map[string]*big.Int {
+	ret := make(map[string]*big.Int)
+	total := big.NewInt(0)
+	keys := make([]string, 0, len(weights))
+
+	for key, weight := range weights {
+		if weight.Sign() > 0 {
+			total.Add(total, weight)
+			keys = append(keys, key)
+		}
+	}
+
+	if total.Sign() <= 0 {
+		return ret
+	}
+
+	remainders := make(map[string]*big.Int)
+	left := big.NewInt(0).Set(amount)
+
+	for _, key := range keys {
+		part := big.NewInt(0).Mul(amount, weights[key])
+		remainder := big.NewInt(0)
+		part.DivMod(part, total, remainder)
+		ret[key] = part
+		remainders[key] = remainder
+		left.Sub(left, part)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		c := remainders[keys[i]].Cmp(remainders[keys[j]])
+		return c > 0 || (c == 0 && keys[i] < keys[j])
+	})
+
+	for i := 0; left.Sign() > 0; i++ {
+		ret[keys[i%len(keys)]].Add(ret[keys[i%len(keys)]], big.NewInt(1))
+		left.Sub(left, big.NewInt(1))
+	}
+
+	return ret
+}
+
+func getShareWeights(shares []*ShareRecord) map[string]*big.Int {
+	weights := make(map[string]*big.Int)
+	for _, share := range shares {
+		if _, ok := weights[share.Miner]; !ok {
+			weights[share.Miner] = big.NewInt(0)
+		}
+		weights[share.Miner].Add(weights[share.Miner], share.getDifficulty())
+	}
+	return weights
+}
+
+/*
+ * pay per last N shares: the reward is split over the most recent shares
+ * before the block, up to 'window' times the block difficulty
+ */
+type PPLNSScheme struct {
+	window float64
+	fee    float64
+}
+
+func (*PPLNSScheme) Name() string {
+	return "pplns"
+}
+
+func (*PPLNSScheme) ShareCredit(*ShareRecord, *big.Int) *big.Int {
+	return nil
+}
+
+func (self *PPLNSScheme) ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return getPPSCredit(share, baseReward, self.fee)
+}
+
+func (self *PPLNSScheme) getWeights(block *BlockCandidate, shares ShareSource) (map[string]*big.Int, error) {
+	difficulty, _ := big.NewInt(0).SetString(block.Difficulty, 10)
+	window, _ := new(big.Float).Mul(new(big.Float).SetInt(difficulty), big.NewFloat(self.window)).Int(nil)
+
+	recent, err := shares.GetSharesBefore(block, SHARE_LOG_LIMIT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make(map[string]*big.Int)
+
+	for _, share := range recent {
+		if window.Sign() <= 0 {
+			break
+		}
+
+		// the oldest share in the window only counts for the part that fits
+		weight := share.getDifficulty()
+		if weight.Cmp(window) > 0 {
+			weight = big.NewInt(0).Set(window)
+		}
+		window.Sub(window, weight)
+
+		if _, ok := weights[share.Miner]; !ok {
+			weights[share.Miner] = big.NewInt(0)
+		}
+		weights[share.Miner].Add(weights[share.Miner], weight)
+	}
+
+	return weights, nil
+}
+
+func (self *PPLNSScheme) BlockCredits(block *BlockCandidate, reward *BlockReward, shares ShareSource) (map[string]*big.Int, error) {
+	weights, err := self.getWeights(block, shares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	net, _ := takePoolFee(reward.getTotal(), self.fee)
+	return splitReward(net, weights), nil
+}
+
+/*
+ * proportional: the reward is split over the shares of the round the block ended
+ */
+type PropScheme struct {
+	fee float64
+}
+
+func (*PropScheme) Name() string {
+	return "prop"
+}
+
+func (*PropScheme) ShareCredit(*ShareRecord, *big.Int) *big.Int {
+	return nil
+}
+
+func (self *PropScheme) ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return getPPSCredit(share, baseReward, self.fee)
+}
+
+func (self *PropScheme) BlockCredits(block *BlockCandidate, reward *BlockReward, shares ShareSource) (map[string]*big.Int, error) {
+	round, err := shares.GetRoundShares(block.Round)
+
+	if err != nil {
+		return nil, err
+	}
+
+	net, _ := takePoolFee(reward.getTotal(), self.fee)
+	return splitReward(net, getShareWeights(round)), nil
+}
+
+/*
+ * pay per share: every share is worth its part of the expected block
+ * reward right away. blocks belong to the pool
+ */
+type PPSScheme struct {
+	fee float64
+}
+
+func (*PPSScheme) Name() string {
+	return "pps"
+}
+
+func getPPSCredit(share *ShareRecord, baseReward *big.Int, fee float64) *big.Int {
+	blockDifficulty := share.getBlockDifficulty()
+
+	if blockDifficulty.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	credit := big.NewInt(0).Mul(baseReward, share.getDifficulty())
+	credit.Div(credit, blockDifficulty)
+	net, _ := takePoolFee(credit, fee)
+	return net
+}
+
+func (self *PPSScheme) ShareCredit(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return getPPSCredit(share, baseReward, self.fee)
+}
+
+func (self *PPSScheme) ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return self.ShareCredit(share, baseReward)
+}
+
+func (*PPSScheme) BlockCredits(*BlockCandidate, *BlockReward, ShareSource) (map[string]*big.Int, error) {
+	return make(map[string]*big.Int), nil
+}
+
+/*
+ * pps for the base reward, and pplns for the transaction fees
+ */
+type PPSPlusScheme struct {
+	fees *PPLNSScheme
+}
+
+func (*PPSPlusScheme) Name() string {
+	return "pps+"
+}
+
+func (self *PPSPlusScheme) ShareCredit(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return getPPSCredit(share, baseReward, self.fees.fee)
+}
+
+// the transaction fees are left out
+func (self *PPSPlusScheme) ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return self.ShareCredit(share, baseReward)
+}
+
+func (self *PPSPlusScheme) BlockCredits(block *BlockCandidate, reward *BlockReward, shares ShareSource) (map[string]*big.Int, error) {
+	weights, err := self.fees.getWeights(block, shares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	net, _ := takePoolFee(reward.Fees, self.fees.fee)
+	return splitReward(net, weights), nil
+}
+
+/*
+ * solo: the miner who found the block gets all of it
+ */
+type SoloScheme struct {
+	fee float64
+}
+
+func (*SoloScheme) Name() string {
+	return "solo"
+}
+
+func (*SoloScheme) ShareCredit(*ShareRecord, *big.Int) *big.Int {
+	return nil
+}
+
+// on average; the finder of a block gets all of it
+func (self *SoloScheme) ShareEstimate(share *ShareRecord, baseReward *big.Int) *big.Int {
+	return getPPSCredit(share, baseReward, self.fee)
+}
+
+func (self *SoloScheme) BlockCredits(block *BlockCandidate, reward *BlockReward, shares ShareSource) (map[string]*big.Int, error) {
+	net, _ := takePoolFee(reward.getTotal(), self.fee)
+	return map[string]*big.Int{block.Finder: net}, nil
+}
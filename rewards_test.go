@@ -0,0 +1,188 @@
+package main
+
+import "context"
+import "errors"
+import "testing"
+import "math/big"
+import "time"
+
+// newest share last
+type memoryShareSource struct {
+	shares []*ShareRecord
+}
+
+func (self *memoryShareSource) GetRoundShares(round uint64) ([]*ShareRecord, error) {
+	ret := make([]*ShareRecord, 0)
+	for _, share := range self.shares {
+		if share.Round == round {
+			ret = append(ret, share)
+		}
+	}
+	return ret, nil
+}
+
+func (self *memoryShareSource) GetSharesBefore(block *BlockCandidate, limit int) ([]*ShareRecord, error) {
+	ret := make([]*ShareRecord, 0)
+	for i := len(self.shares) - 1; i >= 0 && len(ret) < limit; i-- {
+		ret = append(ret, self.shares[i])
+	}
+	return ret, nil
+}
+
+func newTestShare(round uint64, miner string, difficulty int64) *ShareRecord {
+	return &ShareRecord{Round: round, Miner: miner, Difficulty: big.NewInt(difficulty).String(),
+		BlockNumber: "0x10", BlockDifficulty: "1000", Time: time.Now()}
+}
+
+func sumCredits(credits map[string]*big.Int) *big.Int {
+	ret := big.NewInt(0)
+	for _, credit := range credits {
+		ret.Add(ret, credit)
+	}
+	return ret
+}
+
+func TestSplitReward(t *testing.T) {
+	weights := map[string]*big.Int{"a": big.NewInt(1), "b": big.NewInt(1), "c": big.NewInt(1)}
+	credits := splitReward(big.NewInt(100), weights)
+
+	if sumCredits(credits).Cmp(big.NewInt(100)) != 0 {
+		t.Error("expected credits to add up to 100, found ", sumCredits(credits))
+	}
+
+	if credits["a"].Int64() != 34 || credits["b"].Int64() != 33 || credits["c"].Int64() != 33 {
+		t.Error("unexpected split ", credits)
+	}
+
+	net, fee := takePoolFee(big.NewInt(1000), 0.02)
+	if net.Int64() != 980 || fee.Int64() != 20 {
+		t.Error("expected 980 and 20, found ", net, fee)
+	}
+}
+
+func TestRewardSchemes(t *testing.T) {
+	shares := &memoryShareSource{shares: []*ShareRecord{
+		newTestShare(1, "a", 500),
+		newTestShare(2, "a", 1000),
+		newTestShare(2, "b", 500),
+		newTestShare(2, "b", 1000),
+	}}
+	block := &BlockCandidate{Number: "0x10", Difficulty: "1000", Finder: "b", Round: 2}
+	reward := NewBlockReward(big.NewInt(10000), big.NewInt(0), big.NewInt(1000))
+
+	// window of 2 * 1000: b's 1500 and 500 of a's last share
+	pplns, _ := NewRewardScheme("pplns", 0.02)
+	credits, _ := pplns.BlockCredits(block, reward, shares)
+
+	if credits["a"].Int64() != 2695 || credits["b"].Int64() != 8085 {
+		t.Error("unexpected pplns credits ", credits)
+	}
+
+	// round 2 only: a 1000, b 1500
+	prop, _ := NewRewardScheme("prop", 0.02)
+	credits, _ = prop.BlockCredits(block, reward, shares)
+
+	if credits["a"].Int64() != 4312 || credits["b"].Int64() != 6468 {
+		t.Error("unexpected prop credits ", credits)
+	}
+
+	solo, _ := NewRewardScheme("solo", 0.02)
+	credits, _ = solo.BlockCredits(block, reward, shares)
+
+	if len(credits) != 1 || credits["b"].Int64() != 10780 {
+		t.Error("unexpected solo credits ", credits)
+	}
+
+	// a share of half the block difficulty is worth half the base reward
+	pps, _ := NewRewardScheme("pps", 0.02)
+	if credit := pps.ShareCredit(newTestShare(2, "a", 500), big.NewInt(10000)); credit.Int64() != 4900 {
+		t.Error("expected pps credit of 4900, found ", credit)
+	}
+
+	credits, _ = pps.BlockCredits(block, reward, shares)
+	if len(credits) != 0 {
+		t.Error("expected pps blocks to go to the pool, found ", credits)
+	}
+
+	// pps+ shares out only the fees on blocks
+	ppsplus, _ := NewRewardScheme("pps+", 0.02)
+	credits, _ = ppsplus.BlockCredits(block, reward, shares)
+
+	if sumCredits(credits).Int64() != 980 {
+		t.Error("expected pps+ to credit 980 in fees, found ", credits)
+	}
+
+	if _, err := NewRewardScheme("ppsx", 0.02); err == nil {
+		t.Error("expected unknown scheme to fail")
+	}
+}
+
+type shareLogDatabase struct {
+	Database
+	fail   bool
+	shares []*ShareRecord
+}
+
+func (self *shareLogDatabase) Connect() error    { return nil }
+func (self *shareLogDatabase) Disconnect() error { return nil }
+
+func (self *shareLogDatabase) AddTo(table string, item interface{}) error {
+	if self.fail {
+		return errors.New("database is down")
+	}
+	self.shares = append(self.shares, item.(*ShareRecord))
+	return nil
+}
+
+type recordingCreditListener struct {
+	CreditListener
+	credits []*Credit
+}
+
+func (self *recordingCreditListener) Credited(credit *Credit) {
+	self.credits = append(self.credits, credit)
+}
+
+func TestShareLogQueue(t *testing.T) {
+	db := &shareLogDatabase{}
+	calculator, _ := NewBlockRewardCalculator(&MockGeth{}, BLOCK_REWARD_FORKS)
+	scheme, _ := NewRewardScheme("pps", 0.02)
+	credits := &recordingCreditListener{}
+
+	accountant := NewRoundAccountant(scheme, NewShareLog(db), calculator)
+	accountant.RegisterListener(credits)
+
+	// nothing is written or credited on the submit path
+	if accountant.ShareAccepted(newTestShare(1, "a", 500)).Sign() <= 0 || len(db.shares) != 0 || len(credits.credits) != 0 {
+		t.Error("expected the share to be queued, found ", len(db.shares), " logged")
+	}
+
+	// shares that could not be logged are not credited
+	db.fail = true
+	accountant.Close(context.Background())
+
+	if len(credits.credits) != 0 {
+		t.Error("expected no credit for a share that was not logged")
+	}
+
+	db.fail = false
+	accountant.ShareAccepted(newTestShare(1, "a", 500))
+	accountant.ShareAccepted(newTestShare(1, "b", 500))
+	accountant.Close(context.Background())
+
+	if len(db.shares) != 2 || len(credits.credits) != 2 || credits.credits[1].Miner != "b" {
+		t.Error("expected both shares to be logged and credited, found ", len(db.shares), " and ", len(credits.credits))
+	}
+
+	// the schemes paying on blocks still report what a share is expected to earn
+	pplns, _ := NewRewardScheme("pplns", 0.02)
+	accountant = NewRoundAccountant(pplns, NewShareLog(db), calculator)
+	accountant.RegisterListener(credits)
+
+	expected := accountant.ShareAccepted(newTestShare(1, "c", 500))
+	accountant.Close(context.Background())
+
+	if expected.Cmp(credits.credits[0].getAmount()) != 0 || len(db.shares) != 3 || len(credits.credits) != 2 {
+		t.Error("expected the pps value of the share without a credit, found ", expected)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+//
+// round accounting
+// accepted shares go to a persisted share log, tagged with the round they
+// were found in (a round ends when the pool finds a block). the accountant
+// turns shares and matured blocks into credits using the pool's reward scheme.
+// shares are logged off the submit path, and credited once they are logged
+//
+
+import "context"
+import "errors"
+import "math/big"
+import "sync"
+import "time"
+
+type ShareRecord struct {
+	Key             string    `json:"key" bson:"key"` // of the ShareSubmission, unique
+	Round           uint64    `json:"round" bson:"round"`
+	Miner           string    `json:"miner" bson:"miner"`
+	Worker          string    `json:"worker" bson:"worker"`
+	Difficulty      string    `json:"difficulty" bson:"difficulty"`
+	BlockNumber     string    `json:"blockNumber" bson:"blockNumber"`
+	BlockDifficulty string    `json:"blockDifficulty" bson:"blockDifficulty"` // network difficulty of the job
+	Time            time.Time `json:"time" bson:"time"`
+}
+
+func NewShareRecord(key string, round uint64, miner *Miner, worker string, difficulty *big.Int, job *Job, now time.Time) *ShareRecord {
+	return &ShareRecord{Key: key,
+		Round:           round,
+		Miner:           getHexString(miner.address, 40),
+		Worker:          worker,
+		Difficulty:      difficulty.String(),
+		BlockNumber:     getHexString(job.blockNumber, 0),
+		BlockDifficulty: job.difficulty.String(),
+		Time:            now}
+}
+
+func (self *ShareRecord) getDifficulty() *big.Int {
+	ret, _ := big.NewInt(0).SetString(self.Difficulty, 10)
+	return ret
+}
+
+func (self *ShareRecord) getBlockDifficulty() *big.Int {
+	ret, _ := big.NewInt(0).SetString(self.BlockDifficulty, 10)
+	return ret
+}
+
+/*
+ * the share log, in the "share_records" table
+ */
+type ShareLog struct {
+	db Database
+}
+
+func NewShareLog(db Database) *ShareLog {
+	return &ShareLog{db: db}
+}
+
+// writes shares in order over one connection; returns how many were written
+func (self *ShareLog) addAll(shares []*ShareRecord) (int, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer self.db.Disconnect()
+
+	for i, share := range shares {
+		err = self.db.AddTo("share_records", share)
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(shares), nil
+}
+
+func (self *ShareLog) find(query map[string]interface{}, sort string, limit int) ([]*ShareRecord, error) {
+	err := self.db.Connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.db.Disconnect()
+
+	shares := make([]*ShareRecord, 0)
+	err = self.db.FindIn("share_records", query, sort, limit, &shares)
+	return shares, err
+}
+
+func (self *ShareLog) GetRoundShares(round uint64) ([]*ShareRecord, error) {
+	return self.find(map[string]interface{}{"round": round}, "", 0)
+}
+
+func (self *ShareLog) GetSharesBefore(block *BlockCandidate, limit int) ([]*ShareRecord, error) {
+	query := map[string]interface{}{"time": map[string]interface{}{"$lte": block.Found}}
+	return self.find(query, "-time", limit)
+}
+
+/*
+ * a credit to a miner's balance, for a share (pay per share schemes) or a block
+ */
+type Credit struct {
+	Share  string    `json:"share,omitempty" bson:"share,omitempty"` // key of the share credited; empty for block credits
+	Miner  string    `json:"miner" bson:"miner"`
+	Amount string    `json:"amount" bson:"amount"` // wei
+	Round  uint64    `json:"round" bson:"round"`
+	Block  string    `json:"block" bson:"block"` // number of the block paid out; empty for share credits
+	Nonce  string    `json:"nonce" bson:"nonce"`
+	Scheme string    `json:"scheme" bson:"scheme"`
+	Time   time.Time `json:"time" bson:"time"`
+}
+
+func (self *Credit) getAmount() *big.Int {
+	ret, _ := big.NewInt(0).SetString(self.Amount, 10)
+	return ret
+}
+
+// the credits for one block; provisional while the block is immature
+type BlockCredits struct {
+	Block    *BlockCandidate
+	Reward   *BlockReward
+	Immature bool
+	Credits  []*Credit
+}
+
+// what is left of the reward after the miners are credited
+func (self *BlockCredits) getPoolFee() *big.Int {
+	ret := self.Reward.getTotal()
+	for _, credit := range self.Credits {
+		ret.Sub(ret, credit.getAmount())
+	}
+	return ret
+}
+
+type CreditListener interface {
+	Credited(*Credit)              // share credits, final right away
+	BlockCredited(*BlockCredits)   // once when the block is immature, and again when it matures
+	BlockReverted(*BlockCandidate) // an immature block was orphaned; its immature credits are void
+}
+
+// an accepted share waiting for the share log
+type queuedShare struct {
+	share  *ShareRecord
+	credit *Credit // nil for the schemes paying on blocks
+}
+
+type RoundAccountant struct {
+	scheme    RewardScheme
+	shares    *ShareLog
+	rewards   BlockRewardSource
+	lock      *sync.Mutex
+	listeners []CreditListener
+	queue     chan *queuedShare
+}
+
+func NewRoundAccountant(scheme RewardScheme, shares *ShareLog, rewards BlockRewardSource) *RoundAccountant {
+	return &RoundAccountant{scheme: scheme,
+		shares:    shares,
+		rewards:   rewards,
+		lock:      &sync.Mutex{},
+		listeners: make([]CreditListener, 0, 4),
+		queue:     make(chan *queuedShare, SHARE_LOG_QUEUE_SIZE)}
+}
+
+func (self *RoundAccountant) RegisterListener(l CreditListener) {
+	self.listeners = append(self.listeners, l)
+}
+
+func (self *RoundAccountant) credit(credit *Credit) {
+	if credit.getAmount().Sign() <= 0 {
+		return
+	}
+
+	for _, listener := range self.listeners {
+		listener.Credited(credit)
+	}
+}
+
+func (self *RoundAccountant) creditBlock(block *BlockCandidate, immature bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	credits, err := self.getBlockCredits(block, immature)
+
+	if err != nil {
+		rewardsLog.Error("could not credit block", "block", block.Number, "nonce", block.Nonce, "err", err)
+		return
+	}
+
+	rewardsLog.Info("crediting block", "block", block.Number, "nonce", block.Nonce, "miners", len(credits.Credits), "scheme", self.scheme.Name(), "immature", immature)
+
+	for _, listener := range self.listeners {
+		listener.BlockCredited(credits)
+	}
+}
+
+/*
+ * queues an accepted share for the share log; it is credited once it is
+ * logged. returns what the share is worth: its credit, or its expected value
+ * for the schemes paying on blocks. if the queue is full the share is written
+ * right away
+ */
+func (self *RoundAccountant) ShareAccepted(share *ShareRecord) *big.Int {
+	self.lock.Lock()
+	scheme := self.scheme
+	self.lock.Unlock()
+
+	number, _ := parseHex(share.BlockNumber, 0)
+	baseReward := self.rewards.GetBaseReward(number)
+	amount := scheme.ShareCredit(share, baseReward)
+	queued := &queuedShare{share: share}
+
+	if amount != nil {
+		queued.credit = &Credit{Share: share.Key,
+			Miner:  share.Miner,
+			Amount: amount.String(),
+			Round:  share.Round,
+			Scheme: scheme.Name(),
+			Time:   share.Time}
+	}
+
+	select {
+	case self.queue <- queued:
+	default:
+		rewardsLog.Warn("share log queue is full, writing the share now", "miner", share.Miner, "worker", share.Worker)
+		self.writeShares([]*queuedShare{queued})
+	}
+
+	if amount == nil {
+		return scheme.ShareEstimate(share, baseReward)
+	}
+
+	return amount
+}
+
+// logs the shares and credits the ones that were logged
+func (self *RoundAccountant) writeShares(queued []*queuedShare) {
+	shares := make([]*ShareRecord, 0, len(queued))
+	for _, entry := range queued {
+		shares = append(shares, entry.share)
+	}
+
+	logged, err := self.shares.addAll(shares)
+
+	if err != nil {
+		rewardsLog.Error("could not log shares, not crediting them", "shares", len(queued)-logged, "err", err)
+	}
+
+	for _, entry := range queued[:logged] {
+		if entry.credit != nil {
+			self.credit(entry.credit)
+		}
+	}
+}
+
+// the share, and up to SHARE_LOG_BATCH-1 more that are queued
+func (self *RoundAccountant) takeShares(first *queuedShare) []*queuedShare {
+	ret := []*queuedShare{first}
+
+	for len(ret) < SHARE_LOG_BATCH {
+		select {
+		case queued := <-self.queue:
+			ret = append(ret, queued)
+		default:
+			return ret
+		}
+	}
+
+	return ret
+}
+
+// writes queued shares until the context is cancelled
+func (self *RoundAccountant) Start(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case queued := <-self.queue:
+			self.writeShares(self.takeShares(queued))
+		}
+	}
+}
+
+// writes the shares still queued, once the pool stopped accepting them
+func (self *RoundAccountant) Close(ctx context.Context) error {
+	for {
+		if ctx.Err() != nil {
+			return errors.New("gave up writing queued shares - " + ctx.Err().Error())
+		}
+
+		select {
+		case queued := <-self.queue:
+			self.writeShares(self.takeShares(queued))
+		default:
+			return nil
+		}
+	}
+}
+
+// the credits for a block that is final
+func (self *RoundAccountant) getBlockReward(block *BlockCandidate) (*BlockReward, error) {
+	if block.isUncle() {
+		uncle := self.rewards.GetUncleReward(block.getNumber(), block.getNephew())
+		return NewBlockReward(big.NewInt(0), uncle, big.NewInt(0)), nil
+	}
+
+	return self.rewards.GetBlockReward(block.getNumber())
+}
+
+func (self *RoundAccountant) getBlockCredits(block *BlockCandidate, immature bool) (*BlockCredits, error) {
+	reward, err := self.getBlockReward(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	amounts, err := self.scheme.BlockCredits(block, reward, self.shares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	credits := &BlockCredits{Block: block, Reward: reward, Immature: immature, Credits: make([]*Credit, 0, len(amounts))}
+
+	for miner, amount := range amounts {
+		if amount.Sign() <= 0 {
+			continue
+		}
+
+		credits.Credits = append(credits.Credits, &Credit{Miner: miner,
+			Amount: amount.String(),
+			Round:  block.Round,
+			Block:  block.Number,
+			Nonce:  block.Nonce,
+			Scheme: self.scheme.Name(),
+			Time:   now})
+	}
+
+	return credits, nil
+}
+
+// a new Settings.RewardScheme or HouseRake applies to shares and blocks credited from now on
+func (self *RoundAccountant) ApplySettings(settings *Settings) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	scheme, err := NewRewardScheme(settings.RewardScheme, settings.HouseRake)
+
+	if err != nil {
+		rewardsLog.Error("could not change the reward scheme", "scheme", settings.RewardScheme, "err", err)
+		return
+	}
+
+	if scheme.Name() != self.scheme.Name() {
+		rewardsLog.Warn("changed the reward scheme", "from", self.scheme.Name(), "to", scheme.Name())
+	}
+
+	self.scheme = scheme
+}
+
+func (self *RoundAccountant) BlockImmature(block *BlockCandidate) {
+	self.creditBlock(block, true)
+}
+
+func (self *RoundAccountant) BlockMatured(block *BlockCandidate) {
+	self.creditBlock(block, false)
+}
+
+func (self *RoundAccountant) BlockOrphaned(block *BlockCandidate) {
+	rewardsLog.Info("block was orphaned, its round gets nothing unless it is included as an uncle", "block", block.Number, "nonce", block.Nonce, "round", block.Round)
+
+	for _, listener := range self.listeners {
+		listener.BlockReverted(block)
+	}
+}
+
+/*
+ * records credits in the "credits" table
+ */
+type DatabaseCreditListener struct {
+	db Database
+}
+
+func NewDatabaseCreditListener(db Database) *DatabaseCreditListener {
+	return &DatabaseCreditListener{db: db}
+}
+
+func (self *DatabaseCreditListener) Credited(credit *Credit) {
+	err := self.db.Connect()
+
+	if err == nil {
+		err = self.db.AddTo("credits", credit)
+		self.db.Disconnect()
+	}
+
+	if err != nil {
+		rewardsLog.Error("could not record credit", "miner", credit.Miner, "block", credit.Block, "err", err)
+	}
+}
+
+// only final credits are recorded
+func (self *DatabaseCreditListener) BlockCredited(credits *BlockCredits) {
+	if credits.Immature {
+		return
+	}
+
+	for _, credit := range credits.Credits {
+		self.Credited(credit)
+	}
+}
+
+func (*DatabaseCreditListener) BlockReverted(*BlockCandidate) {
+}
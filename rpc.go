@@ -23,6 +23,7 @@ type RPCRequest struct {
 	Jsonrpc string      `json:"jsonrpc"`
 	Method  string      `json:"method"`
 	Params  RPCParams   `json:"params"`
+	Worker  string      `json:"worker,omitempty"` // eth-proxy clients name the rig here
 }
 
 func (self *RPCRequest) ToJson() string {
@@ -31,7 +32,7 @@ func (self *RPCRequest) ToJson() string {
 }
 
 func (self *RPCRequest) GetParam(i int) (string, error) {
-	if len(self.Params) < i {
+	if len(self.Params) <= i {
 		return "", errors.New("parameter index out of range")
 	}
 
@@ -61,7 +62,7 @@ func (self *RPCRequest) GetBigIntParam(i, size int) (*big.Int, error) {
 }
 
 func (self *RPCRequest) ReplaceParam(i int, str string) error {
-	if len(self.Params) < i {
+	if len(self.Params) <= i {
 		return errors.New("parameter index out of range")
 	}
 
@@ -114,7 +115,7 @@ func (self *RPCResponse) GetStringEntryResult(i int) (string, error) {
 		return "", errors.New("result object is not array")
 	}
 
-	if len(result) < i {
+	if len(result) <= i {
 		return "", errors.New("index out of bounds")
 	}
 
@@ -176,7 +177,7 @@ func (self *RPCResponse) ReplaceResult(i int, str string) error {
 		return errors.New("results are not an array")
 	}
 
-	if len(result) < i {
+	if len(result) <= i {
 		return errors.New("result index out of range")
 	}
 
@@ -6,7 +6,6 @@ package main
 
 import "math/big"
 import "math/rand"
-import "log"
 import "net/http"
 import "bytes"
 import "errors"
@@ -15,6 +14,7 @@ import "encoding/json"
 import "time"
 import "io"
 import "io/ioutil"
+import "sync"
 
 /*
 func getJsonTransactionMessage(coinbase, miner, amount *big.Int) (string, error) {
@@ -47,29 +47,46 @@ func getJsonTransactionMessage(coinbase, miner, amount *big.Int) (string, error)
 }*/
 
 type Server struct {
+	lock     *sync.Mutex
+	settings *Settings
 }
 
-func NewServer() (*Server) {
-    return &Server{}
+func NewServer(settings *Settings) (*Server) {
+    return &Server{lock: &sync.Mutex{}, settings: settings}
+}
+
+// the backend address can change between messages
+func (self *Server) ApplySettings(settings *Settings) {
+	self.lock.Lock()
+	self.settings = settings
+	self.lock.Unlock()
+}
+
+func (self *Server) getBackendAddr() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.settings.getBackendAddr()
+}
+
+func (self *Server) getHouseRake() float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.settings.HouseRake
 }
 
 // for PPLNS, not used
-func getMinersDivvy(value *big.Int) []*Balance {
-	pool.stateLock.Lock()
-	defer pool.stateLock.Unlock()
+func getMinersDivvy(value *big.Int, rake float64) []*Balance {
+	pool.lock()
+	defer pool.unlock()
 
 	balanceList := make([]*Balance, 0, len(pool.miners))
 
-	if debugDivvy {
-		log.Printf("DIVVY: " + value.String() + "\n")
-	}
+	webLog.Debug("divvy", "value", value)
 
 	for _, v := range pool.miners {
-		share := getAccountShare(value, v.getHashes(), pool.getTotalHashes())
+		share := getAccountShare(value, v.getHashes(), pool.getTotalHashes(), rake)
 
-		if debugDivvy {
-			log.Printf("ADDR: " + getHexString(v.address, 40) + "\n")
-		}
+		webLog.Debug("divvy share", "miner", getHexString(v.address, 40), "share", share)
 
 		balanceList = append(balanceList, &Balance{account: v.address, value: share})
 	}
@@ -77,7 +94,7 @@ func getMinersDivvy(value *big.Int) []*Balance {
 }
 
 // for PPLNS, not used
-func getAccountShare(divvy, hashes, totalHashes *big.Int) *big.Int {
+func getAccountShare(divvy, hashes, totalHashes *big.Int, rake float64) *big.Int {
     zero := big.NewInt(0)
 
 	rat := big.NewRat(1.0, 1.0)
@@ -85,7 +102,7 @@ func getAccountShare(divvy, hashes, totalHashes *big.Int) *big.Int {
 	share := big.NewRat(1.0, 1.0)
 	intShare := big.NewInt(0)
 	cut := big.NewRat(1.0, 1.0)
-	cut.SetFloat64(1.0 - HOUSE_RAKE)
+	cut.SetFloat64(1.0 - rake)
 
     if hashes.Cmp(zero) == 0 {
         return zero
@@ -104,7 +121,7 @@ func getAccountShare(divvy, hashes, totalHashes *big.Int) *big.Int {
 	return intShare
 }
 
-func getJsonBalances(divvy *big.Int) []byte {
+func getJsonBalances(divvy *big.Int, rake float64) []byte {
 	type jsonBalanceEntry struct {
 		Address string `json:"address"`
 		Balance string `json:"balance"`
@@ -116,7 +133,7 @@ func getJsonBalances(divvy *big.Int) []byte {
 
 	bList := jsonBalanceList{}
 
-	balances := getMinersDivvy(divvy)
+	balances := getMinersDivvy(divvy, rake)
 
 	for _, balance := range balances {
 		bList.Updatelist = append(bList.Updatelist, jsonBalanceEntry{Address: getHexString(balance.account, 40), Balance: balance.value.String()})
@@ -125,7 +142,7 @@ func getJsonBalances(divvy *big.Int) []byte {
 	ret, err := json.Marshal(bList)
 
 	if err != nil {
-		log.Printf("bad news bears, we cant turn the balances to json")
+		webLog.Error("could not encode balances", "err", err)
 	}
 
 	return ret
@@ -135,13 +152,10 @@ func get_jsonBlock(blockNumber *big.Int) []byte {
 	return []byte(blockNumber.String())
 }
 
-func (*Server) SendMessage(target string, message []byte) error {
-	addr := "http://" + BACKEND_IP + ":" + BACKEND_PORT + "/" + target
+func (self *Server) SendMessage(target string, message []byte) error {
+	addr := self.getBackendAddr() + "/" + target
 
-	if debugServer {
-		log.Printf("SERVER: Sending message to " + addr + "\n")
-		log.Printf(string(message) + "\n")
-	}
+	webLog.Debug("sending message", "url", addr, "body", string(message))
 
 	req, err := http.NewRequest("POST", addr, bytes.NewBuffer(message))
 
@@ -164,12 +178,13 @@ func (*Server) SendMessage(target string, message []byte) error {
 	return error(nil)
 }
 
-func (self *Server) AddBlock(blockNumber *big.Int) {
-    // no longer used
+// tells the backend the pool found a block
+func (self *Server) AddBlock(blockNumber *big.Int) error {
+	return self.SendMessage("addBlock", get_jsonBlock(blockNumber))
 }
 
 // {"address": ..., "difficulty": ..., "value": ..., "pw": ...}
-func (self *Server) submitShare(mr *Miner, sharePrice *big.Int) {
+func (self *Server) submitShare(mr *Miner, difficulty, sharePrice *big.Int) {
     type shareJson struct {
         Address     string `json:"address"`
         Difficulty  string `json:"difficulty"`
@@ -178,7 +193,7 @@ func (self *Server) submitShare(mr *Miner, sharePrice *big.Int) {
     }
 
     st := &shareJson{Address: getHexString(mr.address, 40),
-              Difficulty: mr.getDifficulty().String(),
+              Difficulty: difficulty.String(),
               Value: sharePrice.String(),
               Pw: "super_secret_password"}
 
@@ -231,23 +246,21 @@ func get_jsonHashrate(miner *big.Int, hashrate *big.Int) []byte {
 
 	hashrateStruct := hashrateJson{Address: getHexString(miner, 40), Hashrate: fmt.Sprintf("%d", hashrate)}
 
-	if debugServer {
-		log.Printf("HASHRATE: " + hashrateStruct.Address + " " + hashrateStruct.Hashrate + "\n")
-	}
+	webLog.Debug("hashrate", "miner", hashrateStruct.Address, "hashrate", hashrateStruct.Hashrate)
 
 	ret, err := json.Marshal(hashrateStruct)
 
 	if err != nil {
-		log.Printf("ERROR: cannot get updatelist: this is bad... really bad!")
+		webLog.Error("could not encode hashrate", "miner", hashrateStruct.Address, "err", err)
 	}
 
 	return ret
 }
 
 func (self *Server) UpdateBalances(divvy *big.Int) {
-	msg := getJsonBalances(divvy)
+	msg := getJsonBalances(divvy, self.getHouseRake())
 
-	log.Printf("BALANCEMSG: Sending balance update to server: " + string(msg) + "\n")
+	webLog.Info("sending balance update", "body", string(msg))
 
 	self.SendMessage("addEther", msg)
 }
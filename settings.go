@@ -4,49 +4,162 @@ package main
 // global settings
 //
 
-var SHUTDOWN = false
-
-var LISTEN_PORT = "8080"
-var GETH_IP = "127.0.0.1"
-var GETH_PORT = "8545"
-var CONFIRM_ADDR = "http://127.0.0.1:8081"
-
-var BACKEND_IP = "oneether.com"
-var BACKEND_PORT = "9999"
+// ports, addresses, the database, the pool fee and the share time are in Settings
+// (config.go), read from the -config file and ONEETHER_* environment variables
+const SETTINGS_ENV_PREFIX = "ONEETHER_"
 
 const MACHINE_TIMEOUT = 300.0
+const WORKER_TIMEOUT = 600.0
 const CLIENT_TIMEOUT = 25.0
 const CLIENT_DB_WRITEBACK = 151.0
 const SERVER_UPDATETIME = 9.0
 const BALANCE_POLL_TIME = 5.0
 const POOL_POLL_TIME = 3.0
+const WORK_POLL_TIME = 0.5
+const TCP_KEEPALIVE_TIME = 5.0
+const TCP_READ_TIMEOUT = 600.0
+const TCP_WRITE_TIMEOUT = 10.0
+const SHUTDOWN_TIMEOUT = 30.0 // seconds to finish in-flight work and save state on exit
 
 const DEFAULT_HASHRATE_ESTIMATE = 80000
 const MIN_PROCESSED_BLOCK = 0
 
-const SHARE_TIME = 53.0
+const DEFAULT_SHARE_TIME = 53.0 // Settings.ShareTime
+
+// shares for the last STALE_JOB_COUNT jobs are checked; those arriving within
+// STALE_GRACE_TIME seconds of the job being replaced are credited when
+// ACCEPT_STALE_SHARES is set, and rejected otherwise
+const STALE_JOB_COUNT = 4
+const STALE_GRACE_TIME = 5.0
+var ACCEPT_STALE_SHARES = true
+
+// accepted shares are remembered this long to turn away duplicates. geth
+// hands out a new header at least every block, so this is well past the time
+// a job stays in the STALE_JOB_COUNT recent jobs
+const SHARE_DEDUPE_TTL = 900
+
+// HASHRATE
+// hashrates are reported over each of HASHRATE_WINDOWS seconds, from the
+// accepted share difficulty counted in HASHRATE_BUCKET_TIME second buckets.
+// the first window is the current hashrate, used for new workers' difficulty
+const HASHRATE_BUCKET_TIME = 60
+var HASHRATE_WINDOWS = []int64{600, 3600, 86400}
+const HASHRATE_HISTORY_TTL = 7 * 86400 // hashrate samples saved with the miner stats are kept this long
+
+// BLOCKS
+// a found block is orphaned if another block is at its height
+// BLOCK_CONFIRM_DEPTH blocks later, and matured after BLOCK_MATURE_DEPTH.
+// before that, the UNCLE_MAX_DEPTH blocks that could have included it as an
+// uncle are checked
+const BLOCK_CONFIRM_DEPTH = 8
+const BLOCK_MATURE_DEPTH = 120
+const UNCLE_MAX_DEPTH = 7
+
+// VARDIFF
+// each worker is retargeted towards one share every Settings.ShareTime
+// seconds, judged over its last VARDIFF_WINDOW shares. the difficulty moves
+// at most VARDIFF_MAX_STEP times per retarget and at most once every
+// VARDIFF_RETARGET_TIME seconds, and only when the share time is off by more
+// than VARDIFF_VARIANCE
+const VARDIFF_VARIANCE = 0.3
+const VARDIFF_WINDOW = 16
+const VARDIFF_RETARGET_TIME = 90.0
+const VARDIFF_MAX_STEP = 4.0
+const VARDIFF_MIN_DIFFICULTY = 1000000        // default Settings.VardiffMinDifficulty
+const VARDIFF_MAX_DIFFICULTY = 10000000000000 // default Settings.VardiffMaxDifficulty
+const VARDIFF_GRACE_TIME = STALE_GRACE_TIME // shares at the previous difficulty are still accepted
+const VARDIFF_LOG_SIZE = 512                 // retarget decisions kept for debugging
 
-const HOUSE_RAKE = 0.02
+const DEFAULT_WORKER_NAME = "default"
+const MAX_WORKER_NAME = 32
 
-// DEBUG
-var debugRequest = false
-var debugRPC = false
-var debugDivvy = false
-var debugServer = false
-var debugVerify = false
+// BLOCK REWARDS
+// static block reward from each fork height on, in wei (ethereum mainnet).
+// the default of Settings.BlockRewardForks
+var BLOCK_REWARD_FORKS = []BlockRewardFork{
+	{Name: "frontier", Height: 0, Reward: "5000000000000000000"},
+	{Name: "byzantium", Height: 4370000, Reward: "3000000000000000000"},
+	{Name: "constantinople", Height: 7280000, Reward: "2000000000000000000"},
+}
+
+// REWARDS
+// REWARD_SCHEME (the default of Settings.RewardScheme) is one of pplns, prop,
+// pps, pps+ or solo. pplns pays the
+// shares of the last PPLNS_WINDOW times the block difficulty; at most
+// SHARE_LOG_LIMIT shares are read back from the share log for a block.
+// accepted shares wait in a queue of SHARE_LOG_QUEUE_SIZE and are written to
+// the share log, and credited, in batches of up to SHARE_LOG_BATCH
+const REWARD_SCHEME = "pplns"
+const PPLNS_WINDOW = 2.0
+const SHARE_LOG_LIMIT = 1000000
+const SHARE_LOG_QUEUE_SIZE = 10000
+const SHARE_LOG_BATCH = 100
+
+// VERIFY
+var VERIFY_NATIVE = true          // verify shares in process with ethash
+var VERIFY_REMOTE_FALLBACK = true // use Settings.ConfirmAddr while an ethash cache is generated
+const ETHASH_CACHES = 3           // epoch caches kept in memory
+const VERIFY_WORKERS = 4          // shares verified concurrently
+const VERIFY_QUEUE_SIZE = 256     // shares waiting for a worker before miners are told to retry
+
+// LOGGING
+// LOG_LEVEL is debug, info, warn or error. LOG_LEVELS overrides it by subsystem
+// (main, pool, stratum, ethproxy, verify, scanner, blocks, rewards, ledger,
+// pay, payouts, web, api, db, geth); debug on pool logs every rpc request and
+// response. LOG_FORMAT is text or json. these are the defaults of
+// Settings.LogLevel, LogLevels and LogFormat; levels can also be changed at
+// runtime on Settings.MetricsPort/log
+var LOG_LEVEL = "info"
+var LOG_LEVELS = map[string]string{}
+var LOG_FORMAT = "text"
 
 // CONSTANTS
 var weiToFinney = "1000000000000000"
 var weiToEth = "1000000000000000000"
 
-// BLOCK
-var BLOCK_PERSIST_FILENAME = "block.last"
-
 // PAY
-var PAY_PERSIST_FILENAME = "pending.persist" // i think we use mongo now
 var PAY_COMPLETE_FILENAME = "complete.persist"
 var PAY_WAIT = 10.0
-var PAY_RPC_PORT = "9090"
 
-// MONGO
-var MONGO_DB_ID = "one"
+// PAYOUTS
+// every PAYOUT_INTERVAL seconds, up to PAYOUT_MAX_PER_RUN miners with at
+// least their payout threshold pending get paid (Settings.PayoutMinimum wei,
+// PAYOUT_MINIMUM by default, unless they set their own). these are the
+// defaults of Settings.PayoutInterval, PayoutMinimum and PayoutMaxPerRun
+const PAYOUT_INTERVAL = 3600.0
+const PAYOUT_MINIMUM = "100000000000000000"
+const PAYOUT_MAX_PER_RUN = 50
+
+// BANS
+// an ip or miner address sending BAN_*_THRESHOLD invalid, duplicate or
+// malformed shares within BAN_WINDOW seconds is banned for BAN_TIME seconds.
+// each ip may send RATE_LIMIT requests a second, in bursts of
+// RATE_LIMIT_BURST. Settings.BanAllowlist entries (ips, cidr networks or
+// addresses) are never banned or limited, Settings.BanDenylist entries are
+// always refused. these are the defaults of the Settings.Ban* and RateLimit*
+// settings
+const BAN_INVALID_THRESHOLD = 50
+const BAN_DUPLICATE_THRESHOLD = 50
+const BAN_MALFORMED_THRESHOLD = 20
+const BAN_WINDOW = 600.0
+const BAN_TIME = 1800.0
+const RATE_LIMIT = 20.0
+const RATE_LIMIT_BURST = 100.0
+var BAN_ALLOWLIST = []string{"127.0.0.1"}
+var BAN_DENYLIST = []string{}
+var BAN_PERSIST_FILENAME = "bans.persist"
+
+// API
+// statistics are rebuilt every API_CACHE_TIME seconds, with the last
+// API_BLOCKS_LIMIT found blocks and API_PAYMENTS_LIMIT payments. accounts
+// show API_HISTORY_TIME seconds of hashrate history. at most
+// API_ACCOUNTS_LIMIT accounts, known or not, are looked up per API_CACHE_TIME
+const API_CACHE_TIME = 10.0
+const API_BLOCKS_LIMIT = 50
+const API_PAYMENTS_LIMIT = 50
+const API_MINERS_LIMIT = 500
+const API_HISTORY_TIME = 86400
+const API_ACCOUNTS_LIMIT = 1000
+
+// signed miner settings are taken within MINER_SETTINGS_MAX_AGE seconds of signing
+const MINER_SETTINGS_MAX_AGE = 600
@@ -0,0 +1,90 @@
+package main
+
+//
+// duplicate share detection
+// every accepted share is recorded by (header hash, nonce, mix digest) in
+// the database, so a share cannot be replayed after a restart or against
+// another pool instance sharing the database. entries expire after
+// SHARE_DEDUPE_TTL seconds
+//
+
+import "math/big"
+import "sync"
+import "time"
+
+type ShareSubmission struct {
+	Key     string    `json:"key" bson:"key"` // header hash, nonce and mix digest
+	Miner   string    `json:"miner" bson:"miner"`
+	Worker  string    `json:"worker" bson:"worker"`
+	Created time.Time `json:"created" bson:"created"`
+}
+
+func getShareKey(headerHash, nonce, mixHash *big.Int) string {
+	return getHexString(headerHash, 64) + ":" + getHexString(nonce, 16) + ":" + getHexString(mixHash, 64)
+}
+
+func NewShareSubmission(miner *big.Int, worker string, headerHash, nonce, mixHash *big.Int, now time.Time) *ShareSubmission {
+	return &ShareSubmission{Key: getShareKey(headerHash, nonce, mixHash),
+		Miner:   getHexString(miner, 40),
+		Worker:  worker,
+		Created: now}
+}
+
+type ShareStore struct {
+	db   Database // nil keeps shares in memory only
+	lock *sync.Mutex
+	seen map[string]time.Time
+	ttl  time.Duration
+}
+
+func NewShareStore(db Database, ttl time.Duration) *ShareStore {
+	return &ShareStore{db: db, lock: &sync.Mutex{}, seen: make(map[string]time.Time), ttl: ttl}
+}
+
+// records a share; returns false if it was submitted before
+func (self *ShareStore) add(share *ShareSubmission) bool {
+	self.lock.Lock()
+	_, exists := self.seen[share.Key]
+	if !exists {
+		self.seen[share.Key] = share.Created
+	}
+	self.lock.Unlock()
+
+	if exists {
+		return false
+	}
+
+	if self.db == nil {
+		return true
+	}
+
+	err := self.db.Connect()
+
+	if err == nil {
+		err = self.db.Add(share)
+		self.db.Disconnect()
+	}
+
+	if err == ErrDuplicate {
+		return false
+	}
+
+	// the database being down should not stop the pool; the local cache still catches replays
+	if err != nil {
+		poolLog.Error("could not record share", "miner", share.Miner, "worker", share.Worker, "err", err)
+	}
+
+	return true
+}
+
+// forget shares older than the ttl; the database expires its copies on its own
+func (self *ShareStore) expire(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for key, created := range self.seen {
+		if now.Sub(created) > self.ttl {
+			delete(self.seen, key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+import "math/big"
+import "time"
+
+// stands in for a database with a unique index on the share key
+type shareDatabase struct {
+	Database
+	keys map[string]bool
+}
+
+func (self *shareDatabase) Connect() error    { return nil }
+func (self *shareDatabase) Disconnect() error { return nil }
+
+func (self *shareDatabase) Add(item interface{}) error {
+	share := item.(*ShareSubmission)
+	if self.keys[share.Key] {
+		return ErrDuplicate
+	}
+	self.keys[share.Key] = true
+	return nil
+}
+
+func TestShareStore(t *testing.T) {
+	now := time.Now()
+	db := &shareDatabase{keys: make(map[string]bool)}
+	store := NewShareStore(db, time.Minute)
+	header := big.NewInt(0x1234)
+
+	if !store.add(NewShareSubmission(big.NewInt(1), "rig1", header, big.NewInt(7), big.NewInt(9), now)) {
+		t.Error("expected first share to be new")
+	}
+
+	if store.add(NewShareSubmission(big.NewInt(2), "rig2", header, big.NewInt(7), big.NewInt(9), now)) {
+		t.Error("expected the same share from another miner to be a duplicate")
+	}
+
+	if !store.add(NewShareSubmission(big.NewInt(1), "rig1", big.NewInt(0x5678), big.NewInt(7), big.NewInt(9), now)) {
+		t.Error("expected the same nonce for another job to be new")
+	}
+
+	// a restarted pool (or another instance) only knows the share from the database
+	restarted := NewShareStore(db, time.Minute)
+	if restarted.add(NewShareSubmission(big.NewInt(1), "rig1", header, big.NewInt(7), big.NewInt(9), now)) {
+		t.Error("expected a replay after restart to be a duplicate")
+	}
+
+	memory := NewShareStore(nil, time.Minute)
+	memory.add(NewShareSubmission(big.NewInt(1), "rig1", header, big.NewInt(7), big.NewInt(9), now))
+	memory.expire(now.Add(time.Minute * 2))
+
+	if len(memory.seen) != 0 {
+		t.Error("expected old shares to expire, found ", len(memory.seen))
+	}
+}
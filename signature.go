@@ -0,0 +1,200 @@
+package main
+
+//
+// ethereum signed messages
+// recovers the address that signed a message with personal_sign (EIP-191),
+// so miners can prove they own their mining address. secp256k1 public key
+// recovery is done here with math/big; it only runs for the occasional
+// settings change, so speed does not matter
+//
+
+import "encoding/hex"
+import "errors"
+import "math/big"
+import "strconv"
+import "strings"
+
+type curvePoint struct {
+	x, y *big.Int // nil for the point at infinity
+}
+
+var secp256k1P, _ = big.NewInt(0).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+var secp256k1N, _ = big.NewInt(0).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+var secp256k1Gx, _ = big.NewInt(0).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+var secp256k1Gy, _ = big.NewInt(0).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+
+func getCurveGenerator() *curvePoint {
+	return &curvePoint{x: secp256k1Gx, y: secp256k1Gy}
+}
+
+func (self *curvePoint) isInfinity() bool {
+	return self.x == nil
+}
+
+func modP(x *big.Int) *big.Int {
+	return x.Mod(x, secp256k1P)
+}
+
+func (self *curvePoint) add(oth *curvePoint) *curvePoint {
+	if self.isInfinity() {
+		return oth
+	}
+
+	if oth.isInfinity() {
+		return self
+	}
+
+	var slope *big.Int
+
+	if self.x.Cmp(oth.x) == 0 {
+		if self.y.Cmp(oth.y) != 0 || self.y.Sign() == 0 {
+			return &curvePoint{}
+		}
+
+		// doubling: 3x^2 / 2y
+		slope = big.NewInt(0).Mul(self.x, self.x)
+		slope.Mul(slope, big.NewInt(3))
+		denominator := big.NewInt(0).Lsh(self.y, 1)
+		slope.Mul(slope, denominator.ModInverse(modP(denominator), secp256k1P))
+	} else {
+		slope = big.NewInt(0).Sub(oth.y, self.y)
+		denominator := modP(big.NewInt(0).Sub(oth.x, self.x))
+		slope.Mul(slope, denominator.ModInverse(denominator, secp256k1P))
+	}
+	modP(slope)
+
+	x := big.NewInt(0).Mul(slope, slope)
+	x.Sub(x, self.x)
+	x.Sub(x, oth.x)
+	modP(x)
+
+	y := big.NewInt(0).Sub(self.x, x)
+	y.Mul(y, slope)
+	y.Sub(y, self.y)
+	modP(y)
+
+	return &curvePoint{x: x, y: y}
+}
+
+func (self *curvePoint) multiply(k *big.Int) *curvePoint {
+	ret := &curvePoint{}
+
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		ret = ret.add(ret)
+		if k.Bit(i) == 1 {
+			ret = ret.add(self)
+		}
+	}
+
+	return ret
+}
+
+// the point with this x coordinate and the given parity of y
+func getCurvePoint(x *big.Int, odd bool) (*curvePoint, error) {
+	// y^2 = x^3 + 7; p = 3 mod 4, so y = (y^2)^((p+1)/4)
+	ysquared := big.NewInt(0).Exp(x, big.NewInt(3), secp256k1P)
+	modP(ysquared.Add(ysquared, big.NewInt(7)))
+
+	exponent := big.NewInt(0).Add(secp256k1P, big.NewInt(1))
+	exponent.Rsh(exponent, 2)
+	y := big.NewInt(0).Exp(ysquared, exponent, secp256k1P)
+
+	if big.NewInt(0).Exp(y, big.NewInt(2), secp256k1P).Cmp(ysquared) != 0 {
+		return nil, errors.New("x is not on the curve")
+	}
+
+	if (y.Bit(0) == 1) != odd {
+		y.Sub(secp256k1P, y)
+	}
+
+	return &curvePoint{x: x, y: y}, nil
+}
+
+func getPaddedBytes(x *big.Int, size int) []byte {
+	ret := make([]byte, size)
+	return x.FillBytes(ret)
+}
+
+// the address of a public key: the last 20 bytes of its hash
+func getPublicKeyAddress(key *curvePoint) *big.Int {
+	hash := keccak256(getPaddedBytes(key.x, 32), getPaddedBytes(key.y, 32))
+	return big.NewInt(0).SetBytes(hash[12:])
+}
+
+// the hash personal_sign signs: the message with the EIP-191 prefix
+func getPersonalMessageHash(message []byte) []byte {
+	prefix := "\x19Ethereum Signed Message:\n" + strconv.Itoa(len(message))
+	return keccak256([]byte(prefix), message)
+}
+
+/*
+ * the public key that made a 65 byte signature (r, s, v) of a hash
+ */
+func recoverPublicKey(hash []byte, signature []byte) (*curvePoint, error) {
+	if len(signature) != 65 {
+		return nil, errors.New("signature must be 65 bytes")
+	}
+
+	r := big.NewInt(0).SetBytes(signature[:32])
+	s := big.NewInt(0).SetBytes(signature[32:64])
+	v := signature[64]
+
+	if v >= 27 {
+		v -= 27
+	}
+
+	if v > 1 {
+		return nil, errors.New("invalid recovery id")
+	}
+
+	if r.Sign() <= 0 || r.Cmp(secp256k1N) >= 0 || s.Sign() <= 0 || s.Cmp(secp256k1N) >= 0 {
+		return nil, errors.New("signature out of range")
+	}
+
+	// only low s values are valid since homestead
+	if s.Cmp(big.NewInt(0).Rsh(secp256k1N, 1)) > 0 {
+		return nil, errors.New("signature has a high s value")
+	}
+
+	point, err := getCurvePoint(r, v == 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// key = r^-1 (s * point - e * G)
+	e := big.NewInt(0).SetBytes(hash)
+	e.Neg(e)
+	e.Mod(e, secp256k1N)
+
+	rinv := big.NewInt(0).ModInverse(r, secp256k1N)
+	u1 := e.Mul(e, rinv)
+	u1.Mod(u1, secp256k1N)
+	u2 := big.NewInt(0).Mul(s, rinv)
+	u2.Mod(u2, secp256k1N)
+
+	key := getCurveGenerator().multiply(u1).add(point.multiply(u2))
+
+	if key.isInfinity() {
+		return nil, errors.New("invalid signature")
+	}
+
+	return key, nil
+}
+
+// the address that signed a message with personal_sign; signature is hex
+func recoverPersonalSigner(message []byte, signature string) (*big.Int, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+
+	if err != nil {
+		return nil, errors.New("invalid signature: " + err.Error())
+	}
+
+	key, err := recoverPublicKey(getPersonalMessageHash(message), sig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return getPublicKeyAddress(key), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+import "encoding/hex"
+import "math/big"
+
+// signs a message like personal_sign; k must be secret and random outside of tests
+func signPersonalMessage(message []byte, key, k *big.Int) string {
+	hash := getPersonalMessageHash(message)
+	point := getCurveGenerator().multiply(k)
+
+	r := big.NewInt(0).Mod(point.x, secp256k1N)
+	s := big.NewInt(0).Mul(r, key)
+	s.Add(s, big.NewInt(0).SetBytes(hash))
+	s.Mul(s, big.NewInt(0).ModInverse(k, secp256k1N))
+	s.Mod(s, secp256k1N)
+
+	v := byte(27 + point.y.Bit(0))
+	if s.Cmp(big.NewInt(0).Rsh(secp256k1N, 1)) > 0 {
+		s.Sub(secp256k1N, s)
+		v = 55 - v // 27 <-> 28
+	}
+
+	signature := append(getPaddedBytes(r, 32), getPaddedBytes(s, 32)...)
+	return "0x" + hex.EncodeToString(append(signature, v))
+}
+
+func TestPublicKeyAddress(t *testing.T) {
+	address := getPublicKeyAddress(getCurveGenerator().multiply(big.NewInt(1)))
+
+	if getHexString(address, 40) != "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" {
+		t.Error("unexpected address for private key 1: ", getHexString(address, 40))
+	}
+}
+
+func TestRecoverPersonalSigner(t *testing.T) {
+	message := []byte("hello pool")
+
+	for _, key := range []int64{1, 2, 0x1234567} {
+		for _, k := range []int64{7, 1000003} {
+			expected := getPublicKeyAddress(getCurveGenerator().multiply(big.NewInt(key)))
+			signer, err := recoverPersonalSigner(message, signPersonalMessage(message, big.NewInt(key), big.NewInt(k)))
+
+			if err != nil || signer.Cmp(expected) != 0 {
+				t.Error("could not recover signer of key ", key, ": ", err)
+			}
+		}
+	}
+
+	signature := signPersonalMessage(message, big.NewInt(1), big.NewInt(7))
+	signer, _ := recoverPersonalSigner([]byte("hello pool!"), signature)
+
+	if signer != nil && getHexString(signer, 40) == "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" {
+		t.Error("expected a different message to recover a different signer")
+	}
+
+	if _, err := recoverPersonalSigner(message, signature[:100]); err == nil {
+		t.Error("expected a short signature to fail")
+	}
+}
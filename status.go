@@ -4,7 +4,7 @@ package main
 // chain explorer and callback system
 //
 
-import "log"
+import "context"
 import "time"
 import "math/big"
 import "os"
@@ -27,34 +27,42 @@ type PendingBlockProcessor interface {
 	AddPendingBlock(*Block) error
 }
 
-func NewStatusPoll(eth EthAll, persistFilename string) *StatusPoll {
+// uncles are only fetched if a processor wants them
+type UncleProcessor interface {
+	AddUncle(uncle *Block, nephew *Block)
+}
+
+func NewStatusPoll(eth EthAll, settings *Settings) *StatusPoll {
 	self := &StatusPoll{eth: eth}
 
-	self.persist = NewFilePersistence(persistFilename)
-	if _, err := os.Stat(persistFilename); os.IsNotExist(err) {
+	self.persist = NewFilePersistence(settings.BlockPersistFilename)
+	if _, err := os.Stat(settings.BlockPersistFilename); os.IsNotExist(err) {
 		self.lastProcessedBlock = int64(MIN_PROCESSED_BLOCK)
 		self.persist.Write(self.lastProcessedBlock)
 	} else {
 		self.persist.Read(&self.lastProcessedBlock)
-		log.Printf("loaded block persistence: %d\n", self.lastProcessedBlock)
+		scannerLog.Info("loaded block persistence", "block", self.lastProcessedBlock)
 	}
 
 	return self
 }
 
 /*
- * like get balance, but should not return unless it succeeds
+ * like get balance, but should not return unless it succeeds or the context
+ * is cancelled
  */
-func GetInitialBalance(eth EthWallet) *big.Int {
+func GetInitialBalance(ctx context.Context, eth EthWallet) *big.Int {
 	err := error(nil)
 
 RETRY:
 	ret, err := eth.GetBalance()
 
 	if err != nil {
-		log.Printf("ERROR unable to get initial balance: " + err.Error() + "\n")
-		time.Sleep(2 * time.Second)
-		goto RETRY
+		scannerLog.Error("could not get initial balance, retrying", "err", err)
+
+		if sleepContext(ctx, 2*time.Second) {
+			goto RETRY
+		}
 	}
 
 	return ret
@@ -69,7 +77,7 @@ func (self *StatusPoll) Commit() error {
 		err := proc.Commit()
 
 		if err != nil {
-            log.Println(err)
+            scannerLog.Error("could not commit blocks", "block", self.lastProcessedBlock, "err", err)
 			//panic(err)
 		}
 	}
@@ -79,35 +87,70 @@ func (self *StatusPoll) Commit() error {
 	return nil
 }
 
-func (self *StatusPoll) Start(finished chan bool) {
-	balance := GetInitialBalance(self.eth)
+// scanned blocks are committed before this returns
+func (self *StatusPoll) Start(ctx context.Context) {
+	balance := GetInitialBalance(ctx, self.eth)
 
-	for !SHUTDOWN {
-		self.updateNewBlocks()
+	for ctx.Err() == nil {
+		self.updateNewBlocks(ctx)
 
-		if !SHUTDOWN {
+		if ctx.Err() == nil {
 			balance, _ = self.eth.GetBalance()
-			log.Println("BALANCE: " + balance.String() + "\n")
-			time.Sleep(time.Duration(BALANCE_POLL_TIME) * time.Second)
+			scannerLog.Info("wallet balance", "balance", balance)
+
+			if balance != nil {
+				ether, _ := new(big.Float).Quo(new(big.Float).SetInt(balance), big.NewFloat(1e18)).Float64()
+				metrics.Set("oneether_wallet_balance_ether", ether)
+			}
+			sleepContext(ctx, time.Duration(BALANCE_POLL_TIME)*time.Second)
 		}
 	}
 
-	log.Println("closed status poll")
-	if finished != nil {
-		finished <- true
+	scannerLog.Info("closed status poll", "block", self.lastProcessedBlock)
+}
+
+func (self *StatusPoll) addUncles(block *Block) {
+	uncleProcessors := make([]UncleProcessor, 0, 1)
+	for _, proc := range self.blockProcessors {
+		if uproc, ok := proc.(UncleProcessor); ok {
+			uncleProcessors = append(uncleProcessors, uproc)
+		}
+	}
+
+	if block == nil || len(uncleProcessors) == 0 {
+		return
+	}
+
+	for i := range block.Uncles {
+		uncle := self.eth.GetUncleByBlockNumberAndIndex(block.getNumber(), i)
+
+		if uncle == nil {
+			scannerLog.Error("could not get uncle", "block", block.Number, "index", i)
+			continue
+		}
+
+		for _, uproc := range uncleProcessors {
+			uproc.AddUncle(uncle, block)
+		}
 	}
 }
 
-func (self *StatusPoll) updateNewBlocks() {
+func (self *StatusPoll) setLagMetrics(head int64) {
+	metrics.Set("oneether_scanner_processed_block", float64(self.lastProcessedBlock))
+	metrics.Set("oneether_scanner_lag_blocks", float64(head-self.lastProcessedBlock))
+}
+
+func (self *StatusPoll) updateNewBlocks(ctx context.Context) {
 	num, err := self.eth.GetBlockNumber()
 
 	if err != nil {
-		log.Printf("could not get current block number: " + err.Error())
+		scannerLog.Error("could not get current block number", "err", err)
 		return
 	}
 
 	blockNumber := num.Int64()
 	confirmedBlockNumber := blockNumber - 8
+	metrics.Set("oneether_scanner_head_block", float64(blockNumber))
 	pendingBlockNumber := blockNumber
 	// Only process up to the last 8 blocks (to avoid a mess with uncles)
 
@@ -115,32 +158,41 @@ func (self *StatusPoll) updateNewBlocks() {
 		err := proc.BeginProcessing()
 
 		if err != nil {
-			log.Printf("error beginning block processing: " + err.Error())
-			log.Printf("skipping block update")
+			scannerLog.Error("could not begin block processing, skipping block update", "err", err)
 			return
 		}
 	}
 
-	for self.lastProcessedBlock < confirmedBlockNumber && !SHUTDOWN {
+	for self.lastProcessedBlock < confirmedBlockNumber && ctx.Err() == nil {
 		block := self.eth.GetBlockByNumber(big.NewInt(self.lastProcessedBlock), true)
 
 		if confirmedBlockNumber-self.lastProcessedBlock > 10 {
 			if self.lastProcessedBlock%500 == 0 {
-				log.Printf("processing block: %d\n", self.lastProcessedBlock)
+				scannerLog.Info("processing block", "block", self.lastProcessedBlock, "head", blockNumber)
 			}
 		} else {
-			log.Printf("processing block: %d\n", self.lastProcessedBlock)
+			scannerLog.Info("processing block", "block", self.lastProcessedBlock, "head", blockNumber)
 		}
 
 		for _, proc := range self.blockProcessors {
 			proc.AddBlock(block)
 		}
 
+		self.addUncles(block)
+
 		if self.lastProcessedBlock%1000 == 0 {
 			self.Commit()
 		}
 
 		self.lastProcessedBlock++
+		self.setLagMetrics(blockNumber)
+	}
+
+	self.setLagMetrics(blockNumber)
+
+	// on shutdown only what was confirmed is committed; the pending blocks are redone on the next start
+	if ctx.Err() != nil {
+		pendingBlockNumber = self.lastProcessedBlock
 	}
 
 	for pendingIt := self.lastProcessedBlock; pendingIt < pendingBlockNumber; pendingIt++ {
@@ -1,11 +1,24 @@
 package main
 
 import "fmt"
+import "os"
+import "time"
 
 func status_main() {
-	geth := NewGeth(GETH_IP, GETH_PORT)
-	statusPoll := NewStatusPoll(geth, BLOCK_PERSIST_FILENAME)
-	statusPoll.Start(nil)
+	settings, err := LoadSettings("", os.LookupEnv)
+
+	if err != nil {
+		scannerLog.Fatal("invalid settings", "err", err)
+	}
+
+	geth := NewGeth(settings.GethIP, settings.GethPort)
+	statusPoll := NewStatusPoll(geth, settings)
+
+	lifecycle := NewLifecycle(time.Duration(SHUTDOWN_TIMEOUT) * time.Second)
+	lifecycle.Go("scanner", statusPoll.Start)
+
+	waitForSignal()
+	lifecycle.Shutdown()
 }
 
 func main() {
@@ -0,0 +1,602 @@
+package main
+
+//
+// stratum tcp server (EthereumStratum/1.0.0)
+// miners keep a connection open and get work pushed to them
+// instead of polling eth_getWork over http
+//
+
+import "bufio"
+import "context"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "math/big"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+const STRATUM_PROTOCOL = "EthereumStratum/1.0.0"
+
+// a line based json connection, shared by the tcp protocols
+type tcpClient struct {
+	conn        net.Conn
+	ip          string
+	reader      *bufio.Reader
+	lock        *sync.Mutex
+	interrupted bool      // no more requests are read
+	pushes      chan bool // work to push, see queuePush
+	closed      chan bool
+	pushing     *sync.WaitGroup
+}
+
+func newTcpClient(conn net.Conn) *tcpClient {
+	return &tcpClient{conn: conn,
+		ip:      getRemoteIP(conn.RemoteAddr().String()),
+		reader:  bufio.NewReaderSize(conn, 1024),
+		lock:    &sync.Mutex{},
+		pushes:  make(chan bool, 1),
+		closed:  make(chan bool),
+		pushing: &sync.WaitGroup{}}
+}
+
+// ErrBanned if the client should be disconnected, ErrRateLimited if the request should be refused
+func (self *tcpClient) checkBans(address *big.Int) error {
+	if bans == nil {
+		return nil
+	}
+
+	return bans.Allow(self.ip, address, time.Now())
+}
+
+func (self *tcpClient) send(message interface{}) error {
+	bytes, err := json.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.conn.SetWriteDeadline(time.Now().Add(TCP_WRITE_TIMEOUT * time.Second))
+	_, err = self.conn.Write(append(bytes, '\n'))
+	return err
+}
+
+func (self *tcpClient) readRequest() (*RPCRequest, error) {
+	self.lock.Lock()
+	if self.interrupted {
+		self.lock.Unlock()
+		return nil, ErrShuttingDown
+	}
+	self.conn.SetReadDeadline(time.Now().Add(TCP_READ_TIMEOUT * time.Second))
+	self.lock.Unlock()
+
+	line, isPrefix, err := self.reader.ReadLine()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isPrefix {
+		return nil, fmt.Errorf("request too long")
+	}
+
+	request := &RPCRequest{}
+	err = json.Unmarshal(line, request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// wakes a waiting read, so the connection is closed once the request in hand is answered
+func (self *tcpClient) interrupt() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.interrupted = true
+	self.conn.SetReadDeadline(time.Now())
+}
+
+// also waits for the pushes, so nothing is sent once the connection is handled
+func (self *tcpClient) close() {
+	close(self.closed)
+	self.conn.Close()
+	self.pushing.Wait()
+}
+
+// job broadcasts only queue the push, so a slow socket does not hold up the
+// other miners. a push still waiting is not queued twice
+func (self *tcpClient) queuePush() {
+	select {
+	case self.pushes <- true:
+	default:
+	}
+}
+
+// sends the queued pushes until the client is closed
+func (self *tcpClient) startPushing(push func() error) {
+	self.pushing.Add(1)
+
+	go func() {
+		defer self.pushing.Done()
+
+		for {
+			select {
+			case <-self.pushes:
+				push()
+			case <-self.closed:
+				return
+			}
+		}
+	}()
+}
+
+/*
+ * accepts connections until the context is cancelled. connections counts
+ * the listener and every handler it starts
+ */
+func acceptConnections(ctx context.Context, listener net.Listener, connections *sync.WaitGroup, log *Logger,
+	handle func(context.Context, net.Conn)) {
+	defer connections.Done()
+
+	for {
+		conn, err := listener.Accept()
+
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			log.Error("accept failed", "err", err)
+			continue
+		}
+
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// the login and difficulty are shared with the job broadcasts, so they are read under the lock
+type StratumSession struct {
+	client     *tcpClient
+	extranonce string
+	lock       *sync.Mutex
+	address    *big.Int // set once the session is authorized
+	worker     string
+	difficulty *big.Int // last difficulty sent to the miner
+	subscribed bool
+}
+
+func NewStratumSession(client *tcpClient, extranonce string) *StratumSession {
+	return &StratumSession{client: client, extranonce: extranonce, lock: &sync.Mutex{}}
+}
+
+func (self *StratumSession) getLogin() (*big.Int, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.address, self.worker
+}
+
+func (self *StratumSession) setLogin(address *big.Int, worker string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.address = address
+	self.worker = worker
+}
+
+func (self *StratumSession) subscribe() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.subscribed = true
+}
+
+// true if the miner was last sent another difficulty
+func (self *StratumSession) isDifficultyChanged(difficulty *big.Int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.difficulty == nil || self.difficulty.Cmp(difficulty) != 0
+}
+
+// records the difficulty to send; false if the miner has it already
+func (self *StratumSession) setDifficulty(difficulty *big.Int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.difficulty != nil && self.difficulty.Cmp(difficulty) == 0 {
+		return false
+	}
+
+	self.difficulty = big.NewInt(0).Set(difficulty)
+	return true
+}
+
+type StratumServer struct {
+	port        string
+	listener    net.Listener
+	sessions    map[*StratumSession]bool
+	lock        *sync.Mutex
+	connections *sync.WaitGroup
+	extranonce  uint16
+	extranonces map[string]bool // prefixes held by live sessions
+}
+
+func NewStratumServer(port string) *StratumServer {
+	return &StratumServer{port: port,
+		sessions:    make(map[*StratumSession]bool),
+		lock:        &sync.Mutex{},
+		connections: &sync.WaitGroup{},
+		extranonces: make(map[string]bool)}
+}
+
+// the counter wraps, so prefixes still held by a session are skipped;
+// two miners with the same prefix would search the same nonces
+func (self *StratumServer) nextExtranonce() (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := 0; i <= 0xffff; i++ {
+		self.extranonce++
+		extranonce := fmt.Sprintf("%04x", self.extranonce)
+
+		if !self.extranonces[extranonce] {
+			self.extranonces[extranonce] = true
+			return extranonce, nil
+		}
+	}
+
+	return "", errors.New("no free extranonce")
+}
+
+func (self *StratumServer) addSession(session *StratumSession) {
+	self.lock.Lock()
+	self.sessions[session] = true
+	self.lock.Unlock()
+}
+
+func (self *StratumServer) removeSession(session *StratumSession) {
+	self.lock.Lock()
+	delete(self.sessions, session)
+	delete(self.extranonces, session.extranonce)
+	self.lock.Unlock()
+}
+
+// stratum difficulty 1 corresponds to 2^32 hashes
+func getStratumDifficulty(difficulty *big.Int) float64 {
+	ret := big.NewRat(1, 1)
+	ret.SetFrac(difficulty, big.NewInt(4294967296))
+	fret, _ := ret.Float64()
+	return fret
+}
+
+func (self *StratumSession) sendDifficulty(difficulty *big.Int) error {
+	notify := NewRPCRequest(nil, "mining.set_difficulty", RPCParams{getStratumDifficulty(difficulty)})
+	return self.client.send(notify)
+}
+
+func (self *StratumSession) sendJob(job *Job, clean bool) error {
+	notify := NewRPCRequest(nil, "mining.notify", RPCParams{
+		job.id,
+		getHexString(job.seedHash, 64)[2:],
+		getHexString(job.headerHash, 64)[2:],
+		clean,
+	})
+	return self.client.send(notify)
+}
+
+func (self *StratumSession) isReady() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.address != nil && self.subscribed
+}
+
+// push the latest difficulty (if changed) and the current job
+func (self *StratumSession) sendWork(clean bool) error {
+	job := work.getJob()
+
+	if !self.isReady() || job == nil {
+		return nil
+	}
+
+	address, name := self.getLogin()
+
+	pool.lock()
+	worker := pool.getMiner(address).touch(name)
+	difficulty := big.NewInt(0).Set(worker.getDifficulty())
+	pool.unlock()
+
+	if self.setDifficulty(difficulty) {
+		err := self.sendDifficulty(difficulty)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.sendJob(job, clean)
+}
+
+func (self *StratumServer) handle_subscribe(session *StratumSession, request *RPCRequest) *RPCResponse {
+	session.subscribe()
+
+	result := RPCResultArray{
+		RPCResultArray{"mining.notify", session.extranonce, STRATUM_PROTOCOL},
+		session.extranonce,
+	}
+
+	return NewRPCResult(request.Id, result)
+}
+
+func (self *StratumServer) handle_authorize(session *StratumSession, request *RPCRequest) *RPCResponse {
+	login, err := request.GetParam(0)
+
+	if err != nil {
+		return NewRPCError(request.Id, 24, "missing login", nil)
+	}
+
+	address, worker, err := parseMinerLogin(login)
+
+	if err != nil {
+		return NewRPCError(request.Id, 24, err.Error(), nil)
+	}
+
+	session.setLogin(address, worker)
+	stratumLog.Info("authorized", "login", login, "ip", session.client.ip)
+
+	return NewRPCResult(request.Id, true)
+}
+
+// params: [login, job id, nonce] with the nonce missing the extranonce prefix,
+// or [login, job id, nonce, header hash, mix digest] for full nonces.
+// without a mix digest the verifier computes it
+func (self *StratumServer) handle_submit(session *StratumSession, request *RPCRequest) *RPCResponse {
+	address, workerName := session.getLogin()
+
+	if address == nil {
+		return NewRPCError(request.Id, 24, "unauthorized worker", nil)
+	}
+
+	jobId, err := request.GetParam(1)
+
+	if err != nil {
+		reportShare(session.client.ip, address, SHARE_MALFORMED)
+		return NewRPCError(request.Id, 20, "invalid job id", nil)
+	}
+
+	nonceStr, err := request.GetParam(2)
+
+	if err != nil {
+		reportShare(session.client.ip, address, SHARE_MALFORMED)
+		return NewRPCError(request.Id, 20, "invalid nonce", nil)
+	}
+
+	nonceStr = strings.TrimPrefix(nonceStr, "0x")
+
+	if len(nonceStr) < 16 {
+		nonceStr = session.extranonce + nonceStr
+	}
+
+	// parseHex takes anything, so the digits are checked here
+	if _, err := hex.DecodeString(nonceStr); len(nonceStr) != 16 || err != nil {
+		reportShare(session.client.ip, address, SHARE_MALFORMED)
+		return NewRPCError(request.Id, 20, "invalid nonce", nil)
+	}
+
+	nonce, _ := parseHex(nonceStr, 8)
+
+	var mixHash *big.Int = nil
+
+	if len(request.Params) >= 5 {
+		mixHash, err = request.GetBigIntParam(4, 32)
+
+		if err != nil {
+			reportShare(session.client.ip, address, SHARE_MALFORMED)
+			return NewRPCError(request.Id, 20, "invalid mix digest", nil)
+		}
+	}
+
+	pool.lock()
+	miner := pool.getMiner(address)
+	worker := miner.getWorker(workerName)
+	pool.unlock()
+
+	state := pool.getBlockStateById(jobId)
+
+	status, _, err := processShare(request.Id, miner, worker, state, nonce, mixHash)
+
+	// a verifier or geth failure is not held against the miner
+	if err != nil {
+		countShare(status)
+		return NewRPCError(request.Id, 20, err.Error(), nil)
+	}
+
+	reportShare(session.client.ip, address, status)
+
+	switch status {
+	case SHARE_REJECTED_STALE:
+		return NewRPCError(request.Id, 21, "job not found", nil)
+	case SHARE_REJECTED_DUPLICATE:
+		return NewRPCError(request.Id, 22, "duplicate share", nil)
+	case SHARE_REJECTED_INVALID:
+		return NewRPCError(request.Id, 23, "invalid share", nil)
+	case SHARE_BUSY:
+		return NewRPCError(request.Id, 20, ErrVerifyBusy.Error(), nil)
+	}
+
+	return NewRPCResult(request.Id, true)
+}
+
+func (self *StratumServer) handleRequest(session *StratumSession, request *RPCRequest) *RPCResponse {
+	switch request.Method {
+	case "mining.subscribe":
+		return self.handle_subscribe(session, request)
+	case "mining.extranonce.subscribe":
+		return NewRPCResult(request.Id, true)
+	case "mining.authorize":
+		return self.handle_authorize(session, request)
+	case "mining.submit":
+		return self.handle_submit(session, request)
+	}
+
+	return NewRPCError(request.Id, 20, "unsupported method: "+request.Method, nil)
+}
+
+func (self *StratumServer) handleConnection(ctx context.Context, conn net.Conn) {
+	extranonce, err := self.nextExtranonce()
+
+	if err != nil {
+		stratumLog.Warn("refusing connection", "ip", getRemoteIP(conn.RemoteAddr().String()), "err", err)
+		conn.Close()
+		return
+	}
+
+	session := NewStratumSession(newTcpClient(conn), extranonce)
+
+	self.addSession(session)
+	defer self.removeSession(session)
+	defer session.client.close()
+
+	session.client.startPushing(func() error { return session.sendWork(true) })
+
+	// sessions added after shutdown began were missed by interruptSessions
+	for ctx.Err() == nil {
+		request, err := session.client.readRequest()
+
+		if err != nil {
+			stratumLog.Info("closing connection", "ip", session.client.ip, "err", err)
+			return
+		}
+
+		address, _ := session.getLogin()
+		err = session.client.checkBans(address)
+
+		if err == ErrBanned {
+			stratumLog.Info("closing connection, banned", "ip", session.client.ip, "miner", getHexString(address, 40))
+			return
+		}
+
+		if err != nil {
+			if session.client.send(NewRPCError(request.Id, 20, err.Error(), nil)) != nil {
+				return
+			}
+			continue
+		}
+
+		wasReady := session.isReady()
+		response := self.handleRequest(session, request)
+
+		if session.client.send(response) != nil {
+			return
+		}
+
+		// a freshly subscribed and authorized miner gets work right away
+		if !wasReady && session.isReady() {
+			session.sendWork(true)
+		}
+
+		if request.Method == "mining.submit" {
+			session.sendDifficultyUpdate()
+		}
+	}
+}
+
+// vardiff may have moved the worker; push the new target with the current job
+func (self *StratumSession) sendDifficultyUpdate() {
+	address, name := self.getLogin()
+
+	pool.lock()
+	worker := pool.getMiner(address).getWorker(name)
+	changed := self.isDifficultyChanged(worker.getDifficulty())
+	pool.unlock()
+
+	if changed {
+		self.sendWork(false)
+	}
+}
+
+func (self *StratumServer) getSessions() []*StratumSession {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	sessions := make([]*StratumSession, 0, len(self.sessions))
+	for session := range self.sessions {
+		if session.isReady() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// push a new job to every session
+func (self *StratumServer) NewJob(job *Job) {
+	for _, session := range self.getSessions() {
+		session.client.queuePush()
+	}
+}
+
+// stratum miners do not poll, so keep the pool from dropping them as idle.
+// also passes on difficulty changes made while the worker was quiet
+func (self *StratumServer) keepalive() {
+	for _, session := range self.getSessions() {
+		address, name := session.getLogin()
+
+		pool.lock()
+		pool.getMiner(address).touch(name)
+		pool.unlock()
+
+		session.sendDifficultyUpdate()
+	}
+}
+
+func (self *StratumServer) interruptSessions() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for session := range self.sessions {
+		session.client.interrupt()
+	}
+}
+
+/*
+ * serves until the context is cancelled, then stops taking connections and
+ * waits for the sessions to answer the requests they are handling
+ */
+func (self *StratumServer) Start(ctx context.Context) {
+	var err error
+	self.listener, err = net.Listen("tcp", ":"+self.port)
+
+	if err != nil {
+		stratumLog.Error("could not listen", "port", self.port, "err", err)
+		return
+	}
+
+	stratumLog.Info("listening", "port", self.port)
+	self.connections.Add(1)
+	go acceptConnections(ctx, self.listener, self.connections, stratumLog, self.handleConnection)
+
+	for sleepContext(ctx, time.Duration(TCP_KEEPALIVE_TIME)*time.Second) {
+		self.keepalive()
+	}
+
+	self.listener.Close()
+	self.interruptSessions()
+	self.connections.Wait()
+	stratumLog.Info("server is down")
+}
@@ -0,0 +1,183 @@
+package main
+
+import "context"
+import "math/big"
+import "testing"
+import "time"
+
+func TestStratumSubmitMalformedNonce(t *testing.T) {
+	server := NewStratumServer("")
+	session := NewStratumSession(&tcpClient{ip: "10.0.0.1"}, "0001")
+	session.setLogin(big.NewInt(1), "rig")
+
+	// too short even with the extranonce, not hex, signed, and too long
+	for _, nonce := range []string{"0x1234", "zz0000000000", "-00000000000", "0x00000000000000001"} {
+		request := NewRPCRequest(1, "mining.submit", RPCParams{"login", "0x01", nonce})
+		response := server.handle_submit(session, request)
+
+		if response.Error == nil || response.Error.Message != "invalid nonce" {
+			t.Error("expected nonce ", nonce, " to be rejected, found ", response.ToJson())
+		}
+	}
+}
+
+func TestStratumExtranonceReuse(t *testing.T) {
+	server := NewStratumServer("")
+	server.extranonce = 0xfffe
+
+	if extranonce, _ := server.nextExtranonce(); extranonce != "ffff" {
+		t.Error("expected extranonce ffff, found ", extranonce)
+	}
+
+	// the counter wrapped, but ffff is still held
+	server.extranonce = 0xfffe
+
+	if extranonce, _ := server.nextExtranonce(); extranonce != "0000" {
+		t.Error("expected the live extranonce to be skipped, found ", extranonce)
+	}
+
+	server.removeSession(NewStratumSession(nil, "ffff"))
+	server.extranonce = 0xfffe
+
+	if extranonce, _ := server.nextExtranonce(); extranonce != "ffff" {
+		t.Error("expected a released extranonce to be handed out again, found ", extranonce)
+	}
+}
+
+func TestStratumSession(t *testing.T) {
+	job := setupTcpTest()
+	defer verifier.Close(context.Background())
+
+	server := NewStratumServer("")
+	miner, done := newPipeMiner(t, server.handleConnection)
+	defer done()
+
+	response := miner.call(1, "mining.submit", RPCParams{"login", job.id, "000000000001"})
+
+	if response.Error == nil || response.Error.Message != "unauthorized worker" {
+		t.Error("expected a share to be refused before authorizing, found ", response)
+	}
+
+	response = miner.call(2, "mining.subscribe", RPCParams{"miner/1.0", STRATUM_PROTOCOL})
+	result, ok := response.Result.([]interface{})
+
+	if !ok || len(result) != 2 || result[1] != "0001" {
+		t.Fatal("expected the subscription with extranonce 0001, found ", response)
+	}
+
+	response = miner.call(3, "mining.authorize", RPCParams{"0x1234", "x"})
+
+	if response.Error == nil || response.Error.Code != 24 {
+		t.Error("expected an invalid login to be refused, found ", response)
+	}
+
+	response = miner.call(4, "mining.authorize", RPCParams{"0x00000000000000000000000000000000000000ab.rig1", "x"})
+
+	if response.Result != true {
+		t.Fatal("expected the login to be accepted, found ", response)
+	}
+
+	// the difficulty, then the job
+	if notify := miner.read(); notify.Method != "mining.set_difficulty" || len(notify.Params) != 1 {
+		t.Error("expected the share difficulty, found ", notify)
+	}
+
+	notify := miner.read()
+
+	if notify.Method != "mining.notify" || len(notify.Params) != 4 || notify.Params[0] != job.id ||
+		notify.Params[2] != getHexString(job.headerHash, 64)[2:] || notify.Params[3] != true {
+		t.Error("expected the current job, found ", notify)
+	}
+
+	response = miner.call(5, "mining.submit", RPCParams{"login", job.id, "000000000001"})
+
+	if response.Result != true {
+		t.Error("expected the share to be accepted, found ", response)
+	}
+
+	// the same nonce with the extranonce included
+	response = miner.call(6, "mining.submit", RPCParams{"login", job.id, "0x0001000000000001"})
+
+	if response.Error == nil || response.Error.Message != "duplicate share" {
+		t.Error("expected the duplicate share to be rejected, found ", response)
+	}
+
+	response = miner.call(7, "mining.submit", RPCParams{"login", "ffffffff", "000000000002"})
+
+	if response.Error == nil || response.Error.Message != "job not found" {
+		t.Error("expected the share for an unknown job to be rejected, found ", response)
+	}
+
+	response = miner.call(8, "mining.submit", RPCParams{"login", job.id, "000000000003",
+		getHexString(job.headerHash, 64), getHexString(big.NewInt(1), 64)})
+
+	if response.Error == nil || response.Error.Message != "invalid share" {
+		t.Error("expected the share with the wrong digest to be rejected, found ", response)
+	}
+
+	pool.lock()
+	credited := !pool.getMiner(big.NewInt(0xab)).getWorker("rig1").lastShare.IsZero()
+	pool.unlock()
+
+	if !credited {
+		t.Error("expected the accepted share to be credited to the worker")
+	}
+
+	next := newTestJob("next", 0x5678)
+	work.current = next
+	server.NewJob(next)
+
+	// a difficulty update may still be queued ahead of it
+	for {
+		notify := miner.read()
+
+		if notify.Method == "mining.notify" && notify.Params[0] == next.id {
+			break
+		}
+	}
+}
+
+// a miner that stops reading does not hold up the job for the others
+func TestStratumSlowSession(t *testing.T) {
+	setupTcpTest()
+	defer verifier.Close(context.Background())
+
+	server := NewStratumServer("")
+	miners := make([]*pipeMiner, 2)
+
+	for i := range miners {
+		miner, done := newPipeMiner(t, server.handleConnection)
+		defer done()
+
+		miner.call(1, "mining.subscribe", RPCParams{})
+		miner.call(2, "mining.authorize", RPCParams{"0x00000000000000000000000000000000000000ab", "x"})
+		miner.read()
+		miner.read()
+		miners[i] = miner
+	}
+
+	next := newTestJob("next", 0x5678)
+	work.current = next
+	broadcast := make(chan bool)
+
+	go func() {
+		server.NewJob(next)
+		server.NewJob(next)
+		broadcast <- true
+	}()
+
+	select {
+	case <-broadcast:
+	case <-time.After(time.Second):
+		t.Fatal("expected the broadcast not to wait for the sockets")
+	}
+
+	// only the second miner reads
+	for {
+		notify := miners[1].read()
+
+		if notify.Method == "mining.notify" && notify.Params[0] == next.id {
+			break
+		}
+	}
+}
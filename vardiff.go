@@ -0,0 +1,258 @@
+package main
+
+//
+// variable difficulty
+// each worker's share difficulty is retargeted from the intervals between
+// its accepted shares, so that it submits a share every Settings.ShareTime
+// seconds. new workers start from the miner's measured hashrate (see
+// Miner.getWorkerStartDifficulty); what the miner claims in eth_submitHashrate
+// is not used. the difficulty is kept within the pool's VardiffBounds, which
+// can change while the pool is running
+//
+
+import "fmt"
+import "math/big"
+import "sync"
+import "time"
+
+type VardiffDecision struct {
+	Time          time.Time `json:"time"`
+	Worker        string    `json:"worker"`
+	OldDifficulty string    `json:"oldDifficulty"`
+	NewDifficulty string    `json:"newDifficulty"`
+	AverageTime   float64   `json:"averageTime"` // observed seconds per share
+	Shares        int       `json:"shares"`      // shares in the window
+	Reason        string    `json:"reason"`
+}
+
+func (self *VardiffDecision) String() string {
+	return fmt.Sprintf("%s %s -> %s (%d shares, %.1fs/share, %s)", self.Worker,
+		self.OldDifficulty, self.NewDifficulty, self.Shares, self.AverageTime, self.Reason)
+}
+
+/*
+ * the last VARDIFF_LOG_SIZE retarget decisions, for debugging
+ */
+type VardiffLog struct {
+	lock    *sync.Mutex
+	entries []*VardiffDecision
+	next    int
+}
+
+func NewVardiffLog(size int) *VardiffLog {
+	return &VardiffLog{lock: &sync.Mutex{}, entries: make([]*VardiffDecision, 0, size)}
+}
+
+func (self *VardiffLog) add(decision *VardiffDecision) {
+	poolLog.Debug("vardiff retarget", "worker", decision.Worker, "oldDifficulty", decision.OldDifficulty,
+		"newDifficulty", decision.NewDifficulty, "shares", decision.Shares, "averageTime", decision.AverageTime, "reason", decision.Reason)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.entries) < cap(self.entries) {
+		self.entries = append(self.entries, decision)
+		return
+	}
+
+	self.entries[self.next] = decision
+	self.next = (self.next + 1) % len(self.entries)
+}
+
+// decisions oldest first; an empty worker name returns all of them
+func (self *VardiffLog) getDecisions(worker string) []*VardiffDecision {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ret := make([]*VardiffDecision, 0, len(self.entries))
+	for i := 0; i < len(self.entries); i++ {
+		decision := self.entries[(self.next+i)%len(self.entries)]
+		if len(worker) == 0 || decision.Worker == worker {
+			ret = append(ret, decision)
+		}
+	}
+	return ret
+}
+
+var vardiffLog = NewVardiffLog(VARDIFF_LOG_SIZE)
+
+func getVardiffStartDifficulty(targetTime float64) *big.Int {
+	return big.NewInt(int64(DEFAULT_HASHRATE_ESTIMATE * targetTime))
+}
+
+/*
+ * lowest and highest share difficulty, shared by every worker of a pool
+ */
+type VardiffBounds struct {
+	lock *sync.Mutex
+	min  *big.Int
+	max  *big.Int
+}
+
+func NewVardiffBounds(min, max int64) *VardiffBounds {
+	return &VardiffBounds{lock: &sync.Mutex{}, min: big.NewInt(min), max: big.NewInt(max)}
+}
+
+// workers move into the new bounds at their next retarget
+func (self *VardiffBounds) set(min, max int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.min = big.NewInt(min)
+	self.max = big.NewInt(max)
+}
+
+func (self *VardiffBounds) clamp(difficulty *big.Int) *big.Int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if difficulty.Cmp(self.min) < 0 {
+		return big.NewInt(0).Set(self.min)
+	}
+
+	if difficulty.Cmp(self.max) > 0 {
+		return big.NewInt(0).Set(self.max)
+	}
+
+	return big.NewInt(0).Set(difficulty)
+}
+
+/*
+ * retarget state of one worker
+ */
+type Vardiff struct {
+	lock         *sync.Mutex
+	name         string  // "0xaddr.worker", for the decision log
+	targetTime   float64 // seconds between shares
+	bounds       *VardiffBounds
+	difficulty   *big.Int // difficulty handed out in new work
+	previous     *big.Int // difficulty before the last retarget
+	intervals    []float64
+	lastShare    time.Time
+	lastRetarget time.Time
+}
+
+func NewVardiff(name string, difficulty *big.Int, targetTime float64, bounds *VardiffBounds, now time.Time) *Vardiff {
+	return &Vardiff{lock: &sync.Mutex{},
+		name:         name,
+		targetTime:   targetTime,
+		bounds:       bounds,
+		difficulty:   bounds.clamp(difficulty),
+		previous:     bounds.clamp(difficulty),
+		intervals:    make([]float64, 0, VARDIFF_WINDOW),
+		lastShare:    now,
+		lastRetarget: now}
+}
+
+func (self *Vardiff) getDifficulty() *big.Int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.difficulty
+}
+
+// difficulty to check a share against. for a short while after a retarget the
+// miner may still be working on a lower target, so shares at the previous
+// difficulty are accepted (and credited at that difficulty)
+func (self *Vardiff) getShareDifficulty(now time.Time) *big.Int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if now.Sub(self.lastRetarget).Seconds() < VARDIFF_GRACE_TIME && self.previous.Cmp(self.difficulty) < 0 {
+		return self.previous
+	}
+
+	return self.difficulty
+}
+
+// record an accepted share and retarget if it is time to
+func (self *Vardiff) onShare(now time.Time) *VardiffDecision {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.intervals) >= VARDIFF_WINDOW {
+		copy(self.intervals, self.intervals[1:])
+		self.intervals = self.intervals[:len(self.intervals)-1]
+	}
+
+	self.intervals = append(self.intervals, now.Sub(self.lastShare).Seconds())
+	self.lastShare = now
+
+	return self.retarget(now)
+}
+
+// retarget without a new share; lowers the difficulty of a worker that has gone quiet
+func (self *Vardiff) update(now time.Time) *VardiffDecision {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.retarget(now)
+}
+
+// expects the lock to be held
+func (self *Vardiff) retarget(now time.Time) *VardiffDecision {
+	if now.Sub(self.lastRetarget).Seconds() < VARDIFF_RETARGET_TIME {
+		return nil
+	}
+
+	sum := 0.0
+	for _, interval := range self.intervals {
+		sum += interval
+	}
+
+	shares := len(self.intervals)
+	reason := "share rate"
+	open := now.Sub(self.lastShare).Seconds()
+
+	if shares == 0 {
+		if open < self.targetTime {
+			return nil
+		}
+		reason = "no shares"
+	}
+
+	// the time since the last share counts once it is longer than the average,
+	// so a worker that stops finding shares is eased down
+	if shares == 0 || open > sum/float64(shares) {
+		sum += open
+		shares++
+	}
+
+	average := sum / float64(shares)
+
+	// on target, unless the bounds have changed since the last retarget
+	step := 1.0
+	if average > self.targetTime*(1.0-VARDIFF_VARIANCE) && average < self.targetTime*(1.0+VARDIFF_VARIANCE) {
+		reason = "bounds"
+	} else {
+		step = self.targetTime / average
+	}
+
+	if step > VARDIFF_MAX_STEP {
+		step = VARDIFF_MAX_STEP
+	} else if step < 1.0/VARDIFF_MAX_STEP {
+		step = 1.0 / VARDIFF_MAX_STEP
+	}
+
+	newDifficulty, _ := new(big.Float).Mul(new(big.Float).SetInt(self.difficulty), big.NewFloat(step)).Int(nil)
+	newDifficulty = self.bounds.clamp(newDifficulty)
+
+	if newDifficulty.Cmp(self.difficulty) == 0 {
+		return nil
+	}
+
+	decision := &VardiffDecision{Time: now,
+		Worker:        self.name,
+		OldDifficulty: self.difficulty.String(),
+		NewDifficulty: newDifficulty.String(),
+		AverageTime:   average,
+		Shares:        len(self.intervals),
+		Reason:        reason}
+
+	// intervals seen at the old difficulty say nothing about the new one
+	self.previous = self.difficulty
+	self.difficulty = newDifficulty
+	self.intervals = self.intervals[:0]
+	self.lastRetarget = now
+
+	vardiffLog.add(decision)
+	return decision
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+import "math/big"
+import "time"
+
+func newTestVardiff(difficulty int64, now time.Time) *Vardiff {
+	return NewVardiff("0x00.test", big.NewInt(difficulty), DEFAULT_SHARE_TIME,
+		NewVardiffBounds(VARDIFF_MIN_DIFFICULTY, VARDIFF_MAX_DIFFICULTY), now)
+}
+
+// submits shares every 'interval' seconds until a retarget happens
+func runVardiff(vardiff *Vardiff, now time.Time, interval float64) (*VardiffDecision, time.Time) {
+	for i := 0; i < 1000; i++ {
+		now = now.Add(time.Duration(interval * float64(time.Second)))
+		if decision := vardiff.onShare(now); decision != nil {
+			return decision, now
+		}
+	}
+	return nil, now
+}
+
+func TestVardiffRetarget(t *testing.T) {
+	now := time.Now()
+	vardiff := newTestVardiff(VARDIFF_MIN_DIFFICULTY*100, now)
+
+	// shares twice as often as wanted doubles the difficulty
+	decision, now := runVardiff(vardiff, now, DEFAULT_SHARE_TIME/2)
+	expected := big.NewInt(VARDIFF_MIN_DIFFICULTY * 200)
+
+	if decision == nil || vardiff.getDifficulty().Cmp(expected) != 0 {
+		t.Fatal("expected difficulty ", expected, ", found ", vardiff.getDifficulty(), decision)
+	}
+
+	// on target: no change
+	before := vardiff.getDifficulty()
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second * DEFAULT_SHARE_TIME)
+		vardiff.onShare(now)
+	}
+
+	if vardiff.getDifficulty().Cmp(before) != 0 {
+		t.Error("expected difficulty to hold on target, found ", vardiff.getDifficulty())
+	}
+
+	// far too fast: limited to VARDIFF_MAX_STEP per retarget
+	vardiff = newTestVardiff(VARDIFF_MIN_DIFFICULTY*100, now)
+	runVardiff(vardiff, now, 1.0)
+	expected = big.NewInt(VARDIFF_MIN_DIFFICULTY * 100 * VARDIFF_MAX_STEP)
+
+	if vardiff.getDifficulty().Cmp(expected) != 0 {
+		t.Error("expected difficulty ", expected, ", found ", vardiff.getDifficulty())
+	}
+
+	if len(vardiffLog.getDecisions("0x00.test")) < 2 {
+		t.Error("expected decisions in the log")
+	}
+}
+
+func TestVardiffLimits(t *testing.T) {
+	now := time.Now()
+	vardiff := newTestVardiff(VARDIFF_MIN_DIFFICULTY*2, now)
+
+	// a quiet worker is eased down, but not below the minimum
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second * VARDIFF_RETARGET_TIME)
+		vardiff.update(now)
+	}
+
+	if vardiff.getDifficulty().Cmp(big.NewInt(VARDIFF_MIN_DIFFICULTY)) != 0 {
+		t.Error("expected minimum difficulty, found ", vardiff.getDifficulty())
+	}
+
+	vardiff = newTestVardiff(VARDIFF_MAX_DIFFICULTY, now)
+	runVardiff(vardiff, now, 1.0)
+
+	if vardiff.getDifficulty().Cmp(big.NewInt(VARDIFF_MAX_DIFFICULTY)) != 0 {
+		t.Error("expected maximum difficulty, found ", vardiff.getDifficulty())
+	}
+
+	// a worker on target moves into raised bounds at its next retarget
+	vardiff = newTestVardiff(VARDIFF_MIN_DIFFICULTY*2, now)
+	vardiff.bounds.set(VARDIFF_MIN_DIFFICULTY*3, VARDIFF_MAX_DIFFICULTY)
+	decision, _ := runVardiff(vardiff, now, DEFAULT_SHARE_TIME)
+
+	if decision == nil || decision.Reason != "bounds" || vardiff.getDifficulty().Cmp(big.NewInt(VARDIFF_MIN_DIFFICULTY*3)) != 0 {
+		t.Error("expected the new minimum difficulty, found ", vardiff.getDifficulty(), decision)
+	}
+}
+
+func TestVardiffGrace(t *testing.T) {
+	now := time.Now()
+	vardiff := newTestVardiff(VARDIFF_MIN_DIFFICULTY*100, now)
+	_, now = runVardiff(vardiff, now, DEFAULT_SHARE_TIME/2)
+
+	if vardiff.getShareDifficulty(now).Cmp(big.NewInt(VARDIFF_MIN_DIFFICULTY*100)) != 0 {
+		t.Error("expected previous difficulty right after a retarget, found ", vardiff.getShareDifficulty(now))
+	}
+
+	later := now.Add(time.Second * (VARDIFF_GRACE_TIME + 1))
+	if vardiff.getShareDifficulty(later).Cmp(vardiff.getDifficulty()) != 0 {
+		t.Error("expected current difficulty after the grace time, found ", vardiff.getShareDifficulty(later))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+//
+// share verification
+// a share is evaluated once by a ShareVerifier, and both the share and the
+// block checks are made against that single result. verifications run on a
+// bounded pool of workers; when the queue is full miners are told to retry
+//
+
+import "context"
+import "errors"
+import "math/big"
+import "sync"
+import "time"
+
+var ErrVerifyBusy = errors.New("verifier busy, retry later")
+var ErrCacheNotReady = errors.New("ethash cache is not ready")
+
+type ShareWork struct {
+	blockNumber     *big.Int
+	headerHash      *big.Int
+	nonce           *big.Int
+	mixHash         *big.Int // digest sent by the miner; nil if the protocol does not send one
+	shareDifficulty *big.Int
+	blockTarget     *big.Int
+}
+
+type ShareResult struct {
+	mixDigest *big.Int // digest of the share
+	result    *big.Int // hashimoto result, compared against the share and block targets
+}
+
+// the mix digest matches what the miner claimed, and the result meets the share difficulty
+func (self *ShareResult) isValidShare(work *ShareWork) bool {
+	if work.mixHash != nil && self.mixDigest.Cmp(work.mixHash) != 0 {
+		return false
+	}
+
+	return self.result.Cmp(getBoundaryCondition(work.shareDifficulty)) <= 0
+}
+
+func (self *ShareResult) isBlock(work *ShareWork) bool {
+	return self.result.Cmp(work.blockTarget) <= 0
+}
+
+type ShareVerifier interface {
+	Verify(work *ShareWork) (*ShareResult, error)
+}
+
+/*
+ * verification through the external py-ethereum process at Settings.ConfirmAddr.
+ * it only answers yes or no for a difficulty, so a valid share is asked
+ * about a second time at the block target
+ */
+type RemoteVerifier struct {
+	address string
+}
+
+func NewRemoteVerifier(address string) *RemoteVerifier {
+	return &RemoteVerifier{address: address}
+}
+
+func (self *RemoteVerifier) verify(work *ShareWork, difficulty *big.Int) (bool, error) {
+	verifyLog.Debug("sending remote verify", "block", work.blockNumber, "header", getHexString(work.headerHash, 32),
+		"nonce", getHexString(work.nonce, 8), "difficulty", difficulty)
+
+	request := NewRPCRequest(1, "verify", RPCParams{
+		work.blockNumber.String(),
+		getHexString(work.headerHash, 32),
+		getHexString(work.mixHash, 32),
+		getHexString(work.nonce, 8),
+		difficulty.String(),
+	})
+
+	response, err := sendRPCRequest(request, self.address)
+
+	if err != nil {
+		verifyLog.Error("remote verify failed", "block", work.blockNumber, "nonce", getHexString(work.nonce, 8), "err", err)
+		return false, err
+	}
+
+	// an rpc error is the verifier's failure, not an invalid share
+	ret, err := response.GetBoolResult()
+
+	if err != nil {
+		verifyLog.Error("remote verify sent no result", "block", work.blockNumber, "nonce", getHexString(work.nonce, 8), "err", err)
+		return false, err
+	}
+
+	return ret, nil
+}
+
+func (self *RemoteVerifier) Verify(work *ShareWork) (*ShareResult, error) {
+	if work.mixHash == nil {
+		return nil, errors.New("remote verifier needs the mix digest")
+	}
+
+	// the remote side does not tell us the result, so report the tightest target it met
+	shareBoundary := getBoundaryCondition(work.shareDifficulty)
+	ret := &ShareResult{mixDigest: work.mixHash, result: big.NewInt(0).Add(shareBoundary, big.NewInt(1))}
+
+	valid, err := self.verify(work, work.shareDifficulty)
+
+	if err != nil || !valid {
+		return ret, err
+	}
+
+	ret.result = shareBoundary
+
+	isBlock, err := self.verify(work, getTargetDifficulty(work.blockTarget))
+
+	if err == nil && isBlock {
+		ret.result = work.blockTarget
+	}
+
+	return ret, nil
+}
+
+/*
+ * native verification, falling back to a remote verifier while the
+ * ethash cache for a new epoch is being generated
+ */
+type FallbackVerifier struct {
+	primary  *EthashVerifier
+	fallback ShareVerifier
+}
+
+func NewFallbackVerifier(primary *EthashVerifier, fallback ShareVerifier) *FallbackVerifier {
+	return &FallbackVerifier{primary: primary, fallback: fallback}
+}
+
+func (self *FallbackVerifier) Verify(work *ShareWork) (*ShareResult, error) {
+	ret, err := self.primary.TryVerify(work)
+
+	if err == ErrCacheNotReady && work.mixHash != nil {
+		verifyLog.Debug("native verify unavailable, using remote verifier", "block", work.blockNumber)
+		return self.fallback.Verify(work)
+	}
+
+	if err == ErrCacheNotReady {
+		return self.primary.Verify(work)
+	}
+
+	return ret, err
+}
+
+type VerifyStats struct {
+	QueueDepth int           `json:"queueDepth"`
+	MaxDepth   int           `json:"maxDepth"`
+	Verified   uint64        `json:"verified"`
+	Failed     uint64        `json:"failed"`
+	Busy       uint64        `json:"busy"`    // shares turned away because the queue was full
+	Latency    time.Duration `json:"latency"` // average time from submit to result
+}
+
+type verifyTask struct {
+	work   *ShareWork
+	result *ShareResult
+	err    error
+	queued time.Time
+	done   chan bool
+}
+
+type VerifyPool struct {
+	verifier ShareVerifier
+	queue    chan *verifyTask
+	lock     *sync.Mutex
+	workers  *sync.WaitGroup
+	closed   bool
+	stats    VerifyStats
+	latency  time.Duration // summed over all verified shares
+}
+
+func NewVerifyPool(verifier ShareVerifier, workers, queueSize int) *VerifyPool {
+	self := &VerifyPool{verifier: verifier,
+		queue:   make(chan *verifyTask, queueSize),
+		lock:    &sync.Mutex{},
+		workers: &sync.WaitGroup{}}
+
+	self.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go self.work()
+	}
+
+	return self
+}
+
+func (self *VerifyPool) work() {
+	defer self.workers.Done()
+
+	for task := range self.queue {
+		task.result, task.err = self.verifier.Verify(task.work)
+
+		self.lock.Lock()
+		if task.err != nil {
+			self.stats.Failed++
+		} else {
+			self.stats.Verified++
+			self.latency += time.Since(task.queued)
+		}
+		self.lock.Unlock()
+
+		metrics.ObserveSince("oneether_verify_seconds", task.queued)
+
+		task.done <- true
+	}
+}
+
+// queue a share and wait for its result; fails right away with ErrVerifyBusy when
+// the queue is full, and with ErrShuttingDown once the pool is closed
+func (self *VerifyPool) Verify(work *ShareWork) (*ShareResult, error) {
+	task := &verifyTask{work: work, queued: time.Now(), done: make(chan bool, 1)}
+
+	self.lock.Lock()
+
+	if self.closed {
+		self.lock.Unlock()
+		return nil, ErrShuttingDown
+	}
+
+	select {
+	case self.queue <- task:
+	default:
+		self.stats.Busy++
+		self.lock.Unlock()
+		verifyLog.Warn("queue full, turning share away", "block", work.blockNumber)
+		return nil, ErrVerifyBusy
+	}
+
+	if depth := len(self.queue); depth > self.stats.MaxDepth {
+		self.stats.MaxDepth = depth
+	}
+	self.lock.Unlock()
+
+	<-task.done
+	return task.result, task.err
+}
+
+// stops taking shares and waits for the queued ones to be verified
+func (self *VerifyPool) Close(ctx context.Context) error {
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.queue)
+	}
+	self.lock.Unlock()
+
+	return waitContext(ctx, self.workers)
+}
+
+func (self *VerifyPool) collectMetrics(m *Metrics) {
+	m.Set("oneether_verify_queue_depth", float64(len(self.queue)))
+}
+
+func (self *VerifyPool) getStats() VerifyStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	stats := self.stats
+	stats.QueueDepth = len(self.queue)
+
+	if stats.Verified > 0 {
+		stats.Latency = self.latency / time.Duration(stats.Verified)
+	}
+
+	return stats
+}
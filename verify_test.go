@@ -0,0 +1,114 @@
+package main
+
+import "context"
+import "testing"
+import "math/big"
+import "net/http"
+import "net/http/httptest"
+
+// holds every verification until released
+type blockingVerifier struct {
+	started chan bool
+	release chan bool
+}
+
+func (self *blockingVerifier) Verify(work *ShareWork) (*ShareResult, error) {
+	self.started <- true
+	<-self.release
+	return &ShareResult{mixDigest: big.NewInt(0), result: big.NewInt(0)}, nil
+}
+
+func TestVerifyPoolBusy(t *testing.T) {
+	verifier := &blockingVerifier{started: make(chan bool, 2), release: make(chan bool)}
+	vpool := NewVerifyPool(verifier, 1, 1)
+	work := &ShareWork{shareDifficulty: big.NewInt(1), blockTarget: big.NewInt(1)}
+
+	results := make(chan error, 2)
+
+	// one share is being worked on, the next waits in the queue
+	go func() { _, err := vpool.Verify(work); results <- err }()
+	<-verifier.started
+	go func() { _, err := vpool.Verify(work); results <- err }()
+	for vpool.getStats().QueueDepth != 1 {
+	}
+
+	if _, err := vpool.Verify(work); err != ErrVerifyBusy {
+		t.Error("expected a full queue to turn the share away, found ", err)
+	}
+
+	verifier.release <- true
+	<-verifier.started
+	verifier.release <- true
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error("expected queued shares to verify, found ", err)
+		}
+	}
+
+	stats := vpool.getStats()
+	if stats.Verified != 2 || stats.Busy != 1 || stats.MaxDepth != 1 {
+		t.Error("unexpected stats ", stats)
+	}
+}
+
+func TestVerifyPoolClose(t *testing.T) {
+	verifier := &blockingVerifier{started: make(chan bool, 2), release: make(chan bool)}
+	vpool := NewVerifyPool(verifier, 1, 1)
+	work := &ShareWork{shareDifficulty: big.NewInt(1), blockTarget: big.NewInt(1)}
+
+	results := make(chan error, 2)
+
+	go func() { _, err := vpool.Verify(work); results <- err }()
+	<-verifier.started
+	go func() { _, err := vpool.Verify(work); results <- err }()
+	for vpool.getStats().QueueDepth != 1 {
+	}
+
+	closed := make(chan error)
+	go func() { closed <- vpool.Close(context.Background()) }()
+
+	// turned away as busy until the pool is closed
+	for {
+		if _, err := vpool.Verify(work); err == ErrShuttingDown {
+			break
+		}
+	}
+
+	// the queued share is still verified before the pool is closed
+	verifier.release <- true
+	<-verifier.started
+	verifier.release <- true
+
+	if err := <-closed; err != nil {
+		t.Error("expected the pool to drain, found ", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error("expected queued shares to verify, found ", err)
+		}
+	}
+}
+
+func TestRemoteVerifierError(t *testing.T) {
+	reply := `{"jsonrpc": "2.0", "id": 1, "error": {"code": -32000, "message": "no dag"}}`
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(reply))
+	}))
+	defer remote.Close()
+
+	verifier := NewRemoteVerifier(remote.URL)
+	work := &ShareWork{blockNumber: big.NewInt(1), headerHash: big.NewInt(2), nonce: big.NewInt(3), mixHash: big.NewInt(4),
+		shareDifficulty: big.NewInt(1000), blockTarget: big.NewInt(1)}
+
+	if _, err := verifier.Verify(work); err == nil {
+		t.Error("expected an rpc error from the verifier to be an error, not an invalid share")
+	}
+
+	reply = `{"jsonrpc": "2.0", "id": 1, "result": false}`
+
+	if _, err := verifier.Verify(work); err != nil {
+		t.Error("expected an invalid share without an error, found ", err)
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 //
-// web payment callback RPC
+// web payment and block callback RPC
 //
 
 import "math/big"
-import "log"
 import "encoding/json"
 
 type WebPaymentProcessor struct {
@@ -30,14 +29,14 @@ func (self *WebPaymentProcessor) PaymentSent(pmt *PendingTransaction) {
     msg, err := json.Marshal(st)
 
     if err != nil {
-        log.Println("web: could not send payment message!", err.Error())
+        webLog.Error("could not encode payment message", "payment", pmt.Id, "txid", pmt.Transaction.Hash, "err", err)
         return
     }
 
     err = self.server.SendMessage("successfullySent", msg)
 
     if err != nil {
-        log.Println("web: could not mark pending - ", err.Error())
+        webLog.Error("could not mark payment pending", "payment", pmt.Id, "txid", pmt.Transaction.Hash, "err", err)
     }
 }
 
@@ -55,66 +54,38 @@ func (self *WebPaymentProcessor) PaymentVerified(pmt *PendingTransaction) {
     msg, err := json.Marshal(st)
 
     if err != nil {
-        log.Println("web: could not send payment message!", err.Error())
+        webLog.Error("could not encode payment message", "payment", pmt.Id, "txid", pmt.Transaction.Hash, "err", err)
         return
     }
 
     err = self.server.SendMessage("SuccessfullyVerified", msg)
 
     if err != nil {
-        log.Println("web: could not mark verified - ", err.Error())
+        webLog.Error("could not mark payment verified", "payment", pmt.Id, "txid", pmt.Transaction.Hash, "err", err)
     }
 }
 
-//////// this is no longer used. distributed 5 ETHER for PPLNS
-
-type BalanceUpdater struct {
-	eth   EthAll
-	cache []*Block
+// tells the backend about blocks the pool found, once they are on the chain
+type WebBlockListener struct {
+    server *Server
 }
 
-func NewBalanceUpdater(e EthAll) *BalanceUpdater {
-	return &BalanceUpdater{e, make([]*Block, 0, 20)}
+func NewWebBlockListener(server *Server) *WebBlockListener {
+    return &WebBlockListener{server: server}
 }
 
-func (*BalanceUpdater) BeginProcessing() error {
-	return nil
-}
+func (self *WebBlockListener) BlockImmature(block *BlockCandidate) {
+    err := self.server.AddBlock(block.getNumber())
 
-func (*BalanceUpdater) EndProcessing() error {
-	return nil
+    if err != nil {
+        webLog.Error("could not add block", "block", block.Number, "nonce", block.Nonce, "err", err)
+    }
 }
 
-func (self *BalanceUpdater) Commit() error {
-	coinbase, err := self.eth.GetCoinbase()
-	if err != nil {
-		log.Printf("could not get coinbase " + err.Error())
-		return err
-	}
-
-	for _, block := range self.cache {
-		// if we mined that shit
-		if block.getMiner().Cmp(coinbase) == 0 {
-			blockNumber, err := parseHex(block.Number, 0)
-
-			if err != nil {
-				return err
-			}
-
-            if server != nil {
-			    server.AddBlock(blockNumber)
-            }
-			updateBalances(big.NewInt(0), big.NewInt(5)) // distribute 5
-		}
-	}
-
-	self.cache = make([]*Block, 0, 20)
-
-	return nil
+func (*WebBlockListener) BlockMatured(*BlockCandidate) {
 }
 
-func (self *BalanceUpdater) AddBlock(block *Block) {
-	self.cache = append(self.cache, block)
+func (*WebBlockListener) BlockOrphaned(*BlockCandidate) {
 }
 
 type Balance struct {
@@ -0,0 +1,29 @@
+package main
+
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+func TestWebBlockListener(t *testing.T) {
+	paths := make(chan string, 1)
+	bodies := make(chan string, 1)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		paths <- request.URL.Path
+		bodies <- string(body)
+	}))
+	defer backend.Close()
+
+	settings := DefaultSettings()
+	settings.BackendIP, settings.BackendPort, _ = net.SplitHostPort(backend.Listener.Addr().String())
+
+	listener := NewWebBlockListener(NewServer(settings))
+	listener.BlockImmature(&BlockCandidate{Number: "0x10", Nonce: "0x01"})
+
+	if path, body := <-paths, <-bodies; path != "/addBlock" || body != "16" {
+		t.Error("expected the block number to be sent to addBlock, found ", path, " ", body)
+	}
+}
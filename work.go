@@ -0,0 +1,125 @@
+package main
+
+//
+// central work manager
+// polls geth for work on its own schedule and hands the cached job
+// to every miner, so geth load does not grow with the number of miners
+//
+
+import "context"
+import "errors"
+import "fmt"
+import "math/big"
+import "sync"
+import "time"
+
+type Job struct {
+	id          string
+	headerHash  *big.Int
+	seedHash    *big.Int
+	target      *big.Int // network target from geth
+	difficulty  *big.Int // network difficulty implied by the target
+	blockNumber *big.Int // number of the block being mined
+	created     time.Time
+}
+
+// the work package for a miner, with the target set to its share difficulty
+func (self *Job) getWorkResult(shareDifficulty *big.Int) RPCResultArray {
+	return RPCResultArray{
+		getHexString(self.headerHash, 64),
+		getHexString(self.seedHash, 64),
+		getHexString(getBoundaryCondition(shareDifficulty), 64),
+	}
+}
+
+type WorkSource interface {
+	GetWork() (headerHash, seedHash, target, blockNumber *big.Int, err error)
+}
+
+type WorkListener interface {
+	NewJob(*Job)
+}
+
+type WorkManager struct {
+	source    WorkSource
+	lock      *sync.RWMutex
+	current   *Job
+	counter   uint64
+	listeners []WorkListener
+}
+
+func NewWorkManager(source WorkSource) *WorkManager {
+	return &WorkManager{source: source, lock: &sync.RWMutex{}, listeners: make([]WorkListener, 0, 4)}
+}
+
+func (self *WorkManager) RegisterListener(l WorkListener) {
+	self.listeners = append(self.listeners, l)
+}
+
+// network difficulty for a target (inverse of getBoundaryCondition)
+func getTargetDifficulty(target *big.Int) *big.Int {
+	difficulty := big.NewInt(1)
+	difficulty.Lsh(difficulty, 255)
+	difficulty.Div(difficulty, target)
+	difficulty.Lsh(difficulty, 1)
+	return difficulty
+}
+
+func (self *WorkManager) getJob() *Job {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.current
+}
+
+// fetch work from geth; returns the new job if the header changed
+func (self *WorkManager) update() (*Job, error) {
+	headerHash, seedHash, target, blockNumber, err := self.source.GetWork()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Sign() <= 0 {
+		return nil, errors.New("invalid work target")
+	}
+
+	current := self.getJob()
+
+	if current != nil && current.headerHash.Cmp(headerHash) == 0 {
+		return nil, nil
+	}
+
+	self.lock.Lock()
+	self.counter++
+	job := &Job{id: fmt.Sprintf("%08x", self.counter),
+		headerHash:  headerHash,
+		seedHash:    seedHash,
+		target:      target,
+		difficulty:  getTargetDifficulty(target),
+		blockNumber: blockNumber,
+		created:     time.Now()}
+	self.current = job
+	self.lock.Unlock()
+
+	for _, listener := range self.listeners {
+		listener.NewJob(job)
+	}
+
+	return job, nil
+}
+
+func (self *WorkManager) Start(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := self.update()
+
+		if err != nil {
+			poolLog.Error("could not get work from geth", "err", err)
+		} else if job != nil {
+			poolLog.Info("new job", "job", job.id, "block", job.blockNumber)
+		}
+
+		sleepContext(ctx, time.Duration(WORK_POLL_TIME*float64(time.Second)))
+	}
+
+	poolLog.Info("work manager is down")
+}
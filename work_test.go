@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+import "math/big"
+
+type countingWorkListener struct {
+	jobs int
+}
+
+func (self *countingWorkListener) NewJob(*Job) {
+	self.jobs++
+}
+
+func TestWorkManagerUpdate(t *testing.T) {
+	geth := &MockGeth{blockNumber: 10, headerHash: 0x1234}
+	listener := &countingWorkListener{}
+	manager := NewWorkManager(geth)
+	manager.RegisterListener(listener)
+
+	job, err := manager.update()
+
+	if err != nil || job == nil {
+		t.Fatal("expected first job, found ", job, err)
+	}
+
+	if job.blockNumber.Cmp(big.NewInt(11)) != 0 {
+		t.Error("expected job for block 11, found ", job.blockNumber)
+	}
+
+	expected := big.NewInt(1)
+	expected.Lsh(expected, 16)
+	if job.difficulty.Cmp(expected) != 0 {
+		t.Error("expected difficulty 2^16, found ", job.difficulty)
+	}
+
+	job, _ = manager.update()
+
+	if job != nil || listener.jobs != 1 {
+		t.Error("expected no new job for an unchanged header, found ", listener.jobs, " jobs")
+	}
+
+	first := manager.getJob()
+	geth.headerHash = 0x4321
+	job, _ = manager.update()
+
+	if job == nil || job.id == first.id || listener.jobs != 2 {
+		t.Error("expected a new job with a new id after the header changed")
+	}
+
+	if manager.getJob() != job {
+		t.Error("expected the new job to be current")
+	}
+}